@@ -0,0 +1,241 @@
+package harald
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLog writes a record for each forwarded connection to a file of its
+// own, separate from the operational logs.
+type AccessLog struct {
+	Path string `json:"path" yaml:"path" toml:"path"`
+	// MaxSize is the size in bytes after which the file is rotated, zero
+	// disables size based rotation.
+	MaxSize int64 `json:"max_size" yaml:"max_size" toml:"max_size"`
+	// MaxAge is the duration after which the file is rotated, measured from
+	// the time it has been opened. Zero disables age based rotation.
+	MaxAge Duration `json:"max_age" yaml:"max_age" toml:"max_age"`
+	// MaxBackups is the number of rotated files which are kept, zero keeps
+	// all of them.
+	MaxBackups int `json:"max_backups" yaml:"max_backups" toml:"max_backups"`
+	// Compress rotated files with gzip.
+	Compress bool `json:"compress" yaml:"compress" toml:"compress"`
+}
+
+// accessLog writes the access records of all forwarders. A nil *accessLog
+// discards them.
+type accessLog struct {
+	log  *slog.Logger
+	file *rotatingFile
+}
+
+func newAccessLog(c *AccessLog) (*accessLog, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.Path == "" {
+		return nil, fmt.Errorf("access log: missing path")
+	}
+	if c.MaxSize < 0 || c.MaxAge < 0 || c.MaxBackups < 0 {
+		return nil, fmt.Errorf("access log: limits must not be negative")
+	}
+	f := &rotatingFile{conf: *c}
+	return &accessLog{log: slog.New(slog.NewJSONHandler(f, nil)), file: f}, nil
+}
+
+// record writes the access record of a connection from src, the address is
+// redacted like in all other logs.
+func (a *accessLog) record(r *redactor, src netip.Addr, attrs ...slog.Attr) {
+	if a == nil {
+		return
+	}
+	attrs = append(attrs, attrSource(src))
+	r.logger(a.log, src).LogAttrs(context.Background(), slog.LevelInfo, "connection", attrs...)
+}
+
+// close the current file and wait for rotated files to be compressed.
+func (a *accessLog) close() error {
+	if a == nil {
+		return nil
+	}
+	return a.file.close()
+}
+
+// rotatedTimeFormat is appended to the names of rotated files.
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// rotatingFile is an io.Writer appending to a file which is rotated once it
+// exceeds the limits. The file is opened on the first write.
+type rotatingFile struct {
+	conf AccessLog
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+	// housekeeping tracks the compression and removal of rotated files,
+	// housekeepingMu runs them one at a time.
+	housekeeping   sync.WaitGroup
+	housekeepingMu sync.Mutex
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f != nil && r.due(len(p)) {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if r.f == nil {
+		err := r.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file has to be rotated before n more bytes are
+// written. A file is never rotated while it is empty.
+func (r *rotatingFile) due(n int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.conf.MaxSize > 0 && r.size+int64(n) > r.conf.MaxSize {
+		return true
+	}
+	return r.conf.MaxAge > 0 && time.Since(r.opened) > r.conf.MaxAge.Duration()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.conf.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("access log: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("access log: %w", err)
+	}
+	r.f, r.size, r.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+// rotate moves the current file aside, the next write opens a new one.
+func (r *rotatingFile) rotate() error {
+	err := r.f.Close()
+	r.f = nil
+	if err != nil {
+		return fmt.Errorf("access log: %w", err)
+	}
+
+	rotated := r.conf.Path + "." + time.Now().UTC().Format(rotatedTimeFormat)
+	err = os.Rename(r.conf.Path, rotated)
+	if err != nil {
+		return fmt.Errorf("access log: %w", err)
+	}
+
+	r.housekeeping.Add(1)
+	go func() {
+		defer r.housekeeping.Done()
+		r.housekeepingMu.Lock()
+		defer r.housekeepingMu.Unlock()
+		if r.conf.Compress {
+			err := compressFile(rotated)
+			if err != nil {
+				slog.Warn("unable to compress rotated access log", attrError(err))
+			}
+		}
+		r.prune()
+	}()
+	return nil
+}
+
+// prune removes the oldest rotated files exceeding the configured number of
+// backups.
+func (r *rotatingFile) prune() {
+	if r.conf.MaxBackups == 0 {
+		return
+	}
+	backups, err := filepath.Glob(r.conf.Path + ".*")
+	if err != nil {
+		return
+	}
+	backups = slices.DeleteFunc(backups, func(name string) bool {
+		suffix := strings.TrimPrefix(name, r.conf.Path+".")
+		if _, err := time.Parse(rotatedTimeFormat, strings.TrimSuffix(suffix, ".gz")); err != nil {
+			// not one of ours
+			return true
+		}
+		// a file which is still being compressed exists twice
+		_, err := os.Stat(name + ".gz")
+		return !strings.HasSuffix(name, ".gz") && err == nil
+	})
+	// the timestamps in the names sort chronologically
+	slices.Sort(backups)
+	for len(backups) > r.conf.MaxBackups {
+		err = os.Remove(backups[0])
+		if err != nil {
+			slog.Warn("unable to remove rotated access log", attrError(err))
+		}
+		backups = backups[1:]
+	}
+}
+
+func (r *rotatingFile) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	if r.f != nil {
+		err = r.f.Close()
+		r.f = nil
+	}
+	r.housekeeping.Wait()
+	return err
+}
+
+// compressFile replaces the file by a gzip compressed copy.
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	} else {
+		_ = out.Close()
+	}
+	if err != nil {
+		_ = os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,191 @@
+package harald
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestAccessLogRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	access, err := newAccessLog(&AccessLog{Path: path})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	echo, _ := haraldtest.EchoServer(t)
+	r := testRule(echo)
+	r.Labels = map[string]string{"team": "web"}
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.access = access
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	c, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, _ = c.Write([]byte("ping"))
+	_, _ = io.ReadFull(c, make([]byte, 4))
+	_ = c.Close()
+
+	var record map[string]any
+	for i := 0; i < 50 && record == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		b, _ := os.ReadFile(path)
+		_ = json.Unmarshal(b, &record)
+	}
+	if record == nil {
+		t.Fatal("no access record written")
+	}
+	if record["rule"] != "test" || record["source"] != "127.0.0.1" || record["bytes-in"] != 4.0 || record["bytes-out"] != 4.0 {
+		t.Errorf("unexpected record %v", record)
+	}
+	if labels, _ := record["labels"].(map[string]any); labels["team"] != "web" {
+		t.Errorf("expected the labels of the rule in the record; got = %v", record["labels"])
+	}
+
+	err = access.close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestAccessLogRecordTLS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	access, err := newAccessLog(&AccessLog{Path: path})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+	clientCrt, clientKey := ca.NewClientCertificate(t)
+	clientCert, err := tls.X509KeyPair(clientCrt, clientKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	echo, _ := haraldtest.EchoServer(t)
+	r := testRule(echo)
+	r.TLS = &TLS{
+		Certificate:          string(crt),
+		Key:                  string(key),
+		ClientCAs:            string(ca.PEM()),
+		ClientAuth:           tls.RequireAndVerifyClientCert,
+		ApplicationProtocols: []string{"echo"},
+	}
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.access = access
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	c, err := tls.Dial("tcp", f.Addr().String(), &tls.Config{
+		ServerName:         "localhost",
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{clientCert},
+		NextProtos:         []string{"echo"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, _ = c.Write([]byte("ping"))
+	_, _ = io.ReadFull(c, make([]byte, 4))
+	_ = c.Close()
+
+	var record map[string]any
+	for i := 0; i < 50 && record == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		b, _ := os.ReadFile(path)
+		_ = json.Unmarshal(b, &record)
+	}
+	if record == nil {
+		t.Fatal("no access record written")
+	}
+	handshake, _ := record["tls"].(map[string]any)
+	if handshake["version"] != "TLS 1.3" || handshake["alpn"] != "echo" || handshake["server-name"] != "localhost" || handshake["resumed"] != false {
+		t.Errorf("unexpected tls details %v", record["tls"])
+	}
+	if subject, _ := handshake["client-subject"].(string); subject == "" {
+		t.Errorf("expected subject of the client certificate; got = %v", record["tls"])
+	}
+	if _, ok := handshake["cipher-suite"].(string); !ok {
+		t.Errorf("expected cipher suite; got = %v", record["tls"])
+	}
+
+	err = access.close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r := &rotatingFile{conf: AccessLog{Path: path, MaxSize: 10, MaxBackups: 2, Compress: true}}
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := r.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	err := r.close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(current) != "fourth\n" {
+		t.Errorf("want = fourth; got = %q", current)
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("expected two backups; got = %v", backups)
+	}
+	var contents []string
+	for _, name := range backups {
+		if !strings.HasSuffix(name, ".gz") {
+			t.Errorf("expected %s to be compressed", name)
+			continue
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		b, _ = io.ReadAll(gz)
+		contents = append(contents, string(b))
+	}
+	if strings.Join(contents, "") != "second\nthird\n" {
+		t.Errorf("expected the oldest backup to be removed; got = %q", contents)
+	}
+}
@@ -0,0 +1,83 @@
+package harald
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// addressTemplate is the data of the templates in addresses, e.g.
+// "{{ .Hostname }}:8443" or `{{ env "POD_IP" }}:8443`.
+type addressTemplate struct{}
+
+// Hostname returns the hostname of the machine.
+func (addressTemplate) Hostname() (string, error) {
+	return os.Hostname()
+}
+
+// addressFuncs are the functions available in the templates of addresses.
+var addressFuncs = template.FuncMap{
+	// env returns the value of an environment variable, unset variables are
+	// an error instead of an empty host, which would listen on all
+	// addresses.
+	"env": func(key string) (string, error) {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", key)
+		}
+		return v, nil
+	},
+}
+
+// expand evaluates the address if it contains a template and returns it
+// unchanged otherwise.
+func (t addressTemplate) expand(address string) (string, error) {
+	if !strings.Contains(address, "{{") {
+		return address, nil
+	}
+	tmpl, err := template.New("address").Funcs(addressFuncs).Parse(address)
+	if err != nil {
+		return "", fmt.Errorf("address template: %w", err)
+	}
+	var b strings.Builder
+	err = tmpl.Execute(&b, t)
+	if err != nil {
+		return "", fmt.Errorf("address template: %w", err)
+	}
+	return b.String(), nil
+}
+
+// expandRule evaluates the templates in the listen and connect addresses of
+// the rule, including the ones of its upstreams, fallback and routes. They are
+// copied before they are changed, the rule may share them with the config.
+func (t addressTemplate) expandRule(r *ForwardRule) error {
+	r.Upstreams = slices.Clone(r.Upstreams)
+	confs := []*NetConf{&r.Listen, &r.Connect}
+	for i := range r.Upstreams {
+		confs = append(confs, &r.Upstreams[i])
+	}
+	if r.Fallback != nil {
+		fallback := *r.Fallback
+		r.Fallback = &fallback
+		confs = append(confs, r.Fallback)
+	}
+	if r.Routing != nil {
+		routing := *r.Routing
+		routing.Routes = slices.Clone(routing.Routes)
+		r.Routing = &routing
+		for i := range routing.Routes {
+			confs = append(confs, &routing.Routes[i].Connect)
+		}
+	}
+
+	for _, c := range confs {
+		address, err := t.expand(c.Address)
+		if err != nil {
+			return err
+		}
+		c.Address = address
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package harald
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAddressTemplates(t *testing.T) {
+	t.Setenv("HARALD_TEST_IP", "10.1.2.3")
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	upstreams := []NetConf{{Network: "tcp", Address: "{{ .Hostname }}:8080"}}
+	conf := map[string]ForwardRule{
+		"test": {
+			Listen:    NetConf{Network: "tcp", Address: `{{ env "HARALD_TEST_IP" }}:8443-8444`},
+			Upstreams: upstreams,
+		},
+	}
+	e := expandRules(conf)
+	err = e.err()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rules := e.rules
+
+	r, ok := rules["test/8444"]
+	if !ok || r.Listen.Address != "10.1.2.3:8444" {
+		t.Fatalf("expected the listen address to be evaluated before the port range; got = %v", rules)
+	}
+	if r.Upstreams[0].Address != hostname+":8080" {
+		t.Errorf("want = %s:8080; got = %s", hostname, r.Upstreams[0].Address)
+	}
+	// the config keeps the templates, they are evaluated again on reload
+	if upstreams[0].Address != "{{ .Hostname }}:8080" {
+		t.Errorf("the upstreams of the config have been changed: %v", upstreams)
+	}
+}
+
+func TestAddressTemplatesInvalid(t *testing.T) {
+	for name, address := range map[string]string{
+		"unset variable": `{{ env "HARALD_TEST_UNSET" }}:8443`,
+		"unknown field":  "{{ .Foo }}:8443",
+		"syntax":         "{{ env }:8443",
+	} {
+		e := expandRules(map[string]ForwardRule{
+			"test": {Listen: NetConf{Network: "tcp", Address: address}},
+		})
+		if e.err() == nil || len(e.rules) != 0 {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+//go:build unix
+
+package harald
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminTimeout limits how long a single admin connection may take.
+const adminTimeout = 5 * time.Second
+
+// AdminResponse is written as JSON in response to every admin command. Either
+// Error or Result is set.
+type AdminResponse struct {
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// RuleStatus describes a single rule as reported by the admin status command.
+type RuleStatus struct {
+	State ForwarderState `json:"state"`
+	// Address the rule is listening on, empty if the listener is closed.
+	Address string `json:"address,omitempty"`
+	// Maintenance is set while clients are rejected.
+	Maintenance bool `json:"maintenance"`
+	// Draining is set after drain until the last connection has been closed,
+	// it is the same as the state draining.
+	Draining bool `json:"draining,omitempty"`
+	// StartError is the error of the last attempt to open the listener.
+	StartError string `json:"start_error,omitempty"`
+	Stats      Stats  `json:"stats"`
+}
+
+// ServerInfo describes the server as reported by the admin info command.
+type ServerInfo struct {
+	PID int `json:"pid"`
+	// Uptime is the duration since the server has been started.
+	Uptime time.Duration `json:"uptime"`
+	// ConfigHash is the SHA-256 of the config file as of the last (re)load,
+	// empty if the config hasn't been loaded from a file.
+	ConfigHash string `json:"config_hash,omitempty"`
+	// Listening is set while all listeners are supposed to be open.
+	Listening bool `json:"listening"`
+	// Runtime describes the process, e.g. to catch leaked handlers.
+	Runtime RuntimeStats `json:"runtime"`
+}
+
+// adminCommand handles a single admin command, the returned value is encoded
+// as the result of the response.
+type adminCommand func(s *Server, args []string) (any, error)
+
+var adminCommands = map[string]adminCommand{
+	"status":      adminStatus,
+	"info":        adminInfo,
+	"start":       adminStart,
+	"stop":        adminStop,
+	"drain":       adminDrain,
+	"maintenance": adminMaintenance,
+	"reload":      adminReload,
+	"shutdown":    adminShutdown,
+	"connections": adminConnections,
+	"kill":        adminKill,
+	"capture":     adminCapture,
+	"captures":    adminCaptures,
+}
+
+// adminActions maps the commands which change the state of the server to
+// the action recorded in the audit log.
+var adminActions = map[string]string{
+	"start":       "rule.start",
+	"stop":        "rule.stop",
+	"drain":       "rule.drain",
+	"maintenance": "rule.maintenance",
+	"reload":      "config.reload",
+	"shutdown":    "shutdown",
+	"kill":        "connection.kill",
+	"capture":     "capture",
+}
+
+// adminState returns a function describing the state changed by the command.
+func (s *Server) adminState(command string, args []string) func() string {
+	switch command {
+	case "reload":
+		return s.configState
+	case "shutdown":
+		return s.runState
+	case "kill":
+		return s.conns.state(firstArg(args))
+	case "capture":
+		return s.captures.state(firstArg(args))
+	default:
+		return s.ruleState(firstArg(args))
+	}
+}
+
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+// adminTrigger describes the client of an admin connection for the audit
+// log, including its credentials where the platform reports them.
+func adminTrigger(c net.Conn) string {
+	if creds := peerCredentials(c); creds != "" {
+		return "admin (" + creds + ")"
+	}
+	return "admin"
+}
+
+// adminUIDAllowed reports whether the user may run admin commands, only root
+// and the user harald runs as may. It is checked on top of the mode of the
+// socket where the platform reports the credentials of the peer.
+func adminUIDAllowed(uid int) bool {
+	return uid == 0 || uid == os.Getuid()
+}
+
+// listenAdmin opens the admin socket. Each connection carries a single
+// command terminated by a newline, the response is written as JSON and the
+// connection is closed afterwards.
+func (s *Server) listenAdmin(path string) (net.Listener, error) {
+	// a socket left behind by a previous instance would prevent us from
+	// listening, other files are left alone.
+	if fi, err := os.Stat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		_ = os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, withKind(ErrBind, fmt.Errorf("admin: %w", err))
+	}
+	// only our own user may connect, peers which connect before the mode is
+	// changed are still rejected by their credentials.
+	err = os.Chmod(path, 0o600)
+	if err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("admin: %w", err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Error("unable to accept admin connection", attrError(err))
+				continue
+			}
+			go s.handleAdmin(c)
+		}
+	}()
+
+	return l, nil
+}
+
+func (s *Server) handleAdmin(c net.Conn) {
+	defer func() { _ = c.Close() }()
+	if uid, ok := peerUID(c); ok && !adminUIDAllowed(uid) {
+		slog.Warn("rejecting admin connection of another user", slog.String("peer", peerCredentials(c)))
+		return
+	}
+	_ = c.SetDeadline(time.Now().Add(adminTimeout))
+
+	var resp AdminResponse
+
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		slog.Warn("unable to read admin command", attrError(err))
+		return
+	}
+
+	args := strings.Fields(line)
+	if len(args) == 1 && args[0] == "events" {
+		s.streamEvents(c)
+		return
+	}
+	if len(args) == 0 {
+		resp.Error = "empty command"
+	} else if cmd, ok := adminCommands[args[0]]; !ok {
+		resp.Error = fmt.Sprintf("unknown command '%s'", args[0])
+	} else {
+		slog.Debug("running admin command", slog.String("command", args[0]))
+		var result any
+		run := func() (err error) {
+			result, err = cmd(s, args[1:])
+			return err
+		}
+		if action, ok := adminActions[args[0]]; ok {
+			err = s.audited(action, adminTrigger(c), s.adminState(args[0], args[1:]), run)
+		} else {
+			err = run()
+		}
+		if err == nil {
+			resp.Result, err = json.Marshal(result)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	}
+
+	err = json.NewEncoder(c).Encode(resp)
+	if err != nil {
+		slog.Warn("unable to write admin response", attrError(err))
+	}
+}
+
+// streamEvents writes each event as a line of JSON until the client closes
+// the connection. Unlike the other commands it isn't wrapped in an
+// AdminResponse.
+func (s *Server) streamEvents(c net.Conn) {
+	_ = c.SetDeadline(time.Time{})
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+
+	// the client doesn't send anything else, so the read only returns once
+	// the connection has been closed.
+	closed := make(chan struct{})
+	go func() {
+		_, _ = c.Read(make([]byte, 1))
+		close(closed)
+	}()
+
+	enc := json.NewEncoder(c)
+	for {
+		select {
+		case <-closed:
+			return
+		case e := <-events:
+			_ = c.SetWriteDeadline(time.Now().Add(adminTimeout))
+			err := enc.Encode(e)
+			if err != nil {
+				slog.Debug("stopped streaming events", attrError(err))
+				return
+			}
+		}
+	}
+}
+
+func adminStatus(s *Server, _ []string) (any, error) {
+	forwarders := s.getForwarders()
+	status := make(map[string]RuleStatus, len(forwarders))
+	for _, f := range forwarders {
+		status[f.name] = ruleStatus(f)
+	}
+	return status, nil
+}
+
+func adminInfo(s *Server, _ []string) (any, error) {
+	info := ServerInfo{
+		PID:     os.Getpid(),
+		Uptime:  time.Since(s.started),
+		Runtime: s.RuntimeStats(),
+	}
+
+	s.rulesMu.Lock()
+	info.ConfigHash = s.conf.hash
+	s.rulesMu.Unlock()
+
+	s.mu.Lock()
+	info.Listening = s.listening
+	s.mu.Unlock()
+
+	return info, nil
+}
+
+// adminStart opens the listener of the rule given as the only argument.
+func adminStart(s *Server, args []string) (any, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: start <rule>")
+	}
+	f, err := s.startRule(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return ruleStatus(f), nil
+}
+
+// adminStop closes the listener of the rule given as the only argument.
+func adminStop(s *Server, args []string) (any, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: stop <rule>")
+	}
+	f, err := s.stopRule(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return ruleStatus(f), nil
+}
+
+// adminDrain closes the listener of the rule given as the only argument and
+// keeps its connections alive, the event rule.drained is sent once the last
+// one has been closed.
+func adminDrain(s *Server, args []string) (any, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: drain <rule>")
+	}
+	f, err := s.drainRule(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return ruleStatus(f), nil
+}
+
+// adminMaintenance turns the maintenance mode of a rule on or off.
+func adminMaintenance(s *Server, args []string) (any, error) {
+	if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+		return nil, fmt.Errorf("usage: maintenance <rule> on|off")
+	}
+	f, err := s.setMaintenance(args[0], args[1] == "on")
+	if err != nil {
+		return nil, err
+	}
+	return ruleStatus(f), nil
+}
+
+func ruleStatus(f *Forwarder) RuleStatus {
+	rs := RuleStatus{State: f.State()}
+	if a := f.Addr(); a != nil {
+		rs.Address = a.String()
+	}
+	rs.Maintenance = f.maintenance.Load()
+	rs.Draining = rs.State == StateDraining
+	if err := f.StartError(); err != nil {
+		rs.StartError = err.Error()
+	}
+	rs.Stats = f.Stats()
+	return rs
+}
+
+// adminConnections lists the open connections of the rule given as the
+// optional argument, or of all rules.
+func adminConnections(s *Server, args []string) (any, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("usage: connections [<rule>]")
+	}
+	return s.connections(firstArg(args))
+}
+
+// adminKill closes the connection with the id given as the only argument.
+func adminKill(s *Server, args []string) (any, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: kill <conn-id>")
+	}
+	return nil, s.killConnection(args[0])
+}
+
+// adminCapture starts or stops capturing the data of the connections of a
+// rule or of a single connection, optionally with the format and the limit
+// of the data recorded.
+func adminCapture(s *Server, args []string) (any, error) {
+	usage := fmt.Errorf("usage: capture <rule|conn-id> on [pcap|dump] [<max-bytes>] | capture <rule|conn-id> off")
+	switch {
+	case len(args) == 2 && args[1] == "off":
+		return s.captures.stop(args[0])
+	case len(args) >= 2 && len(args) <= 4 && args[1] == "on":
+		var format string
+		var maxBytes int64
+		if len(args) > 2 {
+			format = args[2]
+		}
+		if len(args) > 3 {
+			var err error
+			maxBytes, err = strconv.ParseInt(args[3], 10, 64)
+			if err != nil || maxBytes <= 0 {
+				return nil, usage
+			}
+		}
+		return s.captures.start(args[0], format, maxBytes)
+	default:
+		return nil, usage
+	}
+}
+
+// adminCaptures lists the active captures.
+func adminCaptures(s *Server, _ []string) (any, error) {
+	return s.captures.list(), nil
+}
+
+// adminReload reloads the rules from the config file like SIGHUP.
+func adminReload(s *Server, _ []string) (any, error) {
+	return nil, s.reload()
+}
+
+// adminShutdown shuts the server down like SIGTERM, the response is sent
+// before the listeners are closed.
+func adminShutdown(s *Server, _ []string) (any, error) {
+	select {
+	case s.shutdown <- struct{}{}:
+	default:
+		// a shutdown is already pending
+	}
+	return nil, nil
+}
+
+// AdminCommand sends a command to the admin socket at path and returns the
+// result. An error reported by the server is returned as error.
+func AdminCommand(path, command string) (json.RawMessage, error) {
+	c, err := net.DialTimeout("unix", path, adminTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("admin: %w", err)
+	}
+	defer func() { _ = c.Close() }()
+	_ = c.SetDeadline(time.Now().Add(adminTimeout))
+
+	_, err = fmt.Fprintln(c, command)
+	if err != nil {
+		return nil, fmt.Errorf("admin: %w", err)
+	}
+
+	var resp AdminResponse
+	err = json.NewDecoder(c).Decode(&resp)
+	if err != nil {
+		return nil, fmt.Errorf("admin: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("admin: %s", resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// AdminEvents subscribes to the events of the server through the admin socket
+// at path and calls handle for each of them until handle returns an error or
+// the server closes the connection.
+func AdminEvents(path string, handle func(Event) error) error {
+	c, err := net.DialTimeout("unix", path, adminTimeout)
+	if err != nil {
+		return fmt.Errorf("admin: %w", err)
+	}
+	defer func() { _ = c.Close() }()
+
+	_, err = fmt.Fprintln(c, "events")
+	if err != nil {
+		return fmt.Errorf("admin: %w", err)
+	}
+
+	dec := json.NewDecoder(c)
+	for {
+		var e Event
+		err = dec.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("admin: %w", err)
+		}
+		err = handle(e)
+		if err != nil {
+			return err
+		}
+	}
+}
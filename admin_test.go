@@ -0,0 +1,455 @@
+package harald
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+// adminRequest sends a single command to the admin socket at path and decodes
+// the result into v.
+func adminRequest(t *testing.T, path string, command string, v any) AdminResponse {
+	t.Helper()
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("connect to admin socket: %s", err.Error())
+	}
+	defer c.Close()
+
+	_, err = c.Write([]byte(command + "\n"))
+	if err != nil {
+		t.Fatalf("write admin command: %s", err.Error())
+	}
+
+	var resp AdminResponse
+	err = json.NewDecoder(bufio.NewReader(c)).Decode(&resp)
+	if err != nil {
+		t.Fatalf("decode admin response: %s", err.Error())
+	}
+
+	if v != nil && resp.Result != nil {
+		err = json.Unmarshal(resp.Result, v)
+		if err != nil {
+			t.Fatalf("decode admin result: %s", err.Error())
+		}
+	}
+
+	return resp
+}
+
+// startAdminServer runs a server with the given rules and an admin socket in
+// a temporary directory. The path of the socket is returned.
+func startAdminServer(t *testing.T, rules map[string]ForwardRule) (*Server, string) {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+
+	s, err := NewServer(Config{
+		EnableListeners: true,
+		AdminSocket:     socket,
+		Rules:           rules,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	signals := make(chan os.Signal, 1)
+	go s.Run(signals)
+	t.Cleanup(func() { signals <- syscall.SIGTERM })
+
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(socket); err == nil && len(s.Addrs()) == len(rules) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return s, socket
+}
+
+func TestAdminStatus(t *testing.T) {
+	_, socket := startAdminServer(t, map[string]ForwardRule{
+		"test": {
+			Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+			Connect: NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		},
+	})
+
+	var status map[string]RuleStatus
+	resp := adminRequest(t, socket, "status", &status)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+
+	rs, ok := status["test"]
+	if !ok {
+		t.Fatal("expected status of rule 'test'")
+	}
+	if rs.Address == "" {
+		t.Errorf("expected address to be set")
+	}
+}
+
+func TestAdminUnknownCommand(t *testing.T) {
+	_, socket := startAdminServer(t, map[string]ForwardRule{
+		"test": {
+			Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+			Connect: NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		},
+	})
+
+	resp := adminRequest(t, socket, "foo", nil)
+	if resp.Error == "" {
+		t.Fatal("expected an error for an unknown command")
+	}
+}
+
+func TestAdminSocketAccess(t *testing.T) {
+	_, socket := startAdminServer(t, map[string]ForwardRule{
+		"test": {
+			Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+			Connect: NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		},
+	})
+
+	fi, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("want = 600; got = %o", perm)
+	}
+
+	if !adminUIDAllowed(0) || !adminUIDAllowed(os.Getuid()) {
+		t.Error("expected root and our own user to be allowed")
+	}
+	if adminUIDAllowed(os.Getuid() + 1000) {
+		t.Error("expected other users to be rejected")
+	}
+}
+
+func TestAdminStartStop(t *testing.T) {
+	s, socket := startAdminServer(t, map[string]ForwardRule{
+		"a": testRule("127.0.0.1:1"),
+		"b": testRule("127.0.0.1:2"),
+	})
+
+	var rs RuleStatus
+	resp := adminRequest(t, socket, "stop a", &rs)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if rs.Address != "" || rs.State != StateStopped {
+		t.Errorf("expected rule to be stopped; got = %+v", rs)
+	}
+	if addrs := s.Addrs(); len(addrs) != 1 || addrs["b"] == nil {
+		t.Fatalf("expected only rule b to listen; got = %v", addrs)
+	}
+
+	// starting all listeners leaves the individually stopped rule alone
+	s.setListening(true)
+	if _, ok := s.Addrs()["a"]; ok {
+		t.Errorf("stopped rule has been started with the others")
+	}
+
+	resp = adminRequest(t, socket, "start a", &rs)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if rs.Address == "" || rs.State != StateListening {
+		t.Errorf("expected rule to be started; got = %+v", rs)
+	}
+
+	if resp = adminRequest(t, socket, "stop c", nil); resp.Error == "" {
+		t.Errorf("expected an error for an unknown rule")
+	}
+	if resp = adminRequest(t, socket, "start", nil); resp.Error == "" {
+		t.Errorf("expected an error without a rule")
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	echo, _ := haraldtest.EchoServer(t)
+	s, socket := startAdminServer(t, map[string]ForwardRule{"test": testRule(echo)})
+
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+
+	c, err := net.Dial("tcp", s.Addrs()["test"].String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	_, _ = c.Write([]byte("ping"))
+	_, _ = io.ReadFull(c, make([]byte, 4))
+
+	var rs RuleStatus
+	resp := adminRequest(t, socket, "drain test", &rs)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if rs.Address != "" || !rs.Draining || rs.State != StateDraining {
+		t.Errorf("expected the rule to be closed and draining; got = %+v", rs)
+	}
+
+	// the open connection keeps working while the rule is draining
+	_, _ = c.Write([]byte("pong"))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(c, b)
+	if err != nil || string(b) != "pong" {
+		t.Fatalf("expected the connection to stay open; got = %q, %v", b, err)
+	}
+	_ = c.Close()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type != EventRuleDrained {
+				continue
+			}
+			if e.Rule != "test" {
+				t.Errorf("unexpected event %+v", e)
+			}
+			var status map[string]RuleStatus
+			adminRequest(t, socket, "status", &status)
+			if status["test"].Draining || status["test"].State != StateStopped {
+				t.Errorf("expected the rule to be drained; got = %+v", status["test"])
+			}
+			return
+		case <-timeout:
+			t.Fatal("rule has not been drained")
+		}
+	}
+}
+
+func TestAdminDrainWaitsForHandshake(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+	echo, _ := haraldtest.EchoServer(t)
+	r := testRule(echo)
+	r.TLS = &TLS{Certificate: string(crt), Key: string(key)}
+	s, socket := startAdminServer(t, map[string]ForwardRule{"test": r})
+
+	// the client never sends its client hello, the connection isn't active
+	// but its handler is running
+	c, err := net.Dial("tcp", s.Addrs()["test"].String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	f := s.getForwarders()[0]
+	for i := 0; i < 100 && f.handlers.Load() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp := adminRequest(t, socket, "drain test", nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	time.Sleep(3 * drainInterval)
+	if f.State() != StateDraining {
+		t.Fatalf("expected the rule to wait for the handshake; got = %s", f.State())
+	}
+
+	_ = c.Close()
+	for i := 0; i < 100 && f.State() != StateStopped; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f.State() != StateStopped {
+		t.Errorf("expected the rule to be drained; got = %s", f.State())
+	}
+}
+
+func TestAdminDrainDeadline(t *testing.T) {
+	tests := map[string]func(err error) bool{
+		DrainClose: func(err error) bool { return errors.Is(err, io.EOF) },
+		DrainReset: func(err error) bool { return errors.Is(err, syscall.ECONNRESET) },
+		DrainWait:  func(err error) bool { return err == nil },
+	}
+	for action, check := range tests {
+		t.Run(action, func(t *testing.T) {
+			echo, _ := haraldtest.EchoServer(t)
+			r := testRule(echo)
+			r.Drain = &Drain{Timeout: Duration(200 * time.Millisecond), OnTimeout: action}
+			s, socket := startAdminServer(t, map[string]ForwardRule{"test": r})
+
+			c, err := net.Dial("tcp", s.Addrs()["test"].String())
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer c.Close()
+			_, _ = c.Write([]byte("ping"))
+			_, _ = io.ReadFull(c, make([]byte, 4))
+
+			resp := adminRequest(t, socket, "drain test", nil)
+			if resp.Error != "" {
+				t.Fatalf("unexpected error: %s", resp.Error)
+			}
+			time.Sleep(500 * time.Millisecond)
+
+			_ = c.SetDeadline(time.Now().Add(time.Second))
+			_, err = c.Write([]byte("pong"))
+			if err == nil {
+				_, err = io.ReadFull(c, make([]byte, 4))
+			}
+			if !check(err) {
+				t.Errorf("unexpected result after the drain deadline: %v", err)
+			}
+		})
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	_, socket := startAdminServer(t, map[string]ForwardRule{
+		"test": {
+			Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+			Connect: NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		},
+	})
+
+	// the config of the server hasn't been loaded from a file
+	_, err := AdminCommand(socket, "reload")
+	if err == nil {
+		t.Fatal("expected reload to fail")
+	}
+}
+
+func TestAdminShutdown(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	s, err := NewServer(Config{
+		AdminSocket: socket,
+		Rules:       map[string]ForwardRule{"test": testRule("127.0.0.1:1")},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run(make(chan os.Signal)) }()
+
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = AdminCommand(socket, "shutdown")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't shut down")
+	}
+}
+
+func TestAdminInfo(t *testing.T) {
+	_, socket := startAdminServer(t, map[string]ForwardRule{
+		"test": {
+			Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+			Connect: NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		},
+	})
+
+	var info ServerInfo
+	resp := adminRequest(t, socket, "info", &info)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if info.PID != os.Getpid() || !info.Listening || info.Uptime <= 0 {
+		t.Errorf("unexpected info %+v", info)
+	}
+}
+
+func TestAdminEvents(t *testing.T) {
+	echo, _ := haraldtest.EchoServer(t)
+	s, socket := startAdminServer(t, map[string]ForwardRule{"test": testRule(echo)})
+
+	events := make(chan Event, 16)
+	go func() {
+		_ = AdminEvents(socket, func(e Event) error {
+			events <- e
+			return nil
+		})
+	}()
+	for i := 0; i < 100 && s.events.n.Load() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c, err := net.Dial("tcp", s.Addrs()["test"].String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, _ = c.Write([]byte("ping"))
+	_, _ = io.ReadFull(c, make([]byte, 4))
+	_ = c.Close()
+
+	var got []Event
+	next := func() {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing events; got = %+v", got)
+		}
+	}
+	next()
+	next()
+
+	_, err = AdminCommand(socket, "stop test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	next()
+
+	if got[0].Type != EventConnectionOpen || got[0].Rule != "test" || got[0].Source != "127.0.0.1" {
+		t.Errorf("unexpected event %+v", got[0])
+	}
+	if got[1].Type != EventConnectionClose || got[1].ConnID != got[0].ConnID || got[1].BytesIn != 4 {
+		t.Errorf("unexpected event %+v", got[1])
+	}
+	if got[2].Type != "rule.stop" || got[2].New != "closed" {
+		t.Errorf("unexpected event %+v", got[2])
+	}
+}
+
+func TestAdminCapture(t *testing.T) {
+	echo, _ := haraldtest.EchoServer(t)
+	_, socket := startAdminServer(t, map[string]ForwardRule{"test": testRule(echo)})
+
+	for _, command := range []string{"capture test", "capture test on pcap 0", "capture test on pcap 10 x"} {
+		resp := adminRequest(t, socket, command, nil)
+		if !strings.HasPrefix(resp.Error, "usage:") {
+			t.Errorf("expected usage for '%s', got %+v", command, resp)
+		}
+	}
+
+	resp := adminRequest(t, socket, "capture test on", nil)
+	if resp.Error != "capture: capture_dir isn't configured" {
+		t.Errorf("expected error without a capture dir, got %+v", resp)
+	}
+
+	var captures []Capture
+	resp = adminRequest(t, socket, "captures", &captures)
+	if resp.Error != "" || len(captures) != 0 {
+		t.Errorf("expected no captures, got %+v", resp)
+	}
+}
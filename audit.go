@@ -0,0 +1,139 @@
+//go:build unix
+
+package harald
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// auditLog is an append-only record of the changes to the state of the
+// server, e.g. listeners which have been opened or config reloads. Each
+// record names what triggered the change and the state before and after it.
+// A nil *auditLog discards all records.
+type auditLog struct {
+	f   *os.File
+	log *slog.Logger
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("audit log: %w", err)
+	}
+	return &auditLog{f: f, log: slog.New(slog.NewJSONHandler(syncWriter{f}, nil))}, nil
+}
+
+// record writes a single event. The error is the outcome of the change, if
+// it failed.
+func (a *auditLog) record(action, trigger, before, after string, err error) {
+	if a == nil {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("action", action),
+		slog.String("trigger", trigger),
+		slog.String("old", before),
+		slog.String("new", after),
+	}
+	if err != nil {
+		attrs = append(attrs, attrError(err))
+	}
+	a.log.LogAttrs(context.Background(), slog.LevelInfo, "audit", attrs...)
+}
+
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+	return a.f.Close()
+}
+
+// syncWriter flushes each record to disk before the change is carried on.
+type syncWriter struct {
+	*os.File
+}
+
+func (w syncWriter) Write(b []byte) (int, error) {
+	n, err := w.File.Write(b)
+	if err == nil {
+		err = w.File.Sync()
+	}
+	return n, err
+}
+
+// audited runs change and records it in the audit log together with the
+// state reported by state before and after the change. The change is
+// published as an event as well.
+func (s *Server) audited(action, trigger string, state func() string, change func() error) error {
+	before := state()
+	err := change()
+	after := state()
+	s.audit.record(action, trigger, before, after, err)
+
+	e := Event{Type: action, Trigger: trigger, Old: before, New: after}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.events.publish(e)
+	return err
+}
+
+// listeningState describes whether the listeners are supposed to be open.
+func (s *Server) listeningState() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listening {
+		return "listening"
+	}
+	return "stopped"
+}
+
+// configState describes the config file by its hash.
+func (s *Server) configState() string {
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+	return s.conf.hash
+}
+
+// rulesState lists the names of all rules.
+func (s *Server) rulesState() string {
+	forwarders := s.getForwarders()
+	names := make([]string, len(forwarders))
+	for i, f := range forwarders {
+		names[i] = f.name
+	}
+	return strings.Join(names, ",")
+}
+
+// ruleState returns a function describing the listener and maintenance mode
+// of a single rule.
+func (s *Server) ruleState(name string) func() string {
+	return func() string {
+		s.mu.Lock()
+		f := s.forwarder(name)
+		s.mu.Unlock()
+		if f == nil {
+			return "unknown"
+		}
+		state := "closed"
+		if a := f.Addr(); a != nil {
+			state = "open " + a.String()
+		}
+		if f.maintenance.Load() {
+			state += ", maintenance"
+		}
+		return state
+	}
+}
+
+// runState describes whether the server is shutting down.
+func (s *Server) runState() string {
+	if s.stopping.Load() || len(s.shutdown) > 0 {
+		return "stopping"
+	}
+	return "running"
+}
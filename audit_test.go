@@ -0,0 +1,95 @@
+package harald
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	socket, auditPath := filepath.Join(dir, "admin.sock"), filepath.Join(dir, "audit.log")
+	s, err := NewServer(Config{
+		AdminSocket:     socket,
+		AuditLog:        auditPath,
+		EnableListeners: true,
+		Rules:           map[string]ForwardRule{"test": testRule("127.0.0.1:1")},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	signals := make(chan os.Signal)
+	done := make(chan error, 1)
+	go func() { done <- s.Run(signals) }()
+
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = AdminCommand(socket, "stop test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signals <- syscall.SIGTERM
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't shut down")
+	}
+
+	f, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+
+	type event struct {
+		Action, Trigger, Old, New string
+	}
+	var events []event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e event
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		events = append(events, e)
+	}
+
+	want := []event{
+		{Action: "server.start", Trigger: "startup", New: "running"},
+		{Action: "listeners.start", Trigger: "startup", Old: "stopped", New: "listening"},
+		{Action: "rule.stop", Trigger: "admin", New: "closed"},
+		{Action: "listeners.stop", Trigger: "signal terminated", Old: "listening", New: "stopped"},
+		{Action: "server.stop", Trigger: "shutdown", Old: "stopping", New: "stopped"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("want = %v; got = %v", want, events)
+	}
+	for i, e := range events {
+		w := want[i]
+		if e.Action != w.Action || !strings.HasPrefix(e.Trigger, w.Trigger) || e.New != w.New {
+			t.Errorf("want = %+v; got = %+v", w, e)
+		}
+		if w.Old != "" && e.Old != w.Old {
+			t.Errorf("want = %+v; got = %+v", w, e)
+		}
+	}
+	if !strings.HasPrefix(events[2].Old, "open 127.0.0.1:") {
+		t.Errorf("expected the rule to be open before; got = %s", events[2].Old)
+	}
+}
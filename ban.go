@@ -0,0 +1,136 @@
+package harald
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Ban configures the automatic banning of sources which repeatedly fail the
+// TLS handshake or are rejected by a policy of a rule.
+type Ban struct {
+	// Threshold is the number of failures within Window after which a source
+	// is banned.
+	Threshold int      `json:"threshold" yaml:"threshold" toml:"threshold"`
+	Window    Duration `json:"window" yaml:"window" toml:"window"`
+	// Duration of a ban.
+	Duration Duration `json:"duration" yaml:"duration" toml:"duration"`
+	// Exempt lists networks in CIDR notation which are never banned.
+	Exempt []string `json:"exempt" yaml:"exempt" toml:"exempt"`
+}
+
+type banEntry struct {
+	windowStart time.Time
+	failures    int
+	bannedUntil time.Time
+}
+
+// banList tracks failures per source address, it is shared by all forwarders
+// of a server. A nil *banList never bans anyone.
+type banList struct {
+	conf      Ban
+	exempt    []netip.Prefix
+	mu        sync.Mutex
+	sources   map[netip.Addr]*banEntry
+	lastSweep time.Time
+}
+
+func newBanList(c Ban) (*banList, error) {
+	if c.Threshold <= 0 {
+		return nil, fmt.Errorf("ban: threshold must be greater than zero")
+	}
+	if c.Window <= 0 || c.Duration <= 0 {
+		return nil, fmt.Errorf("ban: window and duration must be greater than zero")
+	}
+
+	b := &banList{
+		conf:    c,
+		sources: make(map[netip.Addr]*banEntry),
+	}
+	for _, cidr := range c.Exempt {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("ban: %w", err)
+		}
+		b.exempt = append(b.exempt, p.Masked())
+	}
+	return b, nil
+}
+
+// banned reports whether addr is currently banned.
+func (b *banList) banned(addr netip.Addr) bool {
+	if b == nil || !addr.IsValid() {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.sources[addr]
+	return ok && time.Now().Before(e.bannedUntil)
+}
+
+// fail records a failure for addr and bans it once the threshold is reached.
+func (b *banList) fail(addr netip.Addr, log *slog.Logger) {
+	if b == nil || !addr.IsValid() {
+		return
+	}
+	for _, p := range b.exempt {
+		if p.Contains(addr) {
+			return
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.sweep(now)
+
+	e, ok := b.sources[addr]
+	if !ok {
+		e = &banEntry{windowStart: now}
+		b.sources[addr] = e
+	}
+	if now.Sub(e.windowStart) > b.conf.Window.Duration() {
+		e.windowStart = now
+		e.failures = 0
+	}
+
+	e.failures++
+	if e.failures >= b.conf.Threshold && now.After(e.bannedUntil) {
+		e.bannedUntil = now.Add(b.conf.Duration.Duration())
+		log.Warn("banning source", attrSource(addr), slog.Time("until", e.bannedUntil))
+	}
+}
+
+// sweep removes entries which are neither banned nor within their window. It
+// runs at most once per window.
+func (b *banList) sweep(now time.Time) {
+	window := b.conf.Window.Duration()
+	if now.Sub(b.lastSweep) < window {
+		return
+	}
+	b.lastSweep = now
+
+	for addr, e := range b.sources {
+		if now.Sub(e.windowStart) > window && now.After(e.bannedUntil) {
+			delete(b.sources, addr)
+		}
+	}
+}
+
+// sourceAddr returns the IP address of the remote end of c. If c is not an IP
+// based connection the returned address is invalid.
+func sourceAddr(c net.Conn) netip.Addr {
+	switch a := c.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
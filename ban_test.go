@@ -0,0 +1,89 @@
+package harald
+
+import (
+	"log/slog"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	b, err := newBanList(Ban{
+		Threshold: 3,
+		Window:    Duration(time.Hour),
+		Duration:  Duration(time.Hour),
+		Exempt:    []string{"10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	source := netip.MustParseAddr("192.0.2.1")
+	exempt := netip.MustParseAddr("10.1.2.3")
+
+	for i := 0; i < 3; i++ {
+		if b.banned(source) {
+			t.Fatalf("source banned after %d failures", i)
+		}
+		b.fail(source, slog.Default())
+		b.fail(exempt, slog.Default())
+	}
+
+	if !b.banned(source) {
+		t.Errorf("expected source to be banned")
+	}
+	if b.banned(exempt) {
+		t.Errorf("expected exempt source not to be banned")
+	}
+	if b.banned(netip.MustParseAddr("192.0.2.2")) {
+		t.Errorf("expected other source not to be banned")
+	}
+}
+
+func TestBanListExpiry(t *testing.T) {
+	b, err := newBanList(Ban{
+		Threshold: 1,
+		Window:    Duration(time.Hour),
+		Duration:  Duration(10 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	source := netip.MustParseAddr("2001:db8::1")
+	b.fail(source, slog.Default())
+	if !b.banned(source) {
+		t.Fatal("expected source to be banned")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if b.banned(source) {
+		t.Fatal("expected ban to be expired")
+	}
+}
+
+func TestBanListInvalidConfig(t *testing.T) {
+	tests := map[string]Ban{
+		"no threshold": {Window: Duration(time.Second), Duration: Duration(time.Second)},
+		"no window":    {Threshold: 1, Duration: Duration(time.Second)},
+		"invalid cidr": {Threshold: 1, Window: Duration(time.Second), Duration: Duration(time.Second), Exempt: []string{"foo"}},
+	}
+	for name, c := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := newBanList(c)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestNilBanList(t *testing.T) {
+	var b *banList
+	source := netip.MustParseAddr("192.0.2.1")
+	b.fail(source, slog.Default())
+	if b.banned(source) {
+		t.Fatal("nil ban list must not ban")
+	}
+}
@@ -0,0 +1,231 @@
+package harald
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCircuitCoolDown = 30 * time.Second
+	defaultCircuitProbes   = 1
+)
+
+// CircuitBreaker stops sending connections to an upstream after consecutive
+// failures to connect to it or connections which it broke off with an
+// error. After the cool down a limited number of probe connections is let
+// through, the circuit closes once they could be established.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failures which open the circuit.
+	Failures int `json:"failures" yaml:"failures" toml:"failures"`
+	// Window limits the duration in which the failures have to occur, zero
+	// doesn't limit it.
+	Window Duration `json:"window" yaml:"window" toml:"window"`
+	// CoolDown is the duration the circuit stays open before it is probed,
+	// defaults to 30s.
+	CoolDown Duration `json:"cool_down" yaml:"cool_down" toml:"cool_down"`
+	// Probes is the number of connections which have to be established
+	// while probing to close the circuit, defaults to 1.
+	Probes int `json:"probes" yaml:"probes" toml:"probes"`
+}
+
+func (c *CircuitBreaker) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Failures <= 0 {
+		return fmt.Errorf("circuit breaker: failures must be positive")
+	}
+	if c.Window < 0 || c.CoolDown < 0 || c.Probes < 0 {
+		return fmt.Errorf("circuit breaker: window, cool_down and probes must not be negative")
+	}
+	return nil
+}
+
+func (c *CircuitBreaker) coolDown() time.Duration {
+	if c.CoolDown == 0 {
+		return defaultCircuitCoolDown
+	}
+	return c.CoolDown.Duration()
+}
+
+func (c *CircuitBreaker) probes() int {
+	if c.Probes == 0 {
+		return defaultCircuitProbes
+	}
+	return c.Probes
+}
+
+// States of a circuit.
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuit is the state of the circuit breaker of a single upstream.
+type circuit struct {
+	mu    sync.Mutex
+	state int
+	// failures is the number of consecutive failures while closed.
+	failures int
+	// since is the time of the first of the failures while closed and the
+	// time the circuit opened otherwise.
+	since time.Time
+	// probing is the number of probes in flight, succeeded the number of
+	// probes which could connect while half open.
+	probing, succeeded int
+}
+
+// String describes the state for the stats, empty if closed.
+func (c *circuit) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half_open"
+	default:
+		return ""
+	}
+}
+
+// available reports whether a connection may be sent to the upstream. All
+// methods of a nil *CircuitBreaker report the circuit as closed.
+func (cb *CircuitBreaker) available(c *circuit, now time.Time) bool {
+	if cb == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case circuitOpen:
+		return now.Sub(c.since) >= cb.coolDown()
+	case circuitHalfOpen:
+		return c.probing < cb.probes()
+	default:
+		return true
+	}
+}
+
+// acquire is called before connecting to the upstream, it returns true if
+// the connection is a probe.
+func (cb *CircuitBreaker) acquire(c *circuit, now time.Time) bool {
+	if cb == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == circuitOpen && now.Sub(c.since) >= cb.coolDown() {
+		c.state, c.probing, c.succeeded = circuitHalfOpen, 0, 0
+	}
+	if c.state != circuitHalfOpen {
+		return false
+	}
+	c.probing++
+	return true
+}
+
+// connected records an established connection, it returns true if this
+// closed the circuit.
+func (cb *CircuitBreaker) connected(c *circuit, probe bool) bool {
+	if cb == nil || !probe {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probing--
+	if c.state != circuitHalfOpen {
+		return false
+	}
+	c.succeeded++
+	if c.succeeded < cb.probes() {
+		return false
+	}
+	c.state, c.failures = circuitClosed, 0
+	return true
+}
+
+// failed records a failure to connect or a connection which has been broken
+// off by the upstream, it returns true if this opened the circuit.
+func (cb *CircuitBreaker) failed(c *circuit, probe bool, now time.Time) bool {
+	if cb == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if probe {
+		c.probing--
+	}
+	switch c.state {
+	case circuitHalfOpen:
+		c.state, c.since = circuitOpen, now
+		return true
+	case circuitClosed:
+		if c.failures == 0 || cb.Window > 0 && now.Sub(c.since) > cb.Window.Duration() {
+			c.failures, c.since = 0, now
+		}
+		c.failures++
+		if c.failures >= cb.Failures {
+			c.state, c.since = circuitOpen, now
+			return true
+		}
+	}
+	return false
+}
+
+// succeeded records a connection which ended without an error of the
+// upstream, it resets the consecutive failures.
+func (cb *CircuitBreaker) succeeded(c *circuit) {
+	if cb == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == circuitClosed {
+		c.failures = 0
+	}
+}
+
+// upstreamFailed reports a failure of the upstream to its circuit breaker
+// and the outlier detection.
+func (f *Forwarder) upstreamFailed(u *upstream, probe bool) {
+	f.reportOutlier(u, true)
+	if f.balancer.breaker.failed(&u.circuit, probe, time.Now()) {
+		f.log.Warn("opening circuit of upstream", attrUpstream(u),
+			slog.Duration("cool-down", f.balancer.breaker.coolDown()))
+	}
+}
+
+// upstreamEnded reports the end of a connection to the upstream to its
+// circuit breaker and the outlier detection, err is the error of the
+// upstream if it ended the connection. Premature closes are only errors to
+// the outlier detection.
+func (f *Forwarder) upstreamEnded(u *upstream, err error) {
+	switch {
+	case errors.Is(err, errPrematureClose):
+		f.reportOutlier(u, true)
+	case err != nil:
+		f.upstreamFailed(u, false)
+	default:
+		f.reportOutlier(u, false)
+		f.balancer.breaker.succeeded(&u.circuit)
+	}
+}
+
+// pooledConnBroken reports an idle connection of the pool which the upstream
+// closed or broke off before it could be used. The dials of the pool are
+// reported by dial like any other.
+func (f *Forwarder) pooledConnBroken(c *upstreamConn, err error) {
+	if !c.balanced {
+		return
+	}
+	if errors.Is(err, io.EOF) {
+		err = errPrematureClose
+	}
+	f.upstreamEnded(c.upstream, err)
+}
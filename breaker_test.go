@@ -0,0 +1,136 @@
+package harald
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := &CircuitBreaker{Failures: 3, Window: Duration(time.Minute), CoolDown: Duration(time.Minute), Probes: 2}
+	var c circuit
+	now := time.Now()
+
+	// failures outside of the window don't add up
+	cb.failed(&c, false, now)
+	cb.failed(&c, false, now.Add(time.Second))
+	now = now.Add(2 * time.Minute)
+	if cb.failed(&c, false, now) || cb.failed(&c, false, now) {
+		t.Fatal("expected failures outside of the window not to open the circuit")
+	}
+
+	// a connection without an error resets the failures
+	cb.succeeded(&c)
+	if cb.failed(&c, false, now) || cb.failed(&c, false, now) {
+		t.Fatal("expected a success to reset the failures")
+	}
+	if !cb.failed(&c, false, now) {
+		t.Fatal("expected the third consecutive failure to open the circuit")
+	}
+	if cb.available(&c, now) || c.String() != "open" {
+		t.Fatal("expected the circuit to be open")
+	}
+
+	// after the cool down a limited number of probes is let through
+	now = now.Add(time.Minute)
+	if !cb.available(&c, now) {
+		t.Fatal("expected the circuit to be probed after the cool down")
+	}
+	p1, p2 := cb.acquire(&c, now), cb.acquire(&c, now)
+	if !p1 || !p2 || c.String() != "half_open" {
+		t.Fatal("expected probes while half open")
+	}
+	if cb.available(&c, now) {
+		t.Fatal("expected no further connections while the probes are in flight")
+	}
+
+	// a failing probe opens the circuit again
+	cb.connected(&c, p1)
+	if !cb.failed(&c, p2, now) || c.String() != "open" {
+		t.Fatal("expected a failed probe to open the circuit again")
+	}
+
+	now = now.Add(time.Minute)
+	p1, p2 = cb.acquire(&c, now), cb.acquire(&c, now)
+	if cb.connected(&c, p1) {
+		t.Fatal("expected the circuit to close only once all probes connected")
+	}
+	if !cb.connected(&c, p2) || c.String() != "" {
+		t.Fatal("expected the circuit to close")
+	}
+}
+
+func TestCircuitBreakerFallback(t *testing.T) {
+	targets := testTargets(2)
+	targets[1].Priority = 1
+	b := testBalancer(t, "", targets...)
+	b.breaker = &CircuitBreaker{Failures: 1}
+
+	primary := b.pick(netip.Addr{})
+	if primary.Address != "a" {
+		t.Fatalf("expected upstream a, got %s", primary)
+	}
+	b.breaker.failed(&primary.circuit, false, time.Now())
+	if u := b.pick(netip.Addr{}); u == nil || u.Address != "b" {
+		t.Fatalf("expected upstream b while the circuit of a is open, got %v", u)
+	}
+
+	b.breaker.failed(&(*b.upstreams.Load())[1].circuit, false, time.Now())
+	if u := b.pick(netip.Addr{}); u != nil {
+		t.Fatalf("expected no upstream while all circuits are open, got %s", u)
+	}
+	if !errors.Is(b.unavailable(), errUnavailable) {
+		t.Fatal("expected connections to fail fast while all circuits are open")
+	}
+}
+
+// TestCircuitBreakerDial ensures that the circuit opens once the upstream
+// refuses connections and closes again once a probe could connect.
+func TestCircuitBreakerDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	upstreamAddr := l.Addr().String()
+	_ = l.Close()
+
+	r := testRule(upstreamAddr)
+	r.SlowStart = Duration(time.Minute)
+	r.CircuitBreaker = &CircuitBreaker{Failures: 2, CoolDown: Duration(200 * time.Millisecond)}
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = f.dial(netip.Addr{}); err == nil || errors.Is(err, errUnavailable) {
+			t.Fatalf("expected the dial to fail, got %v", err)
+		}
+	}
+	_, err = f.dial(netip.Addr{})
+	if !errors.Is(err, errUnavailable) || !errors.Is(err, ErrDial) {
+		t.Fatalf("expected the dial to fail fast, got %v", err)
+	}
+	if st := f.Stats().Upstreams[0]; st.Circuit != "open" || st.DialErrors != 2 {
+		t.Fatalf("expected the circuit to be open after two dial errors, got %+v", st)
+	}
+
+	l, err = net.Listen("tcp", upstreamAddr)
+	if err != nil {
+		t.Fatalf("start upstream: %s", err.Error())
+	}
+	defer l.Close()
+	time.Sleep(300 * time.Millisecond)
+
+	c, err := f.dial(netip.Addr{})
+	if err != nil {
+		t.Fatalf("expected the probe to connect, got %s", err.Error())
+	}
+	defer c.Close()
+	u := (*f.balancer.upstreams.Load())[0]
+	if u.circuit.String() != "" || u.joined.Load() == 0 {
+		t.Fatal("expected the circuit to close and the upstream to start slowly")
+	}
+}
@@ -0,0 +1,100 @@
+package harald
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Buffers configures the buffers used to copy data between the client and the
+// upstream. Without a size the kernel copies the data directly between the
+// sockets where possible (splice), otherwise a 32KiB buffer is used.
+type Buffers struct {
+	// In is the size in bytes of the buffer copying from client to upstream.
+	In int `json:"in" yaml:"in" toml:"in"`
+	// Out is the size in bytes of the buffer copying from upstream to client.
+	Out int `json:"out" yaml:"out" toml:"out"`
+}
+
+func (b *Buffers) validate() error {
+	if b == nil {
+		return nil
+	}
+	if b.In < 0 || b.Out < 0 {
+		return fmt.Errorf("buffers: size must not be negative")
+	}
+	return nil
+}
+
+func (b *Buffers) in() int {
+	if b == nil {
+		return 0
+	}
+	return b.In
+}
+
+func (b *Buffers) out() int {
+	if b == nil {
+		return 0
+	}
+	return b.Out
+}
+
+// size returns the memory a single connection allocates for its buffers.
+func (b *Buffers) size() int {
+	return b.in() + b.out()
+}
+
+// copyBuffer copies from src to dst using a buffer of the given size. A size
+// of zero behaves like io.Copy.
+func copyBuffer(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		return io.Copy(dst, src)
+	}
+	// hide ReadFrom and WriteTo, they would ignore the buffer.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, size))
+}
+
+// bufferBudget limits the memory of the copy buffers across all forwarders of
+// a server. A nil *bufferBudget does not limit anything.
+type bufferBudget struct {
+	max  int
+	mu   sync.Mutex
+	used int
+}
+
+func newBufferBudget(max int) *bufferBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &bufferBudget{max: max}
+}
+
+// reserve accounts for n bytes of buffers. It returns false if that would
+// exceed the budget. Every successful call must be followed by a call to
+// release.
+func (b *bufferBudget) reserve(n int) bool {
+	if b == nil || n == 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.used+n > b.max {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *bufferBudget) release(n int) {
+	if b == nil || n == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+}
@@ -0,0 +1,94 @@
+package harald
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestBufferBudget(t *testing.T) {
+	b := newBufferBudget(100)
+	if !b.reserve(60) {
+		t.Fatal("expected reservation within budget")
+	}
+	if b.reserve(60) {
+		t.Fatal("expected reservation exceeding the budget to fail")
+	}
+	b.release(60)
+	if !b.reserve(100) {
+		t.Fatal("expected released memory to be available")
+	}
+
+	if newBufferBudget(0) != nil {
+		t.Fatal("expected no budget")
+	}
+}
+
+// chunkWriter records the size of the largest write.
+type chunkWriter struct {
+	bytes.Buffer
+	largest int
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.largest = max(w.largest, len(p))
+	return w.Buffer.Write(p)
+}
+
+func TestCopyBuffer(t *testing.T) {
+	payload := strings.Repeat("a", 1000)
+
+	var w chunkWriter
+	n, err := copyBuffer(&w, strings.NewReader(payload), 64)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n != int64(len(payload)) || w.String() != payload {
+		t.Errorf("unexpected copy of %d bytes", n)
+	}
+	if w.largest > 64 {
+		t.Errorf("expected writes of at most 64 bytes; got %d", w.largest)
+	}
+}
+
+func TestBuffersInvalid(t *testing.T) {
+	r := testRule("127.0.0.1:1")
+	r.Buffers = &Buffers{In: -1}
+	if _, err := r.NewForwarder("test", 0); err == nil {
+		t.Fatal("expected error for negative buffer size")
+	}
+}
+
+// TestForwarderLoad pushes data through the copy paths in parallel and
+// verifies it arrives intact.
+func TestForwarderLoad(t *testing.T) {
+	for name, buffers := range map[string]*Buffers{
+		"splice":  nil,
+		"buffers": {In: 4 << 10, Out: 1000},
+	} {
+		t.Run(name, func(t *testing.T) {
+			echo, _ := haraldtest.EchoServer(t)
+			r := testRule(echo)
+			r.Buffers = buffers
+			f, err := r.NewForwarder("test", time.Second)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			err = f.Start()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer f.Stop()
+
+			lc := haraldtest.LoadClient{Connections: 8, Bytes: 4 << 20, ChunkSize: 10000}
+			for i, res := range lc.Run(t, f.Addr().String()) {
+				if !res.Intact || res.Received != 4<<20 {
+					t.Errorf("connection %d: expected data to arrive intact, got %+v", i, res)
+				}
+			}
+		})
+	}
+}
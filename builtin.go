@@ -0,0 +1,85 @@
+package harald
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// networkEcho is the connect network of rules which echo the data of the
+	// clients back instead of forwarding it, e.g. for load tests or to check
+	// the TLS setup of clients without a backend.
+	networkEcho = "echo"
+	// networkDiscard is the connect network of rules which read and drop the
+	// data of the clients, it is still counted in the stats of the rule.
+	networkDiscard = "discard"
+	// networkStatic is the connect network of rules which write the static
+	// response to the clients and close the connection, e.g. as the fallback
+	// if all upstreams are down.
+	networkStatic = "static"
+)
+
+// isBuiltin reports whether the network is served by harald itself instead of
+// being dialed.
+func isBuiltin(network string) bool {
+	switch network {
+	case networkEcho, networkDiscard, networkStatic:
+		return true
+	default:
+		return false
+	}
+}
+
+// validateBuiltin reports options which don't make sense with an upstream
+// served by harald itself.
+func validateBuiltin(r ForwardRule) error {
+	static := r.Connect.Network == networkStatic
+	if r.Fallback != nil {
+		if !isBuiltin(r.Fallback.Network) {
+			return fmt.Errorf("fallback requires a builtin network, got %s", r.Fallback.Network)
+		}
+		static = static || r.Fallback.Network == networkStatic
+	}
+	if static && r.StaticResponse == "" {
+		return fmt.Errorf("the static network requires static_response")
+	}
+	if !isBuiltin(r.Connect.Network) && r.Connect.Network != networkExec && r.Connect.Network != networkStdio {
+		return nil
+	}
+	switch {
+	case r.Fallback != nil:
+		return fmt.Errorf("connect network %s can't be combined with a fallback", r.Connect.Network)
+	case len(r.Upstreams) > 0 || r.Discovery != nil:
+		return fmt.Errorf("connect network %s can't be combined with upstreams or discovery", r.Connect.Network)
+	case r.UpstreamTLS != nil || r.ProxyProtocol != nil || r.Pool != nil:
+		return fmt.Errorf("connect network %s can't be combined with upstream_tls, proxy_protocol or a pool", r.Connect.Network)
+	}
+	return nil
+}
+
+// dialBuiltin returns the end of an in-memory connection served by a builtin
+// upstream.
+func (f *Forwarder) dialBuiltin(network string) net.Conn {
+	c, upstream := net.Pipe()
+	go func() {
+		defer upstream.Close()
+		switch network {
+		case networkEcho:
+			_, _ = io.Copy(upstream, upstream)
+		case networkDiscard:
+			_, _ = io.Copy(io.Discard, upstream)
+		case networkStatic:
+			_, err := io.WriteString(upstream, f.StaticResponse)
+			if err != nil {
+				return
+			}
+			// like a rejected client in maintenance mode we keep reading for
+			// a while, so the response isn't discarded by a reset.
+			_ = upstream.SetReadDeadline(time.Now().Add(maintenanceLinger))
+			_, _ = io.Copy(io.Discard, upstream)
+		}
+	}()
+	return c
+}
@@ -0,0 +1,162 @@
+package harald
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestEchoUpstream(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+
+	f, err := ForwardRule{
+		Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		Connect: NetConf{Network: networkEcho},
+		TLS:     &TLS{Certificate: string(crt), Key: string(key)},
+	}.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+	c, err := tls.Dial("tcp", f.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+
+	for _, msg := range []string{"hello", "world"} {
+		_, err = c.Write([]byte(msg))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		b := make([]byte, len(msg))
+		_, err = io.ReadFull(c, b)
+		if err != nil || string(b) != msg {
+			t.Fatalf("want = %s; got = %q, %v", msg, b, err)
+		}
+	}
+}
+
+func TestDiscardUpstream(t *testing.T) {
+	f, err := ForwardRule{
+		Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		Connect: NetConf{Network: networkDiscard},
+	}.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	c, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = c.Write(make([]byte, 64<<10))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = c.Close()
+
+	for i := 0; i < 100 && f.Stats().ActiveConnections > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := f.Stats(); st.BytesIn != 64<<10 || st.BytesOut != 0 {
+		t.Errorf("expected the data to be counted and dropped; got = %+v", st)
+	}
+}
+
+func TestStaticUpstream(t *testing.T) {
+	const response = "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n"
+	tests := map[string]ForwardRule{
+		"connect": {
+			Connect:        NetConf{Network: networkStatic},
+			StaticResponse: response,
+		},
+		"fallback": {
+			// nothing listens on the port of tcpmux
+			Connect:        NetConf{Network: "tcp", Address: "127.0.0.1:1"},
+			Fallback:       &NetConf{Network: networkStatic},
+			StaticResponse: response,
+		},
+	}
+	for name, r := range tests {
+		t.Run(name, func(t *testing.T) {
+			r.Listen = NetConf{Network: "tcp", Address: "127.0.0.1:0"}
+			f, err := r.NewForwarder("test", time.Second)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			err = f.Start()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer f.Stop()
+
+			c, err := net.Dial("tcp", f.Addr().String())
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer c.Close()
+			_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+			_, _ = c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+			b, err := io.ReadAll(c)
+			if err != nil || string(b) != response {
+				t.Errorf("want = %q; got = %q, %v", response, b, err)
+			}
+		})
+	}
+}
+
+func TestValidateBuiltin(t *testing.T) {
+	tests := map[string]ForwardRule{
+		"upstreams": {
+			Connect:   NetConf{Network: networkEcho},
+			Upstreams: []NetConf{{Network: "tcp", Address: "127.0.0.1:8080"}},
+		},
+		"upstream tls": {
+			Connect:     NetConf{Network: networkEcho},
+			UpstreamTLS: &UpstreamTLS{},
+		},
+		"proxy protocol": {
+			Connect:       NetConf{Network: networkEcho},
+			ProxyProtocol: &ProxyProtocol{},
+		},
+		"static without response": {
+			Connect: NetConf{Network: networkStatic},
+		},
+		"fallback without builtin": {
+			Connect:  NetConf{Network: "tcp", Address: "127.0.0.1:8080"},
+			Fallback: &NetConf{Network: "tcp", Address: "127.0.0.1:8081"},
+		},
+		"fallback of builtin": {
+			Connect:  NetConf{Network: networkEcho},
+			Fallback: &NetConf{Network: networkDiscard},
+		},
+	}
+	for name, r := range tests {
+		err := validateBuiltin(r)
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
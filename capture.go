@@ -0,0 +1,478 @@
+package harald
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Formats of the files written by captures.
+const (
+	// CapturePCAP writes the data as TCP segments between the client and
+	// harald which can be inspected with the usual tools. The handshake and
+	// the addresses are synthesized, the segments carry the data as it has
+	// been read.
+	CapturePCAP = "pcap"
+	// CaptureDump writes a record for each read: the direction ('>' from the
+	// client, '<' from the upstream), the time in unix nanoseconds as 8 and
+	// the length of the data as 4 big endian bytes followed by the data.
+	CaptureDump = "dump"
+)
+
+// defaultCaptureMaxBytes limits the data recorded by a capture if the admin
+// doesn't set a limit.
+const defaultCaptureMaxBytes = 10 << 20
+
+// Capture describes a capture of the data forwarded for a rule or a single
+// connection.
+type Capture struct {
+	// Target is the rule or the ID of the connection which is captured.
+	Target string `json:"target"`
+	Format string `json:"format"`
+	// MaxBytes limits the data recorded across all connections, the capture
+	// ends once it is reached.
+	MaxBytes int64 `json:"max_bytes"`
+	// Bytes is the data recorded so far.
+	Bytes int64 `json:"bytes"`
+	// Files are the paths of the files written for each connection.
+	Files []string  `json:"files"`
+	Since time.Time `json:"since"`
+}
+
+// captureTable holds the captures started by the admin. Connections look up
+// a capture for their rule or ID once they start forwarding, it is shared by
+// the forwarders of a server. A nil *captureTable doesn't capture anything.
+type captureTable struct {
+	// dir the files are written to, captures are disabled if it is empty.
+	dir string
+
+	mu       sync.Mutex
+	captures map[string]*capture
+}
+
+type capture struct {
+	Capture // Files are guarded by the mutex of the table
+	bytes   atomic.Int64
+	// stopped is set once the capture has been removed from the table.
+	stopped atomic.Bool
+}
+
+func newCaptureTable(dir string) *captureTable {
+	return &captureTable{dir: dir, captures: make(map[string]*capture)}
+}
+
+// start begins capturing the connections of target.
+func (t *captureTable) start(target, format string, maxBytes int64) (Capture, error) {
+	if t == nil || t.dir == "" {
+		return Capture{}, fmt.Errorf("capture: capture_dir isn't configured")
+	}
+	switch format {
+	case "":
+		format = CapturePCAP
+	case CapturePCAP, CaptureDump:
+	default:
+		return Capture{}, fmt.Errorf("capture: unknown format '%s'", format)
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultCaptureMaxBytes
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.captures[target]; ok {
+		return Capture{}, fmt.Errorf("capture: '%s' is already captured", target)
+	}
+	c := &capture{Capture: Capture{Target: target, Format: format, MaxBytes: maxBytes, Since: time.Now()}}
+	t.captures[target] = c
+	return c.snapshot(), nil
+}
+
+// stop ends the capture of target, connections which are being captured
+// stop recording right away.
+func (t *captureTable) stop(target string) (Capture, error) {
+	if t == nil {
+		return Capture{}, withKind(ErrNotFound, fmt.Errorf("capture: '%s' isn't captured", target))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.captures[target]
+	if !ok {
+		return Capture{}, withKind(ErrNotFound, fmt.Errorf("capture: '%s' isn't captured", target))
+	}
+	delete(t.captures, target)
+	c.stopped.Store(true)
+	return c.snapshot(), nil
+}
+
+// expire ends the capture once it reached its limit.
+func (t *captureTable) expire(c *capture) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.captures[c.Target] != c {
+		return
+	}
+	delete(t.captures, c.Target)
+	c.stopped.Store(true)
+	slog.Info("capture reached its limit", slog.String("target", c.Target), slog.Int64("max-bytes", c.MaxBytes))
+}
+
+// list returns the active captures ordered by the time they have been
+// started.
+func (t *captureTable) list() []Capture {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	captures := make([]Capture, 0, len(t.captures))
+	for _, c := range t.captures {
+		captures = append(captures, c.snapshot())
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(captures, func(a, b Capture) int { return a.Since.Compare(b.Since) })
+	return captures
+}
+
+// state describes whether target is captured for the audit log.
+func (t *captureTable) state(target string) func() string {
+	return func() string {
+		if t == nil {
+			return "off"
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if c, ok := t.captures[target]; ok {
+			return "on " + c.Format
+		}
+		return "off"
+	}
+}
+
+// snapshot copies the description, the mutex of the table has to be held.
+func (c *capture) snapshot() Capture {
+	s := c.Capture
+	s.Bytes = min(c.bytes.Load(), c.MaxBytes)
+	s.Files = slices.Clone(c.Files)
+	return s
+}
+
+// tap returns source and target recording the data read from them if the
+// connection or its rule is captured. The returned function has to be called
+// once the connection has been closed.
+func (t *captureTable) tap(rule, id string, source, target net.Conn) (net.Conn, net.Conn, func(), error) {
+	if t == nil {
+		return source, target, func() {}, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.captures[id]
+	if !ok {
+		c, ok = t.captures[rule]
+	}
+	if !ok {
+		return source, target, func() {}, nil
+	}
+
+	path := filepath.Join(t.dir, captureFileName(rule)+"-"+captureFileName(id)+"."+c.Format)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return source, target, func() {}, fmt.Errorf("capture: %w", err)
+	}
+	c.Files = append(c.Files, path)
+
+	w := &captureWriter{table: t, capture: c, file: file, buf: bufio.NewWriter(file)}
+	if c.Format == CapturePCAP {
+		w.enc = newPCAPEncoder(w.buf, source.RemoteAddr(), source.LocalAddr())
+	} else {
+		w.enc = dumpEncoder{w.buf}
+	}
+	w.mu.Lock()
+	err = w.enc.open(time.Now())
+	w.mu.Unlock()
+	if err != nil {
+		_ = file.Close()
+		return source, target, func() {}, fmt.Errorf("capture: %w", err)
+	}
+
+	return &tapConn{Conn: source, w: w, fromClient: true}, &tapConn{Conn: target, w: w}, w.close, nil
+}
+
+// captureFileName replaces the characters of rule names and connection IDs
+// which aren't safe in file names.
+func captureFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// captureEncoder writes the data of a single connection in one of the
+// formats.
+type captureEncoder interface {
+	open(t time.Time) error
+	record(t time.Time, fromClient bool, b []byte) error
+	close(t time.Time) error
+}
+
+// captureWriter records the data of a single connection until the limit of
+// the capture is reached.
+type captureWriter struct {
+	table   *captureTable
+	capture *capture
+	file    *os.File
+
+	mu  sync.Mutex
+	buf *bufio.Writer
+	enc captureEncoder
+	err error
+}
+
+func (w *captureWriter) record(fromClient bool, b []byte) {
+	c := w.capture
+	if c.stopped.Load() {
+		return
+	}
+	n := int64(len(b))
+	if total := c.bytes.Add(n); total >= c.MaxBytes {
+		if total-n >= c.MaxBytes {
+			return
+		}
+		b = b[:c.MaxBytes-(total-n)]
+		w.table.expire(c)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = w.enc.record(time.Now(), fromClient, b)
+	}
+}
+
+func (w *captureWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = w.enc.close(time.Now())
+	}
+	if w.err == nil {
+		w.err = w.buf.Flush()
+	}
+	if err := w.file.Close(); w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		slog.Warn("writing capture failed", slog.String("file", w.file.Name()), attrError(w.err))
+	}
+}
+
+// tapConn records the data read from the connection. It hides the fast
+// paths of the connection, captured connections are always copied in user
+// space.
+type tapConn struct {
+	net.Conn
+	w          *captureWriter
+	fromClient bool
+}
+
+func (c *tapConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.w.record(c.fromClient, b[:n])
+	}
+	return n, err
+}
+
+type dumpEncoder struct {
+	w *bufio.Writer
+}
+
+func (dumpEncoder) open(time.Time) error  { return nil }
+func (dumpEncoder) close(time.Time) error { return nil }
+
+func (e dumpEncoder) record(t time.Time, fromClient bool, b []byte) error {
+	var hdr [13]byte
+	hdr[0] = '<'
+	if fromClient {
+		hdr[0] = '>'
+	}
+	binary.BigEndian.PutUint64(hdr[1:], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(hdr[9:], uint32(len(b)))
+	_, _ = e.w.Write(hdr[:])
+	_, err := e.w.Write(b)
+	return err
+}
+
+const (
+	// pcapLinkTypeRaw marks packets starting with an IPv4 or IPv6 header.
+	pcapLinkTypeRaw = 101
+	// pcapMaxSegment is the maximum data of a single TCP segment, larger
+	// reads are split up.
+	pcapMaxSegment = 65000
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// pcapEncoder writes a synthesized TCP connection between the client and
+// harald in the pcap format with nanosecond timestamps.
+type pcapEncoder struct {
+	w                 *bufio.Writer
+	client, server    netip.AddrPort
+	clientSeq, srvSeq uint32
+}
+
+// newPCAPEncoder uses the addresses of the connection of the client if they
+// belong to the same IP family and placeholders otherwise, e.g. for unix
+// sockets.
+func newPCAPEncoder(w *bufio.Writer, client, server net.Addr) *pcapEncoder {
+	e := &pcapEncoder{
+		w:      w,
+		client: netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 1),
+		server: netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 2}), 2),
+	}
+	c, err1 := netip.ParseAddrPort(client.String())
+	s, err2 := netip.ParseAddrPort(server.String())
+	if err1 == nil && err2 == nil {
+		c = netip.AddrPortFrom(c.Addr().Unmap(), c.Port())
+		s = netip.AddrPortFrom(s.Addr().Unmap(), s.Port())
+		if c.Addr().Is4() == s.Addr().Is4() {
+			e.client, e.server = c, s
+		}
+	}
+	return e
+}
+
+func (e *pcapEncoder) open(t time.Time) error {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b23c4d) // nanosecond timestamps
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	_, _ = e.w.Write(hdr[:])
+
+	// the sequence numbers start at zero, the data at one
+	e.packet(t, true, tcpSYN, nil)
+	e.clientSeq++
+	e.packet(t, false, tcpSYN|tcpACK, nil)
+	e.srvSeq++
+	return e.packet(t, true, tcpACK, nil)
+}
+
+func (e *pcapEncoder) record(t time.Time, fromClient bool, b []byte) error {
+	for len(b) > 0 {
+		n := min(len(b), pcapMaxSegment)
+		err := e.packet(t, fromClient, tcpPSH|tcpACK, b[:n])
+		if err != nil {
+			return err
+		}
+		if fromClient {
+			e.clientSeq += uint32(n)
+		} else {
+			e.srvSeq += uint32(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func (e *pcapEncoder) close(t time.Time) error {
+	e.packet(t, true, tcpFIN|tcpACK, nil)
+	e.clientSeq++
+	e.packet(t, false, tcpFIN|tcpACK, nil)
+	e.srvSeq++
+	return e.packet(t, true, tcpACK, nil)
+}
+
+// packet writes a single TCP segment including its IP header.
+func (e *pcapEncoder) packet(t time.Time, fromClient bool, flags byte, data []byte) error {
+	src, dst, seq, ack := e.client, e.server, e.clientSeq, e.srvSeq
+	if !fromClient {
+		src, dst, seq, ack = e.server, e.client, e.srvSeq, e.clientSeq
+	}
+
+	tcp := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], ack)
+	}
+	tcp[12] = 5 << 4 // header length in 32-bit words
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	tcp = append(tcp, data...)
+
+	// the checksum covers a pseudo header of the addresses, the protocol
+	// and the length of the segment. The layout of IPv6 sums up to the same
+	// value for IPv4.
+	pseudo := append(src.Addr().AsSlice(), dst.Addr().AsSlice()...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(tcp)))
+	pseudo = append(pseudo, 0, 0, 0, 6)
+	binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+	var ip []byte
+	if src.Addr().Is4() {
+		ip = make([]byte, 20)
+		ip[0] = 0x45 // version 4, header length of 5 words
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[8] = 64 // ttl
+		ip[9] = 6  // tcp
+		copy(ip[12:], src.Addr().AsSlice())
+		copy(ip[16:], dst.Addr().AsSlice())
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+	} else {
+		ip = make([]byte, 40)
+		ip[0] = 6 << 4
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6  // next header: tcp
+		ip[7] = 64 // hop limit
+		copy(ip[8:], src.Addr().AsSlice())
+		copy(ip[24:], dst.Addr().AsSlice())
+	}
+
+	var rec [16]byte
+	binary.LittleEndian.PutUint32(rec[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(t.Nanosecond()))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(ip)+len(tcp)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(ip)+len(tcp)))
+	_, _ = e.w.Write(rec[:])
+	_, _ = e.w.Write(ip)
+	_, err := e.w.Write(tcp)
+	return err
+}
+
+// checksum is the internet checksum of the concatenated parts, each part
+// but the last has to be of even length.
+func checksum(parts ...[]byte) uint16 {
+	var sum uint32
+	for _, b := range parts {
+		for len(b) > 1 {
+			sum += uint32(binary.BigEndian.Uint16(b))
+			b = b[2:]
+		}
+		if len(b) == 1 {
+			sum += uint32(b[0]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
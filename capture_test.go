@@ -0,0 +1,173 @@
+package harald
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+// readDump parses the records of a dump file into the concatenated data of
+// each direction.
+func readDump(t *testing.T, b []byte) (in, out string) {
+	t.Helper()
+	for len(b) > 0 {
+		if len(b) < 13 {
+			t.Fatalf("truncated record header")
+		}
+		n := int(binary.BigEndian.Uint32(b[9:]))
+		if len(b) < 13+n {
+			t.Fatalf("truncated record data")
+		}
+		switch b[0] {
+		case '>':
+			in += string(b[13 : 13+n])
+		case '<':
+			out += string(b[13 : 13+n])
+		default:
+			t.Fatalf("unexpected direction %q", b[0])
+		}
+		b = b[13+n:]
+	}
+	return in, out
+}
+
+func TestCaptureDump(t *testing.T) {
+	echo, _ := haraldtest.EchoServer(t)
+	f, err := testRule(echo).NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.captures = newCaptureTable(t.TempDir())
+	_, err = f.captures.start("test", CaptureDump, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	c, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, _ = c.Write([]byte("hello"))
+	_, err = io.ReadFull(c, make([]byte, 5))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = c.Close()
+
+	var data []byte
+	for deadline := time.Now().Add(2 * time.Second); len(data) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the capture to be written once the connection closed")
+		}
+		captures := f.captures.list()
+		if len(captures) != 1 || len(captures[0].Files) != 1 {
+			continue
+		}
+		data, _ = os.ReadFile(captures[0].Files[0])
+	}
+
+	in, out := readDump(t, data)
+	if in != "hello" || out != "hello" {
+		t.Fatalf("expected hello in both directions, got %q and %q", in, out)
+	}
+}
+
+func TestCaptureLimit(t *testing.T) {
+	ct := newCaptureTable(t.TempDir())
+	_, err := ct.start("test", CaptureDump, 3)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client, server := net.Pipe()
+	source, _, done, err := ct.tap("test", "id", server, server)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	go func() { _, _ = client.Write([]byte("hello")) }()
+	_, _ = io.ReadFull(source, make([]byte, 5))
+	done()
+
+	if len(ct.list()) != 0 {
+		t.Fatal("expected the capture to end once it reached its limit")
+	}
+	data, err := os.ReadFile(filepath.Join(ct.dir, "test-id.dump"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if in, _ := readDump(t, data); in != "hel" {
+		t.Fatalf("expected the data to be cut at the limit, got %q", in)
+	}
+}
+
+func TestCaptureInvalid(t *testing.T) {
+	if _, err := newCaptureTable("").start("test", "", 0); err == nil {
+		t.Error("expected error without a capture dir")
+	}
+	ct := newCaptureTable(t.TempDir())
+	if _, err := ct.start("test", "txt", 0); err == nil {
+		t.Error("expected error for an unknown format")
+	}
+	if _, err := ct.stop("test"); err == nil {
+		t.Error("expected error for a target which isn't captured")
+	}
+}
+
+func TestPCAPEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	e := newPCAPEncoder(w, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 80})
+	now := time.Now()
+	_ = e.open(now)
+	_ = e.record(now, true, []byte("GET / HTTP/1.1\r\n\r\n"))
+	_ = e.record(now, false, []byte("HTTP/1.1 204 No Content\r\n\r\n"))
+	_ = e.close(now)
+	_ = w.Flush()
+
+	b := buf.Bytes()
+	if binary.LittleEndian.Uint32(b) != 0xa1b23c4d || binary.LittleEndian.Uint32(b[20:]) != pcapLinkTypeRaw {
+		t.Fatal("unexpected pcap header")
+	}
+	b = b[24:]
+
+	var packets int
+	var seq uint32
+	for len(b) > 0 {
+		n := int(binary.LittleEndian.Uint32(b[8:]))
+		p := b[16 : 16+n]
+		b = b[16+n:]
+		packets++
+
+		ip, tcp := p[:20], p[20:]
+		if checksum(ip) != 0 {
+			t.Fatalf("invalid ip checksum of packet %d", packets)
+		}
+		pseudo := append(append([]byte{}, ip[12:20]...), 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+		if checksum(pseudo, tcp) != 0 {
+			t.Fatalf("invalid tcp checksum of packet %d", packets)
+		}
+		if packets == 5 {
+			// the response acknowledges the request
+			seq = binary.BigEndian.Uint32(tcp[8:])
+		}
+	}
+	if packets != 8 {
+		t.Fatalf("expected 8 packets, got %d", packets)
+	}
+	if seq != 1+uint32(len("GET / HTTP/1.1\r\n\r\n")) {
+		t.Fatalf("unexpected acknowledgement number %d", seq)
+	}
+}
@@ -0,0 +1,151 @@
+package harald
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certificateTimeout is the time a listener waits for the first certificate
+// of a source before it fails to start.
+const certificateTimeout = 10 * time.Second
+
+// CertificateSource obtains the certificate of a listener dynamically as an
+// alternative to the certificate and key of TLS. The certificate is renewed
+// while the listener is open.
+type CertificateSource struct {
+	// Type selects the source, the config of the source is expected in the
+	// field of the same name.
+	Type   string        `json:"type" yaml:"type" toml:"type"`
+	SPIFFE *SPIFFESource `json:"spiffe" yaml:"spiffe" toml:"spiffe"`
+	Vault  *VaultSource  `json:"vault" yaml:"vault" toml:"vault"`
+}
+
+// certSource provides the certificates of a listener.
+type certSource interface {
+	// watch calls update with the current certificate and whenever it
+	// changes until ctx is canceled.
+	watch(ctx context.Context, update func(certBundle))
+	String() string
+}
+
+// certBundle is a certificate obtained from a source.
+type certBundle struct {
+	cert tls.Certificate
+	// clientCAs are the authorities the source trusts to verify clients,
+	// nil if it doesn't provide any.
+	clientCAs *x509.CertPool
+}
+
+// newSource creates the certificate source described by the config.
+func (c *CertificateSource) newSource(log *slog.Logger) (certSource, error) {
+	switch c.Type {
+	case "spiffe":
+		if c.SPIFFE == nil {
+			return nil, fmt.Errorf("certificate source: missing spiffe config")
+		}
+		return newSPIFFESource(*c.SPIFFE, log)
+	case "vault":
+		if c.Vault == nil {
+			return nil, fmt.Errorf("certificate source: missing vault config")
+		}
+		return newVaultSource(*c.Vault, log)
+	default:
+		return nil, fmt.Errorf("certificate source: unknown type '%s'", c.Type)
+	}
+}
+
+// certStore serves the latest certificate of a source to the handshakes of a
+// listener.
+type certStore struct {
+	source   certSource
+	base     *tls.Config
+	policies []clientAuthPolicy
+	log      *slog.Logger
+
+	// configs are derived from base with the latest certificate.
+	configs atomic.Pointer[tlsConfigs]
+	mu      sync.Mutex // guards cancel
+	cancel  context.CancelFunc
+}
+
+// newCertStore hooks the source into conf, handshakes fail until the first
+// certificate has been received.
+func newCertStore(source certSource, conf *tls.Config, policies []clientAuthPolicy, log *slog.Logger) *certStore {
+	s := &certStore{source: source, base: conf.Clone(), policies: policies, log: log}
+	s.base.GetConfigForClient = nil
+	conf.GetConfigForClient = s.config
+	return s
+}
+
+func (s *certStore) config(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	configs := s.configs.Load()
+	if configs == nil {
+		return nil, fmt.Errorf("no certificate received from %s yet", s.source)
+	}
+	return configs.forHello(hello), nil
+}
+
+func (s *certStore) update(b certBundle) {
+	conf := s.base.Clone()
+	conf.Certificates = []tls.Certificate{b.cert}
+	if b.clientCAs != nil && conf.ClientCAs == nil {
+		conf.ClientCAs = b.clientCAs
+	}
+	s.configs.Store(newTLSConfigs(conf, s.policies))
+
+	attrs := []any{slog.String("source", s.source.String())}
+	if b.cert.Leaf != nil {
+		attrs = append(attrs, slog.Time("not-after", b.cert.Leaf.NotAfter))
+	}
+	s.log.Info("received certificate", attrs...)
+}
+
+// start watches the source until stop is called and waits for the first
+// certificate. It does nothing if the store is nil or already started.
+func (s *certStore) start() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		return nil
+	}
+
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	received := make(chan struct{})
+	var once sync.Once
+	go s.source.watch(ctx, func(b certBundle) {
+		s.update(b)
+		once.Do(func() { close(received) })
+	})
+
+	select {
+	case <-received:
+		return nil
+	case <-time.After(certificateTimeout):
+		s.cancel()
+		s.cancel = nil
+		return withKind(ErrTLS, fmt.Errorf("no certificate received from %s within %s", s.source, certificateTimeout))
+	}
+}
+
+// stop ends watching the source, the latest certificate is still served.
+func (s *certStore) stop() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+}
@@ -0,0 +1,120 @@
+package harald
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// ClientAuthPolicy overrides the client authentication of TLS for handshakes
+// which request one of the server names via SNI, e.g. to require client
+// certificates for an admin hostname only.
+type ClientAuthPolicy struct {
+	// ServerNames are matched case-insensitively, a leading "*." matches
+	// exactly one label (*.example.com matches a.example.com but neither
+	// example.com nor a.b.example.com).
+	ServerNames []string `json:"server_names" yaml:"server_names" toml:"server_names"`
+	// ClientAuth is the level as described at
+	// https://pkg.go.dev/crypto/tls#ClientAuthType
+	ClientAuth tls.ClientAuthType `json:"client_auth" yaml:"client_auth" toml:"client_auth"`
+	// ClientCAs are the PEM encoded authorities to verify the clients,
+	// defaults to the client CAs of TLS.
+	ClientCAs string `json:"client_cas" yaml:"client_cas" toml:"client_cas"`
+}
+
+// clientAuthPolicy is a parsed ClientAuthPolicy.
+type clientAuthPolicy struct {
+	names      []string
+	clientAuth tls.ClientAuthType
+	// clientCAs is nil if the CAs of the base config are used.
+	clientCAs *x509.CertPool
+}
+
+// clientAuthPolicies parses the policies of the config.
+func (t *TLS) clientAuthPolicies() ([]clientAuthPolicy, error) {
+	policies := make([]clientAuthPolicy, len(t.ClientAuthPolicies))
+	for i, p := range t.ClientAuthPolicies {
+		if len(p.ServerNames) == 0 {
+			return nil, fmt.Errorf("client auth policy %d: no server names", i)
+		}
+		if p.ClientAuth > tls.RequireAndVerifyClientCert {
+			return nil, fmt.Errorf("client auth policy %d: unknown client_auth %d", i, p.ClientAuth)
+		}
+		policies[i] = clientAuthPolicy{clientAuth: p.ClientAuth}
+		for _, n := range p.ServerNames {
+			policies[i].names = append(policies[i].names, strings.ToLower(n))
+		}
+		if p.ClientCAs != "" {
+			policies[i].clientCAs = x509.NewCertPool()
+			if !policies[i].clientCAs.AppendCertsFromPEM([]byte(p.ClientCAs)) {
+				return nil, fmt.Errorf("client auth policy %d: unable to parse provided client CAs", i)
+			}
+		} else if p.ClientAuth >= tls.VerifyClientCertIfGiven && t.ClientCAs == "" && t.Source == nil {
+			return nil, fmt.Errorf("client auth policy %d: configured client authentication but no client CAs provided", i)
+		}
+	}
+	return policies, nil
+}
+
+// matches reports whether the server name requested by a client is one of
+// the names of the policy.
+func (p clientAuthPolicy) matches(serverName string) bool {
+	return matchServerName(p.names, serverName)
+}
+
+// matchServerName reports whether serverName matches one of the names, see
+// ClientAuthPolicy.ServerNames for the syntax.
+func matchServerName(names []string, serverName string) bool {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	for _, n := range names {
+		n = strings.ToLower(n)
+		if n == serverName {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(n, "*."); ok {
+			label, rest, found := strings.Cut(serverName, ".")
+			if found && label != "" && rest == suffix {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tlsConfigs holds the config of a listener and its variants for the client
+// auth policies.
+type tlsConfigs struct {
+	base     *tls.Config
+	policies []clientAuthPolicy
+	variants []*tls.Config
+}
+
+// newTLSConfigs derives a variant of base for each policy, base must not have
+// a GetConfigForClient callback.
+func newTLSConfigs(base *tls.Config, policies []clientAuthPolicy) *tlsConfigs {
+	c := &tlsConfigs{base: base, policies: policies}
+	for _, p := range policies {
+		v := base.Clone()
+		v.ClientAuth = p.clientAuth
+		if p.clientCAs != nil {
+			v.ClientCAs = p.clientCAs
+		}
+		c.variants = append(c.variants, v)
+	}
+	return c
+}
+
+// forHello returns the variant of the first policy matching the server name
+// of the client, the base config if none does.
+func (c *tlsConfigs) forHello(hello *tls.ClientHelloInfo) *tls.Config {
+	if hello.ServerName == "" {
+		return c.base
+	}
+	for i, p := range c.policies {
+		if p.matches(hello.ServerName) {
+			return c.variants[i]
+		}
+	}
+	return c.base
+}
@@ -0,0 +1,79 @@
+package harald
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestClientAuthPolicyMatches(t *testing.T) {
+	p := clientAuthPolicy{names: []string{"admin.example.com", "*.internal.example.com"}}
+	for name, want := range map[string]bool{
+		"admin.example.com":          true,
+		"Admin.Example.com.":         true,
+		"www.example.com":            false,
+		"a.internal.example.com":     true,
+		"internal.example.com":       false,
+		"a.b.internal.example.com":   false,
+		".internal.example.com":      false,
+		"admin.example.com.evil.com": false,
+	} {
+		if got := p.matches(name); got != want {
+			t.Errorf("%s: want = %t; got = %t", name, want, got)
+		}
+	}
+}
+
+func TestClientAuthPolicies(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+	conf, err := (&TLS{
+		Certificate: string(crt),
+		Key:         string(key),
+		ClientAuthPolicies: []ClientAuthPolicy{{
+			ServerNames: []string{"admin.example.com"},
+			ClientAuth:  tls.RequireAndVerifyClientCert,
+			ClientCAs:   string(ca.PEM()),
+		}},
+	}).Config()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	clientCert, err := tls.X509KeyPair(ca.NewClientCertificate(t))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// handshake returns the error of the server
+	handshake := func(serverName string, certs ...tls.Certificate) error {
+		client, server := net.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- tls.Server(server, conf).Handshake()
+			_ = server.Close()
+		}()
+		_ = tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true, Certificates: certs}).Handshake()
+		_ = client.Close()
+		return <-errc
+	}
+
+	if err = handshake("www.example.com"); err != nil {
+		t.Errorf("expected clients of other names to connect without a certificate: %s", err.Error())
+	}
+	if err = handshake("admin.example.com"); err == nil {
+		t.Error("expected a client certificate to be required for admin.example.com")
+	}
+	if err = handshake("admin.example.com", clientCert); err != nil {
+		t.Errorf("expected the client certificate to be accepted: %s", err.Error())
+	}
+
+	_, err = (&TLS{Certificate: string(crt), Key: string(key), ClientAuthPolicies: []ClientAuthPolicy{{
+		ServerNames: []string{"admin.example.com"},
+		ClientAuth:  tls.RequireAndVerifyClientCert,
+	}}}).Config()
+	if err == nil {
+		t.Error("expected error for a policy verifying clients without client CAs")
+	}
+}
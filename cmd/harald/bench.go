@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/maxmoehl/harald"
+)
+
+// benchReport is printed by the bench subcommand.
+type benchReport struct {
+	Connections int           `json:"connections"`
+	Size        int           `json:"size"`
+	Duration    time.Duration `json:"duration"`
+	// Bytes is the data echoed back to the clients.
+	Bytes uint64 `json:"bytes"`
+	// Throughput is the data echoed back per second.
+	Throughput float64 `json:"throughput"`
+	// Setup is the latency from dialing until the first byte has been
+	// echoed back through the forwarder.
+	Setup benchLatency `json:"setup"`
+	// Allocs and AllocBytes are the allocations of the process per MiB
+	// echoed back, including the ones of the clients and the backend.
+	Allocs     float64 `json:"allocs_per_mib"`
+	AllocBytes float64 `json:"alloc_bytes_per_mib"`
+}
+
+type benchLatency struct {
+	P50 time.Duration `json:"p50"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+// bench measures the forwarding performance of this build: it forwards the
+// connections of local clients to a local echo backend for a while.
+func bench(args []string) error {
+	fs := flag.NewFlagSet("harald bench", flag.ContinueOnError)
+	conns := fs.Int("connections", 16, "number of concurrent client connections")
+	duration := fs.Duration("duration", 5*time.Second, "how long the clients send data")
+	size := fs.Int("size", 32<<10, "size of each write of the clients in bytes")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *conns <= 0 || *duration <= 0 || *size <= 0 {
+		return fmt.Errorf("usage: harald bench [-connections n] [-duration d] [-size bytes] [-json]")
+	}
+
+	// errors of the clients are reported, the forwarder logs would only
+	// distort the measurement (and report the clients closing their
+	// connections at the end as errors).
+	logLevel.Set(slog.LevelError + 1)
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("bench: backend: %w", err)
+	}
+	defer backend.Close()
+	go echo(backend)
+
+	r := harald.ForwardRule{
+		Listen:  harald.NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		Connect: harald.NetConf{Network: "tcp", Address: backend.Addr().String()},
+	}
+	f, err := r.NewForwarder("bench", time.Second)
+	if err != nil {
+		return fmt.Errorf("bench: %w", err)
+	}
+	err = f.Start()
+	if err != nil {
+		return fmt.Errorf("bench: %w", err)
+	}
+	defer f.Stop()
+
+	report := benchReport{Connections: *conns, Size: *size, Duration: *duration}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var setups []time.Duration
+	var firstErr error
+	deadline := time.Now().Add(*duration)
+	for i := 0; i < *conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			setup, n, err := benchClient(f.Addr().String(), *size, deadline)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if setup > 0 {
+				setups = append(setups, setup)
+			}
+			report.Bytes += n
+		}()
+	}
+	wg.Wait()
+
+	runtime.ReadMemStats(&after)
+	if firstErr != nil {
+		return fmt.Errorf("bench: %w", firstErr)
+	}
+
+	mib := float64(report.Bytes) / (1 << 20)
+	report.Throughput = float64(report.Bytes) / duration.Seconds()
+	if mib > 0 {
+		report.Allocs = float64(after.Mallocs-before.Mallocs) / mib
+		report.AllocBytes = float64(after.TotalAlloc-before.TotalAlloc) / mib
+	}
+	slices.Sort(setups)
+	if n := len(setups); n > 0 {
+		report.Setup = benchLatency{P50: setups[n/2], P99: setups[(n*99)/100], Max: setups[n-1]}
+	}
+
+	if *asJSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(report)
+	}
+	return report.print(os.Stdout)
+}
+
+// benchClient connects through the forwarder and writes size bytes at a time
+// until the deadline, each write is read back before the next one. It
+// returns the setup latency and the bytes echoed back.
+func benchClient(addr string, size int, deadline time.Time) (time.Duration, uint64, error) {
+	start := time.Now()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(deadline.Add(5 * time.Second))
+
+	buf := make([]byte, size)
+	_, err = c.Write(buf[:1])
+	if err == nil {
+		_, err = io.ReadFull(c, buf[:1])
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	setup := time.Since(start)
+
+	var n uint64
+	for time.Now().Before(deadline) {
+		_, err = c.Write(buf)
+		if err != nil {
+			return setup, n, err
+		}
+		_, err = io.ReadFull(c, buf)
+		if err != nil {
+			return setup, n, err
+		}
+		n += uint64(size)
+	}
+	return setup, n, nil
+}
+
+// echo writes everything back to the clients of l until it is closed.
+func echo(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			_, _ = io.Copy(c, c)
+		}()
+	}
+}
+
+func (r benchReport) print(out io.Writer) error {
+	_, err := fmt.Fprintf(out, "%d connections, %d byte writes, %s\n\n"+
+		"throughput   %.1f MiB/s (%d bytes)\n"+
+		"setup        p50 %s, p99 %s, max %s\n"+
+		"allocations  %.1f allocs/MiB, %.0f bytes/MiB\n",
+		r.Connections, r.Size, r.Duration,
+		r.Throughput/(1<<20), r.Bytes,
+		r.Setup.P50.Round(time.Microsecond), r.Setup.P99.Round(time.Microsecond), r.Setup.Max.Round(time.Microsecond),
+		r.Allocs, r.AllocBytes)
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"syscall"
+
+	"github.com/maxmoehl/harald"
+)
+
+// instance locates a running instance through its admin socket or pid file,
+// either given as flags or read from the config file passed as argument.
+type instance struct {
+	adminSocket string
+	pidFile     string
+}
+
+// parse registers the flags on fs and parses args.
+func (i *instance) parse(fs *flag.FlagSet, args []string) error {
+	fs.StringVar(&i.adminSocket, "admin-socket", "", "path of the admin socket of the running instance")
+	fs.StringVar(&i.pidFile, "pid-file", "", "path of the pid file of the running instance")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	switch fs.NArg() {
+	case 0:
+		return nil
+	case 1:
+		c, err := harald.LoadConfig(fs.Arg(0))
+		if err != nil {
+			return fmt.Errorf("loading config: %w", err)
+		}
+		if i.adminSocket == "" {
+			i.adminSocket = c.AdminSocket
+		}
+		if i.pidFile == "" {
+			i.pidFile = c.PIDFile
+		}
+		return nil
+	default:
+		return fmt.Errorf("usage: %s [flags] [config]", fs.Name())
+	}
+}
+
+// subcommands run against an instance which is already running or help to
+// prepare its config.
+var subcommands = map[string]func(args []string) error{
+	"reload":     control("reload", "reload", syscall.SIGHUP),
+	"stop":       control("stop", "shutdown", syscall.SIGTERM),
+	"status":     status,
+	"bench":      bench,
+	"test-dial":  testDial,
+	"forward":    forward,
+	"ech-keygen": echKeygen,
+	"ech-config": echConfig,
+}
+
+// control returns a subcommand which sends the admin command to the instance.
+// If no admin socket is known, the signal is sent to the process found
+// through the pid file instead. The admin socket is preferred as it reports
+// errors back.
+func control(name, command string, sig syscall.Signal) func(args []string) error {
+	return func(args []string) error {
+		var i instance
+		err := i.parse(flag.NewFlagSet("harald "+name, flag.ContinueOnError), args)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case i.adminSocket != "":
+			_, err = harald.AdminCommand(i.adminSocket, command)
+			return err
+		case i.pidFile != "":
+			pid, err := harald.ReadPIDFile(i.pidFile)
+			if err != nil {
+				return err
+			}
+			err = syscall.Kill(pid, sig)
+			if err != nil {
+				return fmt.Errorf("signal %d: %w", pid, err)
+			}
+			return nil
+		default:
+			return fmt.Errorf("unable to locate harald, neither an admin socket nor a pid file is known")
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+
+	"github.com/maxmoehl/harald"
+)
+
+// dryRunConfig builds everything the config describes and prints the rules
+// instead of running them. All errors are printed, not only the first one.
+func dryRunConfig(c harald.Config) error {
+	// the summary is printed to the standard output, the logs of building
+	// the rules would only get in the way.
+	setLogHandler(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	plan, err := harald.DryRun(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return fmt.Errorf("dry run: the config is invalid")
+	}
+	return printPlan(os.Stdout, plan)
+}
+
+func printPlan(out io.Writer, plan []harald.PlannedRule) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tTENANT\tLISTEN\tCONNECT\tTLS\tSTART")
+	for _, r := range plan {
+		tenant, tlsInfo := "-", "-"
+		if r.Tenant != "" {
+			tenant = r.Tenant
+		}
+		switch {
+		case r.TLS && r.UpstreamTLS:
+			tlsInfo = "terminate,upstream"
+		case r.TLS:
+			tlsInfo = "terminate"
+		case r.UpstreamTLS:
+			tlsInfo = "upstream"
+		}
+		start := "on startup"
+		if !r.Start {
+			start = "on SIGUSR1"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s://%s\t%s\t%s\t%s\n", r.Rule, tenant, r.Listen.Network, r.Listen.Address, r.Connect, tlsInfo, start)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/maxmoehl/harald"
+)
+
+// echKeygen generates a key for Encrypted Client Hello and prints it as an
+// entry of ech_keys together with the ECHConfigList of the new key.
+func echKeygen(args []string) error {
+	fs := flag.NewFlagSet("harald ech-keygen", flag.ContinueOnError)
+	publicName := fs.String("public-name", "", "server name sent in the clear by clients using the key")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *publicName == "" {
+		return fmt.Errorf("usage: harald ech-keygen -public-name name")
+	}
+
+	key, err := harald.NewECHKey(*publicName)
+	if err != nil {
+		return err
+	}
+	list, err := (&harald.TLS{ECHKeys: []harald.ECHKey{key}}).ECHConfigList()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "# add to ech_keys of the rule\n")
+	fmt.Fprintf(os.Stdout, "- config: %s\n", key.Config)
+	fmt.Fprintf(os.Stdout, "  private_key: %s\n", key.PrivateKey)
+	fmt.Fprintf(os.Stdout, "# ECHConfigList of this key alone, see harald ech-config for all keys of a rule\n")
+	fmt.Fprintf(os.Stdout, "# %s\n", base64.StdEncoding.EncodeToString(list))
+	return nil
+}
+
+// echConfig prints the ECHConfigList of each rule of the config, which is
+// published in the ech parameter of the HTTPS records of its names.
+func echConfig(args []string) error {
+	fs := flag.NewFlagSet("harald ech-config", flag.ContinueOnError)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: harald ech-config config")
+	}
+
+	c, err := harald.LoadConfig(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	names := make([]string, 0, len(c.Rules))
+	for name := range c.Rules {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		list, err := c.Rules[name].TLS.ECHConfigList()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if list != nil {
+			fmt.Fprintf(os.Stdout, "%s: %s\n", name, base64.StdEncoding.EncodeToString(list))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/maxmoehl/harald"
+)
+
+// forward runs a single rule given through flags instead of a config file,
+// e.g. for quick debugging or a one-off tunnel.
+func forward(args []string) error {
+	fs := flag.NewFlagSet("harald forward", flag.ContinueOnError)
+	listen := fs.String("listen", "", "endpoint to listen on, e.g. tcp://:8443")
+	connect := fs.String("connect", "", "endpoint to connect to, e.g. tcp://10.0.0.5:80")
+	tlsCert := fs.String("tls-cert", "", "PEM file with the certificate to terminate TLS with")
+	tlsKey := fs.String("tls-key", "", "PEM file with the key of the certificate")
+	once := fs.Bool("once", false, "close the listener after the first connection and exit once it is done")
+	var level slog.Level
+	fs.TextVar(&level, "log-level", slog.LevelInfo, "minimum level of the log messages")
+	logFormat := fs.String("log-format", "json", "format of the log messages, json, text or pretty")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	if fs.NArg() != 0 || *listen == "" || *connect == "" {
+		return fmt.Errorf("usage: harald forward -listen network://address -connect network://address [-once] [-tls-cert file -tls-key file]")
+	}
+
+	var r harald.ForwardRule
+	r.Listen, err = parseEndpoint(*listen)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	r.Connect, err = parseEndpoint(*connect)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	if *once {
+		r.MaxAccepts = 1
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key have to be given together")
+	}
+	if *tlsCert != "" {
+		crt, err := os.ReadFile(*tlsCert)
+		if err != nil {
+			return err
+		}
+		key, err := os.ReadFile(*tlsKey)
+		if err != nil {
+			return err
+		}
+		r.TLS = &harald.TLS{Certificate: string(crt), Key: string(key)}
+	}
+
+	c := harald.Config{
+		Version:         2,
+		EnableListeners: true,
+		StartPolicy:     harald.StartPolicyAll,
+		LogFormat:       *logFormat,
+		Rules:           map[string]harald.ForwardRule{"forward": r},
+	}
+	h, err := c.LogHandler(logLevel)
+	if err != nil {
+		return err
+	}
+	setLogHandler(h)
+
+	// interrupting the process, e.g. with ctrl-c, shuts it down like SIGTERM
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	signals := make(chan os.Signal, 1)
+	go func() {
+		for range interrupts {
+			signals <- syscall.SIGTERM
+		}
+	}()
+
+	return harald.Harald(c, signals)
+}
+
+// parseEndpoint splits an endpoint like tcp://127.0.0.1:80 or
+// unix:///run/app.sock into its network and address.
+func parseEndpoint(endpoint string) (harald.NetConf, error) {
+	network, address, ok := strings.Cut(endpoint, "://")
+	if !ok || network == "" {
+		return harald.NetConf{}, fmt.Errorf("endpoint '%s' is not of the form network://address", endpoint)
+	}
+	return harald.NetConf{Network: network, Address: address}, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log/slog"
 	"os"
@@ -13,12 +14,27 @@ import (
 var logLevel = &slog.LevelVar{}
 
 func init() {
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})).With("component", "harald"))
+	setLogHandler(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
+}
+
+func setLogHandler(h slog.Handler) {
+	slog.SetDefault(slog.New(h).With("component", "harald"))
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			err := run(os.Args[2:])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
 
 	err := Main(os.Args, signals)
 	if err != nil {
@@ -28,16 +44,34 @@ func main() {
 }
 
 func Main(args []string, signals <-chan os.Signal) error {
-	slog.Info("Harald is getting started", "pid", os.Getpid())
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	pidFile := fs.String("pid-file", "", "write the pid to this file, overwrites pid_file of the config")
+	dryRun := fs.Bool("dry-run", false, "check the config and print what would listen where, without opening any listeners")
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return err
+	}
 
-	if len(args) != 2 {
+	if fs.NArg() != 1 {
 		return fmt.Errorf("please provide the config file as first and only argument")
 	}
 
-	c, err := harald.LoadConfig(args[1])
+	c, err := harald.LoadConfig(fs.Arg(0))
 	if err != nil {
 		return fmt.Errorf("loading config: %w", err)
 	}
+	h, err := c.LogHandler(logLevel)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	if *dryRun {
+		return dryRunConfig(c)
+	}
+	setLogHandler(h)
+	slog.Info("Harald is getting started", "pid", os.Getpid())
+	if *pidFile != "" {
+		c.PIDFile = *pidFile
+	}
 
 	// Until here we always only log INFO and higher, from now on we can use
 	// all levels.
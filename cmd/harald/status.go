@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/maxmoehl/harald"
+)
+
+// statusReport is printed by the status subcommand with -json.
+type statusReport struct {
+	Server harald.ServerInfo            `json:"server"`
+	Rules  map[string]harald.RuleStatus `json:"rules"`
+}
+
+// status prints a summary of the running instance, which requires its admin
+// socket.
+func status(args []string) error {
+	fs := flag.NewFlagSet("harald status", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	follow := fs.Bool("follow", false, "keep printing the events of the instance after the status")
+	var i instance
+	err := i.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if i.adminSocket == "" {
+		return fmt.Errorf("status requires the admin socket of the running instance")
+	}
+
+	var r statusReport
+	err = adminResult(i.adminSocket, "info", &r.Server)
+	if err != nil {
+		return err
+	}
+	err = adminResult(i.adminSocket, "status", &r.Rules)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		err = e.Encode(r)
+	} else {
+		err = r.print(os.Stdout)
+	}
+	if err != nil || !*follow {
+		return err
+	}
+
+	fmt.Fprintln(os.Stdout)
+	enc := json.NewEncoder(os.Stdout)
+	return harald.AdminEvents(i.adminSocket, func(e harald.Event) error {
+		if *asJSON {
+			return enc.Encode(e)
+		}
+		return printEvent(os.Stdout, e)
+	})
+}
+
+// printEvent writes a single line describing the event.
+func printEvent(out io.Writer, e harald.Event) error {
+	var details []string
+	add := func(key, value string) {
+		if value != "" {
+			details = append(details, key+"="+value)
+		}
+	}
+	add("rule", e.Rule)
+	add("conn", e.ConnID)
+	add("source", e.Source)
+	add("upstream", e.Upstream)
+	if e.Type == harald.EventConnectionClose {
+		add("in", fmt.Sprint(e.BytesIn))
+		add("out", fmt.Sprint(e.BytesOut))
+		add("duration", e.Duration.String())
+	}
+	if e.Type == harald.EventUpstreams {
+		add("upstreams", fmt.Sprint(e.Upstreams))
+	}
+	add("trigger", e.Trigger)
+	if e.Old != "" || e.New != "" {
+		add("change", fmt.Sprintf("%q -> %q", e.Old, e.New))
+	}
+	add("error", e.Error)
+
+	_, err := fmt.Fprintf(out, "%s %s %s\n", e.Time.Format(time.TimeOnly), e.Type, strings.Join(details, " "))
+	return err
+}
+
+// adminResult sends the command to the admin socket and decodes the result
+// into v.
+func adminResult(path, command string, v any) error {
+	res, err := harald.AdminCommand(path, command)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(res, v)
+	if err != nil {
+		return fmt.Errorf("admin: %s: %w", command, err)
+	}
+	return nil
+}
+
+func (r statusReport) print(out io.Writer) error {
+	state := "stopped"
+	if r.Server.Listening {
+		state = "listening"
+	}
+	hash := r.Server.ConfigHash
+	if hash == "" {
+		hash = "-"
+	}
+	fmt.Fprintf(out, "pid %d, up %s, %s, config %s, %d goroutines\n\n", r.Server.PID, r.Server.Uptime.Round(time.Second), state, hash,
+		r.Server.Runtime.Goroutines)
+
+	names := make([]string, 0, len(r.Rules))
+	for name := range r.Rules {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tSTATE\tADDRESS\tACTIVE\tTOTAL\tUPTIME")
+	for _, name := range names {
+		rs := r.Rules[name]
+		state, address := string(rs.State), "-"
+		if rs.Address != "" {
+			address = rs.Address
+		}
+		if rs.State == harald.StateStopped && rs.StartError != "" {
+			state = "failed"
+		}
+		if rs.Maintenance {
+			state = "maintenance"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", name, state, address,
+			rs.Stats.ActiveConnections, rs.Stats.TotalConnections, rs.Stats.Uptime.Round(time.Second))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/maxmoehl/harald"
+)
+
+// testDial connects to the upstreams of a rule the way the forwarder would and
+// reports the outcome, which tells apart problems of harald from problems of
+// the upstreams. The rule is expanded like on startup, the upstreams of each
+// port of a port range are dialed unless a single port (<rule>/<port>) is
+// given.
+func testDial(args []string) error {
+	fs := flag.NewFlagSet("harald test-dial", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the results as JSON")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: harald test-dial [-json] config rule")
+	}
+
+	c, err := harald.LoadConfig(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	rules, err := c.ExpandRules(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	// the result is reported, the logs of the discovery would only get in
+	// the way.
+	logLevel.Set(slog.LevelError + 1)
+
+	var results []harald.DialResult
+	for _, name := range slices.Sorted(maps.Keys(rules)) {
+		f, err := rules[name].NewForwarder(name, c.DialTimeout.Duration())
+		if err != nil {
+			return err
+		}
+		res, err := f.TestDial()
+		if err != nil {
+			return err
+		}
+		results = append(results, res...)
+	}
+
+	if *asJSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		err = e.Encode(results)
+	} else {
+		err = printDialResults(os.Stdout, results)
+	}
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, res := range results {
+		if res.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d upstreams failed", failed, len(results))
+	}
+	return nil
+}
+
+func printDialResults(out io.Writer, results []harald.DialResult) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tUPSTREAM\tREMOTE\tLATENCY\tTLS\tRESULT")
+	for _, res := range results {
+		remote, tlsInfo, result := "-", "-", "ok"
+		if res.RemoteAddr != "" {
+			remote = res.RemoteAddr
+		}
+		if res.TLS != nil {
+			tlsInfo = res.TLS.Version + " " + res.TLS.CipherSuite
+			if res.TLS.ALPN != "" {
+				tlsInfo += " " + res.TLS.ALPN
+			}
+		}
+		if res.Error != "" {
+			result = res.Error
+		}
+		fmt.Fprintf(w, "%s\t%s/%s\t%s\t%s\t%s\t%s\n", res.Rule, res.Upstream.Network, res.Upstream.Address, remote,
+			res.Latency.Round(time.Microsecond), tlsInfo, result)
+	}
+	return w.Flush()
+}
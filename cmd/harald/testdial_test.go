@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestTestDialExpandsRules(t *testing.T) {
+	echo, _ := haraldtest.EchoServer(t)
+	host, port, _ := net.SplitHostPort(echo)
+	t.Setenv("UPHOST", host)
+
+	config := `version: 2
+rules:
+  templated:
+    listen: { network: tcp, address: 127.0.0.1:0 }
+    connect: { network: tcp, address: '{{ env "UPHOST" }}:` + port + `' }
+  range:
+    listen: { network: tcp, address: 127.0.0.1:19000-19001 }
+    connect: { network: tcp, address: '{{ env "UPHOST" }}:` + port + `' }
+`
+	path := filepath.Join(t.TempDir(), "harald.yml")
+	err := os.WriteFile(path, []byte(config), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, rule := range []string{"templated", "range", "range/19001"} {
+		err = testDial([]string{"-json", path, rule})
+		if err != nil {
+			t.Errorf("%s: %s", rule, err.Error())
+		}
+	}
+
+	err = testDial([]string{path, "range/19002"})
+	if err == nil || !strings.Contains(err.Error(), "unknown rule") {
+		t.Errorf("expected unknown rule; got %v", err)
+	}
+}
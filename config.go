@@ -1,13 +1,18 @@
 package harald
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"net/netip"
 	"os"
 	"strings"
 	"time"
@@ -50,24 +55,241 @@ func (d *Duration) Duration() time.Duration {
 }
 
 type Config struct {
-	Version         int                    `json:"version" yaml:"version" toml:"version"`
-	LogLevel        slog.Level             `json:"log_level" yaml:"log_level" toml:"log_level"`
-	DialTimeout     Duration               `json:"dial_timeout" yaml:"dial_timeout" toml:"dial_timeout"`
-	EnableListeners bool                   `json:"enable_listeners" yaml:"enable_listeners" toml:"enable_listeners"`
-	Rules           map[string]ForwardRule `json:"rules" yaml:"rules" toml:"rules"`
+	Version         int        `json:"version" yaml:"version" toml:"version"`
+	LogLevel        slog.Level `json:"log_level" yaml:"log_level" toml:"log_level"`
+	DialTimeout     Duration   `json:"dial_timeout" yaml:"dial_timeout" toml:"dial_timeout"`
+	EnableListeners bool       `json:"enable_listeners" yaml:"enable_listeners" toml:"enable_listeners"`
+	AdminSocket     string     `json:"admin_socket" yaml:"admin_socket" toml:"admin_socket"`
+	StatsD          *StatsD    `json:"statsd" yaml:"statsd" toml:"statsd"`
+	HTTPListen      *NetConf   `json:"http_listen" yaml:"http_listen" toml:"http_listen"`
+	Ban             *Ban       `json:"ban" yaml:"ban" toml:"ban"`
+	Etcd            *Etcd      `json:"etcd" yaml:"etcd" toml:"etcd"`
+	// LogFormat is the format of the logs, either "json" (default), "text"
+	// or "pretty" which is meant for reading them in a terminal.
+	LogFormat string `json:"log_format" yaml:"log_format" toml:"log_format"`
+	// Logs are the outputs the logs are written to, each with its own level
+	// and format. Without them the logs are written to the standard output
+	// at LogLevel in LogFormat. They are only applied on restart.
+	Logs []LogSink `json:"logs" yaml:"logs" toml:"logs"`
+	// LogSampling limits the debug messages of connections to one in
+	// LogSampling connections, messages of level info and above are always
+	// logged. Rules can overwrite it, zero or one logs every connection.
+	LogSampling int `json:"log_sampling" yaml:"log_sampling" toml:"log_sampling"`
+	// RedactSources replaces the addresses of clients in all log messages,
+	// either RedactHash or RedactTruncate. Disabled if empty.
+	RedactSources string `json:"redact_sources" yaml:"redact_sources" toml:"redact_sources"`
+	// AuditLog is the path of an append-only file recording each change to
+	// the state of the server, e.g. listeners being opened or closed, config
+	// reloads and admin commands, together with what triggered it.
+	AuditLog string `json:"audit_log" yaml:"audit_log" toml:"audit_log"`
+	// AccessLog writes a record for each forwarded connection to a separate
+	// file.
+	AccessLog *AccessLog `json:"access_log" yaml:"access_log" toml:"access_log"`
+	// ConnIDFormat is the format of the IDs of the connections, either
+	// ConnIDUUIDv4 (default), ConnIDUUIDv7 or ConnIDBase58.
+	ConnIDFormat string `json:"conn_id_format" yaml:"conn_id_format" toml:"conn_id_format"`
+	// CaptureDir is the directory the files of captures started through the
+	// admin socket are written to, captures are disabled if it is empty.
+	CaptureDir string `json:"capture_dir" yaml:"capture_dir" toml:"capture_dir"`
+	// AdminGRPC serves the commands of the admin socket as a gRPC service
+	// over mutually authenticated TLS.
+	AdminGRPC *AdminGRPC `json:"admin_grpc" yaml:"admin_grpc" toml:"admin_grpc"`
+	// MemoryBudget limits the memory in bytes used by the copy buffers of
+	// all rules, connections which would exceed it are rejected. Only
+	// buffers configured on a rule are accounted for.
+	MemoryBudget int `json:"memory_budget" yaml:"memory_budget" toml:"memory_budget"`
+	// BindRetryWindow is the default duration for which opening a listener
+	// is retried while its address is in use or not available, e.g. because
+	// the previous instance is still shutting down.
+	BindRetryWindow Duration `json:"bind_retry_window" yaml:"bind_retry_window" toml:"bind_retry_window"`
+	// PIDFile is the path of a file the PID of the process is written to,
+	// harald refuses to start if another running instance owns it.
+	PIDFile string `json:"pid_file" yaml:"pid_file" toml:"pid_file"`
+	// StateFile is the path of a file the cumulative counters of the rules
+	// are written to every StateInterval (default 1m) and on shutdown. They
+	// are restored from it on startup, so they continue across restarts.
+	StateFile     string   `json:"state_file" yaml:"state_file" toml:"state_file"`
+	StateInterval Duration `json:"state_interval" yaml:"state_interval" toml:"state_interval"`
+	// ConnectionAgeWarning logs a warning for each connection which is still
+	// handled after this duration, e.g. to find leaked handlers. Disabled if
+	// zero.
+	ConnectionAgeWarning Duration `json:"connection_age_warning" yaml:"connection_age_warning" toml:"connection_age_warning"`
+	// User and Group to switch to once the listeners have been opened on
+	// startup, either names or numeric ids. Group defaults to the primary
+	// group of the user. Listeners opened later on (e.g. on SIGUSR1) are
+	// opened with the reduced privileges.
+	User  string `json:"user" yaml:"user" toml:"user"`
+	Group string `json:"group" yaml:"group" toml:"group"`
+	// Sandbox restricts the process after the listeners have been opened on
+	// startup.
+	Sandbox *Sandbox `json:"sandbox" yaml:"sandbox" toml:"sandbox"`
+	// StartPolicy decides whether harald keeps running if some listeners
+	// can't be opened, either StartPolicyAny (default) or StartPolicyAll.
+	StartPolicy string `json:"start_policy" yaml:"start_policy" toml:"start_policy"`
+	// WatchConfig reloads the rules automatically whenever the config file
+	// changes, in addition to reloading on SIGHUP.
+	WatchConfig bool `json:"watch_config" yaml:"watch_config" toml:"watch_config"`
+	// Tenants configure the quotas and admin access of the tenants named by
+	// the rules, they are only applied on restart.
+	Tenants map[string]Tenant      `json:"tenants" yaml:"tenants" toml:"tenants"`
+	Rules   map[string]ForwardRule `json:"rules" yaml:"rules" toml:"rules"`
+
+	// path of the file the config has been loaded from, empty if it has been
+	// created otherwise.
+	path string
+	// hash is the hex encoded SHA-256 of the file the config has been loaded
+	// from.
+	hash string
 }
 
+// Policies for opening the listeners of all rules.
+const (
+	// StartPolicyAny continues as long as at least one listener is open.
+	StartPolicyAny = "any"
+	// StartPolicyAll fails if any listener can't be opened.
+	StartPolicyAll = "all"
+)
+
 type ForwardRule struct {
 	DialTimeout Duration `json:"dial_timeout" yaml:"dial_timeout" toml:"dial_timeout"`
-	Listen      NetConf  `json:"listen" yaml:"listen" toml:"listen"`
-	Connect     NetConf  `json:"connect" yaml:"connect" toml:"connect"`
-	TLS         *TLS     `json:"tls" yaml:"tls" toml:"tls"`
+	// DialRetryWindow is the duration for which failed attempts to connect
+	// upstream are retried while the client is kept waiting. By default the
+	// client connection is closed after the first failed attempt.
+	DialRetryWindow Duration `json:"dial_retry_window" yaml:"dial_retry_window" toml:"dial_retry_window"`
+	// BindRetryWindow is the duration for which opening the listener is
+	// retried while the address is in use or not available, overwrites the
+	// global bind_retry_window.
+	BindRetryWindow Duration `json:"bind_retry_window" yaml:"bind_retry_window" toml:"bind_retry_window"`
+	// Required rules must open their listener when all listeners are started,
+	// regardless of the start policy.
+	Required bool    `json:"required" yaml:"required" toml:"required"`
+	Listen   NetConf `json:"listen" yaml:"listen" toml:"listen"`
+	Connect  NetConf `json:"connect" yaml:"connect" toml:"connect"`
+	// ListenOptions and ConnectOptions configure the sockets facing the
+	// clients and the upstreams respectively.
+	ListenOptions  SocketOptions `json:"listen_options" yaml:"listen_options" toml:"listen_options"`
+	ConnectOptions SocketOptions `json:"connect_options" yaml:"connect_options" toml:"connect_options"`
+	// Upstreams is an alternative to Connect to balance the connections
+	// across multiple targets.
+	Upstreams []NetConf `json:"upstreams" yaml:"upstreams" toml:"upstreams"`
+	// Fallback is a builtin upstream (echo, discard or static) the clients
+	// are forwarded to if none of the upstreams can be connected to.
+	Fallback *NetConf `json:"fallback" yaml:"fallback" toml:"fallback"`
+	// StaticResponse is written to the clients by the builtin static
+	// upstream before the connection is closed, e.g. an HTTP 503 response.
+	StaticResponse string `json:"static_response" yaml:"static_response" toml:"static_response"`
+	// Exec configures the process spawned for each connection if the rule
+	// connects on the exec network.
+	Exec *Exec `json:"exec" yaml:"exec" toml:"exec"`
+	// Balance is the policy used to pick one of the Upstreams, see the
+	// Balance* constants. Defaults to BalanceRoundRobin.
+	Balance string `json:"balance" yaml:"balance" toml:"balance"`
+	// SlowStart is the duration over which the share of new connections of
+	// an upstream grows to its full weight once it became available again,
+	// e.g. after passing the health checks of a discovery source.
+	SlowStart Duration `json:"slow_start" yaml:"slow_start" toml:"slow_start"`
+	// CircuitBreaker stops sending connections to upstreams which failed
+	// repeatedly for a while.
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker" yaml:"circuit_breaker" toml:"circuit_breaker"`
+	// OutlierDetection temporarily ejects upstreams with a high error rate
+	// of the connections forwarded to them.
+	OutlierDetection *OutlierDetection `json:"outlier_detection" yaml:"outlier_detection" toml:"outlier_detection"`
+	// Discovery configures a dynamic source of upstreams as an alternative
+	// to Connect and Upstreams.
+	Discovery *Discovery `json:"discovery" yaml:"discovery" toml:"discovery"`
+	// DiscoveryInterval controls how often upstreams are resolved if they
+	// are discovered dynamically, e.g. if the connect address is the name of
+	// DNS SRV records. Sources which are notified about changes use it as
+	// the delay before retrying after an error.
+	DiscoveryInterval Duration `json:"discovery_interval" yaml:"discovery_interval" toml:"discovery_interval"`
+	// Resolver overwrites the DNS servers used to resolve the hostnames of
+	// the upstreams.
+	Resolver *Resolver `json:"resolver" yaml:"resolver" toml:"resolver"`
+	TLS      *TLS      `json:"tls" yaml:"tls" toml:"tls"`
+	// UpstreamTLS establishes TLS to the upstreams instead of forwarding the
+	// data in plaintext.
+	UpstreamTLS *UpstreamTLS `json:"upstream_tls" yaml:"upstream_tls" toml:"upstream_tls"`
+	// MaxConnectionsPerSource limits the number of concurrent connections a
+	// single source IP can hold through this rule, zero means unlimited.
+	MaxConnectionsPerSource int `json:"max_connections_per_source" yaml:"max_connections_per_source" toml:"max_connections_per_source"`
+	// Workers limits the number of connections handled concurrently, by
+	// default there is no limit.
+	Workers *Workers `json:"workers" yaml:"workers" toml:"workers"`
+	// Acceptors is the number of goroutines accepting connections on the
+	// listener concurrently, defaults to one. More of them reduce the
+	// latency of accepting bursts of connections.
+	Acceptors int `json:"acceptors" yaml:"acceptors" toml:"acceptors"`
+	// MaxAccepts closes the listener once it accepted this many connections,
+	// e.g. for a tunnel used for a single transfer. harald exits once all
+	// rules have been closed this way and their connections are done.
+	// Unlimited if zero.
+	MaxAccepts int `json:"max_accepts" yaml:"max_accepts" toml:"max_accepts"`
+	// Buffers sets the size of the buffers used to copy the data of a
+	// connection in each direction.
+	Buffers *Buffers `json:"buffers" yaml:"buffers" toml:"buffers"`
+	// LogSampling overwrites the global LogSampling for this rule.
+	LogSampling int `json:"log_sampling" yaml:"log_sampling" toml:"log_sampling"`
+	// StartTLS negotiates TLS in-band before the handshake for clients of
+	// the protocol, either StartTLSPostgres or StartTLSSMTP. Requires TLS.
+	StartTLS string `json:"starttls" yaml:"starttls" toml:"starttls"`
+	// Routing picks the upstream of plaintext connections based on the first
+	// bytes sent by the client.
+	Routing *Routing `json:"routing" yaml:"routing" toml:"routing"`
+	// HTTPConnect turns the rule into an HTTP CONNECT proxy as an alternative
+	// to Connect, Upstreams and Discovery.
+	HTTPConnect *HTTPConnect `json:"http_connect" yaml:"http_connect" toml:"http_connect"`
+	// Protocol spoken by the clients, either ProtocolTCP (default) or
+	// ProtocolHTTP to add the X-Forwarded-* and client certificate headers
+	// to each request.
+	Protocol string `json:"protocol" yaml:"protocol" toml:"protocol"`
+	// ConnIDHeader is the name of a header carrying the ID of the connection
+	// which is added to each request of rules using ProtocolHTTP.
+	ConnIDHeader string `json:"conn_id_header" yaml:"conn_id_header" toml:"conn_id_header"`
+	// ProxyProtocol sends a PROXY protocol header to the upstream.
+	ProxyProtocol *ProxyProtocol `json:"proxy_protocol" yaml:"proxy_protocol" toml:"proxy_protocol"`
+	// AcceptProxyProtocol reads a PROXY protocol header from each client
+	// before anything else.
+	AcceptProxyProtocol *AcceptProxyProtocol `json:"accept_proxy_protocol" yaml:"accept_proxy_protocol" toml:"accept_proxy_protocol"`
+	// IdleTimeout closes connections which didn't transfer any data in
+	// either direction for this long, zero disables it.
+	IdleTimeout Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`
+	// Timeouts detect stalled clients and upstreams while data is copied.
+	Timeouts *Timeouts `json:"timeouts" yaml:"timeouts" toml:"timeouts"`
+	// Pool of pre-established upstream connections.
+	Pool *Pool `json:"pool" yaml:"pool" toml:"pool"`
+	// PortOffset derives the port of the upstreams from the port a client
+	// connected to if the rule listens on a port range (e.g. :30000-30100).
+	// The port of each upstream address is replaced by the listen port plus
+	// the offset. Without an offset all ports forward to the same upstreams.
+	PortOffset *int `json:"port_offset" yaml:"port_offset" toml:"port_offset"`
+	// QUIC configures rules which listen on the quic network, each stream is
+	// forwarded like a TCP connection.
+	QUIC *QUIC `json:"quic" yaml:"quic" toml:"quic"`
+	// Tunnel configures rules which listen or connect on the tunnel network,
+	// either as the agent next to the upstream or as the rendezvous.
+	Tunnel *Tunnel `json:"tunnel" yaml:"tunnel" toml:"tunnel"`
+	// Maintenance configures how clients are rejected while the rule is in
+	// maintenance mode.
+	Maintenance *Maintenance `json:"maintenance" yaml:"maintenance" toml:"maintenance"`
+	// Drain configures the deadline for the connections of the rule when it
+	// is drained through the admin socket.
+	Drain *Drain `json:"drain" yaml:"drain" toml:"drain"`
+	// Startup delays opening the listener until the rules it depends on are
+	// listening or its upstreams accept connections.
+	Startup *Startup `json:"startup" yaml:"startup" toml:"startup"`
+	// Labels are attached to the log messages, statistics and access records
+	// of the rule, e.g. to attribute traffic to the team owning the rule.
+	Labels map[string]string `json:"labels" yaml:"labels" toml:"labels"`
+	// Tenant namespaces the logs, metrics and admin visibility of the rule
+	// and shares the quotas of the tenant with its other rules, see Tenant.
+	Tenant string `json:"tenant" yaml:"tenant" toml:"tenant"`
 }
 
 // NewForwarder initialize a new forwarder based on the rule it's called on and
 // the additional parameters passed in.
-func (r ForwardRule) NewForwarder(name string, defaultDialTimeout time.Duration) (*Forwarder, error) {
-	var err error
+func (r ForwardRule) NewForwarder(name string, defaultDialTimeout time.Duration) (_ *Forwarder, err error) {
+	defer func() { err = withKind(ErrConfig, err) }()
+
 	f := Forwarder{
 		ForwardRule: r,
 		name:        name,
@@ -80,10 +302,247 @@ func (r ForwardRule) NewForwarder(name string, defaultDialTimeout time.Duration)
 	}
 
 	if r.DialTimeout != 0 {
-		f.DialTimeout = r.DialTimeout
+		f.timeout = r.DialTimeout.Duration()
+	}
+	f.bindRetry = r.BindRetryWindow.Duration()
+
+	f.upstreamTLS, err = r.UpstreamTLS.Config()
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+
+	if r.Listen.Network == networkQUIC {
+		if r.TLS == nil {
+			return nil, fmt.Errorf("new forwarder: %s: listening on quic requires tls", name)
+		}
+		if len(r.TLS.AllowFingerprints) > 0 || len(r.TLS.DenyFingerprints) > 0 {
+			return nil, fmt.Errorf("new forwarder: %s: fingerprints are not supported with quic", name)
+		}
+		f.quicConf, f.tlsConf = f.tlsConf, nil
+	}
+
+	for _, c := range append([]NetConf{r.Listen, r.Connect}, r.Upstreams...) {
+		err = c.validate()
+		if err != nil {
+			return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+		}
+	}
+	for _, o := range []SocketOptions{r.ListenOptions, r.ConnectOptions} {
+		err = o.validate()
+		if err != nil {
+			return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+		}
+	}
+
+	err = r.Tunnel.validate(r)
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+
+	err = r.Drain.validate()
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+	err = r.Startup.validate(r)
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+
+	err = validateBuiltin(r)
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+	err = validateStdio(r)
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+	err = r.Exec.validate(r)
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+
+	if r.AcceptProxyProtocol != nil && r.Listen.Network == networkQUIC {
+		return nil, fmt.Errorf("new forwarder: %s: accept_proxy_protocol is not supported with quic", name)
+	}
+	f.newID, _ = connIDGenerator(ConnIDUUIDv4)
+
+	f.perSource = newSourceLimiter(r.MaxConnectionsPerSource)
+	f.reaper = newIdleReaper(r.IdleTimeout.Duration(), &f.stats.idleReaped)
+
+	err = r.Buffers.validate()
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+
+	err = r.ProxyProtocol.validate()
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+
+	err = validateProtocol(r.Protocol)
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+	if r.ConnIDHeader != "" && r.Protocol != ProtocolHTTP {
+		return nil, fmt.Errorf("new forwarder: %s: conn_id_header requires protocol http", name)
 	}
 
-	f.log = slog.With(attrForwarder(&f))
+	err = validateStartTLS(r.StartTLS, r.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+	if r.StartTLS == StartTLSSMTP && (r.HTTPConnect != nil || r.ProxyProtocol != nil) {
+		// the dialogue requires a plain connection to a known upstream
+		return nil, fmt.Errorf("new forwarder: %s: starttls smtp can't be combined with http_connect or proxy_protocol", name)
+	}
+
+	if r.Routing != nil && (r.TLS != nil || r.HTTPConnect != nil) {
+		return nil, fmt.Errorf("new forwarder: %s: routing can't be combined with tls or http_connect", name)
+	}
+	f.router, err = newRouter(r.Routing)
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+
+	f.workers, err = newWorkerLimit(r.Workers)
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+	if r.Acceptors < 0 {
+		return nil, fmt.Errorf("new forwarder: %s: acceptors must not be negative", name)
+	}
+	if r.MaxAccepts < 0 {
+		return nil, fmt.Errorf("new forwarder: %s: max_accepts must not be negative", name)
+	}
+
+	if r.Maintenance != nil {
+		if r.Maintenance.TLSAlert != 0 && r.Maintenance.Response != "" {
+			return nil, fmt.Errorf("new forwarder: %s: maintenance: tls_alert and response are mutually exclusive", name)
+		}
+		f.maintenance.Store(r.Maintenance.Enabled)
+	}
+
+	err = validateLabels(r.Labels)
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+
+	err = validateTenant(r.Tenant)
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+
+	f.log = slog.With(attrForwarder(&f), attrLabels(r.Labels))
+	if r.Tenant != "" {
+		f.log = f.log.With(attrTenant(r.Tenant))
+	}
+
+	if r.TLS != nil && r.TLS.Source != nil {
+		source, err := r.TLS.Source.newSource(f.log)
+		if err != nil {
+			return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+		}
+		conf := f.tlsConf
+		if conf == nil {
+			conf = f.quicConf
+		}
+		policies, err := r.TLS.clientAuthPolicies()
+		if err != nil {
+			return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+		}
+		f.certs = newCertStore(source, conf, policies, f.log)
+	}
+	f.sampler = newDebugSampler(r.LogSampling)
+
+	f.balancer, err = newBalancer(r.Balance)
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+	if r.SlowStart < 0 {
+		return nil, fmt.Errorf("new forwarder: %s: slow_start must not be negative", name)
+	}
+	f.balancer.slowStart = r.SlowStart.Duration()
+	err = r.CircuitBreaker.validate()
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+	f.balancer.breaker = r.CircuitBreaker
+	err = r.OutlierDetection.validate()
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+	f.balancer.outliers = r.OutlierDetection
+
+	f.resolver, err = r.Resolver.newResolver()
+	if err != nil {
+		return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+	}
+
+	interval := r.DiscoveryInterval.Duration()
+	if interval <= 0 {
+		interval = defaultDiscoveryInterval
+	}
+
+	switch {
+	case r.HTTPConnect != nil:
+		if r.Connect.Address != "" || len(r.Upstreams) > 0 || r.Discovery != nil {
+			return nil, fmt.Errorf("new forwarder: %s: http_connect can't be combined with a connect address, upstreams or discovery", name)
+		}
+		if r.Pool != nil || r.Protocol == ProtocolHTTP || r.UpstreamTLS != nil {
+			return nil, fmt.Errorf("new forwarder: %s: http_connect can't be combined with a pool, the http protocol or upstream_tls", name)
+		}
+		err = r.HTTPConnect.validate()
+		if err != nil {
+			return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+		}
+	case r.Discovery != nil:
+		if r.Connect.Address != "" || len(r.Upstreams) > 0 {
+			return nil, fmt.Errorf("new forwarder: %s: discovery can't be combined with a connect address or upstreams", name)
+		}
+		f.source, err = r.Discovery.newSource(r.Connect.Network, interval, f.log)
+		if err != nil {
+			return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+		}
+	case len(r.Upstreams) > 0:
+		if r.Connect != (NetConf{}) {
+			return nil, fmt.Errorf("new forwarder: %s: connect and upstreams are mutually exclusive", name)
+		}
+		targets := make([]target, len(r.Upstreams))
+		for i, u := range r.Upstreams {
+			targets[i] = target{NetConf: u}
+		}
+		f.balancer.update(targets)
+	case isSRVName(r.Connect.Address):
+		f.source = &srvSource{
+			network:  r.Connect.Network,
+			name:     r.Connect.Address,
+			interval: interval,
+			resolver: f.resolver,
+			log:      f.log,
+		}
+	default:
+		f.balancer.update([]target{{NetConf: r.Connect}})
+	}
+
+	f.exec = newExecUpstream(r.Exec, f.log)
+
+	if r.Connect.Network == networkTunnel {
+		f.tunnel, err = newTunnelServer(r.Connect.Address, r.Tunnel, f.log)
+		if err != nil {
+			return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+		}
+	}
+
+	if r.Pool != nil {
+		if f.balancer.policy == BalanceSourceHash {
+			// pooled connections are established before the source is known
+			return nil, fmt.Errorf("new forwarder: %s: pool can't be used with balancing policy %s", name, BalanceSourceHash)
+		}
+		f.pool, err = newUpstreamPool(*r.Pool, func() (*upstreamConn, error) { return f.dial(netip.Addr{}) }, f.pooledConnBroken, f.log)
+		if err != nil {
+			return nil, fmt.Errorf("new forwarder: %s: %w", name, err)
+		}
+	}
 
 	return &f, nil
 }
@@ -93,6 +552,52 @@ type NetConf struct {
 	Address string `json:"address" yaml:"address"`
 }
 
+// usesNetwork reports whether the rule listens or connects on the network,
+// including its upstreams, fallback and routes.
+func (r ForwardRule) usesNetwork(network string) bool {
+	if r.Listen.Network == network || r.Connect.Network == network {
+		return true
+	}
+	if r.Fallback != nil && r.Fallback.Network == network {
+		return true
+	}
+	for _, u := range r.Upstreams {
+		if u.Network == network {
+			return true
+		}
+	}
+	if r.Routing != nil {
+		for _, route := range r.Routing.Routes {
+			if route.Connect.Network == network {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validate ensures that an IP address matches the family of the network, e.g.
+// that tcp4 isn't used with an IPv6 address. Hostnames are not checked.
+func (c NetConf) validate() error {
+	host, _, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		// not all networks use host:port addresses, e.g. unix sockets
+		return nil
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+
+	switch {
+	case strings.HasSuffix(c.Network, "4") && !ip.Unmap().Is4():
+		return fmt.Errorf("network %s can't be used with the IPv6 address %s", c.Network, host)
+	case strings.HasSuffix(c.Network, "6") && ip.Is4():
+		return fmt.Errorf("network %s can't be used with the IPv4 address %s", c.Network, host)
+	}
+	return nil
+}
+
 // TLS configuration for the server side.
 type TLS struct {
 	Certificate string `json:"certificate" yaml:"certificate" toml:"certificate"`
@@ -105,6 +610,40 @@ type TLS struct {
 	// See the go documentation for details:
 	// https://pkg.go.dev/crypto/tls#ClientAuthType
 	ClientAuth tls.ClientAuthType `json:"client_auth" yaml:"client_auth" toml:"client_auth"`
+	// AllowFingerprints and DenyFingerprints contain JA3 hashes or JA4
+	// fingerprints of clients. If the allow list is not empty, only matching
+	// clients are accepted.
+	AllowFingerprints []string `json:"allow_fingerprints" yaml:"allow_fingerprints" toml:"allow_fingerprints"`
+	DenyFingerprints  []string `json:"deny_fingerprints" yaml:"deny_fingerprints" toml:"deny_fingerprints"`
+	// RequireSNI rejects clients which don't request a server name via SNI,
+	// e.g. scanners connecting by IP address. If AllowServerNames is not
+	// empty, the requested name must match one of them (with the syntax of
+	// ClientAuthPolicy.ServerNames), which implies RequireSNI. Clients are
+	// rejected before the upstream is dialed.
+	RequireSNI       bool     `json:"require_sni" yaml:"require_sni" toml:"require_sni"`
+	AllowServerNames []string `json:"allow_server_names" yaml:"allow_server_names" toml:"allow_server_names"`
+	// PKCS12File is a PKCS#12 bundle (.p12 or .pfx) with the certificate, its
+	// chain and key as an alternative to Certificate and Key. It is decrypted
+	// with PKCS12Password.
+	PKCS12File     string `json:"pkcs12_file" yaml:"pkcs12_file" toml:"pkcs12_file"`
+	PKCS12Password string `json:"pkcs12_password" yaml:"pkcs12_password" toml:"pkcs12_password"`
+	// SelfSigned generates a self-signed certificate in memory instead of
+	// loading one, e.g. for testing. It is valid for SelfSignedSANs (DNS
+	// names and IP addresses, defaults to localhost) for SelfSignedLifetime
+	// (defaults to one year). A new one is generated whenever the config of
+	// the rule changes.
+	SelfSigned         bool     `json:"self_signed" yaml:"self_signed" toml:"self_signed"`
+	SelfSignedSANs     []string `json:"self_signed_sans" yaml:"self_signed_sans" toml:"self_signed_sans"`
+	SelfSignedLifetime Duration `json:"self_signed_lifetime" yaml:"self_signed_lifetime" toml:"self_signed_lifetime"`
+	// ClientAuthPolicies override ClientAuth and ClientCAs for the server
+	// names requested by the clients, the first matching policy applies.
+	ClientAuthPolicies []ClientAuthPolicy `json:"client_auth_policies" yaml:"client_auth_policies" toml:"client_auth_policies"`
+	// ECHKeys enable Encrypted Client Hello, which hides the requested
+	// server name from observers. See ECHKey for the rotation of keys.
+	ECHKeys []ECHKey `json:"ech_keys" yaml:"ech_keys" toml:"ech_keys"`
+	// Source obtains the certificate dynamically instead of Certificate and
+	// Key, only supported by rules.
+	Source *CertificateSource `json:"source" yaml:"source" toml:"source"`
 }
 
 func (t *TLS) Config() (conf *tls.Config, err error) {
@@ -114,11 +653,11 @@ func (t *TLS) Config() (conf *tls.Config, err error) {
 
 	defer func() {
 		if err != nil {
-			err = fmt.Errorf("tls config: %w", err)
+			err = withKind(ErrTLS, fmt.Errorf("tls config: %w", err))
 		}
 	}()
 
-	if t.ClientCAs == "" && t.ClientAuth > 0 {
+	if t.ClientCAs == "" && t.ClientAuth > 0 && t.Source == nil {
 		return nil, fmt.Errorf("configuered client authentication but no client CAs provided")
 	}
 
@@ -130,12 +669,41 @@ func (t *TLS) Config() (conf *tls.Config, err error) {
 
 	conf.KeyLogWriter = keyLogWriter
 
-	// parse certificate and key
-	cert, err := tls.X509KeyPair([]byte(t.Certificate), []byte(t.Key))
-	if err != nil {
-		return nil, fmt.Errorf("parse certificate and private key: %w", err)
+	// parse certificate and key, a source provides them once the listener
+	// is started
+	var configured int
+	for _, set := range []bool{t.Certificate != "" || t.Key != "", t.PKCS12File != "", t.SelfSigned, t.Source != nil} {
+		if set {
+			configured++
+		}
+	}
+	if configured > 1 {
+		return nil, fmt.Errorf("only one of certificate and key, pkcs12_file, self_signed and source can be configured")
+	}
+	switch {
+	case t.Source != nil:
+	case t.SelfSigned:
+		if t.SelfSignedLifetime < 0 {
+			return nil, fmt.Errorf("self_signed_lifetime must not be negative")
+		}
+		cert, err := selfSignedCertificate(t.SelfSignedSANs, t.SelfSignedLifetime.Duration())
+		if err != nil {
+			return nil, fmt.Errorf("generate self-signed certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	case t.PKCS12File != "":
+		cert, err := loadPKCS12(t.PKCS12File, t.PKCS12Password)
+		if err != nil {
+			return nil, fmt.Errorf("load pkcs12 bundle: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	default:
+		cert, err := tls.X509KeyPair([]byte(t.Certificate), []byte(t.Key))
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate and private key: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
 	}
-	conf.Certificates = []tls.Certificate{cert}
 
 	// parse client certificate authorities
 	var block *pem.Block
@@ -165,15 +733,38 @@ func (t *TLS) Config() (conf *tls.Config, err error) {
 		// there was something configured, but we didn't pick up any certs
 		return nil, fmt.Errorf("unable to parse provided client CAs")
 	}
+	if t.Source != nil && certs == 0 {
+		// the source provides the client CAs
+		conf.ClientCAs = nil
+	}
+
+	conf.EncryptedClientHelloKeys, err = t.echKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := t.clientAuthPolicies()
+	if err != nil {
+		return nil, err
+	}
+	if len(policies) > 0 {
+		configs := newTLSConfigs(conf.Clone(), policies)
+		conf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			return configs.forHello(hello), nil
+		}
+	}
 
 	return conf, nil
 }
 
-func LoadConfig(path string) (Config, error) {
-	r, err := os.Open(path)
+func LoadConfig(path string) (_ Config, err error) {
+	defer func() { err = withKind(ErrConfig, err) }()
+
+	b, err := os.ReadFile(path)
 	if err != nil {
 		return Config{}, fmt.Errorf("load config: %w", err)
 	}
+	plain := b
 
 	parts := strings.Split(path, ".")
 
@@ -181,8 +772,30 @@ func LoadConfig(path string) (Config, error) {
 		return Config{}, fmt.Errorf("load config: file hast no file extension")
 	}
 
+	// configs encrypted with age as a whole have the extension of their
+	// format in front of .age
+	ext := parts[len(parts)-1]
+	if ext == "age" && len(parts) > 2 {
+		identities, err := ageIdentities()
+		if err != nil {
+			return Config{}, fmt.Errorf("load config: %w", err)
+		}
+		plain, err = decryptAge(b, identities)
+		if err != nil {
+			return Config{}, fmt.Errorf("load config: decrypt: %w", err)
+		}
+		ext = parts[len(parts)-2]
+	}
+	if ext == "yaml" || ext == "yml" || ext == "json" {
+		plain, err = decryptSOPS(plain, ext == "json")
+		if err != nil {
+			return Config{}, fmt.Errorf("load config: %w", err)
+		}
+	}
+	r := bytes.NewReader(plain)
+
 	var c Config
-	switch parts[len(parts)-1] {
+	switch ext {
 	case "yaml", "yml":
 		err = yaml.NewDecoder(r).Decode(&c)
 	case "json":
@@ -190,7 +803,7 @@ func LoadConfig(path string) (Config, error) {
 	case "toml":
 		_, err = toml.NewDecoder(r).Decode(&c)
 	default:
-		err = fmt.Errorf("unknown file extension '%s'", parts[len(parts)-1])
+		err = fmt.Errorf("unknown file extension '%s'", ext)
 	}
 	if err != nil {
 		return Config{}, fmt.Errorf("load config: %w", err)
@@ -200,5 +813,9 @@ func LoadConfig(path string) (Config, error) {
 		return Config{}, fmt.Errorf("load config: unknown version '%d'", c.Version)
 	}
 
+	c.path = path
+	sum := sha256.Sum256(b)
+	c.hash = hex.EncodeToString(sum[:])
+
 	return c, nil
 }
@@ -127,3 +127,42 @@ func TestLoadConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestNetConfValidate(t *testing.T) {
+	tests := []struct {
+		c       NetConf
+		wantErr bool
+	}{
+		{NetConf{Network: "tcp", Address: "[::1]:80"}, false},
+		{NetConf{Network: "tcp4", Address: "127.0.0.1:80"}, false},
+		{NetConf{Network: "tcp4", Address: "[::1]:80"}, true},
+		{NetConf{Network: "tcp6", Address: "[::1]:80"}, false},
+		{NetConf{Network: "tcp6", Address: "127.0.0.1:80"}, true},
+		{NetConf{Network: "tcp6", Address: "localhost:80"}, false},
+		{NetConf{Network: "unix", Address: "/run/harald.sock"}, false},
+	}
+	for _, tt := range tests {
+		err := tt.c.validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s@%s: error = %v, wantErr %v", tt.c.Network, tt.c.Address, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	tests := []struct {
+		labels  map[string]string
+		wantErr bool
+	}{
+		{map[string]string{"team": "web", "service": "shop:frontend"}, false},
+		{map[string]string{"": "web"}, true},
+		{map[string]string{"team:name": "web"}, true},
+		{map[string]string{"team": "web,shop"}, true},
+	}
+	for _, tt := range tests {
+		err := validateLabels(tt.labels)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: error = %v, wantErr %v", tt.labels, err, tt.wantErr)
+		}
+	}
+}
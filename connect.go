@@ -0,0 +1,144 @@
+package harald
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"strings"
+	"time"
+)
+
+// HTTPConnect turns a rule into an HTTP CONNECT proxy, each client picks its
+// upstream with a CONNECT request. The rule must not configure any upstreams
+// itself.
+type HTTPConnect struct {
+	// Allow restricts the destinations to the host:port patterns in the
+	// syntax of path.Match, e.g. "*.example.com:443". Hosts are matched as
+	// requested by the client, they are not resolved. All destinations are
+	// allowed if empty.
+	Allow []string `json:"allow" yaml:"allow" toml:"allow"`
+	// Users maps the names of users to their passwords. If set clients have
+	// to authenticate using basic auth.
+	Users map[string]string `json:"users" yaml:"users" toml:"users"`
+}
+
+func (c *HTTPConnect) validate() error {
+	if c == nil {
+		return nil
+	}
+	for _, p := range c.Allow {
+		_, err := path.Match(p, "")
+		if err != nil {
+			return fmt.Errorf("http connect: invalid pattern '%s': %w", p, err)
+		}
+	}
+	return nil
+}
+
+// allows reports whether the client may connect to the host:port address.
+func (c *HTTPConnect) allows(address string) bool {
+	if len(c.Allow) == 0 {
+		return true
+	}
+	address = strings.ToLower(address)
+	for _, p := range c.Allow {
+		if ok, _ := path.Match(strings.ToLower(p), address); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticates reports whether the request carries valid credentials.
+func (c *HTTPConnect) authenticates(req *http.Request) bool {
+	if len(c.Users) == 0 {
+		return true
+	}
+	// BasicAuth only looks at the Authorization header
+	auth := &http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+	user, password, ok := auth.BasicAuth()
+	if !ok {
+		return false
+	}
+	want, ok := c.Users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
+
+// acceptConnect reads the CONNECT request of the client and connects to the
+// requested upstream. The client is informed about the outcome in any case.
+// The returned connection replaces the one of the client, it still holds any
+// data the client sent after the request.
+func (f *Forwarder) acceptConnect(source net.Conn, src netip.Addr, log *slog.Logger) (net.Conn, *upstreamConn, error) {
+	_ = source.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	r := bufio.NewReader(source)
+	req, err := http.ReadRequest(r)
+	_ = source.SetReadDeadline(time.Time{})
+	if err != nil {
+		respond(source, http.StatusBadRequest, nil)
+		return nil, nil, fmt.Errorf("reading connect request: %w", err)
+	}
+
+	if req.Method != http.MethodConnect {
+		respond(source, http.StatusMethodNotAllowed, http.Header{"Allow": {http.MethodConnect}})
+		return nil, nil, fmt.Errorf("unexpected method %s", req.Method)
+	}
+	if !f.HTTPConnect.authenticates(req) {
+		respond(source, http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {`Basic realm="harald"`}})
+		if req.Header.Get("Proxy-Authorization") != "" {
+			f.bans.fail(src, log)
+		}
+		return nil, nil, fmt.Errorf("authentication failed")
+	}
+	if _, _, err = net.SplitHostPort(req.Host); err != nil {
+		respond(source, http.StatusBadRequest, nil)
+		return nil, nil, fmt.Errorf("invalid destination '%s': %w", req.Host, err)
+	}
+	if !f.HTTPConnect.allows(req.Host) {
+		respond(source, http.StatusForbidden, nil)
+		return nil, nil, fmt.Errorf("destination %s is not allowed", req.Host)
+	}
+
+	u := &upstream{NetConf: NetConf{Network: "tcp", Address: req.Host}}
+	c, err := f.ConnectOptions.dial(u.Network, u.Address, f.timeout, f.resolver)
+	if err != nil {
+		f.stats.dialErrors.Add(1)
+		respond(source, http.StatusBadGateway, nil)
+		return nil, nil, withKind(ErrDial, err)
+	}
+
+	_, err = io.WriteString(source, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if err != nil {
+		_ = c.Close()
+		return nil, nil, fmt.Errorf("writing connect response: %w", err)
+	}
+
+	buffered, _ := r.Peek(r.Buffered())
+	if len(buffered) > 0 {
+		source = &prefixConn{Conn: source, prefix: buffered}
+	}
+	return source, &upstreamConn{Conn: c, upstream: u}, nil
+}
+
+// respond writes a response without a body to the client of a CONNECT
+// proxy.
+func respond(c net.Conn, status int, header http.Header) {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Connection", "close")
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: 0,
+	}
+	_ = c.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	_ = resp.Write(c)
+}
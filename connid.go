@@ -0,0 +1,82 @@
+package harald
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"github.com/google/uuid"
+)
+
+// Formats of the connection IDs.
+const (
+	// ConnIDUUIDv4 generates random UUIDs (default).
+	ConnIDUUIDv4 = "uuidv4"
+	// ConnIDUUIDv7 generates UUIDs which are ordered by their creation time.
+	ConnIDUUIDv7 = "uuidv7"
+	// ConnIDBase58 generates short random IDs of 96 bits encoded in base58.
+	ConnIDBase58 = "base58"
+)
+
+// connIDGenerator returns the function generating IDs in the format.
+func connIDGenerator(format string) (func() string, error) {
+	switch format {
+	case "", ConnIDUUIDv4:
+		return func() string { return uuid.Must(uuid.NewRandom()).String() }, nil
+	case ConnIDUUIDv7:
+		return func() string { return uuid.Must(uuid.NewV7()).String() }, nil
+	case ConnIDBase58:
+		return newBase58ID, nil
+	default:
+		return nil, fmt.Errorf("unknown connection id format '%s'", format)
+	}
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func newBase58ID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return base58(b)
+}
+
+// base58 encodes b with the alphabet used by Bitcoin, leading zero bytes are
+// encoded as '1'.
+func base58(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix, mod := big.NewInt(58), new(big.Int)
+
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+// maxInboundConnID is the maximum length of the PP2_TYPE_UNIQUE_ID TLV.
+const maxInboundConnID = 128
+
+// validInboundConnID reports whether an ID received from the client can be
+// used in the logs as is.
+func validInboundConnID(id []byte) bool {
+	if len(id) == 0 || len(id) > maxInboundConnID {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package harald
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestConnIDGenerator(t *testing.T) {
+	for _, format := range []string{"", ConnIDUUIDv4, ConnIDUUIDv7} {
+		gen, err := connIDGenerator(format)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		id, err := uuid.Parse(gen())
+		if err != nil {
+			t.Errorf("%s: %s", format, err.Error())
+		}
+		want := uuid.Version(4)
+		if format == ConnIDUUIDv7 {
+			want = 7
+		}
+		if id.Version() != want {
+			t.Errorf("%s: want = %d; got = %d", format, want, id.Version())
+		}
+	}
+
+	gen, err := connIDGenerator(ConnIDBase58)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if a, b := gen(), gen(); a == b || len(a) > 17 {
+		t.Errorf("expected two distinct short ids; got = %s, %s", a, b)
+	}
+
+	_, err = connIDGenerator("uuidv1")
+	if err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
+
+func TestBase58(t *testing.T) {
+	tests := map[string]string{
+		"Hello World!":                     "2NEpo7TZRRrLZSi2U",
+		"\x00\x00\x00\x00\x28\x7f\xb4\xcd": "1111233QC4",
+		"":                                 "",
+	}
+	for in, want := range tests {
+		if got := base58([]byte(in)); got != want {
+			t.Errorf("%x: want = %s; got = %s", in, want, got)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package harald
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stages a connection goes through in its handler.
+const (
+	// StageAccepted covers everything before the upstream is connected, e.g.
+	// reading the PROXY protocol header or the TLS client hello.
+	StageAccepted   = "accepted"
+	StageConnecting = "connecting"
+	// StageHandshake is the TLS handshake with the client, it happens after
+	// the upstream has been connected.
+	StageHandshake  = "handshake"
+	StageForwarding = "forwarding"
+)
+
+// Connection describes a connection which is currently handled.
+type Connection struct {
+	ID   string `json:"id"`
+	Rule string `json:"rule"`
+	// Source is the address of the client, redacted like in the logs.
+	Source string `json:"source"`
+	// Upstream is empty until the connection is forwarded.
+	Upstream string    `json:"upstream"`
+	Since    time.Time `json:"since"`
+	// Stage is how far the handler got, see the Stage* constants.
+	Stage string `json:"stage"`
+	// LastActivity is the time of the last stage change. With an idle
+	// timeout it is the time data has last been received while forwarding.
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// connTable keeps track of the connections of all forwarders from the moment
+// their handler starts, so they can be listed and closed by an operator and
+// handlers which never return show up. It is shared by the forwarders of a
+// server, connections of rules which have been replaced by a reload remain
+// listed until they are closed. A nil *connTable doesn't track anything.
+type connTable struct {
+	mu    sync.Mutex
+	conns map[string]*trackedConn
+}
+
+// trackedConn is a connection in the table. The fields other than lastActive
+// are guarded by the mutex of the table.
+type trackedConn struct {
+	Connection
+	close func(reset bool)
+	// lastActive is the time of the last activity in unix nanoseconds.
+	lastActive atomic.Int64
+	// warned is set once the connection has been reported as too old.
+	warned bool
+}
+
+func (c *trackedConn) snapshot() Connection {
+	conn := c.Connection
+	conn.LastActivity = time.Unix(0, c.lastActive.Load())
+	return conn
+}
+
+func newConnTable() *connTable {
+	return &connTable{conns: make(map[string]*trackedConn)}
+}
+
+// liveConn updates a tracked connection on behalf of its handler. A nil
+// *liveConn doesn't track anything.
+type liveConn struct {
+	t *connTable
+	c *trackedConn
+}
+
+// add tracks the connection in StageAccepted until done is called. close is
+// called if the connection is killed, reset asks for the connection to be
+// reset instead of closed gracefully.
+func (t *connTable) add(c Connection, close func(reset bool)) *liveConn {
+	if t == nil {
+		return nil
+	}
+	c.Stage = StageAccepted
+	tc := &trackedConn{Connection: c, close: close}
+	tc.lastActive.Store(time.Now().UnixNano())
+
+	t.mu.Lock()
+	t.conns[c.ID] = tc
+	t.mu.Unlock()
+	return &liveConn{t: t, c: tc}
+}
+
+// stage records the progress of the handler.
+func (l *liveConn) stage(stage string) {
+	if l == nil {
+		return
+	}
+	l.t.mu.Lock()
+	l.c.Stage = stage
+	l.t.mu.Unlock()
+	l.c.lastActive.Store(time.Now().UnixNano())
+}
+
+// forwarding records that the connection is forwarded to the upstream, close
+// replaces the one the connection has been added with.
+func (l *liveConn) forwarding(upstream string, close func(reset bool)) {
+	if l == nil {
+		return
+	}
+	l.t.mu.Lock()
+	l.c.Stage = StageForwarding
+	l.c.Upstream = upstream
+	l.c.close = close
+	l.t.mu.Unlock()
+	l.c.lastActive.Store(time.Now().UnixNano())
+}
+
+// activity returns the time of the last activity in unix nanoseconds to be
+// updated while data is forwarded.
+func (l *liveConn) activity() *atomic.Int64 {
+	if l == nil {
+		return new(atomic.Int64)
+	}
+	return &l.c.lastActive
+}
+
+// done stops tracking the connection.
+func (l *liveConn) done() {
+	if l == nil {
+		return
+	}
+	l.t.mu.Lock()
+	delete(l.t.conns, l.c.ID)
+	l.t.mu.Unlock()
+}
+
+// list returns the connections of the rule, or of all rules if it is empty,
+// ordered by the time they have been accepted.
+func (t *connTable) list(rule string) []Connection {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	conns := make([]Connection, 0, len(t.conns))
+	for _, c := range t.conns {
+		if rule == "" || c.Rule == rule {
+			conns = append(conns, c.snapshot())
+		}
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(conns, func(a, b Connection) int { return a.Since.Compare(b.Since) })
+	return conns
+}
+
+// count returns the number of tracked connections.
+func (t *connTable) count() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// kill closes the connection with the id, it returns false if there is no
+// such connection.
+func (t *connTable) kill(id string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	var close func(bool)
+	c, ok := t.conns[id]
+	if ok {
+		close = c.close
+	}
+	t.mu.Unlock()
+
+	if ok {
+		close(false)
+	}
+	return ok
+}
+
+// closeRule closes all connections of the rule and returns how many have
+// been closed.
+func (t *connTable) closeRule(rule string, reset bool) int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	var closers []func(bool)
+	for _, c := range t.conns {
+		if c.Rule == rule {
+			closers = append(closers, c.close)
+		}
+	}
+	t.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, close := range closers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			close(reset)
+		}()
+	}
+	wg.Wait()
+	return len(closers)
+}
+
+// warnOld logs the connections which have been open for longer than maxAge,
+// each connection is reported once.
+func (t *connTable) warnOld(maxAge time.Duration) {
+	if t == nil || maxAge <= 0 {
+		return
+	}
+	now := time.Now()
+	var old []Connection
+	t.mu.Lock()
+	for _, c := range t.conns {
+		if !c.warned && now.Sub(c.Since) > maxAge {
+			c.warned = true
+			old = append(old, c.snapshot())
+		}
+	}
+	t.mu.Unlock()
+
+	for _, c := range old {
+		slog.Warn("connection exceeds the age warning", attrRule(c.Rule), attrConnId(c.ID),
+			slog.String("stage", c.Stage), slog.String("upstream", c.Upstream),
+			slog.Duration("age", now.Sub(c.Since)), slog.Duration("idle", now.Sub(c.LastActivity)))
+	}
+}
+
+// state describes whether the connection is open for the audit log.
+func (t *connTable) state(id string) func() string {
+	return func() string {
+		if t == nil {
+			return "closed"
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if c, ok := t.conns[id]; ok {
+			return "open " + c.Rule
+		}
+		return "closed"
+	}
+}
@@ -0,0 +1,79 @@
+package harald
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestConnTableStages(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+	echo, _ := haraldtest.EchoServer(t)
+
+	r := testRule(echo)
+	r.TLS = &TLS{Certificate: string(crt), Key: string(key)}
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.conns = newConnTable()
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	// the client never sends its client hello
+	c, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+
+	var conns []Connection
+	for i := 0; i < 100; i++ {
+		conns = f.conns.list("test")
+		if len(conns) == 1 && conns[0].Stage == StageAccepted {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(conns) != 1 || conns[0].Stage != StageAccepted || conns[0].Upstream != "" {
+		t.Fatalf("expected the connection to be listed before it is forwarded; got = %+v", conns)
+	}
+	if conns[0].LastActivity.Before(conns[0].Since) {
+		t.Errorf("expected the last activity to be set; got = %+v", conns[0])
+	}
+
+	// killing it aborts the handler
+	if !f.conns.kill(conns[0].ID) {
+		t.Fatal("expected the connection to be killed")
+	}
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	for i := 0; i < 100 && f.conns.count() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := f.conns.count(); n != 0 {
+		t.Errorf("expected the handler to return; got = %d connections", n)
+	}
+}
+
+func TestConnTableWarnOld(t *testing.T) {
+	table := newConnTable()
+	young := table.add(Connection{ID: "young", Rule: "test", Since: time.Now()}, func(bool) {})
+	defer young.done()
+	old := table.add(Connection{ID: "old", Rule: "test", Since: time.Now().Add(-time.Hour)}, func(bool) {})
+	defer old.done()
+
+	table.warnOld(time.Minute)
+	if !old.c.warned || young.c.warned {
+		t.Errorf("expected only the old connection to be reported; old = %t, young = %t", old.c.warned, young.c.warned)
+	}
+}
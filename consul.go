@@ -0,0 +1,198 @@
+package harald
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultConsulAddress = "http://127.0.0.1:8500"
+	// consulWait is the maximum duration of a blocking query.
+	consulWait = 5 * time.Minute
+)
+
+// ConsulDiscovery watches the healthy instances of a Consul service.
+type ConsulDiscovery struct {
+	// Address of the Consul HTTP API, defaults to CONSUL_HTTP_ADDR or
+	// http://127.0.0.1:8500.
+	Address string `json:"address" yaml:"address" toml:"address"`
+	// Token for the Consul API, defaults to CONSUL_HTTP_TOKEN.
+	Token      string `json:"token" yaml:"token" toml:"token"`
+	Service    string `json:"service" yaml:"service" toml:"service"`
+	Tag        string `json:"tag" yaml:"tag" toml:"tag"`
+	Datacenter string `json:"datacenter" yaml:"datacenter" toml:"datacenter"`
+}
+
+// consulSource uses blocking queries against the health endpoint of Consul
+// to learn about changes of the service right away.
+type consulSource struct {
+	conf     ConsulDiscovery
+	network  string
+	endpoint *url.URL
+	retry    time.Duration
+	client   *http.Client
+	log      *slog.Logger
+}
+
+// consulServiceEntry contains the fields we need from the response of
+// /v1/health/service/:service.
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+func newConsulSource(c ConsulDiscovery, network string, retry time.Duration, log *slog.Logger) (*consulSource, error) {
+	if c.Service == "" {
+		return nil, fmt.Errorf("consul: missing service name")
+	}
+	if c.Address == "" {
+		c.Address = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if c.Address == "" {
+		c.Address = defaultConsulAddress
+	}
+	if c.Token == "" {
+		c.Token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+
+	endpoint, err := url.Parse(c.Address)
+	if err != nil {
+		return nil, fmt.Errorf("consul: %w", err)
+	}
+	if endpoint.Scheme == "" {
+		// CONSUL_HTTP_ADDR is commonly set without a scheme
+		endpoint, err = url.Parse("http://" + c.Address)
+		if err != nil {
+			return nil, fmt.Errorf("consul: %w", err)
+		}
+	}
+	endpoint = endpoint.JoinPath("/v1/health/service", c.Service)
+
+	return &consulSource{
+		conf:     c,
+		network:  network,
+		endpoint: endpoint,
+		retry:    retry,
+		client:   &http.Client{Timeout: consulWait + 30*time.Second},
+		log:      log,
+	}, nil
+}
+
+func (s *consulSource) watch(ctx context.Context, update func([]target)) {
+	var index uint64
+	for {
+		targets, next, err := s.query(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.log.Error("querying consul failed", attrError(err))
+			// start over with a non-blocking query after an error
+			index = 0
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(s.retry):
+			}
+			continue
+		}
+
+		if next != index {
+			s.log.Debug("received consul service instances", slog.Int("targets", len(targets)))
+			update(targets)
+		}
+
+		// the index must only ever increase, otherwise we have to reset it
+		// according to the consul documentation.
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+// query fetches the healthy instances of the service. If index is not zero
+// the request blocks until the service changes or the wait time is over.
+func (s *consulSource) query(ctx context.Context, index uint64) ([]target, uint64, error) {
+	q := url.Values{}
+	q.Set("passing", "true")
+	if s.conf.Tag != "" {
+		q.Set("tag", s.conf.Tag)
+	}
+	if s.conf.Datacenter != "" {
+		q.Set("dc", s.conf.Datacenter)
+	}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", consulWait.String())
+	}
+
+	u := *s.endpoint
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.conf.Token != "" {
+		req.Header.Set("X-Consul-Token", s.conf.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status '%s'", resp.Status)
+	}
+
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid X-Consul-Index: %w", err)
+	}
+
+	var entries []consulServiceEntry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decode response: %w", err)
+	}
+
+	targets := make([]target, len(entries))
+	for i, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		targets[i] = target{
+			NetConf: NetConf{
+				Network: s.network,
+				Address: net.JoinHostPort(host, strconv.Itoa(e.Service.Port)),
+			},
+			Weight: uint16(min(max(e.Service.Weights.Passing, 0), 0xffff)),
+		}
+	}
+
+	return targets, next, nil
+}
+
+func (s *consulSource) String() string {
+	return "consul:" + s.network + "@" + s.conf.Service
+}
@@ -0,0 +1,75 @@
+package harald
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConsulSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/web" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("X-Consul-Token") != "secret" || r.URL.Query().Get("passing") != "true" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Query().Get("index") != "" {
+			// block like consul does until the test is over
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", "5")
+		_, _ = w.Write([]byte(`[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 8080, "Weights": {"Passing": 1}}},
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "192.0.2.2", "Port": 8081, "Weights": {"Passing": 3}}}
+		]`))
+	}))
+	defer srv.Close()
+
+	s, err := newConsulSource(ConsulDiscovery{
+		Address: srv.URL,
+		Token:   "secret",
+		Service: "web",
+	}, "tcp", time.Second, testLogger())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := make(chan []target, 1)
+	go s.watch(ctx, func(targets []target) { updates <- targets })
+
+	var targets []target
+	select {
+	case targets = <-updates:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update received")
+	}
+
+	want := []target{
+		{NetConf: NetConf{Network: "tcp", Address: "10.0.0.1:8080"}, Weight: 1},
+		{NetConf: NetConf{Network: "tcp", Address: "192.0.2.2:8081"}, Weight: 3},
+	}
+	if len(targets) != len(want) {
+		t.Fatalf("want = %v; got = %v", want, targets)
+	}
+	for i := range want {
+		if targets[i] != want[i] {
+			t.Errorf("target %d: want = %v; got = %v", i, want[i], targets[i])
+		}
+	}
+}
+
+func TestConsulSourceRequiresService(t *testing.T) {
+	_, err := newConsulSource(ConsulDiscovery{}, "tcp", time.Second, testLogger())
+	if err == nil {
+		t.Fatal("expected error without service")
+	}
+}
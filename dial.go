@@ -0,0 +1,113 @@
+package harald
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	dialRetryMinBackoff = 50 * time.Millisecond
+	dialRetryMaxBackoff = time.Second
+)
+
+// dialUpstream connects to the upstream of the forwarder. Connections from the
+// pool are preferred if one is configured. If the rule configures a retry
+// window, failed attempts are retried with an exponential backoff until the
+// window has passed. This allows smoothing over brief restarts of the
+// upstream while the client is kept waiting. Canceling ctx stops retrying.
+func (f *Forwarder) dialUpstream(ctx context.Context, src netip.Addr, log *slog.Logger) (*upstreamConn, error) {
+	if c := f.pool.get(); c != nil {
+		log.Debug("using pooled upstream connection")
+		return c, nil
+	}
+
+	deadline := time.Now().Add(f.DialRetryWindow.Duration())
+	backoff := dialRetryMinBackoff
+
+	for {
+		c, err := f.dial(src)
+		if err == nil {
+			return c, nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			if f.Fallback != nil {
+				log.Warn("connecting upstream failed, using fallback", attrError(err))
+				return &upstreamConn{Conn: f.dialBuiltin(f.Fallback.Network), upstream: &upstream{NetConf: *f.Fallback}}, nil
+			}
+			return nil, err
+		}
+
+		log.Debug("connecting upstream failed, retrying", attrError(err), slog.Duration("backoff", backoff))
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("retrying canceled: %w", err)
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, dialRetryMaxBackoff)
+	}
+}
+
+// dial makes a single attempt to connect to the upstream picked by the
+// balancer for src.
+func (f *Forwarder) dial(src netip.Addr) (*upstreamConn, error) {
+	u := f.balancer.pick(src)
+	if u == nil {
+		f.stats.dialErrors.Add(1)
+		return nil, withKind(ErrDial, f.balancer.unavailable())
+	}
+	probe := f.balancer.breaker.acquire(&u.circuit, time.Now())
+	var c net.Conn
+	var err error
+	if f.tunnel != nil {
+		c, err = f.tunnel.dial(f.timeout)
+	} else {
+		c, err = f.connect(u)
+	}
+	if err == nil {
+		c, err = f.upstreamHandshake(c, u.Address)
+	}
+	if err != nil {
+		f.stats.dialErrors.Add(1)
+		u.dialErrors.Add(1)
+		f.upstreamFailed(u, probe)
+		return nil, withKind(ErrDial, err)
+	}
+	if f.balancer.breaker.connected(&u.circuit, probe) {
+		f.log.Info("closing circuit of upstream", attrUpstream(u))
+		u.joined.Store(time.Now().UnixNano())
+	}
+	return &upstreamConn{Conn: c, upstream: u, balanced: true, probe: probe}, nil
+}
+
+// dialRoute connects to the upstream of a route picked by the router.
+func (f *Forwarder) dialRoute(u *upstream) (*upstreamConn, error) {
+	c, err := f.connect(u)
+	if err == nil {
+		c, err = f.upstreamHandshake(c, u.Address)
+	}
+	if err != nil {
+		f.stats.dialErrors.Add(1)
+		u.dialErrors.Add(1)
+		return nil, withKind(ErrDial, err)
+	}
+	return &upstreamConn{Conn: c, upstream: u}, nil
+}
+
+// connect establishes a connection to the upstream without the TLS handshake,
+// builtin upstreams and stdio aren't dialed at all.
+func (f *Forwarder) connect(u *upstream) (net.Conn, error) {
+	if u.Network == networkStdio {
+		return openStdio()
+	}
+	if isBuiltin(u.Network) {
+		return f.dialBuiltin(u.Network), nil
+	}
+	return f.ConnectOptions.dial(u.Network, u.Address, f.timeout, f.resolver)
+}
@@ -0,0 +1,143 @@
+package harald
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestDialRetryWindow ensures that a client is kept waiting while the
+// upstream comes up within the retry window.
+func TestDialRetryWindow(t *testing.T) {
+	// reserve an address for the upstream which is not listening yet
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	upstreamAddr := l.Addr().String()
+	_ = l.Close()
+
+	r := ForwardRule{
+		DialRetryWindow: Duration(5 * time.Second),
+		Listen: NetConf{
+			Network: "tcp",
+			Address: "127.0.0.1:0",
+		},
+		Connect: NetConf{
+			Network: "tcp",
+			Address: upstreamAddr,
+		},
+	}
+
+	forwarder, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = forwarder.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer forwarder.Stop()
+
+	conn, err := net.Dial("tcp", forwarder.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	time.Sleep(200 * time.Millisecond)
+
+	l, err = net.Listen("tcp", upstreamAddr)
+	if err != nil {
+		t.Fatalf("start upstream: %s", err.Error())
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = io.Copy(c, c)
+	}()
+
+	payload := []byte("foobar")
+	_, err = conn.Write(payload)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(buf) != string(payload) {
+		t.Fatalf("want = %s; got = %s", payload, buf)
+	}
+
+	if forwarder.Stats().DialErrors == 0 {
+		t.Errorf("expected failed dial attempts to be counted")
+	}
+}
+
+func TestRuleDialTimeoutOverridesDefault(t *testing.T) {
+	r := ForwardRule{DialTimeout: Duration(5 * time.Millisecond)}
+
+	forwarder, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if forwarder.timeout != 5*time.Millisecond {
+		t.Fatalf("want = %s; got = %s", 5*time.Millisecond, forwarder.timeout)
+	}
+}
+
+// TestDialRetryKilled ensures that killing a client stops retrying to
+// connect its upstream.
+func TestDialRetryKilled(t *testing.T) {
+	r := testRule("127.0.0.1:1")
+	r.DialRetryWindow = Duration(time.Minute)
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.conns = newConnTable()
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	c, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+
+	var conns []Connection
+	for i := 0; i < 100; i++ {
+		conns = f.conns.list("test")
+		if len(conns) == 1 && conns[0].Stage == StageConnecting {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(conns) != 1 || conns[0].Stage != StageConnecting {
+		t.Fatalf("expected the connection to connect upstream; got = %+v", conns)
+	}
+
+	if !f.conns.kill(conns[0].ID) {
+		t.Fatal("expected the connection to be killed")
+	}
+	for i := 0; i < 100 && f.conns.count() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := f.conns.count(); n != 0 {
+		t.Errorf("expected the handler to stop retrying; got = %d connections", n)
+	}
+}
@@ -0,0 +1,40 @@
+package harald
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Discovery configures a source which dynamically provides the upstreams of a
+// rule. The network of the upstreams is taken from the connect config of the
+// rule and defaults to tcp.
+type Discovery struct {
+	// Type selects the source, the config of the source is expected in the
+	// field of the same name.
+	Type       string               `json:"type" yaml:"type" toml:"type"`
+	Consul     *ConsulDiscovery     `json:"consul" yaml:"consul" toml:"consul"`
+	Kubernetes *KubernetesDiscovery `json:"kubernetes" yaml:"kubernetes" toml:"kubernetes"`
+}
+
+// newSource creates the upstream source described by the config.
+func (d *Discovery) newSource(network string, interval time.Duration, log *slog.Logger) (upstreamSource, error) {
+	if network == "" {
+		network = "tcp"
+	}
+
+	switch d.Type {
+	case "consul":
+		if d.Consul == nil {
+			return nil, fmt.Errorf("discovery: missing consul config")
+		}
+		return newConsulSource(*d.Consul, network, interval, log)
+	case "kubernetes":
+		if d.Kubernetes == nil {
+			return nil, fmt.Errorf("discovery: missing kubernetes config")
+		}
+		return newKubernetesSource(*d.Kubernetes, network, interval, log)
+	default:
+		return nil, fmt.Errorf("discovery: unknown type '%s'", d.Type)
+	}
+}
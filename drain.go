@@ -0,0 +1,71 @@
+package harald
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// DrainClose closes the remaining connections gracefully (FIN).
+	DrainClose = "close"
+	// DrainReset resets the remaining connections (RST).
+	DrainReset = "reset"
+	// DrainWait leaves the remaining connections to finish on their own.
+	DrainWait = "wait"
+)
+
+// Drain configures what happens to the connections of a rule which is being
+// drained through the admin socket. Without a timeout the connections are
+// left to finish on their own.
+type Drain struct {
+	// Timeout is the deadline for the connections to finish after the
+	// listener has been closed.
+	Timeout Duration `json:"timeout" yaml:"timeout" toml:"timeout"`
+	// OnTimeout decides what happens to the connections which are still open
+	// once the deadline expired: close (default), reset or wait.
+	OnTimeout string `json:"on_timeout" yaml:"on_timeout" toml:"on_timeout"`
+}
+
+func (d *Drain) validate() error {
+	if d == nil {
+		return nil
+	}
+	if d.Timeout < 0 {
+		return fmt.Errorf("drain: timeout must not be negative")
+	}
+	switch d.OnTimeout {
+	case "", DrainClose, DrainReset, DrainWait:
+		return nil
+	default:
+		return fmt.Errorf("drain: unknown on_timeout '%s'", d.OnTimeout)
+	}
+}
+
+// deadline returns the drain timeout and the action taken once it expired,
+// a zero timeout means there is no deadline.
+func (d *Drain) deadline() (time.Duration, string) {
+	if d == nil || d.Timeout == 0 {
+		return 0, DrainWait
+	}
+	if d.OnTimeout == "" {
+		return time.Duration(d.Timeout), DrainClose
+	}
+	return time.Duration(d.Timeout), d.OnTimeout
+}
+
+// resetConn makes closing c send a RST instead of a FIN. Connections which
+// aren't backed by TCP are left untouched.
+func resetConn(c net.Conn) {
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			_ = v.SetLinger(0)
+			return
+		case interface{ NetConn() net.Conn }:
+			c = v.NetConn()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+//go:build unix
+
+package harald
+
+// PlannedRule describes what a rule of the config listens on and connects to,
+// see DryRun.
+type PlannedRule struct {
+	Rule   string  `json:"rule"`
+	Tenant string  `json:"tenant,omitempty"`
+	Listen NetConf `json:"listen"`
+	// Connect lists the upstreams or names the source they are discovered
+	// from.
+	Connect string `json:"connect"`
+	// TLS is set if TLS is terminated for the clients, UpstreamTLS if the
+	// upstreams are connected with TLS.
+	TLS         bool `json:"tls"`
+	UpstreamTLS bool `json:"upstream_tls"`
+	// Start is set if the listener is opened on startup, otherwise it waits
+	// for SIGUSR1 or the admin socket.
+	Start bool `json:"start"`
+}
+
+// DryRun builds everything the config describes the way harald would on
+// startup, including the forwarders and TLS configs, but doesn't open any
+// listeners. It returns the rules with their port ranges and address
+// templates resolved. Rules of an etcd cluster aren't included.
+func DryRun(c Config) ([]PlannedRule, error) {
+	s, err := NewServer(c)
+	if err != nil {
+		return nil, err
+	}
+	plan := make([]PlannedRule, 0, len(s.forwarders))
+	for _, f := range s.forwarders {
+		// builtin upstreams and stdio aren't balanced
+		connect := f.Connect.Network
+		if f.Connect.Address != "" {
+			connect += "@" + f.Connect.Address
+		}
+		if f.source != nil || f.balancer != nil {
+			connect = f.upstreams().String()
+		}
+		plan = append(plan, PlannedRule{
+			Rule:        f.name,
+			Tenant:      f.Tenant,
+			Listen:      f.Listen,
+			Connect:     connect,
+			TLS:         f.tlsConf != nil || f.quicConf != nil,
+			UpstreamTLS: f.upstreamTLS != nil,
+			Start:       c.EnableListeners,
+		})
+	}
+	return plan, nil
+}
@@ -0,0 +1,76 @@
+//go:build unix
+
+package harald
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	// the port is free again, the dry run must not take it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	plan, err := DryRun(Config{
+		EnableListeners: true,
+		Rules: map[string]ForwardRule{
+			"http": {
+				Listen:    NetConf{Network: "tcp", Address: addr},
+				Upstreams: []NetConf{{Network: "tcp", Address: "10.0.0.5:80"}, {Network: "tcp", Address: "10.0.0.6:80"}},
+				Tenant:    "web",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(plan) != 1 {
+		t.Fatalf("want = 1 rule; got = %d", len(plan))
+	}
+	want := PlannedRule{
+		Rule:    "http",
+		Tenant:  "web",
+		Listen:  NetConf{Network: "tcp", Address: addr},
+		Connect: "tcp@10.0.0.5:80,tcp@10.0.0.6:80",
+		Start:   true,
+	}
+	if plan[0] != want {
+		t.Errorf("want = %+v; got = %+v", want, plan[0])
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("expected the address to be free: %s", err.Error())
+	}
+	_ = l.Close()
+}
+
+func TestDryRunAllErrors(t *testing.T) {
+	_, err := DryRun(Config{Rules: map[string]ForwardRule{
+		"bad-balance": {
+			Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+			Connect: NetConf{Network: "tcp", Address: "127.0.0.1:1"},
+			Balance: "foo",
+		},
+		"bad-tls": {
+			Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+			Connect: NetConf{Network: "tcp", Address: "127.0.0.1:1"},
+			TLS:     &TLS{Certificate: "nope", Key: "nope"},
+		},
+		"good": testRule("127.0.0.1:1"),
+	}})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, rule := range []string{"bad-balance", "bad-tls"} {
+		if !strings.Contains(err.Error(), rule) {
+			t.Errorf("expected error of rule %s; got = %s", rule, err.Error())
+		}
+	}
+}
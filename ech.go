@@ -0,0 +1,155 @@
+package harald
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// echVersion is the version of the ECHConfig structure defined by
+	// draft-ietf-tls-esni-18 and supported by crypto/tls.
+	echVersion = 0xfe0d
+
+	hpkeKEMX25519       = 0x0020
+	hpkeKDFHKDFSHA256   = 0x0001
+	hpkeAEADAES128GCM   = 0x0001
+	hpkeAEADChaCha20    = 0x0003
+	echMaxPublicNameLen = 255
+)
+
+// ECHKey is a key of Encrypted Client Hello (ECH), clients encrypt their
+// ClientHello including the server name with the public key in Config. Keys
+// are generated with `harald ech-keygen`.
+//
+// To rotate keys, a new key is added in front of the old one, which is marked
+// as retired once the new ECHConfigList is published in DNS. Retired keys are
+// accepted from clients with outdated DNS records, but not published and not
+// sent to clients as retry configs. After the TTL of the DNS records has
+// passed, retired keys can be removed.
+type ECHKey struct {
+	// Config is the base64 encoded ECHConfig, it contains the public key and
+	// the public name which is sent via SNI in the outer ClientHello.
+	Config string `json:"config" yaml:"config" toml:"config"`
+	// PrivateKey is the base64 encoded HPKE private key belonging to Config.
+	PrivateKey string `json:"private_key" yaml:"private_key" toml:"private_key"`
+	Retired    bool   `json:"retired" yaml:"retired" toml:"retired"`
+}
+
+// NewECHKey generates an ECHKey with a X25519 key pair for the public name,
+// the name that clients send in the clear (e.g. the domain of the CDN or the
+// host itself).
+func NewECHKey(publicName string) (ECHKey, error) {
+	if publicName == "" || len(publicName) > echMaxPublicNameLen {
+		return ECHKey{}, fmt.Errorf("ech: public name must have between 1 and %d characters", echMaxPublicNameLen)
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return ECHKey{}, fmt.Errorf("ech: %w", err)
+	}
+	var id [1]byte
+	_, err = rand.Read(id[:])
+	if err != nil {
+		return ECHKey{}, fmt.Errorf("ech: %w", err)
+	}
+
+	pub := priv.PublicKey().Bytes()
+	var contents []byte
+	contents = append(contents, id[0])
+	contents = binary.BigEndian.AppendUint16(contents, hpkeKEMX25519)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(pub)))
+	contents = append(contents, pub...)
+	// cipher suites, each a KDF and an AEAD
+	contents = binary.BigEndian.AppendUint16(contents, 8)
+	contents = binary.BigEndian.AppendUint16(contents, hpkeKDFHKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, hpkeAEADAES128GCM)
+	contents = binary.BigEndian.AppendUint16(contents, hpkeKDFHKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, hpkeAEADChaCha20)
+	// maximum name length, zero lets the clients choose the padding
+	contents = append(contents, 0)
+	contents = append(contents, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	// no extensions
+	contents = binary.BigEndian.AppendUint16(contents, 0)
+
+	config := binary.BigEndian.AppendUint16(nil, echVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+
+	return ECHKey{
+		Config:     base64.StdEncoding.EncodeToString(config),
+		PrivateKey: base64.StdEncoding.EncodeToString(priv.Bytes()),
+	}, nil
+}
+
+// echKeys decodes the ECH keys of the config.
+func (t *TLS) echKeys() ([]tls.EncryptedClientHelloKey, error) {
+	if len(t.ECHKeys) == 0 {
+		return nil, nil
+	}
+	keys := make([]tls.EncryptedClientHelloKey, len(t.ECHKeys))
+	var current int
+	for i, k := range t.ECHKeys {
+		config, err := base64.StdEncoding.DecodeString(k.Config)
+		if err != nil {
+			return nil, fmt.Errorf("ech key %d: config: %w", i, err)
+		}
+		err = validateECHConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("ech key %d: config: %w", i, err)
+		}
+		priv, err := base64.StdEncoding.DecodeString(k.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("ech key %d: private key: %w", i, err)
+		}
+		if len(priv) == 0 {
+			return nil, fmt.Errorf("ech key %d: missing private key", i)
+		}
+		keys[i] = tls.EncryptedClientHelloKey{Config: config, PrivateKey: priv, SendAsRetry: !k.Retired}
+		if !k.Retired {
+			current++
+		}
+	}
+	if current == 0 {
+		return nil, fmt.Errorf("ech keys: all keys are retired")
+	}
+	return keys, nil
+}
+
+// validateECHConfig checks the framing of an ECHConfig, the contents are
+// validated by crypto/tls during the handshakes.
+func validateECHConfig(config []byte) error {
+	if len(config) < 4 {
+		return fmt.Errorf("too short")
+	}
+	if v := binary.BigEndian.Uint16(config); v != echVersion {
+		return fmt.Errorf("unsupported version %#04x", v)
+	}
+	if n := int(binary.BigEndian.Uint16(config[2:])); n != len(config)-4 {
+		return fmt.Errorf("invalid length")
+	}
+	return nil
+}
+
+// ECHConfigList returns the ECHConfigList of the keys which are not retired,
+// which is published in the ech parameter of the HTTPS record in DNS (RFC
+// 9460). It returns nil if no keys are configured.
+func (t *TLS) ECHConfigList() ([]byte, error) {
+	if t == nil || len(t.ECHKeys) == 0 {
+		return nil, nil
+	}
+	keys, err := t.echKeys()
+	if err != nil {
+		return nil, withKind(ErrTLS, fmt.Errorf("tls config: %w", err))
+	}
+	var configs []byte
+	for _, k := range keys {
+		if k.SendAsRetry {
+			configs = append(configs, k.Config...)
+		}
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(configs))), configs...), nil
+}
@@ -0,0 +1,150 @@
+package harald
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestECHConfigList(t *testing.T) {
+	current, err := NewECHKey("example.com")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	retired, err := NewECHKey("example.com")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	retired.Retired = true
+
+	list, err := (&TLS{ECHKeys: []ECHKey{current, retired}}).ECHConfigList()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	only, err := (&TLS{ECHKeys: []ECHKey{current}}).ECHConfigList()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(list, only) {
+		t.Error("expected retired key to be left out of the list")
+	}
+
+	_, err = (&TLS{ECHKeys: []ECHKey{retired}}).ECHConfigList()
+	if err == nil {
+		t.Error("expected error if all keys are retired")
+	}
+	_, err = (&TLS{ECHKeys: []ECHKey{{Config: "AAAA", PrivateKey: current.PrivateKey}}}).ECHConfigList()
+	if err == nil {
+		t.Error("expected error for invalid config")
+	}
+	_, err = NewECHKey("")
+	if err == nil {
+		t.Error("expected error for empty public name")
+	}
+}
+
+func TestECH(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+	backend, _ := haraldtest.EchoServer(t)
+
+	current, err := NewECHKey("public.example")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	retired, err := NewECHKey("public.example")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	retired.Retired = true
+	unknown, err := NewECHKey("public.example")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	r := ForwardRule{
+		Listen: NetConf{
+			Network: "tcp",
+			Address: "127.0.0.1:0",
+		},
+		Connect: NetConf{
+			Network: "tcp",
+			Address: backend,
+		},
+		TLS: &TLS{
+			Certificate: string(crt),
+			Key:         string(key),
+			ECHKeys:     []ECHKey{current, retired},
+		},
+	}
+
+	forwarder, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = forwarder.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer forwarder.Stop()
+
+	published, err := r.TLS.ECHConfigList()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	dial := func(k ECHKey) (*tls.Conn, error) {
+		list, err := (&TLS{ECHKeys: []ECHKey{{Config: k.Config, PrivateKey: k.PrivateKey}}}).ECHConfigList()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		dialer := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: time.Second},
+			Config: &tls.Config{
+				ServerName:                     "localhost",
+				RootCAs:                        roots,
+				EncryptedClientHelloConfigList: list,
+				// on rejection the certificate is verified against the
+				// public name, which it isn't valid for
+				EncryptedClientHelloRejectionVerify: func(tls.ConnectionState) error { return nil },
+			},
+		}
+		c, err := dialer.Dial("tcp", forwarder.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		return c.(*tls.Conn), nil
+	}
+
+	for name, k := range map[string]ECHKey{"current": current, "retired": retired} {
+		c, err := dial(k)
+		if err != nil {
+			t.Errorf("%s key: %s", name, err)
+			continue
+		}
+		if !c.ConnectionState().ECHAccepted {
+			t.Errorf("%s key: expected ech to be accepted", name)
+		}
+		_ = c.Close()
+	}
+
+	// clients with an unknown key are rejected, but receive the published
+	// configs to retry with
+	_, err = dial(unknown)
+	var rejection *tls.ECHRejectionError
+	if !errors.As(err, &rejection) {
+		t.Fatalf("expected ech rejection, got %v", err)
+	}
+	if !bytes.Equal(rejection.RetryConfigList, published) {
+		t.Error("expected published configs as retry configs")
+	}
+}
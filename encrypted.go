@@ -0,0 +1,346 @@
+package harald
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables pointing to the age identities which decrypt configs,
+// the ones of SOPS are supported so existing setups keep working.
+const (
+	ageKeyFileEnv     = "HARALD_AGE_KEY_FILE"
+	sopsAgeKeyFileEnv = "SOPS_AGE_KEY_FILE"
+	sopsAgeKeyEnv     = "SOPS_AGE_KEY"
+)
+
+// sopsValue matches the values encrypted by SOPS.
+var sopsValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// ageIdentities reads the identities from the file in HARALD_AGE_KEY_FILE or
+// SOPS_AGE_KEY_FILE, or from SOPS_AGE_KEY.
+func ageIdentities() ([]age.Identity, error) {
+	for _, env := range []string{ageKeyFileEnv, sopsAgeKeyFileEnv} {
+		path := os.Getenv(env)
+		if path == "" {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("age identities: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		identities, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("age identities: %s: %w", path, err)
+		}
+		return identities, nil
+	}
+	if key := os.Getenv(sopsAgeKeyEnv); key != "" {
+		identities, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("age identities: %s: %w", sopsAgeKeyEnv, err)
+		}
+		return identities, nil
+	}
+	return nil, fmt.Errorf("age identities: neither %s, %s nor %s is set", ageKeyFileEnv, sopsAgeKeyFileEnv, sopsAgeKeyEnv)
+}
+
+// decryptAge decrypts data encrypted with age, either armored or binary.
+func decryptAge(b []byte, identities []age.Identity) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(b)
+	if trimmed := bytes.TrimSpace(b); bytes.HasPrefix(trimmed, []byte(armor.Header)) {
+		r = armor.NewReader(bytes.NewReader(trimmed))
+	}
+	d, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(d)
+}
+
+// decryptSOPS decrypts a YAML or JSON config encrypted by SOPS with age, other
+// configs are returned as they are.
+func decryptSOPS(b []byte, asJSON bool) ([]byte, error) {
+	if !bytes.Contains(b, []byte("ENC[AES256_GCM,")) {
+		return b, nil
+	}
+	var doc yaml.Node
+	err := yaml.Unmarshal(b, &doc)
+	if err != nil || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		// the error is reported when decoding the config
+		return b, nil
+	}
+	root := doc.Content[0]
+	var meta *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "sops" {
+			meta = root.Content[i+1]
+			root.Content = slices.Delete(root.Content, i, i+2)
+			break
+		}
+	}
+	if meta == nil {
+		return b, nil
+	}
+
+	var m struct {
+		Age []struct {
+			Recipient string `yaml:"recipient"`
+			Enc       string `yaml:"enc"`
+		} `yaml:"age"`
+		LastModified     string `yaml:"lastmodified"`
+		MAC              string `yaml:"mac"`
+		MACOnlyEncrypted bool   `yaml:"mac_only_encrypted"`
+	}
+	err = meta.Decode(&m)
+	if err != nil {
+		return nil, fmt.Errorf("sops: metadata: %w", err)
+	}
+	if len(m.Age) == 0 {
+		return nil, fmt.Errorf("sops: no age recipients, only age is supported")
+	}
+
+	identities, err := ageIdentities()
+	if err != nil {
+		return nil, fmt.Errorf("sops: %w", err)
+	}
+	var key []byte
+	for _, r := range m.Age {
+		key, err = decryptAge([]byte(r.Enc), identities)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sops: decrypt data key: %w", err)
+	}
+
+	s := &sopsDecrypter{key: key, mac: sha512.New(), macOnlyEncrypted: m.MACOnlyEncrypted}
+	err = s.tree(root)
+	if err != nil {
+		return nil, fmt.Errorf("sops: %w", err)
+	}
+	mac, _, _, err := s.decrypt(m.MAC, m.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("sops: mac: %w", err)
+	}
+	if mac != fmt.Sprintf("%X", s.mac.Sum(nil)) {
+		return nil, fmt.Errorf("sops: mac mismatch, the file has been modified")
+	}
+
+	if asJSON {
+		var v any
+		err = root.Decode(&v)
+		if err == nil {
+			b, err = json.Marshal(v)
+		}
+	} else {
+		b, err = yaml.Marshal(&doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sops: %w", err)
+	}
+	return b, nil
+}
+
+// sopsDecrypter decrypts the values of a tree in place and computes the MAC
+// over all of them in the order SOPS does.
+type sopsDecrypter struct {
+	key              []byte
+	mac              hash.Hash
+	macOnlyEncrypted bool
+}
+
+// tree decrypts the document starting at its root, the comments of the root
+// are part of the top level.
+func (s *sopsDecrypter) tree(root *yaml.Node) error {
+	for _, c := range []*string{&root.HeadComment, &root.LineComment} {
+		err := s.comment(c, nil)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.node(root, nil)
+	if err != nil {
+		return err
+	}
+	return s.comment(&root.FootComment, nil)
+}
+
+// node decrypts the values below n, path are the keys leading to it. Comments
+// belong to the mapping or sequence they are in.
+func (s *sopsDecrypter) node(n *yaml.Node, path []string) error {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			err := s.entry(path, slices.Concat(path, []string{k.Value}), v, &k.HeadComment, &k.LineComment, &k.FootComment)
+			if err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, v := range n.Content {
+			err := s.entry(path, path, v, nil, nil, nil)
+			if err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		return s.scalar(n, path)
+	}
+	return nil
+}
+
+// entry decrypts an entry of a mapping or sequence with the comments of its
+// key and value.
+func (s *sopsDecrypter) entry(parent, path []string, v *yaml.Node, head, line, foot *string) error {
+	var before, after []*string
+	if head != nil {
+		before, after = append(before, head, line), append(after, foot)
+	}
+	if v.Kind == yaml.ScalarNode || v.Kind == yaml.AliasNode {
+		before = append(before, &v.HeadComment, &v.LineComment)
+		after = append([]*string{&v.FootComment}, after...)
+	}
+	for _, c := range before {
+		err := s.comment(c, parent)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.node(v, path)
+	if err != nil {
+		return err
+	}
+	for _, c := range after {
+		err := s.comment(c, parent)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sopsDecrypter) comment(c *string, path []string) error {
+	if *c == "" {
+		return nil
+	}
+	lines := strings.Split(*c, "\n")
+	for i, line := range lines {
+		text, ok := strings.CutPrefix(line, "#")
+		if !ok {
+			continue
+		}
+		plain, _, encrypted, err := s.decrypt(text, sopsAAD(path))
+		if err != nil {
+			return fmt.Errorf("decrypt comment at %s: %w", strings.Join(path, "."), err)
+		}
+		if !s.macOnlyEncrypted || encrypted {
+			s.mac.Write([]byte(plain))
+		}
+		lines[i] = "#" + plain
+	}
+	*c = strings.Join(lines, "\n")
+	return nil
+}
+
+func (s *sopsDecrypter) scalar(n *yaml.Node, path []string) error {
+	typ := map[string]string{"!!int": "int", "!!float": "float", "!!bool": "bool", "!!str": "str"}[n.Tag]
+	if typ == "" {
+		// null and other values are not part of the MAC
+		return nil
+	}
+	plain, encryptedType, encrypted, err := s.decrypt(n.Value, sopsAAD(path))
+	if err != nil {
+		return fmt.Errorf("decrypt %s: %w", strings.Join(path, "."), err)
+	}
+	if encrypted {
+		typ = encryptedType
+		n.Value, n.Style = plain, 0
+		n.Tag = map[string]string{"int": "!!int", "float": "!!float", "bool": "!!bool"}[typ]
+		if n.Tag == "" {
+			n.Tag = "!!str"
+		}
+	}
+	if !s.macOnlyEncrypted || encrypted {
+		s.mac.Write(sopsBytes(typ, plain))
+	}
+	return nil
+}
+
+// decrypt returns the plaintext and type of a value encrypted by SOPS with the
+// additional data, other values are returned as they are.
+func (s *sopsDecrypter) decrypt(value, additionalData string) (string, string, bool, error) {
+	m := sopsValue.FindStringSubmatch(value)
+	if m == nil {
+		return value, "", false, nil
+	}
+	var parts [3][]byte
+	for i := range parts {
+		var err error
+		parts[i], err = base64.StdEncoding.DecodeString(m[i+1])
+		if err != nil {
+			return "", "", false, err
+		}
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return "", "", false, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return "", "", false, err
+	}
+	plain, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return "", "", false, err
+	}
+	return string(plain), m[4], true, nil
+}
+
+// sopsAAD is the additional data of the values at path.
+func sopsAAD(path []string) string {
+	return strings.Join(path, ":") + ":"
+}
+
+// sopsBytes is the representation of a value in the MAC, SOPS formats
+// booleans like Python.
+func sopsBytes(typ, value string) []byte {
+	switch typ {
+	case "int":
+		if i, err := strconv.Atoi(value); err == nil {
+			return []byte(strconv.Itoa(i))
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+		}
+	case "bool":
+		if b, err := strconv.ParseBool(value); err == nil {
+			if b {
+				return []byte("True")
+			}
+			return []byte("False")
+		}
+	}
+	return []byte(value)
+}
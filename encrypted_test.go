@@ -0,0 +1,177 @@
+package harald
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// testAgeIdentity creates an identity and makes it available through the
+// environment.
+func testAgeIdentity(t *testing.T) *age.X25519Identity {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	path := filepath.Join(t.TempDir(), "keys.txt")
+	err = os.WriteFile(path, []byte(identity.String()+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Setenv(ageKeyFileEnv, path)
+	t.Setenv(sopsAgeKeyFileEnv, "")
+	t.Setenv(sopsAgeKeyEnv, "")
+	return identity
+}
+
+// ageEncrypt encrypts data for the recipient with armor.
+func ageEncrypt(t *testing.T, recipient age.Recipient, data []byte) []byte {
+	var b bytes.Buffer
+	a := armor.NewWriter(&b)
+	w, err := age.Encrypt(a, recipient)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, _ = w.Write(data)
+	if err = w.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = a.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	return b.Bytes()
+}
+
+// sopsEncrypt encrypts a value like SOPS does.
+func sopsEncrypt(t *testing.T, key []byte, typ, value, additionalData string) string {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	iv := make([]byte, 32)
+	_, _ = rand.Read(iv)
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sealed := gcm.Seal(nil, iv, []byte(value), []byte(additionalData))
+	data, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+	e := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]", e(data), e(iv), e(tag), typ)
+}
+
+func TestLoadConfigAge(t *testing.T) {
+	identity := testAgeIdentity(t)
+	path := filepath.Join(t.TempDir(), "config.yml.age")
+	err := os.WriteFile(path, ageEncrypt(t, identity.Recipient(), exampleConfigYaml), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if c.Rules["http"].Connect.Address != "localhost:8080" {
+		t.Errorf("unexpected config %+v", c)
+	}
+
+	testAgeIdentity(t)
+	_, err = LoadConfig(path)
+	if err == nil {
+		t.Error("expected error with the wrong identity")
+	}
+}
+
+func TestLoadConfigSOPS(t *testing.T) {
+	identity := testAgeIdentity(t)
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	encryptedKey := strings.ReplaceAll(string(ageEncrypt(t, identity.Recipient(), key)), "\n", "\n        ")
+	const lastModified = "2026-10-17T00:00:00Z"
+
+	mac := func(values ...string) string {
+		h := sha512.New()
+		for _, v := range values {
+			h.Write([]byte(v))
+		}
+		return sopsEncrypt(t, key, "str", fmt.Sprintf("%X", h.Sum(nil)), lastModified)
+	}
+	comment := sopsEncrypt(t, key, "comment", " issued by the internal ca", "rules:web:tls:")
+	certificate := sopsEncrypt(t, key, "str", "CERTIFICATE", "rules:web:tls:certificate:")
+	privateKey := sopsEncrypt(t, key, "str", "KEY", "rules:web:tls:key:")
+
+	yamlConfig := fmt.Sprintf(`version: 2
+rules:
+  web:
+    listen:
+      network: tcp
+      address: 127.0.0.1:8443
+    connect:
+      network: tcp
+      address: 127.0.0.1:8080
+    tls:
+      #%s
+      certificate: %s
+      key: %s
+sops:
+  age:
+    - recipient: %s
+      enc: |
+        %s
+  lastmodified: "%s"
+  mac: %s
+  version: 3.9.0
+`, comment, certificate, privateKey, identity.Recipient(), encryptedKey, lastModified,
+		mac("2", "tcp", "127.0.0.1:8443", "tcp", "127.0.0.1:8080", " issued by the internal ca", "CERTIFICATE", "KEY"))
+
+	jsonConfig := fmt.Sprintf(`{
+  "version": 2,
+  "rules": {"web": {"tls": {"certificate": %q, "key": %q}}},
+  "sops": {
+    "age": [{"recipient": %q, "enc": %q}],
+    "lastmodified": %q,
+    "mac": %q
+  }
+}`, certificate, privateKey, identity.Recipient(), string(ageEncrypt(t, identity.Recipient(), key)), lastModified,
+		mac("2", "CERTIFICATE", "KEY"))
+
+	for name, config := range map[string]string{"config.yml": yamlConfig, "config.json": jsonConfig} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			err := os.WriteFile(path, []byte(config), 0o600)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			c, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			tls := c.Rules["web"].TLS
+			if tls == nil || tls.Certificate != "CERTIFICATE" || tls.Key != "KEY" {
+				t.Errorf("unexpected tls config %+v", tls)
+			}
+
+			// values which aren't encrypted are still protected by the mac
+			err = os.WriteFile(path, []byte(strings.Replace(config, "2", "3", 1)), 0o600)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			_, err = LoadConfig(path)
+			if err == nil || !strings.Contains(err.Error(), "mac mismatch") {
+				t.Errorf("expected mac mismatch, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package harald
+
+import (
+	"errors"
+)
+
+// Errors returned by this package wrap one of these sentinels to indicate
+// their cause, use errors.Is to check for them. The message of an error is
+// not affected by the sentinel it wraps.
+var (
+	// ErrConfig is wrapped by errors caused by an invalid configuration.
+	ErrConfig = errors.New("invalid config")
+	// ErrBind is wrapped by errors of opening a listener.
+	ErrBind = errors.New("bind failed")
+	// ErrDial is wrapped by errors of connecting upstream.
+	ErrDial = errors.New("dial failed")
+	// ErrTLS is wrapped by errors of the TLS configuration and handshake.
+	ErrTLS = errors.New("tls failed")
+	// ErrNotFound is wrapped by errors of admin commands referring to a rule
+	// or connection which doesn't exist.
+	ErrNotFound = errors.New("not found")
+)
+
+// kindError marks err with a sentinel without changing its message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// withKind wraps err with the sentinel kind, nil stays nil.
+func withKind(kind, err error) error {
+	if err == nil || errors.Is(err, kind) {
+		return err
+	}
+	return &kindError{kind: kind, err: err}
+}
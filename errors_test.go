@@ -0,0 +1,60 @@
+package harald
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestErrorKinds(t *testing.T) {
+	_, err := LoadConfig("does-not-exist.yaml")
+	if !errors.Is(err, ErrConfig) {
+		t.Errorf("load config: expected ErrConfig; got %v", err)
+	}
+
+	r := testRule("127.0.0.1:1")
+	r.TLS = &TLS{Certificate: "invalid"}
+	_, err = r.NewForwarder("test", 0)
+	if !errors.Is(err, ErrConfig) || !errors.Is(err, ErrTLS) {
+		t.Errorf("new forwarder: expected ErrConfig and ErrTLS; got %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	r = testRule(l.Addr().String())
+	r.Listen.Address = l.Addr().String()
+	f, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if !errors.Is(err, ErrBind) {
+		t.Errorf("start: expected ErrBind; got %v", err)
+	}
+
+	// nothing is listening on port 1
+	f, err = testRule("127.0.0.1:1").NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = f.dial(netip.Addr{})
+	var opErr *net.OpError
+	if !errors.Is(err, ErrDial) || !errors.As(err, &opErr) {
+		t.Errorf("dial: expected ErrDial wrapping the cause; got %v", err)
+	}
+}
+
+func TestWithKindKeepsMessage(t *testing.T) {
+	err := withKind(ErrConfig, errors.New("foo"))
+	if err.Error() != "foo" {
+		t.Errorf("want = foo; got = %s", err.Error())
+	}
+	if withKind(ErrConfig, nil) != nil {
+		t.Error("expected nil to stay nil")
+	}
+}
@@ -0,0 +1,302 @@
+package harald
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// etcdRetry is the delay before trying the next endpoint after an error.
+	etcdRetry = 5 * time.Second
+	// etcdRequestTimeout limits all requests except for watches.
+	etcdRequestTimeout = 10 * time.Second
+)
+
+// Etcd configures etcd as an additional source of rules. Each key below
+// Prefix contains a single rule encoded as JSON, the name of the rule is the
+// remainder of the key. Rules from etcd are applied on top of the rules of the
+// config file, a rule which is also defined in the config file is ignored.
+type Etcd struct {
+	// Endpoints of the etcd cluster, e.g. http://127.0.0.1:2379. They are
+	// tried in turn if one fails.
+	Endpoints []string `json:"endpoints" yaml:"endpoints" toml:"endpoints"`
+	Prefix    string   `json:"prefix" yaml:"prefix" toml:"prefix"`
+	// Username and Password are used to authenticate if set.
+	Username string `json:"username" yaml:"username" toml:"username"`
+	Password string `json:"password" yaml:"password" toml:"password"`
+}
+
+// etcdSource uses the JSON gateway of etcd v3 to load the rules below the
+// prefix and to watch for changes. Every change causes a full reload of the
+// prefix.
+type etcdSource struct {
+	conf      Etcd
+	endpoints []*url.URL
+	// current is the index of the endpoint in use.
+	current int
+	retry   time.Duration
+	client  *http.Client
+	log     *slog.Logger
+	// last are the rules of the previous load, a rule whose value became
+	// invalid keeps its previous version.
+	last map[string]ForwardRule
+}
+
+// etcdKeyValue is a single key of a range response, keys and values are
+// base64 encoded which is handled by encoding/json for byte slices.
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader     `json:"header"`
+	Kvs    []etcdKeyValue `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Header   etcdHeader        `json:"header"`
+		Created  bool              `json:"created"`
+		Canceled bool              `json:"canceled"`
+		Events   []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func newEtcdSource(c Etcd, log *slog.Logger) (*etcdSource, error) {
+	if len(c.Endpoints) == 0 {
+		return nil, fmt.Errorf("etcd: no endpoints configured")
+	}
+	if c.Prefix == "" {
+		return nil, fmt.Errorf("etcd: missing prefix")
+	}
+
+	s := &etcdSource{
+		conf:   c,
+		retry:  etcdRetry,
+		client: &http.Client{},
+		log:    log.With(slog.String("etcd-prefix", c.Prefix)),
+	}
+	for _, e := range c.Endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, fmt.Errorf("etcd: %w", err)
+		}
+		s.endpoints = append(s.endpoints, u)
+	}
+	return s, nil
+}
+
+// watch calls update with the rules stored in etcd every time they change
+// until ctx is cancelled.
+func (s *etcdSource) watch(ctx context.Context, update func(map[string]ForwardRule)) {
+	for {
+		err := s.sync(ctx, update)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.log.Error("syncing rules from etcd failed", slog.String("endpoint", s.endpoint().String()), attrError(err))
+			s.current = (s.current + 1) % len(s.endpoints)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(s.retry):
+			}
+		}
+	}
+}
+
+// sync loads the rules, passes them to update and blocks until they change.
+func (s *etcdSource) sync(ctx context.Context, update func(map[string]ForwardRule)) error {
+	token, err := s.authenticate(ctx)
+	if err != nil {
+		return fmt.Errorf("authenticate: %w", err)
+	}
+
+	rules, revision, err := s.load(ctx, token)
+	if err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+	s.log.Debug("loaded rules from etcd", slog.Int("rules", len(rules)), slog.Int64("revision", revision))
+	update(rules)
+
+	err = s.waitForChange(ctx, token, revision+1)
+	if err != nil {
+		return fmt.Errorf("watch: %w", err)
+	}
+	return nil
+}
+
+// authenticate returns a token if credentials are configured.
+func (s *etcdSource) authenticate(ctx context.Context) (string, error) {
+	if s.conf.Username == "" {
+		return "", nil
+	}
+
+	var resp struct {
+		Token string `json:"token"`
+	}
+	err := s.call(ctx, "", "/v3/auth/authenticate", map[string]string{
+		"name":     s.conf.Username,
+		"password": s.conf.Password,
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+	return resp.Token, nil
+}
+
+// load returns all rules below the prefix and the revision they were read at.
+func (s *etcdSource) load(ctx context.Context, token string) (map[string]ForwardRule, int64, error) {
+	var resp etcdRangeResponse
+	err := s.call(ctx, token, "/v3/kv/range", map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(s.conf.Prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixRangeEnd([]byte(s.conf.Prefix))),
+	}, &resp)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rules := make(map[string]ForwardRule, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		name := strings.TrimPrefix(string(kv.Key), s.conf.Prefix)
+		var r ForwardRule
+		err = json.Unmarshal(kv.Value, &r)
+		if err != nil {
+			// a single broken rule must not prevent the others from being
+			// applied, nor take down its running version.
+			prev, ok := s.last[name]
+			s.log.Error("ignoring invalid rule from etcd", attrRule(name), slog.Bool("kept-previous", ok), attrError(err))
+			if ok {
+				rules[name] = prev
+			}
+			continue
+		}
+		rules[name] = r
+	}
+	s.last = rules
+
+	return rules, resp.Header.Revision, nil
+}
+
+// waitForChange watches the prefix starting at revision and returns once the
+// first change has been observed.
+func (s *etcdSource) waitForChange(ctx context.Context, token string, revision int64) error {
+	body, err := json.Marshal(map[string]any{
+		"create_request": map[string]any{
+			"key":            base64.StdEncoding.EncodeToString([]byte(s.conf.Prefix)),
+			"range_end":      base64.StdEncoding.EncodeToString(prefixRangeEnd([]byte(s.conf.Prefix))),
+			"start_revision": revision,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resp, err := s.post(ctx, token, "/v3/watch", body)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// the response is a stream of JSON objects, one per watch event.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var w etcdWatchResponse
+		err = dec.Decode(&w)
+		if err != nil {
+			return fmt.Errorf("decode response: %w", err)
+		}
+		if w.Error != nil {
+			return errors.New(w.Error.Message)
+		}
+		if w.Result.Canceled {
+			return errors.New("watch canceled")
+		}
+		if len(w.Result.Events) > 0 {
+			return nil
+		}
+	}
+}
+
+// call posts the JSON encoded req to path and decodes the response into resp.
+func (s *etcdSource) call(ctx context.Context, token, path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, etcdRequestTimeout)
+	defer cancel()
+
+	r, err := s.post(ctx, token, path, body)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Body.Close() }()
+
+	err = json.NewDecoder(r.Body).Decode(resp)
+	if err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+func (s *etcdSource) post(ctx context.Context, token, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint().JoinPath(path).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status '%s'", resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *etcdSource) endpoint() *url.URL {
+	return s.endpoints[s.current]
+}
+
+// prefixRangeEnd returns the end of the range which covers all keys starting
+// with prefix.
+func prefixRangeEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// the prefix consists of 0xff only, range to the end of the keyspace
+	return []byte{0}
+}
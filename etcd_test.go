@@ -0,0 +1,155 @@
+package harald
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd implements the parts of the etcd JSON gateway used by etcdSource.
+type fakeEtcd struct {
+	mu       sync.Mutex
+	revision int64
+	kvs      map[string]string
+	changed  chan struct{}
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{kvs: map[string]string{}, changed: make(chan struct{})}
+}
+
+func (e *fakeEtcd) put(key, value string) {
+	e.mu.Lock()
+	e.kvs[key] = value
+	e.revision++
+	close(e.changed)
+	e.changed = make(chan struct{})
+	e.mu.Unlock()
+}
+
+func (e *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v3/auth/authenticate":
+		_, _ = w.Write([]byte(`{"token": "token"}`))
+	case "/v3/kv/range":
+		if r.Header.Get("Authorization") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		var kvs []etcdKeyValue
+		for k, v := range e.kvs {
+			kvs = append(kvs, etcdKeyValue{Key: []byte(k), Value: []byte(v)})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"header": map[string]string{"revision": fmt.Sprint(e.revision)},
+			"kvs":    kvs,
+		})
+	case "/v3/watch":
+		var req struct {
+			CreateRequest struct {
+				StartRevision int64 `json:"start_revision"`
+			} `json:"create_request"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		e.mu.Lock()
+		changed := e.changed
+		if e.revision >= req.CreateRequest.StartRevision {
+			// changes since the requested revision are reported right away
+			changed = make(chan struct{})
+			close(changed)
+		}
+		e.mu.Unlock()
+		_, _ = w.Write([]byte(`{"result": {"header": {"revision": "1"}, "created": true}}`))
+		w.(http.Flusher).Flush()
+		select {
+		case <-changed:
+			_, _ = w.Write([]byte(`{"result": {"header": {"revision": "2"}, "events": [{}]}}`))
+		case <-r.Context().Done():
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestEtcdSource(t *testing.T) {
+	e := newFakeEtcd()
+	e.put("/harald/a", `{"listen": {"network": "tcp", "address": "127.0.0.1:0"}, "connect": {"network": "tcp", "address": "127.0.0.1:1"}}`)
+	e.put("/harald/broken", `{`)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	s, err := newEtcdSource(Etcd{
+		Endpoints: []string{srv.URL},
+		Prefix:    "/harald/",
+		Username:  "harald",
+		Password:  "secret",
+	}, testLogger())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := make(chan map[string]ForwardRule, 1)
+	go s.watch(ctx, func(rules map[string]ForwardRule) { updates <- rules })
+
+	next := func() map[string]ForwardRule {
+		t.Helper()
+		select {
+		case rules := <-updates:
+			return rules
+		case <-time.After(5 * time.Second):
+			t.Fatal("no update received")
+			return nil
+		}
+	}
+
+	rules := next()
+	if len(rules) != 1 || rules["a"].Connect.Address != "127.0.0.1:1" {
+		t.Fatalf("unexpected rules %v", rules)
+	}
+
+	e.put("/harald/b", `{"listen": {"network": "tcp", "address": "127.0.0.1:0"}, "connect": {"network": "tcp", "address": "127.0.0.1:2"}}`)
+
+	rules = next()
+	if len(rules) != 2 || rules["b"].Connect.Address != "127.0.0.1:2" {
+		t.Fatalf("unexpected rules %v", rules)
+	}
+
+	// a rule which becomes invalid keeps its previous version
+	e.put("/harald/b", `{"listen": `)
+
+	rules = next()
+	if len(rules) != 2 || rules["b"].Connect.Address != "127.0.0.1:2" {
+		t.Fatalf("expected the previous version of b; got = %v", rules)
+	}
+}
+
+func TestPrefixRangeEnd(t *testing.T) {
+	tests := []struct {
+		prefix []byte
+		want   []byte
+	}{
+		{[]byte("/harald/"), []byte("/harald0")},
+		{[]byte{'a', 0xff}, []byte{'b'}},
+		{[]byte{0xff}, []byte{0}},
+	}
+	for _, tt := range tests {
+		if got := prefixRangeEnd(tt.prefix); !bytes.Equal(got, tt.want) {
+			t.Errorf("prefix %s: want = %s; got = %s",
+				base64.StdEncoding.EncodeToString(tt.prefix),
+				base64.StdEncoding.EncodeToString(tt.want),
+				base64.StdEncoding.EncodeToString(got))
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package harald
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of the events which are not changes recorded in the audit log, those
+// use the name of the action as their type (e.g. config.reload).
+const (
+	EventConnectionOpen  = "connection.open"
+	EventConnectionClose = "connection.close"
+	// EventUpstreams is sent when a rule receives a new set of upstreams
+	// from its discovery source.
+	EventUpstreams = "upstreams.update"
+	// EventRuleDrained is sent once the last connection of a rule which is
+	// draining has been closed.
+	EventRuleDrained = "rule.drained"
+)
+
+// Event is streamed by the events command of the admin socket. Only the
+// fields relevant to the type are set.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Rule     string    `json:"rule,omitempty"`
+	ConnID   string    `json:"conn_id,omitempty"`
+	Source   string    `json:"source,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	// BytesIn, BytesOut and Duration are set once a connection is closed.
+	BytesIn  int64         `json:"bytes_in,omitempty"`
+	BytesOut int64         `json:"bytes_out,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	// Upstreams is the number of upstreams after an update.
+	Upstreams int `json:"upstreams,omitempty"`
+	// Trigger, Old and New describe a change like in the audit log.
+	Trigger string `json:"trigger,omitempty"`
+	Old     string `json:"old,omitempty"`
+	New     string `json:"new,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// eventBufferSize is the number of events buffered for each subscriber,
+// events are dropped for subscribers which fall further behind.
+const eventBufferSize = 256
+
+// eventBus distributes events to all subscribers. A nil *eventBus discards
+// them.
+type eventBus struct {
+	// n is the number of subscribers, it keeps publishing cheap while
+	// nobody is listening.
+	n    atomic.Int64
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[chan Event]struct{})}
+}
+
+// subscribe returns a channel receiving all events published until the
+// returned function is called.
+func (b *eventBus) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.n.Add(1)
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.n.Add(-1)
+		b.mu.Unlock()
+	}
+}
+
+// publish sends the event to all subscribers without waiting for them.
+func (b *eventBus) publish(e Event) {
+	if b == nil || b.n.Load() == 0 {
+		return
+	}
+	e.Time = time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package harald
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	// networkExec is the connect network of rules which spawn a process for
+	// each connection and forward it to its stdin and stdout, like inetd.
+	networkExec = "exec"
+
+	// execGracePeriod is how long a process may keep running once its client
+	// is gone, before it is killed.
+	execGracePeriod = time.Second
+)
+
+// Exec configures the process spawned for each connection of a rule with the
+// connect network exec. Besides Env the processes get the details of the
+// connection in the environment, the variables follow the UCSPI conventions:
+// PROTO, TCPREMOTEIP, TCPREMOTEPORT, TCPLOCALIP and TCPLOCALPORT. Additionally
+// HARALD_RULE, HARALD_CONN_ID and, if the rule terminates TLS,
+// HARALD_SERVER_NAME and HARALD_CLIENT_SUBJECT are set.
+type Exec struct {
+	// Command is the executable and its arguments.
+	Command []string `json:"command" yaml:"command" toml:"command"`
+	// Env is added to the environment of the processes, the environment of
+	// harald isn't passed on.
+	Env map[string]string `json:"env" yaml:"env" toml:"env"`
+	// MaxProcesses limits the number of processes running at the same time,
+	// further clients are rejected. Unlimited if zero.
+	MaxProcesses int `json:"max_processes" yaml:"max_processes" toml:"max_processes"`
+}
+
+func (e *Exec) validate(r ForwardRule) error {
+	switch {
+	case e == nil && r.Connect.Network == networkExec:
+		return fmt.Errorf("exec: the exec network requires exec")
+	case e == nil:
+		return nil
+	case r.Connect.Network != networkExec:
+		return fmt.Errorf("exec: requires the connect network exec")
+	case len(e.Command) == 0:
+		return fmt.Errorf("exec: command is required")
+	case e.MaxProcesses < 0:
+		return fmt.Errorf("exec: max_processes must not be negative")
+	case r.StartTLS != "" || r.Routing != nil || r.HTTPConnect != nil:
+		return fmt.Errorf("exec: can't be combined with starttls, routing or http_connect")
+	}
+	return nil
+}
+
+// execUpstream spawns the processes of a rule.
+type execUpstream struct {
+	conf Exec
+	// slots limits the number of running processes, nil if unlimited.
+	slots chan struct{}
+	log   *slog.Logger
+}
+
+func newExecUpstream(conf *Exec, log *slog.Logger) *execUpstream {
+	if conf == nil {
+		return nil
+	}
+	e := &execUpstream{conf: *conf, log: log}
+	if conf.MaxProcesses > 0 {
+		e.slots = make(chan struct{}, conf.MaxProcesses)
+	}
+	return e
+}
+
+// spawn starts the process for the connection of a client and returns the
+// end of an in-memory connection to its stdin and stdout. stderr is passed on
+// to the one of harald.
+func (e *execUpstream) spawn(rule, id string, source net.Conn, serverName string, state *tls.ConnectionState) (*upstreamConn, error) {
+	if e.slots != nil {
+		select {
+		case e.slots <- struct{}{}:
+		default:
+			return nil, withKind(ErrDial, fmt.Errorf("exec: %d processes are running already", cap(e.slots)))
+		}
+	}
+	release := func() {
+		if e.slots != nil {
+			<-e.slots
+		}
+	}
+
+	cmd := exec.Command(e.conf.Command[0], e.conf.Command[1:]...)
+	cmd.Env = e.env(rule, id, source, serverName, state)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		release()
+		return nil, withKind(ErrDial, fmt.Errorf("exec: %w", err))
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		release()
+		return nil, withKind(ErrDial, fmt.Errorf("exec: %w", err))
+	}
+	err = cmd.Start()
+	if err != nil {
+		release()
+		return nil, withKind(ErrDial, fmt.Errorf("exec: %w", err))
+	}
+
+	c, process := net.Pipe()
+	exited := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(stdin, process)
+		_ = stdin.Close()
+		// the client is gone, the process gets a moment to exit on its own
+		t := time.NewTimer(execGracePeriod)
+		defer t.Stop()
+		select {
+		case <-exited:
+		case <-t.C:
+			_ = cmd.Process.Kill()
+		}
+	}()
+	go func() {
+		defer release()
+		_, _ = io.Copy(process, stdout)
+		_ = process.Close()
+		err := cmd.Wait()
+		close(exited)
+		if err != nil {
+			e.log.Debug("process exited", attrConnId(id), attrError(err))
+		}
+	}()
+
+	return &upstreamConn{Conn: c, upstream: &upstream{NetConf: NetConf{Network: networkExec, Address: e.conf.Command[0]}}}, nil
+}
+
+// env returns the environment of the process for the connection.
+func (e *execUpstream) env(rule, id string, source net.Conn, serverName string, state *tls.ConnectionState) []string {
+	env := make([]string, 0, len(e.conf.Env)+9)
+	for k, v := range e.conf.Env {
+		env = append(env, k+"="+v)
+	}
+	env = append(env, "PROTO=TCP", "HARALD_RULE="+rule, "HARALD_CONN_ID="+id)
+	if a, ok := source.RemoteAddr().(*net.TCPAddr); ok {
+		env = append(env, "TCPREMOTEIP="+a.AddrPort().Addr().Unmap().String(), "TCPREMOTEPORT="+strconv.Itoa(a.Port))
+	}
+	if a, ok := source.LocalAddr().(*net.TCPAddr); ok {
+		env = append(env, "TCPLOCALIP="+a.AddrPort().Addr().Unmap().String(), "TCPLOCALPORT="+strconv.Itoa(a.Port))
+	}
+	if serverName != "" {
+		env = append(env, "HARALD_SERVER_NAME="+serverName)
+	}
+	if state != nil && len(state.PeerCertificates) > 0 {
+		env = append(env, "HARALD_CLIENT_SUBJECT="+state.PeerCertificates[0].Subject.String())
+	}
+	return env
+}
@@ -0,0 +1,89 @@
+//go:build unix
+
+package harald
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExecUpstream(t *testing.T) {
+	f, err := ForwardRule{
+		Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		Connect: NetConf{Network: networkExec},
+		Exec: &Exec{
+			Command:      []string{"/bin/sh", "-c", `echo "$GREETING $HARALD_RULE $TCPREMOTEIP"; exec cat`},
+			Env:          map[string]string{"GREETING": "hello"},
+			MaxProcesses: 1,
+		},
+	}.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	c, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(c)
+
+	line, err := r.ReadString('\n')
+	if err != nil || line != "hello test 127.0.0.1\n" {
+		t.Fatalf("unexpected greeting %q, %v", line, err)
+	}
+	_, _ = c.Write([]byte("ping"))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(r, b)
+	if err != nil || string(b) != "ping" {
+		t.Fatalf("want = ping; got = %q, %v", b, err)
+	}
+
+	// the only process is taken by the first client
+	second, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer second.Close()
+	_ = second.SetDeadline(time.Now().Add(2 * time.Second))
+	n, err := second.Read(make([]byte, 1))
+	if n != 0 || err == nil {
+		t.Errorf("expected the second client to be rejected; got = %d, %v", n, err)
+	}
+}
+
+func TestExecValidate(t *testing.T) {
+	tests := map[string]ForwardRule{
+		"missing exec": {
+			Connect: NetConf{Network: networkExec},
+		},
+		"missing network": {
+			Connect: NetConf{Network: "tcp", Address: "127.0.0.1:8080"},
+			Exec:    &Exec{Command: []string{"/bin/cat"}},
+		},
+		"missing command": {
+			Connect: NetConf{Network: networkExec},
+			Exec:    &Exec{},
+		},
+		"starttls": {
+			Connect:  NetConf{Network: networkExec},
+			Exec:     &Exec{Command: []string{"/bin/cat"}},
+			StartTLS: StartTLSSMTP,
+		},
+	}
+	for name, r := range tests {
+		err := r.Exec.validate(r)
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
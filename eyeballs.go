@@ -0,0 +1,143 @@
+package harald
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// defaultHappyEyeballsDelay is the head start of each connection attempt
+// before the next address is tried in parallel, the Connection Attempt Delay
+// recommended by RFC 8305.
+const defaultHappyEyeballsDelay = 250 * time.Millisecond
+
+// lookupFunc resolves a hostname to its addresses like
+// net.Resolver.LookupNetIP.
+type lookupFunc func(ctx context.Context, network, host string) ([]netip.Addr, error)
+
+// dialHappyEyeballs connects to the first address of the host which accepts
+// the connection (RFC 8305). The addresses of both families are tried
+// alternately, starting with the preferred family ("ipv4" or "ipv6") or the
+// family of the first address returned by the resolver. Each attempt gets a
+// head start of delay before the next one is started in parallel, a failed
+// attempt starts the next one right away. Broken paths of one family thereby
+// only add the delay instead of the timeout of the connection.
+func dialHappyEyeballs(ctx context.Context, d net.Dialer, lookup lookupFunc, network, address, prefer string, delay time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = netip.ParseAddr(host); err == nil {
+		return d.DialContext(ctx, network, address)
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+		d.Timeout = 0
+	}
+
+	family := "ip"
+	switch network {
+	case "tcp4":
+		family = "ip4"
+	case "tcp6":
+		family = "ip6"
+	}
+	addrs, err := lookup(ctx, family, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs = slices.DeleteFunc(addrs, func(a netip.Addr) bool {
+		return family == "ip4" && !a.Unmap().Is4() || family == "ip6" && a.Unmap().Is4()
+	})
+	addrs = interleaveFamilies(addrs, prefer)
+	if len(addrs) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result)
+	attempt := func(addr netip.Addr) {
+		c, err := d.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		select {
+		case results <- result{c, err}:
+		case <-ctx.Done():
+			// another attempt won
+			if c != nil {
+				_ = c.Close()
+			}
+		}
+	}
+
+	next, pending := 0, 0
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var errs []error
+	for {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				go attempt(addrs[next])
+				next++
+				pending++
+				timer.Reset(delay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.c, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(addrs) {
+				// don't wait for the head start of a failed attempt
+				timer.Reset(0)
+			} else if pending == 0 {
+				return nil, errors.Join(errs...)
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("dial %s %s: %w", network, address, errors.Join(append(errs, ctx.Err())...))
+		}
+	}
+}
+
+// interleaveFamilies orders the addresses alternating between the families,
+// starting with the preferred one. The order within a family is kept.
+func interleaveFamilies(addrs []netip.Addr, prefer string) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, a := range addrs {
+		if a.Unmap().Is4() {
+			v4 = append(v4, a.Unmap())
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+
+	first, second := v6, v4
+	switch {
+	case prefer == "ipv4", prefer == "" && len(addrs) > 0 && addrs[0].Unmap().Is4():
+		first, second = v4, v6
+	}
+
+	res := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			res = append(res, first[i])
+		}
+		if i < len(second) {
+			res = append(res, second[i])
+		}
+	}
+	return res
+}
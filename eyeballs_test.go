@@ -0,0 +1,73 @@
+package harald
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	a := netip.MustParseAddr
+	addrs := []netip.Addr{a("::1"), a("::2"), a("::3"), a("127.0.0.1"), a("127.0.0.2")}
+
+	tests := []struct {
+		prefer string
+		addrs  []netip.Addr
+		expect []netip.Addr
+	}{
+		{"", addrs, []netip.Addr{a("::1"), a("127.0.0.1"), a("::2"), a("127.0.0.2"), a("::3")}},
+		{"ipv4", addrs, []netip.Addr{a("127.0.0.1"), a("::1"), a("127.0.0.2"), a("::2"), a("::3")}},
+		{"", []netip.Addr{a("::ffff:127.0.0.1"), a("::1")}, []netip.Addr{a("127.0.0.1"), a("::1")}},
+	}
+	for _, test := range tests {
+		if got := interleaveFamilies(test.addrs, test.prefer); !slices.Equal(got, test.expect) {
+			t.Errorf("prefer %q: expected %v; got %v", test.prefer, test.expect, got)
+		}
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	lookup := func(context.Context, string, string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("::1"), netip.MustParseAddr("127.0.0.1")}, nil
+	}
+	// the IPv6 path is broken: its attempts hang until they are canceled
+	d := net.Dialer{Timeout: 5 * time.Second, Control: func(_, address string, _ syscall.RawConn) error {
+		if strings.HasPrefix(address, "[::1]") {
+			time.Sleep(time.Second)
+		}
+		return nil
+	}}
+
+	start := time.Now()
+	c, err := dialHappyEyeballs(context.Background(), d, lookup, "tcp", net.JoinHostPort("upstream.test", port), "", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the IPv4 attempt to succeed after the head start; took %s", elapsed)
+	}
+	if ip := c.RemoteAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expected a connection to 127.0.0.1; got %s", ip)
+	}
+
+	lookup = func(context.Context, string, string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("::1")}, nil
+	}
+	_, err = dialHappyEyeballs(context.Background(), net.Dialer{}, lookup, "tcp4", net.JoinHostPort("upstream.test", port), "", 0)
+	if err == nil {
+		t.Fatal("expected error without an address of the network")
+	}
+}
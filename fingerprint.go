@@ -0,0 +1,493 @@
+package harald
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// clientHelloTimeout limits how long we wait for a client to send its
+	// ClientHello.
+	clientHelloTimeout = 10 * time.Second
+	// maxClientHelloSize limits how much data we buffer for a single
+	// ClientHello, real clients stay well below this.
+	maxClientHelloSize = 1 << 16
+
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+
+	extServerName          = 0x0000
+	extSupportedGroups     = 0x000a
+	extECPointFormats      = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+)
+
+// clientHello holds the fields of a TLS ClientHello which are relevant to
+// fingerprint a client. All lists are in the order sent by the client.
+type clientHello struct {
+	version    uint16
+	ciphers    []uint16
+	extensions []uint16
+	curves     []uint16
+	points     []uint8
+	sigAlgs    []uint16
+	versions   []uint16
+	serverName string
+	alpn       []string
+}
+
+// peekClientHello reads the ClientHello from c without consuming it. The
+// returned connection replays the data read so far and can be passed on to
+// tls.Server.
+func peekClientHello(c net.Conn) (net.Conn, *clientHello, error) {
+	_ = c.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	defer func() { _ = c.SetReadDeadline(time.Time{}) }()
+
+	var raw bytes.Buffer
+	r := io.TeeReader(c, &raw)
+	replay := func() net.Conn { return &prefixConn{Conn: c, prefix: raw.Bytes()} }
+
+	// A handshake message may span multiple records, so we collect the
+	// payload of records until the message is complete.
+	var msg []byte
+	for len(msg) < 4 || len(msg) < 4+int(uint32(msg[1])<<16|uint32(msg[2])<<8|uint32(msg[3])) {
+		var header [5]byte
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			return replay(), nil, fmt.Errorf("read client hello: %w", err)
+		}
+		if header[0] != recordTypeHandshake {
+			return replay(), nil, fmt.Errorf("read client hello: unexpected record type %d", header[0])
+		}
+
+		n := int(binary.BigEndian.Uint16(header[3:]))
+		if raw.Len()+n > maxClientHelloSize {
+			return replay(), nil, fmt.Errorf("read client hello: message too large")
+		}
+
+		payload := make([]byte, n)
+		_, err = io.ReadFull(r, payload)
+		if err != nil {
+			return replay(), nil, fmt.Errorf("read client hello: %w", err)
+		}
+		msg = append(msg, payload...)
+	}
+
+	hello, err := parseClientHello(msg)
+	if err != nil {
+		return replay(), nil, fmt.Errorf("parse client hello: %w", err)
+	}
+
+	return replay(), hello, nil
+}
+
+// parseClientHello parses a handshake message containing a ClientHello as
+// described in RFC 8446, section 4.1.2.
+func parseClientHello(msg []byte) (*clientHello, error) {
+	s := cryptoString(msg)
+
+	var typ uint8
+	var body cryptoString
+	if !s.readUint8(&typ) || typ != handshakeTypeClientHello {
+		return nil, errors.New("not a client hello")
+	}
+	if !s.readUint24Prefixed(&body) {
+		return nil, errors.New("truncated message")
+	}
+
+	var h clientHello
+	var random, sessionId, compression, ciphers cryptoString
+	if !body.readUint16(&h.version) ||
+		!body.readBytes(&random, 32) ||
+		!body.readUint8Prefixed(&sessionId) ||
+		!body.readUint16Prefixed(&ciphers) ||
+		!body.readUint8Prefixed(&compression) {
+		return nil, errors.New("malformed client hello")
+	}
+
+	for len(ciphers) > 0 {
+		var c uint16
+		if !ciphers.readUint16(&c) {
+			return nil, errors.New("malformed cipher suites")
+		}
+		h.ciphers = append(h.ciphers, c)
+	}
+
+	if len(body) == 0 {
+		// extensions are optional
+		return &h, nil
+	}
+
+	var exts cryptoString
+	if !body.readUint16Prefixed(&exts) {
+		return nil, errors.New("malformed extensions")
+	}
+
+	for len(exts) > 0 {
+		var typ uint16
+		var data cryptoString
+		if !exts.readUint16(&typ) || !exts.readUint16Prefixed(&data) {
+			return nil, errors.New("malformed extensions")
+		}
+		h.extensions = append(h.extensions, typ)
+
+		var err error
+		switch typ {
+		case extServerName:
+			err = parseServerName(data, &h)
+		case extSupportedGroups:
+			h.curves, err = parseUint16List(data)
+		case extECPointFormats:
+			var points cryptoString
+			if !data.readUint8Prefixed(&points) {
+				err = errors.New("malformed ec point formats")
+			}
+			h.points = points
+		case extSignatureAlgorithms:
+			h.sigAlgs, err = parseUint16List(data)
+		case extALPN:
+			err = parseALPN(data, &h)
+		case extSupportedVersions:
+			var versions cryptoString
+			if !data.readUint8Prefixed(&versions) {
+				err = errors.New("malformed supported versions")
+				break
+			}
+			for len(versions) > 0 {
+				var v uint16
+				if !versions.readUint16(&v) {
+					err = errors.New("malformed supported versions")
+					break
+				}
+				h.versions = append(h.versions, v)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &h, nil
+}
+
+func parseServerName(data cryptoString, h *clientHello) error {
+	var list cryptoString
+	if !data.readUint16Prefixed(&list) {
+		return errors.New("malformed server name")
+	}
+	for len(list) > 0 {
+		var typ uint8
+		var name cryptoString
+		if !list.readUint8(&typ) || !list.readUint16Prefixed(&name) {
+			return errors.New("malformed server name")
+		}
+		if typ == 0 {
+			h.serverName = string(name)
+		}
+	}
+	return nil
+}
+
+func parseALPN(data cryptoString, h *clientHello) error {
+	var list cryptoString
+	if !data.readUint16Prefixed(&list) {
+		return errors.New("malformed alpn")
+	}
+	for len(list) > 0 {
+		var proto cryptoString
+		if !list.readUint8Prefixed(&proto) {
+			return errors.New("malformed alpn")
+		}
+		h.alpn = append(h.alpn, string(proto))
+	}
+	return nil
+}
+
+func parseUint16List(data cryptoString) ([]uint16, error) {
+	var list cryptoString
+	if !data.readUint16Prefixed(&list) {
+		return nil, errors.New("malformed list")
+	}
+	var values []uint16
+	for len(list) > 0 {
+		var v uint16
+		if !list.readUint16(&v) {
+			return nil, errors.New("malformed list")
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// isGREASE reports whether v is one of the reserved values from RFC 8701
+// which clients send to prevent ossification. They are ignored for
+// fingerprinting because they are chosen randomly.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	var res []uint16
+	for _, v := range values {
+		if !isGREASE(v) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// ja3String returns the unhashed JA3 fingerprint of the client hello.
+// See https://github.com/salesforce/ja3 for details.
+func (h *clientHello) ja3String() string {
+	join := func(values []uint16) string {
+		s := make([]string, len(values))
+		for i, v := range values {
+			s[i] = strconv.Itoa(int(v))
+		}
+		return strings.Join(s, "-")
+	}
+
+	points := make([]string, len(h.points))
+	for i, p := range h.points {
+		points[i] = strconv.Itoa(int(p))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		join(withoutGREASE(h.ciphers)),
+		join(withoutGREASE(h.extensions)),
+		join(withoutGREASE(h.curves)),
+		strings.Join(points, "-"),
+	}, ",")
+}
+
+// ja3 returns the JA3 fingerprint of the client hello.
+func (h *clientHello) ja3() string {
+	sum := md5.Sum([]byte(h.ja3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 returns the JA4 fingerprint of the client hello. See
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md for
+// details.
+func (h *clientHello) ja4() string {
+	version := h.version
+	if versions := withoutGREASE(h.versions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+
+	sni := "i"
+	if slices.Contains(h.extensions, extServerName) {
+		sni = "d"
+	}
+
+	alpn := "00"
+	if len(h.alpn) > 0 && len(h.alpn[0]) > 0 {
+		first, last := h.alpn[0][0], h.alpn[0][len(h.alpn[0])-1]
+		if isAlphanumeric(first) && isAlphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			encoded := hex.EncodeToString([]byte(h.alpn[0]))
+			alpn = encoded[:1] + encoded[len(encoded)-1:]
+		}
+	}
+
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s",
+		ja4Version(version), sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	slices.Sort(ciphers)
+	b := ja4Hash(hexList(ciphers))
+
+	extensions = slices.DeleteFunc(extensions, func(e uint16) bool {
+		return e == extServerName || e == extALPN
+	})
+	slices.Sort(extensions)
+	c := "000000000000"
+	if len(extensions) > 0 {
+		in := hexList(extensions)
+		if len(h.sigAlgs) > 0 {
+			in += "_" + hexList(h.sigAlgs)
+		}
+		c = ja4Hash(in)
+	}
+
+	return a + "_" + b + "_" + c
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	case 0xfeff:
+		return "d1"
+	case 0xfefd:
+		return "d2"
+	case 0xfefc:
+		return "d3"
+	default:
+		return "00"
+	}
+}
+
+// ja4Hash returns the truncated hash used for the b and c sections of JA4.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func hexList(values []uint16) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(s, ",")
+}
+
+func isAlphanumeric(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
+
+// allowsFingerprint checks the JA3 and JA4 fingerprint of the client hello
+// against the allow and deny lists of the TLS config. If an allow list is
+// configured, one of the fingerprints must be on it.
+func (t *TLS) allowsFingerprint(h *clientHello) bool {
+	if t == nil {
+		return true
+	}
+
+	ja3, ja4 := h.ja3(), h.ja4()
+	matches := func(list []string) bool {
+		return slices.Contains(list, ja3) || slices.Contains(list, ja4)
+	}
+
+	if matches(t.DenyFingerprints) {
+		return false
+	}
+	if len(t.AllowFingerprints) > 0 && !matches(t.AllowFingerprints) {
+		return false
+	}
+	return true
+}
+
+// allowsServerName checks the server name requested by the client against
+// RequireSNI and AllowServerNames of the TLS config.
+func (t *TLS) allowsServerName(serverName string) bool {
+	if t == nil {
+		return true
+	}
+	if serverName == "" {
+		return !t.RequireSNI && len(t.AllowServerNames) == 0
+	}
+	return len(t.AllowServerNames) == 0 || matchServerName(t.AllowServerNames, serverName)
+}
+
+// prefixConn is a net.Conn which returns the prefix before reading from the
+// underlying connection.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection.
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// cryptoString is a minimal reader for the length-prefixed encoding used by
+// TLS, inspired by golang.org/x/crypto/cryptobyte.
+type cryptoString []byte
+
+func (s *cryptoString) read(n int) []byte {
+	if len(*s) < n || n < 0 {
+		return nil
+	}
+	v := (*s)[:n:n]
+	*s = (*s)[n:]
+	return v
+}
+
+func (s *cryptoString) readUint8(out *uint8) bool {
+	v := s.read(1)
+	if v == nil {
+		return false
+	}
+	*out = v[0]
+	return true
+}
+
+func (s *cryptoString) readUint16(out *uint16) bool {
+	v := s.read(2)
+	if v == nil {
+		return false
+	}
+	*out = binary.BigEndian.Uint16(v)
+	return true
+}
+
+func (s *cryptoString) readBytes(out *cryptoString, n int) bool {
+	v := s.read(n)
+	if v == nil {
+		return false
+	}
+	*out = v
+	return true
+}
+
+func (s *cryptoString) readUint8Prefixed(out *cryptoString) bool {
+	var n uint8
+	return s.readUint8(&n) && s.readBytes(out, int(n))
+}
+
+func (s *cryptoString) readUint16Prefixed(out *cryptoString) bool {
+	var n uint16
+	return s.readUint16(&n) && s.readBytes(out, int(n))
+}
+
+func (s *cryptoString) readUint24Prefixed(out *cryptoString) bool {
+	v := s.read(3)
+	if v == nil {
+		return false
+	}
+	return s.readBytes(out, int(v[0])<<16|int(v[1])<<8|int(v[2]))
+}
@@ -0,0 +1,198 @@
+package harald
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+// testClientHello returns a handshake message containing a ClientHello with
+// GREASE values in all places where they are commonly sent.
+func testClientHello() []byte {
+	u16 := func(v ...uint16) []byte {
+		b := make([]byte, 0, 2*len(v))
+		for _, x := range v {
+			b = binary.BigEndian.AppendUint16(b, x)
+		}
+		return b
+	}
+	prefixed16 := func(b []byte) []byte { return append(u16(uint16(len(b))), b...) }
+	prefixed8 := func(b []byte) []byte { return append([]byte{byte(len(b))}, b...) }
+	ext := func(typ uint16, data []byte) []byte { return append(u16(typ), prefixed16(data)...) }
+
+	var exts []byte
+	exts = append(exts, ext(extServerName, prefixed16(append([]byte{0}, prefixed16([]byte("example.com"))...)))...)
+	exts = append(exts, ext(extSupportedGroups, prefixed16(u16(0x1a1a, 0x001d, 0x0017)))...)
+	exts = append(exts, ext(extECPointFormats, prefixed8([]byte{0}))...)
+	exts = append(exts, ext(extSignatureAlgorithms, prefixed16(u16(0x0403, 0x0804)))...)
+	exts = append(exts, ext(extALPN, prefixed16(append(prefixed8([]byte("h2")), prefixed8([]byte("http/1.1"))...)))...)
+	exts = append(exts, ext(extSupportedVersions, prefixed8(u16(0x2a2a, 0x0304, 0x0303)))...)
+
+	var body []byte
+	body = append(body, u16(0x0303)...)
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, prefixed8(nil)...)   // session id
+	body = append(body, prefixed16(u16(0x0a0a, 0x1301, 0xc02b))...)
+	body = append(body, prefixed8([]byte{0})...) // compression
+	body = append(body, prefixed16(exts)...)
+
+	return append([]byte{handshakeTypeClientHello, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func TestParseClientHello(t *testing.T) {
+	h, err := parseClientHello(testClientHello())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if h.serverName != "example.com" {
+		t.Errorf("serverName: want = example.com; got = %s", h.serverName)
+	}
+
+	wantJA3 := "771,4865-49195,0-10-11-13-16-43,29-23,0"
+	if got := h.ja3String(); got != wantJA3 {
+		t.Errorf("ja3String(): want = %s; got = %s", wantJA3, got)
+	}
+
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])[:12]
+	}
+	wantJA4 := "t13d0206h2_" + hash("1301,c02b") + "_" + hash("000a,000b,000d,002b_0403,0804")
+	if got := h.ja4(); got != wantJA4 {
+		t.Errorf("ja4(): want = %s; got = %s", wantJA4, got)
+	}
+}
+
+func TestParseClientHelloTruncated(t *testing.T) {
+	msg := testClientHello()
+	for _, n := range []int{0, 4, 10, len(msg) - 1} {
+		_, err := parseClientHello(msg[:n])
+		if err == nil {
+			t.Errorf("expected error for message truncated to %d bytes", n)
+		}
+	}
+}
+
+func TestFingerprintAllowList(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+
+	r := ForwardRule{
+		Listen: NetConf{
+			Network: "tcp",
+			Address: "127.0.0.1:0",
+		},
+		Connect: NetConf{
+			Network: "tcp",
+			Address: haraldtest.EchoChamber(t),
+		},
+		TLS: &TLS{
+			Certificate:       string(crt),
+			Key:               string(key),
+			AllowFingerprints: []string{"t13d0000h2_000000000000_000000000000"},
+		},
+	}
+
+	forwarder, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = forwarder.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer forwarder.Stop()
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: time.Second},
+		Config:    &tls.Config{InsecureSkipVerify: true},
+	}
+
+	conn, err := dialer.Dial("tcp", forwarder.Addr().String())
+	if err == nil {
+		_ = conn.Close()
+		t.Fatal("expected client to be rejected")
+	}
+}
+
+func TestAllowsServerName(t *testing.T) {
+	tests := []struct {
+		tls        *TLS
+		serverName string
+		allowed    bool
+	}{
+		{nil, "", true},
+		{&TLS{}, "", true},
+		{&TLS{RequireSNI: true}, "", false},
+		{&TLS{RequireSNI: true}, "example.com", true},
+		{&TLS{AllowServerNames: []string{"example.com"}}, "", false},
+		{&TLS{AllowServerNames: []string{"example.com"}}, "Example.com.", true},
+		{&TLS{AllowServerNames: []string{"*.example.com"}}, "a.example.com", true},
+		{&TLS{AllowServerNames: []string{"*.example.com"}}, "example.com", false},
+		{&TLS{AllowServerNames: []string{"example.com"}}, "example.org", false},
+	}
+	for _, tt := range tests {
+		if got := tt.tls.allowsServerName(tt.serverName); got != tt.allowed {
+			t.Errorf("allowsServerName(%q) with %+v = %t, expected %t", tt.serverName, tt.tls, got, tt.allowed)
+		}
+	}
+}
+
+func TestRequireSNI(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+
+	r := ForwardRule{
+		Listen: NetConf{
+			Network: "tcp",
+			Address: "127.0.0.1:0",
+		},
+		Connect: NetConf{
+			Network: "tcp",
+			Address: haraldtest.EchoChamber(t),
+		},
+		TLS: &TLS{
+			Certificate:      string(crt),
+			Key:              string(key),
+			AllowServerNames: []string{"localhost"},
+		},
+	}
+
+	forwarder, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = forwarder.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer forwarder.Stop()
+
+	// no SNI is sent for IP addresses
+	for serverName, accepted := range map[string]bool{"": false, "example.com": false, "localhost": true} {
+		dialer := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: time.Second},
+			Config:    &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		}
+
+		conn, err := dialer.Dial("tcp", forwarder.Addr().String())
+		if accepted && err != nil {
+			t.Errorf("server name %q: expected client to be accepted: %s", serverName, err)
+		}
+		if !accepted && err == nil {
+			t.Errorf("server name %q: expected client to be rejected", serverName)
+		}
+		if err == nil {
+			_ = conn.Close()
+		}
+	}
+}
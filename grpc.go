@@ -0,0 +1,483 @@
+//go:build unix
+
+package harald
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminGRPC serves the admin commands as the gRPC service harald.admin.v1.Admin
+// described by admin.proto. Clients have to present a certificate issued by
+// one of the client CAs of TLS.
+type AdminGRPC struct {
+	Listen NetConf `json:"listen" yaml:"listen" toml:"listen"`
+	TLS    *TLS    `json:"tls" yaml:"tls" toml:"tls"`
+}
+
+// config returns the TLS config of the listener, client certificates are
+// always required.
+func (c *AdminGRPC) config() (*tls.Config, error) {
+	if c.TLS == nil || c.TLS.ClientCAs == "" {
+		return nil, fmt.Errorf("admin grpc: tls with client_cas is required")
+	}
+	if c.TLS.Source != nil || len(c.TLS.ClientAuthPolicies) > 0 {
+		return nil, fmt.Errorf("admin grpc: certificate sources and client auth policies are not supported")
+	}
+	conf, err := c.TLS.Config()
+	if err != nil {
+		return nil, fmt.Errorf("admin grpc: %w", err)
+	}
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+	conf.NextProtos = []string{"h2"}
+	return conf, nil
+}
+
+// Status codes of gRPC, see
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcOK               = 0
+	grpcUnknown          = 2
+	grpcInvalidArgument  = 3
+	grpcNotFound         = 5
+	grpcPermissionDenied = 7
+	grpcResourceExceeded = 8
+	grpcUnimplemented    = 12
+)
+
+const (
+	// grpcService is the prefix of the paths of all methods.
+	grpcService = "/harald.admin.v1.Admin/"
+	// grpcMaxMessage limits the size of request messages.
+	grpcMaxMessage = 1 << 20
+	// grpcStatsInterval is the default interval of StreamStats.
+	grpcStatsInterval = time.Second
+	// grpcMinStatsInterval is the shortest interval of StreamStats.
+	grpcMinStatsInterval = 100 * time.Millisecond
+)
+
+// grpcError is returned by methods to set the status of the call.
+type grpcError struct {
+	code int
+	err  error
+}
+
+func (e *grpcError) Error() string {
+	return e.err.Error()
+}
+
+func (e *grpcError) Unwrap() error {
+	return e.err
+}
+
+// grpcCall is a single call of a method.
+type grpcCall struct {
+	ctx context.Context
+	// request is the encoded request message.
+	request []byte
+	// trigger describes the client for the audit log.
+	trigger string
+	// tenant limits the client to the rules of the tenant, empty if the
+	// client may see all rules.
+	tenant string
+	// send writes a response message, unary methods call it exactly once.
+	send func(encode func(*pbBuffer)) error
+}
+
+// decode passes the fields of the request to field and turns errors into
+// the status invalid argument.
+func (c *grpcCall) decode(field func(num, wireType int, v uint64, data []byte) error) error {
+	err := decodeProtobuf(c.request, field)
+	if err != nil {
+		return &grpcError{code: grpcInvalidArgument, err: err}
+	}
+	return nil
+}
+
+// visible returns an error unless the client may see the rule. Rules of other
+// tenants are reported as unknown to not reveal their existence.
+func (c *grpcCall) visible(s *Server, rule string) error {
+	if c.tenant == "" {
+		return nil
+	}
+	s.mu.Lock()
+	f := s.forwarder(rule)
+	s.mu.Unlock()
+	if f == nil || f.Tenant != c.tenant {
+		return withKind(ErrNotFound, fmt.Errorf("unknown rule '%s'", rule))
+	}
+	return nil
+}
+
+// string decodes the request as a message with a single string field.
+func (c *grpcCall) string() (string, error) {
+	var s string
+	err := c.decode(func(num, wireType int, _ uint64, data []byte) error {
+		if num == 1 && wireType == pbBytes {
+			s = string(data)
+		}
+		return nil
+	})
+	return s, err
+}
+
+type grpcMethod func(s *Server, c *grpcCall) error
+
+var grpcMethods = map[string]grpcMethod{
+	"Status":          grpcStatus,
+	"StartRule":       grpcStartRule,
+	"StopRule":        grpcStopRule,
+	"DrainRule":       grpcDrainRule,
+	"Reload":          grpcReload,
+	"ListConnections": grpcListConnections,
+	"KillConnection":  grpcKillConnection,
+	"StreamStats":     grpcStreamStats,
+}
+
+// listenGRPC opens the listener of the gRPC admin service.
+func (s *Server) listenGRPC(c NetConf) (*http.Server, error) {
+	l, err := net.Listen(c.Network, c.Address)
+	if err != nil {
+		return nil, withKind(ErrBind, fmt.Errorf("admin grpc: %w", err))
+	}
+
+	srv := &http.Server{
+		Handler:           http.HandlerFunc(s.handleGRPC),
+		TLSConfig:         s.grpcTLS,
+		ReadHeaderTimeout: adminTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+	}
+
+	go func() {
+		err := srv.ServeTLS(l, "", "")
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("admin grpc listener stopped", attrError(err))
+		}
+	}()
+
+	return srv, nil
+}
+
+func (s *Server) handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 {
+		http.Error(w, "grpc requires POST over HTTP/2", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && ct != "application/grpc+proto" {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	err := s.callGRPC(w, r)
+	code := grpcOK
+	if err != nil {
+		code = grpcUnknown
+		var gerr *grpcError
+		if errors.As(err, &gerr) {
+			code = gerr.code
+		} else if errors.Is(err, ErrNotFound) {
+			code = grpcNotFound
+		}
+		w.Header().Set("Grpc-Message", grpcEscape(err.Error()))
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+}
+
+// callGRPC reads the request message and runs the method. Methods changing
+// the state of the server are recorded in the audit log like the commands
+// of the admin socket.
+func (s *Server) callGRPC(w http.ResponseWriter, r *http.Request) error {
+	name, ok := strings.CutPrefix(r.URL.Path, grpcService)
+	method := grpcMethods[name]
+	if !ok || method == nil {
+		return &grpcError{code: grpcUnimplemented, err: fmt.Errorf("unknown method '%s'", r.URL.Path)}
+	}
+
+	request, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return err
+	}
+
+	call := &grpcCall{
+		ctx:     r.Context(),
+		request: request,
+		trigger: grpcTrigger(r),
+		tenant:  s.grpcTenant(r),
+		send: func(encode func(*pbBuffer)) error {
+			var m pbBuffer
+			encode(&m)
+			err := writeGRPCMessage(w, m)
+			if err != nil {
+				return err
+			}
+			http.NewResponseController(w).Flush()
+			return nil
+		},
+	}
+
+	slog.Debug("running admin grpc method", slog.String("method", name))
+	return method(s, call)
+}
+
+// grpcTrigger describes the client for the audit log by the subject of its
+// certificate.
+func grpcTrigger(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "grpc"
+	}
+	return "grpc (" + r.TLS.PeerCertificates[0].Subject.String() + ")"
+}
+
+// grpcTenant returns the tenant the client is limited to by the subject of its
+// certificate.
+func (s *Server) grpcTenant(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return s.adminTenants[r.TLS.PeerCertificates[0].Subject.String()]
+}
+
+// readGRPCMessage reads a single length-prefixed message.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, &grpcError{code: grpcInvalidArgument, err: fmt.Errorf("read request: %w", err)}
+	}
+	if hdr[0] != 0 {
+		return nil, &grpcError{code: grpcUnimplemented, err: fmt.Errorf("compressed messages are not supported")}
+	}
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if size > grpcMaxMessage {
+		return nil, &grpcError{code: grpcResourceExceeded, err: fmt.Errorf("request exceeds %d bytes", grpcMaxMessage)}
+	}
+	msg := make([]byte, size)
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, &grpcError{code: grpcInvalidArgument, err: fmt.Errorf("read request: %w", err)}
+	}
+	return msg, nil
+}
+
+// writeGRPCMessage writes a single uncompressed message.
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+// grpcEscape percent-encodes the message for the grpc-message trailer.
+func grpcEscape(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func grpcStatus(s *Server, c *grpcCall) error {
+	return c.send(s.statusEncoder(c.tenant))
+}
+
+func grpcStartRule(s *Server, c *grpcCall) error {
+	return grpcRuleCommand(s, c, "rule.start", s.startRule)
+}
+
+func grpcStopRule(s *Server, c *grpcCall) error {
+	return grpcRuleCommand(s, c, "rule.stop", s.stopRule)
+}
+
+func grpcDrainRule(s *Server, c *grpcCall) error {
+	return grpcRuleCommand(s, c, "rule.drain", s.drainRule)
+}
+
+// grpcRuleCommand runs command on the rule named by the request and responds
+// with the status of the rule.
+func grpcRuleCommand(s *Server, c *grpcCall, action string, command func(string) (*Forwarder, error)) error {
+	name, err := c.string()
+	if err != nil {
+		return err
+	}
+	err = c.visible(s, name)
+	if err != nil {
+		return err
+	}
+	var f *Forwarder
+	err = s.audited(action, c.trigger, s.ruleState(name), func() (err error) {
+		f, err = command(name)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return c.send(func(b *pbBuffer) { encodeRuleStatus(b, f.name, ruleStatus(f)) })
+}
+
+func grpcReload(s *Server, c *grpcCall) error {
+	if c.tenant != "" {
+		return &grpcError{code: grpcPermissionDenied, err: fmt.Errorf("clients of tenant %s can't reload the config", c.tenant)}
+	}
+	err := s.audited("config.reload", c.trigger, s.configState, s.reload)
+	if err != nil {
+		return err
+	}
+	return c.send(func(*pbBuffer) {})
+}
+
+func grpcListConnections(s *Server, c *grpcCall) error {
+	rule, err := c.string()
+	if err != nil {
+		return err
+	}
+	if rule != "" {
+		err = c.visible(s, rule)
+		if err != nil {
+			return err
+		}
+	}
+	conns, err := s.connections(rule)
+	if err != nil {
+		return err
+	}
+	return c.send(func(b *pbBuffer) {
+		for _, conn := range conns {
+			if rule == "" && c.visible(s, conn.Rule) != nil {
+				continue
+			}
+			b.message(1, func(b *pbBuffer) { encodeConnection(b, conn) })
+		}
+	})
+}
+
+func encodeConnection(b *pbBuffer, conn Connection) {
+	b.string(1, conn.ID)
+	b.string(2, conn.Rule)
+	b.string(3, conn.Source)
+	b.string(4, conn.Upstream)
+	b.int(5, conn.Since.UnixMilli())
+	b.string(6, conn.Stage)
+	b.int(7, conn.LastActivity.UnixMilli())
+}
+
+func grpcKillConnection(s *Server, c *grpcCall) error {
+	id, err := c.string()
+	if err != nil {
+		return err
+	}
+	if c.tenant != "" {
+		conns := s.conns.list("")
+		i := slices.IndexFunc(conns, func(conn Connection) bool { return conn.ID == id })
+		if i < 0 || c.visible(s, conns[i].Rule) != nil {
+			return withKind(ErrNotFound, fmt.Errorf("unknown connection '%s'", id))
+		}
+	}
+	err = s.audited("connection.kill", c.trigger, s.conns.state(id), func() error { return s.killConnection(id) })
+	if err != nil {
+		return err
+	}
+	return c.send(func(*pbBuffer) {})
+}
+
+// grpcStreamStats sends the status until the call is canceled, either by the
+// client or by the server shutting down.
+func grpcStreamStats(s *Server, c *grpcCall) error {
+	interval := grpcStatsInterval
+	err := c.decode(func(num, wireType int, v uint64, _ []byte) error {
+		if num == 1 && wireType == pbVarint && v > 0 {
+			interval = max(time.Duration(v)*time.Millisecond, grpcMinStatsInterval)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err = c.send(s.statusEncoder(c.tenant))
+		if err != nil {
+			return err
+		}
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// statusEncoder encodes a StatusResponse with the rules of the tenant, or all
+// rules if tenant is empty.
+func (s *Server) statusEncoder(tenant string) func(*pbBuffer) {
+	return func(b *pbBuffer) {
+		for _, f := range s.getForwarders() {
+			if tenant != "" && f.Tenant != tenant {
+				continue
+			}
+			b.message(1, func(b *pbBuffer) { encodeRuleStatus(b, f.name, ruleStatus(f)) })
+		}
+	}
+}
+
+func encodeRuleStatus(b *pbBuffer, name string, rs RuleStatus) {
+	b.string(1, name)
+	b.string(2, rs.Address)
+	b.bool(3, rs.Maintenance)
+	b.message(4, func(b *pbBuffer) {
+		st := rs.Stats
+		b.uint(1, st.TotalConnections)
+		b.int(2, st.ActiveConnections)
+		b.uint(3, st.BytesIn)
+		b.uint(4, st.BytesOut)
+		b.uint(5, st.DialErrors)
+		b.uint(6, st.Overflows)
+		b.uint(7, st.IdleReaped)
+		b.string(8, st.LastError)
+		b.int(9, st.Uptime.Milliseconds())
+		for _, u := range st.Upstreams {
+			b.message(10, func(b *pbBuffer) {
+				b.string(1, u.Network)
+				b.string(2, u.Address)
+				b.int(3, u.ActiveConnections)
+				b.uint(4, u.TotalConnections)
+				b.uint(5, u.DialErrors)
+				b.string(6, u.Circuit)
+				b.bool(7, u.Ejected)
+			})
+		}
+	})
+	// map fields are encoded as repeated key value messages
+	for _, k := range slices.Sorted(maps.Keys(rs.Stats.Labels)) {
+		b.message(5, func(b *pbBuffer) {
+			b.string(1, k)
+			b.string(2, rs.Stats.Labels[k])
+		})
+	}
+	b.string(6, rs.Stats.Tenant)
+	b.string(7, rs.StartError)
+	b.bool(8, rs.Draining)
+	b.string(9, string(rs.State))
+}
@@ -0,0 +1,347 @@
+package harald
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestAdminGRPC(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	cert, key := ca.NewServerCertificate(t)
+	echo, _ := haraldtest.EchoServer(t)
+
+	s, err := NewServer(Config{
+		AdminGRPC: &AdminGRPC{TLS: &TLS{Certificate: string(cert), Key: string(key), ClientCAs: string(ca.PEM())}},
+		Rules:     map[string]ForwardRule{"test": testRule(echo)},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = s.setListening(true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.setListening(false)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(s.handleGRPC))
+	srv.TLS = s.grpcTLS
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+	clientCert, err := tls.X509KeyPair(ca.NewClientCertificate(t))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}},
+		ForceAttemptHTTP2: true,
+	}}
+
+	// a client without certificate is rejected during the handshake
+	anonymous := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	_, err = anonymous.Post(srv.URL+grpcService+"Status", "application/grpc", nil)
+	if err == nil {
+		t.Errorf("expected a client without certificate to be rejected")
+	}
+
+	msgs, status := invokeGRPC(t, client, srv.URL, "Status", nil)
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("status: unexpected status %s with %d messages", status, len(msgs))
+	}
+	rules := decodeStringFields(t, msgs[0], 1, 1)
+	if len(rules) != 1 || rules[0] != "test" {
+		t.Errorf("status: want = [test]; got = %v", rules)
+	}
+
+	c, err := net.Dial("tcp", s.forwarder("test").Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	_, _ = c.Write([]byte("ping"))
+	_, _ = io.ReadFull(c, make([]byte, 4))
+
+	msgs, status = invokeGRPC(t, client, srv.URL, "ListConnections", nil)
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("list connections: unexpected status %s with %d messages", status, len(msgs))
+	}
+	ids := decodeStringFields(t, msgs[0], 1, 1)
+	if len(ids) != 1 {
+		t.Fatalf("list connections: expected one connection; got = %v", ids)
+	}
+
+	var req pbBuffer
+	req.string(1, ids[0])
+	_, status = invokeGRPC(t, client, srv.URL, "KillConnection", req)
+	if status != "0" {
+		t.Fatalf("kill connection: unexpected status %s", status)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("expected the connection to be closed; got = %v", err)
+	}
+
+	_, status = invokeGRPC(t, client, srv.URL, "KillConnection", req)
+	if status != "5" {
+		t.Errorf("kill unknown connection: want = 5; got = %s", status)
+	}
+
+	req = nil
+	req.string(1, "test")
+	msgs, status = invokeGRPC(t, client, srv.URL, "StopRule", req)
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("stop rule: unexpected status %s with %d messages", status, len(msgs))
+	}
+	if s.forwarder("test").Addr() != nil {
+		t.Errorf("expected the rule to be stopped")
+	}
+
+	_, status = invokeGRPC(t, client, srv.URL, "Unknown", nil)
+	if status != "12" {
+		t.Errorf("unknown method: want = 12; got = %s", status)
+	}
+
+	req = nil
+	req.uint(1, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := postGRPC(t, ctx, client, srv.URL, "StreamStats", req)
+	defer resp.Body.Close()
+	for i := 0; i < 2; i++ {
+		_, err = readGRPCMessage(resp.Body)
+		if err != nil {
+			t.Fatalf("stream stats: %s", err.Error())
+		}
+	}
+}
+
+// TestAdminGRPCFixtures compares the messages with the ones encoded from the
+// text format in testdata/admin by protoc, e.g.
+//
+//	protoc --encode=harald.admin.v1.StatusResponse admin.proto \
+//		< testdata/admin/status_response.txtpb > testdata/admin/status_response.binpb
+func TestAdminGRPCFixtures(t *testing.T) {
+	fixture := func(name string) []byte {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join("testdata", "admin", name+".binpb"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return b
+	}
+
+	rules := []struct {
+		name string
+		rs   RuleStatus
+	}{
+		{"http", RuleStatus{
+			State:       StateListening,
+			Address:     "127.0.0.1:8080",
+			Maintenance: true,
+			Stats: Stats{
+				TotalConnections:  300,
+				ActiveConnections: 2,
+				BytesIn:           4096,
+				BytesOut:          1 << 20,
+				DialErrors:        1,
+				Overflows:         3,
+				IdleReaped:        4,
+				LastError:         "dial tcp 10.0.0.2:80: connection refused",
+				Uptime:            90 * time.Second,
+				Upstreams: []UpstreamStats{
+					{Network: "tcp", Address: "10.0.0.1:80", ActiveConnections: 2, TotalConnections: 299},
+					{Network: "tcp", Address: "10.0.0.2:80", DialErrors: 1, Circuit: "open", Ejected: true},
+				},
+				Labels: map[string]string{"team": "web"},
+				Tenant: "shop",
+			},
+		}},
+		{"ssh", RuleStatus{State: StateStopped, StartError: "listen tcp :22: bind: address already in use"}},
+		{"smtp", RuleStatus{State: StateDraining, Draining: true, Stats: Stats{ActiveConnections: 1}}},
+	}
+	var b pbBuffer
+	for _, r := range rules {
+		b.message(1, func(b *pbBuffer) { encodeRuleStatus(b, r.name, r.rs) })
+	}
+	if want := fixture("status_response"); !bytes.Equal(b, want) {
+		t.Errorf("status response: want = %x; got = %x", want, []byte(b))
+	}
+
+	since := time.UnixMilli(1760659200000)
+	conns := []Connection{
+		{ID: "0b5c7d3e-6f1a-4c2b-9d8e-7a6b5c4d3e2f", Rule: "http", Source: "192.0.2.1:51234", Upstream: "tcp@10.0.0.1:80",
+			Since: since, Stage: StageForwarding, LastActivity: since.Add(1500 * time.Millisecond)},
+		{ID: "1c6d8e4f-7a2b-4d3c-8e9f-8b7c6d5e4f3a", Rule: "http", Source: "192.0.2.2:40000",
+			Since: since.Add(2 * time.Second), Stage: StageHandshake, LastActivity: since.Add(2 * time.Second)},
+	}
+	b = nil
+	for _, conn := range conns {
+		b.message(1, func(b *pbBuffer) { encodeConnection(b, conn) })
+	}
+	if want := fixture("list_connections_response"); !bytes.Equal(b, want) {
+		t.Errorf("list connections response: want = %x; got = %x", want, []byte(b))
+	}
+
+	c := &grpcCall{request: fixture("rule_request")}
+	rule, err := c.string()
+	if err != nil || rule != "http" {
+		t.Errorf("rule request: want = http; got = %q, %v", rule, err)
+	}
+
+	var interval uint64
+	err = decodeProtobuf(fixture("stream_stats_request"), func(num, wireType int, v uint64, _ []byte) error {
+		if num == 1 && wireType == pbVarint {
+			interval = v
+		}
+		return nil
+	})
+	if err != nil || interval != 250 {
+		t.Errorf("stream stats request: want = 250; got = %d, %v", interval, err)
+	}
+}
+
+func postGRPC(t *testing.T, ctx context.Context, client *http.Client, url, method string, msg []byte) *http.Response {
+	var body bytes.Buffer
+	_ = writeGRPCMessage(&body, msg)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+grpcService+method, &body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return resp
+}
+
+// invokeGRPC returns the response messages and the grpc-status of the call.
+func invokeGRPC(t *testing.T, client *http.Client, url, method string, msg []byte) ([][]byte, string) {
+	resp := postGRPC(t, context.Background(), client, url, method, msg)
+	defer resp.Body.Close()
+
+	var msgs [][]byte
+	for {
+		m, err := readGRPCMessage(resp.Body)
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, resp.Trailer.Get("Grpc-Status")
+}
+
+// decodeStringFields returns the string field inner of each embedded message
+// in field outer.
+func decodeStringFields(t *testing.T, msg []byte, outer, inner int) []string {
+	var values []string
+	err := decodeProtobuf(msg, func(num, _ int, _ uint64, data []byte) error {
+		if num != outer {
+			return nil
+		}
+		return decodeProtobuf(data, func(num, _ int, _ uint64, data []byte) error {
+			if num == inner {
+				values = append(values, string(data))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return values
+}
+
+func TestAdminGRPCTenant(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	cert, key := ca.NewServerCertificate(t)
+	echo, _ := haraldtest.EchoServer(t)
+
+	clientCert, err := tls.X509KeyPair(ca.NewClientCertificate(t))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	web := testRule(echo)
+	web.Tenant = "web"
+	s, err := NewServer(Config{
+		AdminGRPC: &AdminGRPC{TLS: &TLS{Certificate: string(cert), Key: string(key), ClientCAs: string(ca.PEM())}},
+		Tenants:   map[string]Tenant{"web": {AdminSubjects: []string{leaf.Subject.String()}}},
+		Rules:     map[string]ForwardRule{"web": web, "other": testRule(echo)},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(s.handleGRPC))
+	srv.TLS = s.grpcTLS
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}},
+		ForceAttemptHTTP2: true,
+	}}
+
+	msgs, status := invokeGRPC(t, client, srv.URL, "Status", nil)
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("status: unexpected status %s with %d messages", status, len(msgs))
+	}
+	rules := decodeStringFields(t, msgs[0], 1, 1)
+	if len(rules) != 1 || rules[0] != "web" {
+		t.Errorf("status: want = [web]; got = %v", rules)
+	}
+	tenants := decodeStringFields(t, msgs[0], 1, 6)
+	if len(tenants) != 1 || tenants[0] != "web" {
+		t.Errorf("status: want tenant = [web]; got = %v", tenants)
+	}
+
+	var req pbBuffer
+	req.string(1, "other")
+	_, status = invokeGRPC(t, client, srv.URL, "StartRule", req)
+	if status != "5" {
+		t.Errorf("start rule of other tenant: want = 5; got = %s", status)
+	}
+	if s.forwarder("other").Addr() != nil {
+		t.Errorf("expected the rule of the other tenant to remain stopped")
+	}
+
+	req = nil
+	req.string(1, "web")
+	_, status = invokeGRPC(t, client, srv.URL, "StartRule", req)
+	if status != "0" {
+		t.Errorf("start rule: want = 0; got = %s", status)
+	}
+	defer s.setListening(false)
+
+	_, status = invokeGRPC(t, client, srv.URL, "Reload", nil)
+	if status != "7" {
+		t.Errorf("reload: want = 7; got = %s", status)
+	}
+}
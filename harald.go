@@ -13,156 +13,780 @@
 package harald
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
+	"maps"
 	"net"
+	"net/http"
+	"net/netip"
 	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-
-	"github.com/google/uuid"
 )
 
 // Helpers to format common logging fields consistently.
 var (
 	attrBytesWritten = func(n int64) slog.Attr { return slog.Int64("bytes-written", n) }
-	attrConnId       = func(id uuid.UUID) slog.Attr { return slog.Any("conn-id", fmt.Stringer(id)) }
+	attrConnId       = func(id string) slog.Attr { return slog.String("conn-id", id) }
 	attrError        = func(err error) slog.Attr { return slog.String("error", err.Error()) }
 	attrForwarder    = func(f *Forwarder) slog.Attr { return slog.Any("forwarder", fmt.Stringer(f)) }
+	attrRule         = func(name string) slog.Attr { return slog.String("rule", name) }
+	attrServerName   = func(name string) slog.Attr { return slog.String("server-name", name) }
+	attrJA3          = func(ja3 string) slog.Attr { return slog.String("ja3", ja3) }
+	attrJA4          = func(ja4 string) slog.Attr { return slog.String("ja4", ja4) }
 	attrSignal       = func(s os.Signal) slog.Attr { return slog.String("signal", s.String()) }
+	attrSource       = func(a netip.Addr) slog.Attr { return slog.String("source", a.String()) }
+	attrTenant       = func(t string) slog.Attr { return slog.String("tenant", t) }
+	attrUpstream     = func(u *upstream) slog.Attr { return slog.Any("upstream", fmt.Stringer(u)) }
 )
 
+// attrHandshake describes the result of a TLS handshake with a client.
+func attrHandshake(cs *tls.ConnectionState) slog.Attr {
+	attrs := []any{
+		slog.String("version", tls.VersionName(cs.Version)),
+		slog.String("cipher-suite", tls.CipherSuiteName(cs.CipherSuite)),
+		slog.String("alpn", cs.NegotiatedProtocol),
+		slog.String("server-name", cs.ServerName),
+		slog.Bool("resumed", cs.DidResume),
+	}
+	if len(cs.PeerCertificates) > 0 {
+		attrs = append(attrs, slog.String("client-subject", cs.PeerCertificates[0].Subject.String()))
+	}
+	return slog.Group("tls", attrs...)
+}
+
 // Harald is the main entrypoint. The config controls the behaviour and the
 // signals channel is used to bring up / shut down the listeners and stop the
 // execution. The channel should be subscribed to SIGTERM, SIGUSR1 and SIGUSR2.
-func Harald(c Config, signals <-chan os.Signal) (err error) {
-	var forwarders Forwarders
+func Harald(c Config, signals <-chan os.Signal) error {
+	s, err := NewServer(c)
+	if err != nil {
+		return err
+	}
+	return s.Run(signals)
+}
 
-	var f *Forwarder
-	for name, r := range c.Rules {
-		f, err = r.NewForwarder(name, c.DialTimeout.Duration())
-		if err != nil {
-			return fmt.Errorf("harald: %w", err)
-		}
-		forwarders = append(forwarders, f)
+type Forwarder struct {
+	ForwardRule
+	name string
+	// parent is the name of the rule of the config the forwarder has been
+	// expanded from, empty unless it is created by a server.
+	parent   string
+	mu       sync.Mutex // guards listener and startErr
+	listener *listener
+	// startErr is the error of the last call to Start, nil if it succeeded.
+	startErr error
+	tlsConf  *tls.Config
+	// upstreamTLS is the config of the TLS client towards the upstreams, nil
+	// if they are connected in plaintext.
+	upstreamTLS *tls.Config
+	// certs provides the certificate of tlsConf or quicConf if the rule
+	// configures a certificate source, nil otherwise.
+	certs *certStore
+	// quicConf is used instead of tlsConf if the rule listens on the quic
+	// network, the handshake is done by the listener in that case.
+	quicConf *tls.Config
+	timeout  time.Duration
+	// bindRetry is the duration for which opening the listener is retried.
+	bindRetry time.Duration
+	log       *slog.Logger
+	// sampler picks the connections which log debug messages.
+	sampler  *debugSampler
+	stats    stats
+	bans     *banList
+	budget   *bufferBudget
+	redactor *redactor
+	// perSource limits the concurrent connections of a single source.
+	perSource *sourceLimiter
+	// tenant enforces the quotas shared with the other rules of the tenant,
+	// nil if the tenant has none.
+	tenant *tenantQuota
+	// workers limits the connections handled concurrently.
+	workers *workerLimit
+	pool    *upstreamPool
+	// exec spawns the processes of the rule if it connects on the exec
+	// network, nil otherwise.
+	exec *execUpstream
+	// tunnel accepts the tunnel connections of the agents if the rule is
+	// the rendezvous of a tunnel, nil otherwise.
+	tunnel   *tunnelServer
+	balancer *balancer
+	// resolver resolves the hostnames of the upstreams, nil if the resolver
+	// of the system is used.
+	resolver *net.Resolver
+	// router picks the upstream based on the first bytes of a connection,
+	// nil if the rule doesn't configure routing.
+	router *router
+	// source keeps the upstreams of the balancer up to date while the
+	// listener is open, nil if the upstreams are static.
+	source       upstreamSource
+	cancelSource context.CancelFunc
+	// events receives the opened and closed connections.
+	events *eventBus
+	// conns lists the open connections and allows to close them.
+	conns *connTable
+	// captures record the data of connections for debugging.
+	captures *captureTable
+	// newID generates the IDs of the connections.
+	newID func() string
+	// access writes a record for each forwarded connection.
+	access *accessLog
+	// reaper closes connections which have been idle for too long.
+	reaper *idleReaper
+	// maintenance is set while clients are rejected instead of forwarded.
+	maintenance atomic.Bool
+	// accepted counts the connections accepted since the listener has been
+	// opened, it is only maintained with max accepts.
+	accepted atomic.Int64
+	// handlers counts the accepted connections from the moment they are
+	// dispatched until their handler returns. Unlike the active connections
+	// of the stats it includes connections which aren't forwarded yet.
+	handlers atomic.Int64
+	// stateMu guards state and stopped, it is separate from mu so the state
+	// can be read while the listener is being opened.
+	stateMu sync.Mutex
+	state   ForwarderState
+	// stopped is closed once the listener is deactivated, it wakes up the
+	// connections queued for a worker.
+	stopped chan struct{}
+}
+
+// ForwarderState is the state of the listener of a forwarder.
+type ForwarderState string
+
+const (
+	// StateStopped is the state of a forwarder without a listener.
+	StateStopped ForwarderState = "stopped"
+	// StateStarting is the state while the listener is being opened, which
+	// may take a while if binding is retried.
+	StateStarting ForwarderState = "starting"
+	// StateListening is the state while the listener is open.
+	StateListening ForwarderState = "listening"
+	// StateDraining is the state from closing the listener with drain until
+	// the last connection has been closed or the listener is opened again.
+	StateDraining ForwarderState = "draining"
+)
+
+// State returns the state of the listener of the forwarder.
+func (f *Forwarder) State() ForwarderState {
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	return cmp.Or(f.state, StateStopped)
+}
+
+// stopSignal returns the channel which is closed once the current listener is
+// deactivated.
+func (f *Forwarder) stopSignal() <-chan struct{} {
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	return f.stopped
+}
+
+// setState moves the forwarder to the state.
+func (f *Forwarder) setState(to ForwarderState) {
+	f.changeState("", to)
+}
+
+// changeState moves the forwarder to the state if it is in the state from, or
+// in any state if from is empty, and logs the change. It returns false if the
+// forwarder is in another state.
+func (f *Forwarder) changeState(from, to ForwarderState) bool {
+	f.stateMu.Lock()
+	current := cmp.Or(f.state, StateStopped)
+	if from != "" && current != from {
+		f.stateMu.Unlock()
+		return false
 	}
+	f.state = to
+	f.stateMu.Unlock()
 
-	if len(forwarders) == 0 {
-		return fmt.Errorf("harald: no forwarders configured")
+	if current != to {
+		f.log.Info("state changed", slog.String("from", string(current)), slog.String("to", string(to)))
 	}
+	return true
+}
 
-	slog.Info("harald is ready")
+// Start opens a new listener.
+func (f *Forwarder) Start() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-	if c.EnableListeners {
-		forwarders.Start()
-		slog.Info("started listeners")
+	if f.State() == StateListening {
+		f.log.Debug("listener already open, not starting again")
+		return nil
 	}
+	f.log.Debug("starting listener")
+	f.setState(StateStarting)
 
-	for sig := range signals {
-		slog.Info("received signal", attrSignal(sig))
+	err := f.certs.start()
+	if err != nil {
+		f.startErr = err
+		f.setState(StateStopped)
+		return err
+	}
+	err = f.tunnel.start()
+	if err != nil {
+		f.certs.stop()
+		f.startErr = err
+		f.setState(StateStopped)
+		return err
+	}
+	nl, err := f.listen()
+	if err != nil {
+		f.certs.stop()
+		f.tunnel.stop()
+		f.startErr = withKind(ErrBind, err)
+		f.setState(StateStopped)
+		return f.startErr
+	}
+	f.startErr = nil
+	f.accepted.Store(0)
+	l := &listener{Listener: nl}
+	l.owner.Store(f)
+	f.activate(l)
+
+	for range max(f.Acceptors, 1) {
+		go l.serve()
+	}
+
+	return nil
+}
+
+const (
+	bindRetryMinBackoff = 100 * time.Millisecond
+	bindRetryMaxBackoff = 2 * time.Second
+)
+
+// listen opens the socket of the rule. If the address is still in use (e.g.
+// by a predecessor shutting down) or not available yet, binding is retried
+// with an exponential backoff until the bind retry window has passed.
+func (f *Forwarder) listen() (net.Listener, error) {
+	deadline := time.Now().Add(f.bindRetry)
+	backoff := bindRetryMinBackoff
+
+	for {
+		l, err := f.listenOnce()
+		if err == nil {
+			return l, nil
+		}
 
-		switch sig {
-		case syscall.SIGTERM:
-			slog.Info("shutting down")
-			forwarders.Stop()
-			slog.Info("stopped listeners")
-			return nil // cannot break because of the switch
-		case syscall.SIGUSR1:
-			forwarders.Start()
-			slog.Info("started listeners")
-		case syscall.SIGUSR2:
-			forwarders.Stop()
-			slog.Info("stopped listeners")
-		default:
-			slog.Debug("ignoring unknown signal", attrSignal(sig))
+		retry := errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)
+		if !retry || time.Now().Add(backoff).After(deadline) {
+			return nil, err
 		}
+
+		f.log.Info("opening listener failed, retrying", attrError(err), slog.Duration("backoff", backoff))
+		time.Sleep(backoff)
+		backoff = min(2*backoff, bindRetryMaxBackoff)
 	}
+}
 
-	return nil
+// listenOnce makes a single attempt to open the socket of the rule.
+func (f *Forwarder) listenOnce() (net.Listener, error) {
+	switch f.Listen.Network {
+	case networkQUIC:
+		return listenQUIC(f.ListenOptions, f.Listen.Address, f.quicConf, f.QUIC)
+	case networkTunnel:
+		return listenTunnel(f.Listen.Address, f.Tunnel, f.log)
+	case networkStdio:
+		return listenStdio()
+	}
+	return f.ListenOptions.listen(f.Listen.Network, f.Listen.Address)
 }
 
-type Forwarder struct {
-	ForwardRule
-	name     string
-	listener net.Listener
-	tlsConf  *tls.Config
-	timeout  time.Duration
-	log      *slog.Logger
+// takeOver moves the listener of old to f if both listen on the same
+// address with the same options, which allows replacing the forwarder of a rule without refusing
+// connections in the meantime. Connections handled by old are not affected.
+// Returns false if the listener could not be taken over.
+func (f *Forwarder) takeOver(old *Forwarder) bool {
+	// options of the listener can't be changed once it is open, neither can
+	// the number of goroutines accepting on it.
+	if f.Listen != old.Listen || f.ListenOptions != old.ListenOptions || max(f.Acceptors, 1) != max(old.Acceptors, 1) {
+		return false
+	}
+	// the listener of an agent dials out with the tunnel config, the one of
+	// the rendezvous is owned by the forwarder
+	if (f.Listen.Network == networkTunnel && !reflect.DeepEqual(f.Tunnel, old.Tunnel)) || f.tunnel != nil {
+		return false
+	}
+	// the certificate has to be available before the listener is handed
+	// over, otherwise the handshakes fail in the meantime
+	err := f.certs.start()
+	if err != nil {
+		f.log.Error("unable to take over listener", attrError(err))
+		return false
+	}
+
+	old.mu.Lock()
+	l := old.deactivate()
+	old.mu.Unlock()
+	if l == nil {
+		f.certs.stop()
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.log.Debug("taking over listener")
+	f.activate(l)
+	l.owner.Store(f)
+	return true
 }
 
-// Start opens a new listener.
-func (f *Forwarder) Start() (err error) {
-	if f.listener != nil {
-		f.log.Debug("listener already open, not starting again")
+// activate starts everything that runs alongside an open listener. The caller
+// must hold mu.
+func (f *Forwarder) activate(l *listener) {
+	f.listener = l
+	f.stateMu.Lock()
+	f.stopped = make(chan struct{})
+	f.stateMu.Unlock()
+	f.stats.listeningSince.Store(time.Now().UnixNano())
+	f.pool.start()
+	f.setState(StateListening)
+
+	if f.source != nil {
+		var ctx context.Context
+		ctx, f.cancelSource = context.WithCancel(context.Background())
+		go f.source.watch(ctx, func(targets []target) {
+			f.balancer.update(targets)
+			f.events.publish(Event{Type: EventUpstreams, Rule: f.name, Upstreams: len(targets)})
+		})
+	}
+}
+
+// deactivate is the counterpart to activate, it returns the listener without
+// closing it or nil if there is none. The caller must hold mu.
+func (f *Forwarder) deactivate() *listener {
+	l := f.listener
+	if l == nil {
 		return nil
 	}
-	f.log.Debug("starting listener")
 
-	f.listener, err = net.Listen(f.Listen.Network, f.Listen.Address)
-	if err != nil {
-		return err
+	f.listener = nil
+	f.stats.listeningSince.Store(0)
+	f.setState(StateStopped)
+	f.stateMu.Lock()
+	close(f.stopped)
+	f.stateMu.Unlock()
+	f.pool.stop()
+	f.certs.stop()
+	f.tunnel.stop()
+
+	if f.cancelSource != nil {
+		f.cancelSource()
+		f.cancelSource = nil
 	}
+	return l
+}
 
-	go func() {
-		for {
-			c, err := f.listener.Accept()
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
-					// net.ErrClosed is expected in cases where we shut down the listener so
-					// this is not considered a real error but the clean exit case.
-					return
-				} else {
-					// otherwise we log the error and continue
-					// TODO: could this result in a short-circuit where we constantly log the same error?
-					f.log.Error("unable to accept connection", attrError(err))
-					continue
-				}
-			}
+// listener accepts connections on behalf of a forwarder. The owner can be
+// replaced while the listener is open.
+type listener struct {
+	net.Listener
+	owner atomic.Pointer[Forwarder]
+}
 
-			go f.handle(c)
+// serve accepts connections until the listener is closed and passes them to
+// the current owner.
+func (l *listener) serve() {
+	for {
+		c, err := l.Accept()
+		f := l.owner.Load()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// net.ErrClosed is expected in cases where we shut down the listener so
+				// this is not considered a real error but the clean exit case.
+				return
+			} else {
+				// otherwise we log the error and continue
+				// TODO: could this result in a short-circuit where we constantly log the same error?
+				f.log.Error("unable to accept connection", attrError(err))
+				f.stats.setError(err)
+				continue
+			}
 		}
+
+		f.dispatch(c)
+	}
+}
+
+// dispatch hands the connection to a new worker. If the workers of the rule
+// are exhausted this blocks the accept loop according to the overflow policy,
+// the kernel keeps queueing new connections in the meantime. A connection
+// waiting for a worker is closed once the listener is stopped.
+func (f *Forwarder) dispatch(c net.Conn) {
+	// the connection is counted before countAccept may stop the rule, the
+	// rule must not look exhausted before its last connection is handled.
+	f.handlers.Add(1)
+	if !f.countAccept() {
+		f.handlers.Add(-1)
+		_ = c.Close()
+		return
+	}
+	// the connections counted towards the max accepts are served even though
+	// the last of them stops the rule.
+	stop := f.stopSignal()
+	if f.maxAccepts() > 0 {
+		stop = nil
+	}
+	if !f.workers.acquire(stop) {
+		f.handlers.Add(-1)
+		f.log.Warn("rejecting connection, all workers are busy")
+		f.stats.overflows.Add(1)
+		_ = c.Close()
+		return
+	}
+	go func() {
+		defer f.handlers.Add(-1)
+		defer f.workers.release()
+		f.handle(c)
 	}()
+}
 
-	return nil
+// countAccept counts the connection towards the max accepts of the rule and
+// closes the listener once they have been reached. It returns false if the
+// connection exceeds them, e.g. because another acceptor has been faster.
+func (f *Forwarder) countAccept() bool {
+	limit := f.maxAccepts()
+	if limit == 0 {
+		return true
+	}
+	n := f.accepted.Add(1)
+	if n == int64(limit) {
+		f.log.Info("accepted the maximum number of connections, closing listener", slog.Int("max-accepts", limit))
+		f.Stop()
+	}
+	return n <= int64(limit)
+}
+
+// maxAccepts returns the number of connections after which the listener is
+// closed, zero if unlimited. Listening on stdio accepts a single connection.
+func (f *Forwarder) maxAccepts() int {
+	if f.Listen.Network == networkStdio {
+		return 1
+	}
+	return f.MaxAccepts
 }
 
+// exhausted reports whether the rule has been closed after accepting its
+// maximum number of connections and all of them are done.
+func (f *Forwarder) exhausted() bool {
+	limit := f.maxAccepts()
+	return limit > 0 && f.accepted.Load() >= int64(limit) &&
+		f.State() == StateStopped && f.handlers.Load() == 0
+}
+
+// handshakeTimeout limits the duration of the TLS handshake with the client.
+const handshakeTimeout = 10 * time.Second
+
 func (f *Forwarder) handle(source net.Conn) {
-	log := f.log.With(attrConnId(uuid.Must(uuid.NewRandom())))
+	start := time.Now()
+	defer func() { _ = source.Close() }()
+	client := source
+
+	var id, serverName string
+	if f.AcceptProxyProtocol != nil {
+		proxied, header, err := readProxyHeader(source)
+		if err != nil {
+			f.log.Info("rejecting client without proxy protocol header", attrError(err))
+			f.stats.setError(err)
+			return
+		}
+		source = proxied
+		if f.AcceptProxyProtocol.ConnID {
+			id = header.connID()
+		}
+		if f.AcceptProxyProtocol.ServerName {
+			serverName = header.serverName()
+		}
+	}
+	if id == "" {
+		id = f.newID()
+	}
+	log := f.sampler.logger(f.log).With(attrConnId(id))
+	if serverName != "" {
+		log = log.With(attrServerName(serverName))
+	}
 	log.Debug("handle start")
 
-	defer func() { _ = source.Close() }()
+	src := sourceAddr(source)
+	log = f.redactor.logger(log, src)
+
+	// closing the client aborts the handler until the connection is
+	// forwarded, which stops waiting for the upstream as well.
+	dialCtx, cancelDial := context.WithCancel(context.Background())
+	defer cancelDial()
+	live := f.conns.add(Connection{ID: id, Rule: f.name, Source: f.redactor.addr(src), Since: start}, func(reset bool) {
+		cancelDial()
+		if reset {
+			resetConn(client)
+		}
+		_ = client.Close()
+	})
+	defer live.done()
+	if f.bans.banned(src) {
+		log.Debug("rejecting connection from banned source", attrSource(src))
+		return
+	}
 
-	target, err := net.DialTimeout(f.Connect.Network, f.Connect.Address, f.timeout)
-	if err != nil {
-		log.Error("connecting upstream failed", attrError(err))
+	if !f.perSource.acquire(src) {
+		log.Info("rejecting connection, too many connections from source", attrSource(src))
+		f.bans.fail(src, log)
 		return
 	}
-	defer func() { _ = target.Close() }()
+	defer f.perSource.release(src)
 
-	log.Debug("established upstream connection")
+	if !f.tenant.acquire() {
+		log.Warn("rejecting connection, the tenant reached its connection quota")
+		return
+	}
+	defer f.tenant.release()
+
+	f.stats.totalConns.Add(1)
+	f.stats.activeConns.Add(1)
+	defer f.stats.activeConns.Add(-1)
 
+	terminate := f.tlsConf != nil
+	if f.StartTLS == StartTLSPostgres {
+		negotiated, plaintext, err := negotiatePostgres(source)
+		if err != nil {
+			log.Info("rejecting client during starttls negotiation", attrError(err))
+			f.stats.setError(err)
+			return
+		}
+		source, terminate = negotiated, !plaintext
+	}
+
+	// the client hello is inspected before connecting upstream, this way
+	// unwanted clients never reach the upstream. SMTP clients only send it
+	// after the dialogue with the upstream.
+	if terminate && f.StartTLS != StartTLSSMTP {
+		var hello *clientHello
+		var err error
+		source, hello, err = peekClientHello(source)
+		if err != nil {
+			log.Error("reading client hello failed", attrError(err))
+			f.stats.setError(err)
+			f.bans.fail(src, log)
+			return
+		}
+
+		log = log.With(attrJA3(hello.ja3()), attrJA4(hello.ja4()))
+		log.Debug("received client hello")
+
+		if !f.TLS.allowsFingerprint(hello) {
+			log.Info("rejecting client based on its fingerprint")
+			f.bans.fail(src, log)
+			return
+		}
+
+		if !f.TLS.allowsServerName(hello.serverName) {
+			log.Info("rejecting client based on its server name", attrServerName(hello.serverName))
+			f.bans.fail(src, log)
+			return
+		}
+	}
+
+	if f.maintenance.Load() {
+		f.rejectMaintenance(source, terminate && f.StartTLS != StartTLSSMTP, log)
+		return
+	}
+
+	bufSize := f.Buffers.size()
+	if !f.budget.reserve(bufSize) {
+		log.Warn("rejecting connection, memory budget for buffers exhausted")
+		f.stats.overflows.Add(1)
+		return
+	}
+	defer f.budget.release(bufSize)
+
+	var route *upstream
+	if f.router != nil {
+		var err error
+		source, route, err = f.router.route(source)
+		if err != nil {
+			log.Debug("routing connection failed", attrError(err))
+			return
+		}
+	}
+
+	// the upstream of a CONNECT proxy is only known once the client sent its
+	// request, processes are spawned with the details of the TLS handshake.
+	var conn *upstreamConn
+	var err error
+	if f.HTTPConnect == nil && f.exec == nil {
+		live.stage(StageConnecting)
+		if route != nil {
+			conn, err = f.dialRoute(route)
+		} else {
+			conn, err = f.dialUpstream(dialCtx, src, log)
+		}
+		if err != nil {
+			log.Error("connecting upstream failed", attrError(err))
+			f.stats.setError(err)
+			return
+		}
+		defer func() { _ = conn.Close() }()
+	}
+
+	if f.StartTLS == StartTLSSMTP {
+		err = negotiateSMTP(source, conn.Conn)
+		if err != nil {
+			log.Info("smtp dialogue ended before starttls", attrError(err))
+			return
+		}
+	}
+
+	var state *tls.ConnectionState
 	// only after the tcp connection could be established upstream we add TLS
 	// to the connection.
-	if f.tlsConf != nil {
-		source = tls.Server(source, f.tlsConf)
+	//
+	// Record encryption stays in user space: handing the connection over to
+	// kernel TLS requires the traffic keys, the record sequence numbers and
+	// any data crypto/tls has already read past the handshake, none of which
+	// are exposed by the package. Until that changes, TLS terminated rules
+	// can't make use of splice.
+	if terminate {
+		live.stage(StageHandshake)
+		tlsConn := tls.Server(source, f.tlsConf)
+
+		ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+		err = tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			err = withKind(ErrTLS, err)
+			log.Error("tls handshake failed", attrError(err))
+			f.stats.setError(err)
+			f.bans.fail(src, log)
+			return
+		}
+
+		source = tlsConn
+		cs := tlsConn.ConnectionState()
+		state = &cs
+		if cs.ServerName != "" {
+			serverName = cs.ServerName
+		}
+		log = log.With(attrHandshake(state))
+		log.Debug("completed tls handshake")
+	}
+
+	if f.HTTPConnect != nil {
+		var tunneled net.Conn
+		tunneled, conn, err = f.acceptConnect(source, src, log)
+		if err != nil {
+			log.Info("rejecting connect request", attrError(err))
+			f.stats.setError(err)
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		source = tunneled
+	}
+
+	if f.exec != nil {
+		conn, err = f.exec.spawn(f.name, id, source, serverName, state)
+		if err != nil {
+			log.Error("spawning process failed", attrError(err))
+			f.stats.setError(err)
+			return
+		}
+		defer func() { _ = conn.Close() }()
+	}
+
+	// the plain connection is used from here on to keep the fast paths of
+	// io.Copy available.
+	target := conn.Conn
+	upstream := target
+
+	conn.upstream.total.Add(1)
+	conn.upstream.active.Add(1)
+	defer conn.upstream.active.Add(-1)
+
+	log = log.With(attrUpstream(conn.upstream))
+	log.Debug("established upstream connection")
+	f.events.publish(Event{Type: EventConnectionOpen, Rule: f.name, ConnID: id,
+		Source: f.redactor.addr(src), Upstream: conn.upstream.String()})
+
+	if f.ProxyProtocol != nil {
+		_, err = target.Write(f.ProxyProtocol.header(source, state, id, serverName))
+		if err != nil {
+			log.Error("sending proxy protocol header failed", attrError(err))
+			f.stats.setError(err)
+			return
+		}
+	}
+
+	var headers http.Header
+	if f.Protocol == ProtocolHTTP {
+		headers = forwardedHeaders(src, state)
+		if f.ConnIDHeader != "" {
+			headers.Set(f.ConnIDHeader, id)
+		}
+	}
+
+	source = f.Timeouts.client(source)
+	target = f.Timeouts.upstream(target)
+	source, target = f.tenant.limit(source, target)
+
+	source, target, untrack := f.reaper.track(source, target, live.activity(), log)
+	defer untrack()
+
+	source, target, uncapture, err := f.captures.tap(f.name, id, source, target)
+	if err != nil {
+		log.Warn("starting capture failed", attrError(err))
 	}
+	defer uncapture()
 
-	// we only wait until one end closes the connection. We return after that
-	// which runs the defers and closes both connections. This causes the
-	// second copy operation to return as well.
+	// we only wait until one end closes the connection. After that both
+	// connections are closed which causes the second copy operation to return
+	// as well.
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// killing the connection waits until it has been cleaned up.
+	closed := make(chan struct{})
+	defer close(closed)
+	live.forwarding(conn.upstream.String(), func(reset bool) {
+		if reset {
+			resetConn(client)
+			resetConn(upstream)
+		}
+		cancel()
+		<-closed
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var bytesIn, bytesOut int64
+	// upstreamErr is the error of the upstream if it ended the connection.
+	var upstreamErr error
+
 	go func() {
+		defer wg.Done()
 		defer cancel()
 		log.Debug("copy source->target started")
-		n, err := io.Copy(target, source)
+		var n int64
+		var err error
+		if headers != nil {
+			n, err = copyHTTP(target, source, headers, f.Buffers.in())
+		} else {
+			n, err = copyBuffer(target, source, f.Buffers.in())
+		}
+		f.stats.bytesIn.Add(uint64(n))
+		bytesIn = n
 		if err != nil {
 			log.Error("copy source->target stopped", attrBytesWritten(n), attrError(err))
+			f.stats.setError(err)
 		} else {
 			log.Debug("copy source->target stopped", attrBytesWritten(n))
 		}
@@ -170,73 +794,197 @@ func (f *Forwarder) handle(source net.Conn) {
 	}()
 
 	go func() {
+		defer wg.Done()
 		defer cancel()
 		log.Debug("copy target->source started")
-		n, err := io.Copy(source, target)
+		n, err := copyBuffer(source, target, f.Buffers.out())
+		f.stats.bytesOut.Add(uint64(n))
+		bytesOut = n
 		if err != nil {
 			log.Error("copy target->source stopped", attrBytesWritten(n), attrError(err))
+			f.stats.setError(err)
+			if ctx.Err() == nil {
+				upstreamErr = err
+			}
 		} else {
 			log.Debug("copy target->source stopped", attrBytesWritten(n))
+			if n == 0 && ctx.Err() == nil {
+				upstreamErr = errPrematureClose
+			}
 		}
 	}()
 
 	<-ctx.Done()
+
+	// wait for the second copy operation so the stats are complete once the
+	// connection is no longer counted as active.
+	_ = source.Close()
+	_ = target.Close()
+	wg.Wait()
+
+	if conn.balanced {
+		f.upstreamEnded(conn.upstream, upstreamErr)
+	}
+
+	duration := time.Since(start)
+	record := []slog.Attr{attrRule(f.name), attrLabels(f.Labels), attrConnId(id), attrUpstream(conn.upstream),
+		slog.Int64("bytes-in", bytesIn), slog.Int64("bytes-out", bytesOut), slog.Duration("duration", duration)}
+	if f.Tenant != "" {
+		record = append(record, attrTenant(f.Tenant))
+	}
+	if state != nil {
+		record = append(record, attrHandshake(state))
+	} else if serverName != "" {
+		record = append(record, attrServerName(serverName))
+	}
+	f.access.record(f.redactor, src, record...)
+	f.events.publish(Event{Type: EventConnectionClose, Rule: f.name, ConnID: id,
+		Source: f.redactor.addr(src), Upstream: conn.upstream.String(),
+		BytesIn: bytesIn, BytesOut: bytesOut, Duration: duration})
+
 	log.Debug("handle done")
 }
 
 // Stop will close the listener if it is open. The reference to the listener is
 // also set to nil to prevent further usage.
-// TODO: does this need explicit synchronization?
 func (f *Forwarder) Stop() {
-	if f.listener == nil {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.State() != StateListening {
 		f.log.Debug("listener already cosed")
 		return
 	}
 	f.log.Debug("closing listener")
 
-	// First, we copy the pointer, then we set the listener to nil. The case
-	// in which this happens twice and one of the routines gets nil is handled
-	// below.
-	l := f.listener
-	f.listener = nil
-
-	if l == nil {
-		// Since we do not properly synchronize we have the risk that two calls
-		// to stop run in parallel. In such cases the if at the beginning of
-		// the function is not enough to prevent us from still getting a nil
-		// listener which would cause a panic when we try to call Close on it.
-		f.log.Warn("detected double stop, ignoring second stop")
-		return
-	}
-
-	err := l.Close()
+	err := f.deactivate().Close()
 	if err != nil {
 		// Only a warning because the listener is closed in any case.
 		f.log.Warn("error while closing listener", attrError(err))
 	}
 }
 
+// Addr returns the address the forwarder is listening on or nil if the
+// listener is not open. If the rule uses port 0 this reports the port which
+// has been picked by the operating system.
+func (f *Forwarder) Addr() net.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.listener == nil {
+		return nil
+	}
+	return f.listener.Addr()
+}
+
+// StartError returns the error of the last attempt to open the listener, nil
+// if it succeeded or hasn't been attempted yet.
+func (f *Forwarder) StartError() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.startErr
+}
+
 // String representation of the Forwarder. The format of the addresses is
 // inspired by the '-i' argument of lsof.
 func (f *Forwarder) String() string {
-	return fmt.Sprintf("Forwarder(%s; %s@%s->%s@%s)",
-		f.name, f.Listen.Network, f.Listen.Address, f.Connect.Network, f.Connect.Address)
+	return fmt.Sprintf("Forwarder(%s; %s@%s->%s)",
+		f.name, f.Listen.Network, f.Listen.Address, f.upstreams())
+}
+
+// upstreams describes the upstreams of the forwarder, a dynamic source
+// names where they are discovered.
+func (f *Forwarder) upstreams() fmt.Stringer {
+	if f.source != nil {
+		return f.source
+	}
+	return f.balancer
 }
 
 // Forwarders maintains a list of pointers to Forwarder. It holds pointers
 // because each struct may maintain data that can not be copied.
 type Forwarders []*Forwarder
 
-// Start all forwarders in the list. Logs errors encountered while starting a
-// forwarder but continues starting the forwarders.
-func (forwarders Forwarders) Start() {
-	var err error
-	for _, f := range forwarders {
-		err = f.Start()
-		if err != nil {
-			f.log.Error("failed to start forwarder", attrError(err))
+// Start all forwarders in the list, each one after the forwarders it depends
+// on according to its startup config. Errors encountered while starting a
+// forwarder are logged and returned together as StartErrors once all other
+// forwarders have been started.
+func (forwarders Forwarders) Start() error {
+	return forwarders.start(forwarders.rule, (*Forwarder).Start)
+}
+
+// start is like Start, rule looks up the forwarders the ones of the list
+// depend on and start opens the listener of a forwarder once it is ready. The
+// forwarders wait for their startup conditions concurrently, each one once the
+// forwarders of the list it is started after are done.
+func (forwarders Forwarders) start(rule func(name string) *Forwarder, start func(*Forwarder) error) error {
+	ordered := forwarders.startOrder()
+	done := make(map[string]chan struct{}, len(ordered))
+	for _, f := range ordered {
+		done[f.name] = make(chan struct{})
+	}
+
+	var mu sync.Mutex
+	errs := make(StartErrors)
+	waiting := make(map[string]bool, len(ordered))
+	for _, f := range ordered {
+		// only the forwarders which come first are waited for, the other
+		// ones are on a cycle and fail to start
+		var deps []chan struct{}
+		for _, name := range f.Startup.after() {
+			if waiting[name] {
+				deps = append(deps, done[name])
+			}
 		}
+		waiting[f.name] = true
+
+		go func() {
+			defer close(done[f.name])
+			for _, dep := range deps {
+				<-dep
+			}
+			err := f.startWhenReady(rule, start)
+			if err != nil {
+				f.log.Error("failed to start forwarder", attrError(err))
+				mu.Lock()
+				errs[f.name] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, c := range done {
+		<-c
+	}
+
+	if len(errs) == 0 {
+		return nil
 	}
+	return errs
+}
+
+// StartErrors are the errors of the forwarders which couldn't be started keyed
+// by the name of their rule. Use errors.As to find out which rules failed.
+type StartErrors map[string]error
+
+func (e StartErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, name := range slices.Sorted(maps.Keys(e)) {
+		msgs = append(msgs, fmt.Sprintf("rule %s: %s", name, e[name]))
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e StartErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, name := range slices.Sorted(maps.Keys(e)) {
+		errs = append(errs, e[name])
+	}
+	return errs
+}
+
+// sort the forwarders by the name of their rule.
+func (forwarders Forwarders) sort() {
+	slices.SortFunc(forwarders, func(a, b *Forwarder) int { return strings.Compare(a.name, b.name) })
 }
 
 // Stop all forwarders in the list.
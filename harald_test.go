@@ -3,6 +3,8 @@ package harald
 import (
 	"context"
 	"crypto/tls"
+	"io"
+	"log/slog"
 	"net"
 	"net/http/httptrace"
 	"testing"
@@ -189,3 +191,132 @@ func TestTlsTermination(t *testing.T) {
 
 	forwarder.Stop()
 }
+
+// testLogger returns a logger which discards all output.
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestBindRetry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	r := testRule("127.0.0.1:1")
+	r.Listen.Address = l.Addr().String()
+	r.BindRetryWindow = Duration(5 * time.Second)
+	f, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the predecessor releases the port after a moment
+	retrying := make(chan ForwarderState, 1)
+	time.AfterFunc(200*time.Millisecond, func() {
+		retrying <- f.State()
+		_ = l.Close()
+	})
+
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	if f.Addr().String() != r.Listen.Address {
+		t.Errorf("want = %s; got = %s", r.Listen.Address, f.Addr())
+	}
+	if state := <-retrying; state != StateStarting {
+		t.Errorf("want = %s while retrying; got = %s", StateStarting, state)
+	}
+	if f.State() != StateListening {
+		t.Errorf("want = %s; got = %s", StateListening, f.State())
+	}
+	f.Stop()
+	if f.State() != StateStopped {
+		t.Errorf("want = %s; got = %s", StateStopped, f.State())
+	}
+}
+
+func TestAcceptors(t *testing.T) {
+	echo, _ := haraldtest.EchoServer(t)
+	r := testRule(echo)
+	r.Acceptors = 4
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	lc := haraldtest.LoadClient{Connections: 32, Bytes: 64 << 10}
+	for i, res := range lc.Run(t, f.Addr().String()) {
+		if !res.Intact {
+			t.Errorf("connection %d: expected data to arrive intact, got %+v", i, res)
+		}
+	}
+
+	// the listener is reopened to change the number of acceptors
+	r.Acceptors = 2
+	g, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if g.takeOver(f) {
+		t.Error("expected the listener not to be taken over with a different number of acceptors")
+	}
+
+	r.Acceptors = -1
+	if _, err = r.NewForwarder("test", time.Second); err == nil {
+		t.Error("expected error for a negative number of acceptors")
+	}
+}
+
+// TestStopRejectsQueuedConnection ensures that a connection waiting for a
+// worker doesn't keep the accept loop blocked once the listener is closed.
+func TestStopRejectsQueuedConnection(t *testing.T) {
+	echo, _ := haraldtest.EchoServer(t)
+	r := testRule(echo)
+	r.Workers = &Workers{Max: 1, Overflow: OverflowQueue}
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	busy, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer busy.Close()
+	queued, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer queued.Close()
+
+	for deadline := time.Now().Add(time.Second); f.handlers.Load() < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the second connection to wait for a worker")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.Stop()
+
+	_ = queued.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = queued.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("expected the queued connection to be closed; got %v", err)
+	}
+	if n := f.handlers.Load(); n != 1 {
+		t.Errorf("expected only the busy connection to be handled; got %d", n)
+	}
+}
@@ -3,6 +3,7 @@ package haraldtest
 import (
 	"io"
 	"net"
+	"sync/atomic"
 	"testing"
 )
 
@@ -32,3 +33,32 @@ func EchoChamber(t *testing.T) string {
 
 	return listener.Addr().String()
 }
+
+// EchoServer is like EchoChamber but accepts any number of connections until
+// the test has finished. The returned function reports the number of
+// connections accepted so far.
+func EchoServer(t *testing.T) (addr string, accepted func() int) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	var n atomic.Int64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			n.Add(1)
+			go func() {
+				defer func() { _ = conn.Close() }()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), func() int { return int(n.Load()) }
+}
@@ -0,0 +1,120 @@
+package haraldtest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// LoadClient opens a number of concurrent connections through a forwarder to
+// an echo backend (e.g. EchoServer) and sends random data on each of them.
+// The data read back is compared to the data sent by their checksums, each
+// connection sends different data so mixed up streams are detected as well.
+type LoadClient struct {
+	// Connections is the number of concurrent connections, defaults to 1.
+	Connections int
+	// Bytes is the data sent on each connection, defaults to 1MiB.
+	Bytes int
+	// ChunkSize is the size of each write, defaults to 32KiB.
+	ChunkSize int
+	// Timeout limits the duration of each connection, defaults to 10s.
+	Timeout time.Duration
+}
+
+// LoadResult describes a single connection of a LoadClient.
+type LoadResult struct {
+	Sent, Received int64
+	// Intact is set if the data received matches the data sent.
+	Intact bool
+	// Setup is the duration until the connection has been established,
+	// Duration the time until all data has been read back.
+	Setup, Duration time.Duration
+	// Err is the first error of the connection.
+	Err error
+}
+
+// Run sends the data through the tcp address addr and returns the result of
+// each connection. It only fails the test if the parameters are invalid.
+func (lc LoadClient) Run(t *testing.T, addr string) []LoadResult {
+	t.Helper()
+	conns, size, chunk, timeout := lc.Connections, lc.Bytes, lc.ChunkSize, lc.Timeout
+	if conns == 0 {
+		conns = 1
+	}
+	if size == 0 {
+		size = 1 << 20
+	}
+	if chunk == 0 {
+		chunk = 32 << 10
+	}
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	if conns < 0 || size < 0 || chunk < 0 {
+		t.Fatalf("invalid load client %+v", lc)
+	}
+
+	results := make([]LoadResult, conns)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runLoad(addr, uint64(i), size, chunk, timeout)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func runLoad(addr string, seed uint64, size, chunk int, timeout time.Duration) (res LoadResult) {
+	start := time.Now()
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer func() { _ = c.Close() }()
+	res.Setup = time.Since(start)
+	_ = c.SetDeadline(start.Add(timeout))
+
+	sent := sha256.New()
+	done := make(chan error, 1)
+	go func() {
+		rng := rand.NewChaCha8([32]byte{byte(seed), byte(seed >> 8), byte(seed >> 16), byte(seed >> 24)})
+		buf := make([]byte, chunk)
+		for remaining := size; remaining > 0; {
+			b := buf[:min(remaining, chunk)]
+			_, _ = rng.Read(b)
+			_, _ = sent.Write(b)
+			n, err := c.Write(b)
+			res.Sent += int64(n)
+			if err != nil {
+				done <- err
+				return
+			}
+			remaining -= n
+		}
+		done <- nil
+	}()
+
+	received := sha256.New()
+	n, err := io.CopyN(received, c, int64(size))
+	res.Received = n
+	werr := <-done
+	res.Duration = time.Since(start)
+
+	switch {
+	case werr != nil:
+		res.Err = werr
+	case err != nil:
+		res.Err = err
+	}
+	res.Intact = res.Err == nil && bytes.Equal(sent.Sum(nil), received.Sum(nil))
+	return res
+}
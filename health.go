@@ -0,0 +1,66 @@
+package harald
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// listenHTTP opens the optional HTTP listener which serves:
+//
+//   - /healthz: always 200 as long as the process is alive.
+//   - /readyz: 200 if at least one forwarder is listening and the server is
+//     not shutting down, 503 otherwise.
+func (s *Server) listenHTTP(c NetConf) (*http.Server, error) {
+	l, err := net.Listen(c.Network, c.Address)
+	if err != nil {
+		return nil, withKind(ErrBind, fmt.Errorf("http: %w", err))
+	}
+
+	srv := &http.Server{
+		Handler:           s.httpHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		err := srv.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("http listener stopped", attrError(err))
+		}
+	}()
+
+	return srv, nil
+}
+
+func (s *Server) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if !s.ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, "not ready\n")
+			return
+		}
+		_, _ = io.WriteString(w, "ready\n")
+	})
+	return mux
+}
+
+// ready reports whether the server is accepting connections.
+func (s *Server) ready() bool {
+	if s.stopping.Load() {
+		return false
+	}
+	for _, f := range s.getForwarders() {
+		if f.State() == StateListening {
+			return true
+		}
+	}
+	return false
+}
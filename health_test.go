@@ -0,0 +1,48 @@
+package harald
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPHealthEndpoints(t *testing.T) {
+	s, err := NewServer(Config{
+		Rules: map[string]ForwardRule{
+			"test": {
+				Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+				Connect: NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	h := s.httpHandler()
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz: expected %d, got %d", http.StatusOK, code)
+	}
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz without listeners: expected %d, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	s.setListening(true)
+	defer s.setListening(false)
+
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz with listeners: expected %d, got %d", http.StatusOK, code)
+	}
+
+	s.stopping.Store(true)
+
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz while stopping: expected %d, got %d", http.StatusServiceUnavailable, code)
+	}
+}
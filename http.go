@@ -0,0 +1,129 @@
+package harald
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// Protocols spoken by the clients of a rule.
+const (
+	// ProtocolTCP forwards the data of the clients as is (default).
+	ProtocolTCP = "tcp"
+	// ProtocolHTTP parses the HTTP/1.x requests of the clients and adds the
+	// forwarding headers to each of them.
+	ProtocolHTTP = "http"
+)
+
+// Headers added to the requests of rules using ProtocolHTTP. Any values sent
+// by the client are replaced, they can't be trusted.
+const (
+	headerForwardedFor   = "X-Forwarded-For"
+	headerForwardedProto = "X-Forwarded-Proto"
+	// headerClientCert holds the verified client certificate as URL encoded
+	// PEM, the same format nginx uses for $ssl_client_escaped_cert.
+	headerClientCert        = "X-Client-Cert"
+	headerClientCertSubject = "X-Client-Cert-Subject"
+)
+
+func validateProtocol(p string) error {
+	switch p {
+	case "", ProtocolTCP, ProtocolHTTP:
+		return nil
+	default:
+		return fmt.Errorf("unknown protocol '%s'", p)
+	}
+}
+
+// forwardedHeaders returns the headers added to each request of a client
+// connected from addr. The TLS state is nil if the rule doesn't terminate
+// TLS.
+func forwardedHeaders(addr netip.Addr, state *tls.ConnectionState) http.Header {
+	h := http.Header{}
+	if addr.IsValid() {
+		h.Set(headerForwardedFor, addr.String())
+	}
+	if state == nil {
+		h.Set(headerForwardedProto, "http")
+		return h
+	}
+	h.Set(headerForwardedProto, "https")
+	if len(state.VerifiedChains) > 0 {
+		cert := state.PeerCertificates[0]
+		h.Set(headerClientCert, url.PathEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))))
+		h.Set(headerClientCertSubject, cert.Subject.String())
+	}
+	return h
+}
+
+// copyHTTP reads the requests from src and writes them to dst with the
+// headers replaced. Once a request upgrades the connection to a different
+// protocol (e.g. websockets) the remaining data is copied as is. It returns
+// the number of bytes written.
+func copyHTTP(dst io.Writer, src io.Reader, headers http.Header, size int) (int64, error) {
+	w := &countingWriter{Writer: dst}
+	r := bufio.NewReader(src)
+	for {
+		req, err := http.ReadRequest(r)
+		if errors.Is(err, io.EOF) {
+			return w.n, nil
+		}
+		if err != nil {
+			return w.n, fmt.Errorf("reading request: %w", err)
+		}
+
+		for _, k := range []string{headerForwardedFor, headerForwardedProto, headerClientCert, headerClientCertSubject} {
+			req.Header.Del(k)
+		}
+		for k, v := range headers {
+			req.Header[k] = v
+		}
+		// Request.Write adds its own user agent to requests without one.
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header["User-Agent"] = []string{""}
+		}
+
+		err = req.Write(w)
+		if err != nil {
+			return w.n, fmt.Errorf("writing request: %w", err)
+		}
+
+		if req.Method == http.MethodConnect || upgrades(req.Header) {
+			n, err := copyBuffer(dst, r, size)
+			return w.n + n, err
+		}
+	}
+}
+
+// upgrades reports whether the headers request a protocol upgrade.
+func upgrades(h http.Header) bool {
+	if h.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range h.Values("Connection") {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,149 @@
+package harald
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+// headerServer responds to each request with the value of the header named
+// by the path.
+func headerServer(t *testing.T) string {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Join(r.Header.Values(strings.TrimPrefix(r.URL.Path, "/")), ","))
+	}))
+	t.Cleanup(s.Close)
+	return s.Listener.Addr().String()
+}
+
+func get(t *testing.T, c *http.Client, url string, header http.Header) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.Header = header
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return string(b)
+}
+
+func TestProtocolHTTP(t *testing.T) {
+	r := testRule(headerServer(t))
+	r.Protocol = ProtocolHTTP
+	r.ConnIDHeader = "X-Request-Id"
+	f, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	// a single client to send all requests over the same connection
+	c := &http.Client{}
+	base := "http://" + f.Addr().String() + "/"
+	spoofed := http.Header{headerForwardedFor: {"192.0.2.1"}, headerClientCert: {"forged"}}
+
+	for i := 0; i < 2; i++ {
+		if got := get(t, c, base+headerForwardedFor, spoofed); got != "127.0.0.1" {
+			t.Errorf("want = 127.0.0.1; got = %s", got)
+		}
+	}
+	if got := get(t, c, base+headerForwardedProto, nil); got != "http" {
+		t.Errorf("want = http; got = %s", got)
+	}
+	if got := get(t, c, base+headerClientCert, spoofed); got != "" {
+		t.Errorf("expected client certificate header to be removed; got = %s", got)
+	}
+	if got := get(t, c, base+"User-Agent", http.Header{"User-Agent": {"test"}}); got != "test" {
+		t.Errorf("want = test; got = %s", got)
+	}
+	// all requests of a connection carry its id
+	id := get(t, c, base+"X-Request-Id", http.Header{"X-Request-Id": {"forged"}})
+	if id == "" || id == "forged" {
+		t.Errorf("expected the connection id; got = %s", id)
+	}
+	if got := get(t, c, base+"X-Request-Id", nil); got != id {
+		t.Errorf("want = %s; got = %s", id, got)
+	}
+}
+
+func TestProtocolHTTPClientCertificate(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+
+	r := testRule(headerServer(t))
+	r.Protocol = ProtocolHTTP
+	r.TLS = &TLS{
+		Certificate: string(crt),
+		Key:         string(key),
+		ClientCAs:   string(ca.PEM()),
+		ClientAuth:  tls.RequireAndVerifyClientCert,
+	}
+	f, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	clientCert, err := tls.X509KeyPair(ca.NewClientCertificate(t))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{clientCert}, RootCAs: x509.NewCertPool()}
+	conf.RootCAs.AddCert(ca.Certificate())
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+	base := "https://" + f.Addr().String() + "/"
+
+	if got := get(t, c, base+headerForwardedProto, nil); got != "https" {
+		t.Errorf("want = https; got = %s", got)
+	}
+
+	escaped := get(t, c, base+headerClientCert, nil)
+	unescaped, err := url.PathUnescape(escaped)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, _ := pem.Decode([]byte(unescaped))
+	if b == nil || string(b.Bytes) != string(clientCert.Certificate[0]) {
+		t.Errorf("expected the client certificate; got = %s", escaped)
+	}
+}
+
+func TestUpgrades(t *testing.T) {
+	for _, tc := range []struct {
+		header http.Header
+		want   bool
+	}{
+		{http.Header{"Upgrade": {"websocket"}, "Connection": {"keep-alive, Upgrade"}}, true},
+		{http.Header{"Upgrade": {"websocket"}}, false},
+		{http.Header{"Connection": {"upgrade"}}, false},
+	} {
+		if got := upgrades(tc.header); got != tc.want {
+			t.Errorf("%v: want = %t; got = %t", tc.header, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package harald
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxReapInterval limits how long an idle connection may outlive its timeout.
+const maxReapInterval = 30 * time.Second
+
+// idleReaper closes connections which didn't transfer any data in either
+// direction for longer than the timeout. It runs in the background as long
+// as there are connections to watch. A nil *idleReaper doesn't track
+// connections.
+type idleReaper struct {
+	timeout time.Duration
+	reaped  *atomic.Uint64
+
+	mu      sync.Mutex
+	conns   map[*idleConn]struct{}
+	running bool
+}
+
+func newIdleReaper(timeout time.Duration, reaped *atomic.Uint64) *idleReaper {
+	if timeout <= 0 {
+		return nil
+	}
+	return &idleReaper{
+		timeout: timeout,
+		reaped:  reaped,
+		conns:   make(map[*idleConn]struct{}),
+	}
+}
+
+// idleConn is a forwarded connection watched by the reaper.
+type idleConn struct {
+	source, target net.Conn
+	log            *slog.Logger
+	// lastActive is the time of the last read in unix nanoseconds, it is
+	// shared with the connection table.
+	lastActive *atomic.Int64
+}
+
+// track watches the connection until the returned function is called. The
+// returned connections replace source and target, they record the time of
+// each read in lastActive and therefore hide the fast paths of io.Copy.
+func (r *idleReaper) track(source, target net.Conn, lastActive *atomic.Int64, log *slog.Logger) (net.Conn, net.Conn, func()) {
+	if r == nil {
+		return source, target, func() {}
+	}
+
+	c := &idleConn{source: source, target: target, lastActive: lastActive, log: log}
+	c.lastActive.Store(time.Now().UnixNano())
+
+	r.mu.Lock()
+	r.conns[c] = struct{}{}
+	if !r.running {
+		r.running = true
+		go r.run()
+	}
+	r.mu.Unlock()
+
+	untrack := func() {
+		r.mu.Lock()
+		delete(r.conns, c)
+		r.mu.Unlock()
+	}
+	return &activityConn{Conn: source, c: c}, &activityConn{Conn: target, c: c}, untrack
+}
+
+// run reaps idle connections until none are left to watch.
+func (r *idleReaper) run() {
+	t := time.NewTicker(max(min(r.timeout/4, maxReapInterval), time.Millisecond))
+	defer t.Stop()
+
+	for now := range t.C {
+		r.mu.Lock()
+		if len(r.conns) == 0 {
+			r.running = false
+			r.mu.Unlock()
+			return
+		}
+		var idle []*idleConn
+		for c := range r.conns {
+			if now.Sub(time.Unix(0, c.lastActive.Load())) > r.timeout {
+				idle = append(idle, c)
+				delete(r.conns, c)
+			}
+		}
+		r.mu.Unlock()
+
+		for _, c := range idle {
+			c.log.Info("closing idle connection", slog.Duration("idle", now.Sub(time.Unix(0, c.lastActive.Load()))))
+			r.reaped.Add(1)
+			_ = c.source.Close()
+			_ = c.target.Close()
+		}
+	}
+}
+
+// activityConn records the time of each successful read.
+type activityConn struct {
+	net.Conn
+	c *idleConn
+}
+
+func (a *activityConn) Read(b []byte) (int, error) {
+	n, err := a.Conn.Read(b)
+	if n > 0 {
+		a.c.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
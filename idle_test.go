@@ -0,0 +1,59 @@
+package harald
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	echo, _ := haraldtest.EchoServer(t)
+
+	r := testRule(echo)
+	r.IdleTimeout = Duration(200 * time.Millisecond)
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	c, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// an active connection is kept open past the timeout
+	b := make([]byte, 4)
+	for i := 0; i < 6; i++ {
+		_, err = c.Write([]byte("ping"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = io.ReadFull(c, b)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	start := time.Now()
+	_, err = c.Read(b)
+	if err != io.EOF {
+		t.Fatalf("expected the idle connection to be closed; got = %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("idle connection was closed after %s", d)
+	}
+	if n := f.Stats().IdleReaped; n != 1 {
+		t.Errorf("want = 1; got = %d", n)
+	}
+}
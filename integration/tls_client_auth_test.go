@@ -1,7 +1,5 @@
 // Package integration holds the tests that run harald as a block box by
-// calling harald.Harald without accessing any internal details.
-//
-// TODO: find a way to automatically select unused ports
+// using the exported API without accessing any internal details.
 package integration
 
 import (
@@ -23,17 +21,16 @@ func TestTlsWithClientAuth(t *testing.T) {
 	ca := haraldtest.NewCertificateAuthority(t)
 	serverCertPem, serverKeyPem := ca.NewServerCertificate(t)
 
-	haraldAddr := "localhost:60001"
 	backendAddr := haraldtest.EchoChamber(t)
 
-	go harald.Harald(harald.Config{
+	s, err := harald.NewServer(harald.Config{
 		LogLevel:    slog.LevelDebug,
 		DialTimeout: harald.Duration(10 * time.Millisecond),
 		Rules: map[string]harald.ForwardRule{
 			"http": {
 				Listen: harald.NetConf{
 					Network: "tcp",
-					Address: haraldAddr,
+					Address: "127.0.0.1:0",
 				},
 				Connect: harald.NetConf{
 					Network: "tcp",
@@ -45,7 +42,12 @@ func TestTlsWithClientAuth(t *testing.T) {
 					ClientCAs:   string(ca.PEM()),
 				},
 			}},
-	}, signals)
+	})
+	if err != nil {
+		t.Fatalf("new server: %s", err.Error())
+	}
+
+	go s.Run(signals)
 
 	signals <- syscall.SIGUSR1
 	defer func() { signals <- syscall.SIGTERM }()
@@ -53,6 +55,11 @@ func TestTlsWithClientAuth(t *testing.T) {
 	// signal processing may take some time
 	time.Sleep(100 * time.Millisecond)
 
+	haraldAddr, ok := s.Addrs()["http"]
+	if !ok {
+		t.Fatal("rule 'http' is not listening")
+	}
+
 	clientCert, err := tls.X509KeyPair(ca.NewClientCertificate(t))
 	if err != nil {
 		t.Fatalf("load x509 key pair: %s", err.Error())
@@ -65,7 +72,7 @@ func TestTlsWithClientAuth(t *testing.T) {
 
 	clientConf.RootCAs.AddCert(ca.Certificate())
 
-	conn, err := tls.Dial("tcp", haraldAddr, clientConf)
+	conn, err := tls.Dial("tcp", haraldAddr.String(), clientConf)
 	if err != nil {
 		t.Fatalf("connect to harald: %s", err.Error())
 	}
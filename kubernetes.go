@@ -0,0 +1,286 @@
+package harald
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir contains the credentials kubernetes mounts into every pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesDiscovery watches the EndpointSlices of a kubernetes service. The
+// API server is reached via the in-cluster config of the pod harald runs in.
+type KubernetesDiscovery struct {
+	// Namespace of the service, defaults to the namespace of the pod.
+	Namespace string `json:"namespace" yaml:"namespace" toml:"namespace"`
+	Service   string `json:"service" yaml:"service" toml:"service"`
+	// Port is the name of the port of the service, required if the service
+	// has more than one port.
+	Port string `json:"port" yaml:"port" toml:"port"`
+}
+
+// kubernetesSource lists the EndpointSlices of the service and watches them
+// for changes. Every change causes the slices to be listed again.
+type kubernetesSource struct {
+	conf      KubernetesDiscovery
+	network   string
+	endpoint  *url.URL
+	tokenFile string
+	retry     time.Duration
+	client    *http.Client
+	log       *slog.Logger
+}
+
+// endpointSliceList contains the fields we need from the response of
+// /apis/discovery.k8s.io/v1/namespaces/:namespace/endpointslices.
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []struct {
+		Endpoints []struct {
+			Addresses  []string `json:"addresses"`
+			Conditions struct {
+				// Ready is nil if the state is unknown which should be
+				// interpreted as ready.
+				Ready *bool `json:"ready"`
+			} `json:"conditions"`
+		} `json:"endpoints"`
+		Ports []endpointPort `json:"ports"`
+	} `json:"items"`
+}
+
+type endpointPort struct {
+	Name *string `json:"name"`
+	Port *int    `json:"port"`
+}
+
+func newKubernetesSource(c KubernetesDiscovery, network string, retry time.Duration, log *slog.Logger) (*kubernetesSource, error) {
+	if c.Service == "" {
+		return nil, fmt.Errorf("kubernetes: missing service name")
+	}
+	return &kubernetesSource{
+		conf:    c,
+		network: network,
+		retry:   retry,
+		log:     log,
+	}, nil
+}
+
+// inCluster reads the in-cluster config of the pod. It is only read once the
+// source is watched, this way rules can be checked outside of the cluster.
+func (s *kubernetesSource) inCluster() error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("kubernetes: not running inside a cluster")
+	}
+
+	namespace := s.conf.Namespace
+	if namespace == "" {
+		ns, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return fmt.Errorf("kubernetes: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return fmt.Errorf("kubernetes: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("kubernetes: unable to parse ca.crt")
+	}
+
+	endpoint := &url.URL{Scheme: "https", Host: net.JoinHostPort(host, port)}
+	s.endpoint = endpoint.JoinPath("/apis/discovery.k8s.io/v1/namespaces", namespace, "endpointslices")
+	s.tokenFile = filepath.Join(serviceAccountDir, "token")
+	s.client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}
+	return nil
+}
+
+func (s *kubernetesSource) watch(ctx context.Context, update func([]target)) {
+	for {
+		err := s.sync(ctx, update)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.log.Error("watching endpoint slices failed", attrError(err))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(s.retry):
+			}
+		}
+	}
+}
+
+// sync lists the endpoint slices, passes the targets to update and blocks
+// until the slices change.
+func (s *kubernetesSource) sync(ctx context.Context, update func([]target)) error {
+	if s.endpoint == nil {
+		err := s.inCluster()
+		if err != nil {
+			return err
+		}
+	}
+
+	targets, version, err := s.list(ctx)
+	if err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+	s.log.Debug("received endpoint slices", slog.Int("targets", len(targets)))
+	update(targets)
+
+	err = s.waitForChange(ctx, version)
+	if err != nil {
+		return fmt.Errorf("watch: %w", err)
+	}
+	return nil
+}
+
+func (s *kubernetesSource) list(ctx context.Context) ([]target, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	resp, err := s.get(ctx, url.Values{})
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var l endpointSliceList
+	err = json.NewDecoder(resp.Body).Decode(&l)
+	if err != nil {
+		return nil, "", fmt.Errorf("decode response: %w", err)
+	}
+
+	// an endpoint may be part of multiple slices during updates
+	seen := make(map[string]bool)
+	var targets []target
+	for _, slice := range l.Items {
+		port, ok := s.port(slice.Ports)
+		if !ok {
+			continue
+		}
+		for _, e := range slice.Endpoints {
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+			for _, a := range e.Addresses {
+				addr := net.JoinHostPort(a, strconv.Itoa(port))
+				if seen[addr] {
+					continue
+				}
+				seen[addr] = true
+				targets = append(targets, target{NetConf: NetConf{Network: s.network, Address: addr}})
+			}
+		}
+	}
+
+	return targets, l.Metadata.ResourceVersion, nil
+}
+
+// port returns the port number matching the configured port name.
+func (s *kubernetesSource) port(ports []endpointPort) (int, bool) {
+	for _, p := range ports {
+		if p.Port == nil {
+			continue
+		}
+		name := ""
+		if p.Name != nil {
+			name = *p.Name
+		}
+		if s.conf.Port == "" || s.conf.Port == name {
+			return *p.Port, true
+		}
+	}
+	return 0, false
+}
+
+// waitForChange watches the endpoint slices starting at version and returns
+// once the first event has been received or the api server ended the watch.
+func (s *kubernetesSource) waitForChange(ctx context.Context, version string) error {
+	q := url.Values{}
+	q.Set("watch", "true")
+	q.Set("resourceVersion", version)
+	q.Set("allowWatchBookmarks", "false")
+
+	resp, err := s.get(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var event struct {
+		Type string `json:"type"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&event)
+	if errors.Is(err, io.EOF) {
+		// the api server ends watches after a while, this is not an error
+		s.log.Debug("watch ended, listing endpoint slices again")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("decode event: %w", err)
+	}
+	if event.Type == "ERROR" {
+		// most likely the version is too old, listing again resolves it
+		s.log.Debug("watch returned an error, listing endpoint slices again")
+	}
+	return nil
+}
+
+func (s *kubernetesSource) get(ctx context.Context, q url.Values) (*http.Response, error) {
+	q.Set("labelSelector", "kubernetes.io/service-name="+s.conf.Service)
+	u := *s.endpoint
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	// the token is rotated by kubernetes, so we read it for every request
+	token, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status '%s'", resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *kubernetesSource) String() string {
+	if s.conf.Namespace == "" {
+		return "kubernetes:" + s.network + "@" + s.conf.Service
+	}
+	return "kubernetes:" + s.network + "@" + s.conf.Namespace + "/" + s.conf.Service
+}
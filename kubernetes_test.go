@@ -0,0 +1,155 @@
+package harald
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKubernetesSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" || r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=web" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Query().Get("watch") == "true" {
+			<-r.Context().Done()
+			return
+		}
+		_, _ = w.Write([]byte(`{"metadata": {"resourceVersion": "5"}, "items": [
+			{
+				"endpoints": [
+					{"addresses": ["10.0.0.1"], "conditions": {"ready": true}},
+					{"addresses": ["10.0.0.2"], "conditions": {"ready": false}},
+					{"addresses": ["10.0.0.3"], "conditions": {}}
+				],
+				"ports": [{"name": "http", "port": 8080}, {"name": "https", "port": 8443}]
+			},
+			{
+				"endpoints": [{"addresses": ["10.0.0.1"], "conditions": {"ready": true}}],
+				"ports": [{"name": "https", "port": 8443}]
+			}
+		]}`))
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("token\n"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	endpoint, _ := url.Parse(srv.URL + "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices")
+	s := &kubernetesSource{
+		conf:      KubernetesDiscovery{Namespace: "default", Service: "web", Port: "https"},
+		network:   "tcp",
+		endpoint:  endpoint,
+		tokenFile: tokenFile,
+		retry:     time.Second,
+		client:    srv.Client(),
+		log:       testLogger(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := make(chan []target, 1)
+	go s.watch(ctx, func(targets []target) { updates <- targets })
+
+	var targets []target
+	select {
+	case targets = <-updates:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update received")
+	}
+
+	want := []target{
+		{NetConf: NetConf{Network: "tcp", Address: "10.0.0.1:8443"}},
+		{NetConf: NetConf{Network: "tcp", Address: "10.0.0.3:8443"}},
+	}
+	if len(targets) != len(want) {
+		t.Fatalf("want = %v; got = %v", want, targets)
+	}
+	for i := range want {
+		if targets[i] != want[i] {
+			t.Errorf("target %d: want = %v; got = %v", i, want[i], targets[i])
+		}
+	}
+}
+
+// TestKubernetesSourceWatchEnds ensures that the slices are listed again
+// right away once the api server ends a watch without an event.
+func TestKubernetesSourceWatchEnds(t *testing.T) {
+	var watches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "true" {
+			if watches.Add(1) > 1 {
+				<-r.Context().Done()
+			}
+			return
+		}
+		_, _ = w.Write([]byte(`{"metadata": {"resourceVersion": "5"}, "items": [
+			{"endpoints": [{"addresses": ["10.0.0.1"]}], "ports": [{"port": 8080}]}
+		]}`))
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("token"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	endpoint, _ := url.Parse(srv.URL)
+	s := &kubernetesSource{
+		conf:      KubernetesDiscovery{Namespace: "default", Service: "web"},
+		network:   "tcp",
+		endpoint:  endpoint,
+		tokenFile: tokenFile,
+		retry:     time.Minute,
+		client:    srv.Client(),
+		log:       testLogger(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := make(chan []target, 2)
+	go s.watch(ctx, func(targets []target) { updates <- targets })
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-updates:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected update %d without waiting for the retry interval", i+1)
+		}
+	}
+}
+
+// TestKubernetesSourceRequiresCluster ensures that rules can be created
+// outside of a cluster, e.g. for a dry run, but fail to watch the service.
+func TestKubernetesSourceRequiresCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	r := testRule("")
+	r.Connect = NetConf{}
+	r.Discovery = &Discovery{Type: "kubernetes", Kubernetes: &KubernetesDiscovery{Service: "web"}}
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatalf("expected the rule to be created outside of a cluster: %s", err.Error())
+	}
+
+	err = f.source.(*kubernetesSource).sync(context.Background(), func([]target) {})
+	if err == nil {
+		t.Fatal("expected error outside of a cluster")
+	}
+}
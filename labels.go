@@ -0,0 +1,31 @@
+package harald
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// validateLabels rejects labels which can't be sent as dogstatsd tags.
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if k == "" || strings.ContainsAny(k, ":,|#\n") {
+			return fmt.Errorf("invalid label name '%s'", k)
+		}
+		if strings.ContainsAny(v, ",|#\n") {
+			return fmt.Errorf("invalid value of label '%s'", k)
+		}
+	}
+	return nil
+}
+
+// attrLabels groups the labels of a rule sorted by their name.
+func attrLabels(labels map[string]string) slog.Attr {
+	attrs := make([]any, 0, len(labels))
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		attrs = append(attrs, slog.String(k, labels[k]))
+	}
+	return slog.Group("labels", attrs...)
+}
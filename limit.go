@@ -0,0 +1,145 @@
+package harald
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// sourceLimiter limits the number of concurrent connections per source
+// address. A nil *sourceLimiter does not limit anything.
+type sourceLimiter struct {
+	max   int
+	mu    sync.Mutex
+	conns map[netip.Addr]int
+}
+
+func newSourceLimiter(max int) *sourceLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &sourceLimiter{
+		max:   max,
+		conns: make(map[netip.Addr]int),
+	}
+}
+
+// acquire reserves a connection slot for addr. It returns false if addr
+// already holds the maximum number of connections. Every successful call
+// must be followed by a call to release.
+func (l *sourceLimiter) acquire(addr netip.Addr) bool {
+	if l == nil || !addr.IsValid() {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[addr] >= l.max {
+		return false
+	}
+	l.conns[addr]++
+	return true
+}
+
+func (l *sourceLimiter) release(addr netip.Addr) {
+	if l == nil || !addr.IsValid() {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.conns[addr]--
+	if l.conns[addr] <= 0 {
+		delete(l.conns, addr)
+	}
+}
+
+// Policies for connections arriving while all workers of a rule are busy.
+const (
+	// OverflowReject closes the connection right away.
+	OverflowReject = "reject"
+	// OverflowQueue leaves the connection waiting in the backlog of the
+	// listener until a worker becomes available or the queue timeout passed.
+	OverflowQueue = "queue"
+)
+
+// Workers caps the number of connections a rule handles concurrently.
+type Workers struct {
+	Max int `json:"max" yaml:"max" toml:"max"`
+	// Overflow is either OverflowReject (default) or OverflowQueue.
+	Overflow string `json:"overflow" yaml:"overflow" toml:"overflow"`
+	// QueueTimeout is the maximum time a connection waits for a worker if
+	// Overflow is OverflowQueue, zero waits indefinitely.
+	QueueTimeout Duration `json:"queue_timeout" yaml:"queue_timeout" toml:"queue_timeout"`
+}
+
+// workerLimit is a semaphore for the connections of a forwarder. A nil
+// *workerLimit does not limit anything.
+type workerLimit struct {
+	slots   chan struct{}
+	queue   bool
+	timeout time.Duration
+}
+
+func newWorkerLimit(c *Workers) (*workerLimit, error) {
+	if c == nil || c.Max <= 0 {
+		return nil, nil
+	}
+
+	l := &workerLimit{
+		slots:   make(chan struct{}, c.Max),
+		timeout: c.QueueTimeout.Duration(),
+	}
+	switch c.Overflow {
+	case "", OverflowReject:
+	case OverflowQueue:
+		l.queue = true
+	default:
+		return nil, fmt.Errorf("workers: unknown overflow policy '%s'", c.Overflow)
+	}
+	return l, nil
+}
+
+// acquire reserves a worker, depending on the overflow policy it waits for
+// one to become available or until stop is closed. It returns false if no
+// worker could be reserved. Every successful call must be followed by a call
+// to release.
+func (l *workerLimit) acquire(stop <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if !l.queue {
+		return false
+	}
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		t := time.NewTimer(l.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timeout:
+		return false
+	case <-stop:
+		return false
+	}
+}
+
+func (l *workerLimit) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
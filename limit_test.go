@@ -0,0 +1,110 @@
+package harald
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSourceLimiter(t *testing.T) {
+	l := newSourceLimiter(2)
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("192.0.2.2")
+
+	if !l.acquire(a) || !l.acquire(a) {
+		t.Fatal("expected first two connections to be accepted")
+	}
+	if l.acquire(a) {
+		t.Fatal("expected third connection to be rejected")
+	}
+	if !l.acquire(b) {
+		t.Fatal("expected connection from other source to be accepted")
+	}
+
+	l.release(a)
+	if !l.acquire(a) {
+		t.Fatal("expected connection to be accepted after release")
+	}
+
+	l.release(a)
+	l.release(a)
+	l.release(b)
+	if len(l.conns) != 0 {
+		t.Fatalf("expected no tracked sources, got %d", len(l.conns))
+	}
+}
+
+func TestSourceLimiterUnlimited(t *testing.T) {
+	l := newSourceLimiter(0)
+	if l != nil {
+		t.Fatal("expected nil limiter")
+	}
+	a := netip.MustParseAddr("192.0.2.1")
+	for i := 0; i < 10; i++ {
+		if !l.acquire(a) {
+			t.Fatal("nil limiter must not limit")
+		}
+	}
+}
+
+func TestWorkerLimit(t *testing.T) {
+	l, err := newWorkerLimit(&Workers{Max: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !l.acquire(nil) {
+		t.Fatal("expected first worker to be available")
+	}
+	if l.acquire(nil) {
+		t.Fatal("expected overflow to be rejected")
+	}
+	l.release()
+	if !l.acquire(nil) {
+		t.Fatal("expected released worker to be available")
+	}
+}
+
+func TestWorkerLimitQueue(t *testing.T) {
+	l, err := newWorkerLimit(&Workers{Max: 1, Overflow: OverflowQueue, QueueTimeout: Duration(50 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	l.acquire(nil)
+
+	start := time.Now()
+	if l.acquire(nil) {
+		t.Fatal("expected queued connection to time out")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("expected to wait for the queue timeout; waited %s", d)
+	}
+
+	time.AfterFunc(10*time.Millisecond, l.release)
+	if !l.acquire(nil) {
+		t.Fatal("expected queued connection to get the released worker")
+	}
+}
+
+func TestWorkerLimitQueueStop(t *testing.T) {
+	l, err := newWorkerLimit(&Workers{Max: 1, Overflow: OverflowQueue})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	l.acquire(nil)
+
+	stop := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(stop) })
+	if l.acquire(stop) {
+		t.Fatal("expected queued connection to be rejected once stopped")
+	}
+}
+
+func TestWorkerLimitDisabled(t *testing.T) {
+	l, err := newWorkerLimit(nil)
+	if err != nil || l != nil {
+		t.Fatalf("expected no limit; got %v, %v", l, err)
+	}
+	if _, err = newWorkerLimit(&Workers{Max: 1, Overflow: "drop"}); err == nil {
+		t.Fatal("expected error for unknown overflow policy")
+	}
+}
@@ -0,0 +1,48 @@
+package harald
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+// debugSampler decides which connections log debug messages, all others only
+// log messages of level info and above. A nil *debugSampler samples every
+// connection.
+type debugSampler struct {
+	n     uint64
+	count atomic.Uint64
+}
+
+func newDebugSampler(n int) *debugSampler {
+	if n <= 1 {
+		return nil
+	}
+	return &debugSampler{n: uint64(n)}
+}
+
+// logger returns the logger for the next connection.
+func (s *debugSampler) logger(log *slog.Logger) *slog.Logger {
+	if s == nil || s.count.Add(1)%s.n == 1 {
+		return log
+	}
+	return slog.New(minLevelHandler{Handler: log.Handler(), level: slog.LevelInfo})
+}
+
+// minLevelHandler drops all records below level.
+type minLevelHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h minLevelHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= h.level && h.Handler.Enabled(ctx, l)
+}
+
+func (h minLevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return minLevelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h minLevelHandler) WithGroup(name string) slog.Handler {
+	return minLevelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
@@ -0,0 +1,39 @@
+package harald
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestDebugSampler(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	s := newDebugSampler(3)
+	for i := 0; i < 6; i++ {
+		l := s.logger(log).With("conn", i)
+		l.Debug("debug")
+		l.Error("error")
+	}
+
+	out := buf.String()
+	if n := strings.Count(out, "msg=debug"); n != 2 {
+		t.Errorf("expected debug messages of two connections; got %d", n)
+	}
+	if n := strings.Count(out, "msg=error"); n != 6 {
+		t.Errorf("expected error messages of all connections; got %d", n)
+	}
+}
+
+func TestDebugSamplerDisabled(t *testing.T) {
+	if newDebugSampler(1) != nil {
+		t.Fatal("expected no sampling")
+	}
+	log := slog.Default()
+	var s *debugSampler
+	if s.logger(log) != log {
+		t.Error("expected logger to be returned as is")
+	}
+}
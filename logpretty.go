@@ -0,0 +1,174 @@
+package harald
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// prettyMessageWidth is the width the messages are padded to, so the
+// attributes of consecutive lines start in the same column.
+const prettyMessageWidth = 32
+
+// prettyConnIDLength is the number of characters of a connection ID which are
+// shown, the end of all ID formats is random.
+const prettyConnIDLength = 8
+
+const (
+	colorReset  = "\x1b[0m"
+	colorDim    = "\x1b[2m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+)
+
+// prettyHandler writes the logs in a compact form which is easy to read in a
+// terminal, e.g. while running harald interactively during development:
+//
+//	15:04:05.000 INF connection accepted            rule=http conn-id=1b9d6bcd source=127.0.0.1:52814
+//
+// Levels and errors are colored if w is a terminal and NO_COLOR isn't set.
+// The handlers derived from it share mu.
+type prettyHandler struct {
+	w     io.Writer
+	mu    *sync.Mutex
+	level slog.Leveler
+	color bool
+	// attrs are the formatted attributes added with WithAttrs, group is the
+	// prefix of the keys added from now on.
+	attrs string
+	group string
+}
+
+func newPrettyHandler(w io.Writer, level slog.Leveler) *prettyHandler {
+	if level == nil {
+		level = slog.LevelInfo
+	}
+	color := false
+	if f, ok := w.(*os.File); ok && os.Getenv("NO_COLOR") == "" {
+		fi, err := f.Stat()
+		color = err == nil && fi.Mode()&os.ModeCharDevice != 0
+	}
+	return &prettyHandler{w: w, mu: &sync.Mutex{}, level: level, color: color}
+}
+
+func (h *prettyHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *prettyHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	if !r.Time.IsZero() {
+		h.colored(&buf, colorDim, r.Time.Format(time.TimeOnly+".000"))
+		buf.WriteByte(' ')
+	}
+	h.writeLevel(&buf, r.Level)
+	buf.WriteByte(' ')
+	buf.WriteString(r.Message)
+	if n := prettyMessageWidth - len(r.Message); n > 0 && (h.attrs != "" || r.NumAttrs() > 0) {
+		buf.WriteString(strings.Repeat(" ", n))
+	}
+	buf.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		h.writeAttr(&buf, h.group, a)
+		return true
+	})
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *prettyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var buf bytes.Buffer
+	for _, a := range attrs {
+		h.writeAttr(&buf, h.group, a)
+	}
+	c := *h
+	c.attrs += buf.String()
+	return &c
+}
+
+func (h *prettyHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.group += name + "."
+	return &c
+}
+
+func (h *prettyHandler) writeLevel(buf *bytes.Buffer, l slog.Level) {
+	switch {
+	case l >= slog.LevelError:
+		h.colored(buf, colorRed, "ERR")
+	case l >= slog.LevelWarn:
+		h.colored(buf, colorYellow, "WRN")
+	case l >= slog.LevelInfo:
+		h.colored(buf, colorGreen, "INF")
+	default:
+		h.colored(buf, colorCyan, "DBG")
+	}
+}
+
+// writeAttr writes a as key=value, groups are flattened into keys joined by
+// dots.
+func (h *prettyHandler) writeAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, g := range v.Group() {
+			h.writeAttr(buf, prefix, g)
+		}
+		return
+	}
+
+	buf.WriteByte(' ')
+	h.colored(buf, colorDim, prefix+a.Key+"=")
+	s := v.String()
+	if a.Key == attrConnId("").Key && len(s) > prettyConnIDLength {
+		s = s[len(s)-prettyConnIDLength:]
+	}
+	s = quoteIfNeeded(s)
+	if a.Key == "error" {
+		h.colored(buf, colorRed, s)
+	} else {
+		buf.WriteString(s)
+	}
+}
+
+func (h *prettyHandler) colored(buf *bytes.Buffer, color, s string) {
+	if !h.color {
+		buf.WriteString(s)
+		return
+	}
+	buf.WriteString(color)
+	buf.WriteString(s)
+	buf.WriteString(colorReset)
+}
+
+// quoteIfNeeded quotes values which are empty or contain spaces, quotes or
+// other characters which would make the line ambiguous.
+func quoteIfNeeded(s string) string {
+	if s == "" || strings.ContainsFunc(s, func(r rune) bool {
+		return r == '"' || r == '=' || unicode.IsSpace(r) || !unicode.IsPrint(r)
+	}) {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,46 @@
+package harald
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestPrettyHandler(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(newPrettyHandler(&buf, slog.LevelDebug)).With(attrRule("http"))
+
+	log.Debug("dialing", attrConnId("1b9d6bcd-bbfd-4b2d-9b5d-ab8dfbbd4bed"), slog.Group("tls", "version", "1.3"))
+	log.Error("dial failed", attrError(errors.New("connection refused")), "empty", "")
+	log.Info("done")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("want = 3 lines; got:\n%s", buf.String())
+	}
+	for i, want := range []string{
+		"DBG dialing                          rule=http conn-id=fbbd4bed tls.version=1.3",
+		`ERR dial failed                      rule=http error="connection refused" empty=""`,
+		"INF done                             rule=http",
+	} {
+		// the lines start with the time
+		_, got, _ := strings.Cut(lines[i], " ")
+		if got != want {
+			t.Errorf("want = %q; got = %q", want, got)
+		}
+	}
+	if strings.Contains(buf.String(), "\x1b[") {
+		t.Error("expected no colors if the output isn't a terminal")
+	}
+}
+
+func TestPrettyHandlerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(newPrettyHandler(&buf, slog.LevelWarn))
+	log.Info("ignored")
+	if buf.Len() != 0 {
+		t.Errorf("expected no output; got = %q", buf.String())
+	}
+}
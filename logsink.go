@@ -0,0 +1,195 @@
+package harald
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"sync"
+)
+
+// Outputs of a log sink, all other outputs are the path of a file.
+const (
+	LogOutputStdout = "stdout"
+	LogOutputStderr = "stderr"
+	LogOutputSyslog = "syslog"
+)
+
+// LogSink is one of the outputs the operational logs are written to, each of
+// them filters and formats the messages on its own.
+type LogSink struct {
+	// Output is either LogOutputStdout, LogOutputStderr, LogOutputSyslog or
+	// the path of a file the logs are appended to.
+	Output string `json:"output" yaml:"output" toml:"output"`
+	// Level is the minimum level of the messages written to the sink,
+	// defaults to info.
+	Level slog.Level `json:"level" yaml:"level" toml:"level"`
+	// Format is either "json" (default), "text" or "pretty".
+	Format string `json:"format" yaml:"format" toml:"format"`
+	// Network and Address of a remote syslog daemon, the local one is used
+	// if they are empty. Only used by the syslog output.
+	Network string `json:"network" yaml:"network" toml:"network"`
+	Address string `json:"address" yaml:"address" toml:"address"`
+}
+
+// LogHandler returns the handler writing to all log sinks of the config.
+// Without sinks the logs are written to the standard output in LogFormat at
+// level, or to the standard error if a rule uses the standard output.
+func (c Config) LogHandler(level slog.Leveler) (slog.Handler, error) {
+	if len(c.Logs) == 0 {
+		out := os.Stdout
+		if c.UsesStdio() {
+			out = os.Stderr
+		}
+		h, err := NewLogHandler(out, c.LogFormat, level)
+		if err != nil {
+			return nil, fmt.Errorf("log format: %w", err)
+		}
+		return h, nil
+	}
+	handlers := make(multiHandler, 0, len(c.Logs))
+	for i, s := range c.Logs {
+		if s.Output == LogOutputStdout && c.UsesStdio() {
+			return nil, fmt.Errorf("logs: %d: the standard output is used by a rule on stdio", i)
+		}
+		h, err := s.handler()
+		if err != nil {
+			return nil, fmt.Errorf("logs: %d: %w", i, err)
+		}
+		handlers = append(handlers, h)
+	}
+	return handlers, nil
+}
+
+// NewLogHandler returns a handler writing the logs to w in the given format,
+// either "json" (default), "text" or "pretty".
+func NewLogHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "", "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "pretty":
+		return newPrettyHandler(w, level), nil
+	default:
+		return nil, fmt.Errorf("unknown format '%s'", format)
+	}
+}
+
+func (s LogSink) handler() (slog.Handler, error) {
+	switch s.Output {
+	case "":
+		return nil, fmt.Errorf("missing output")
+	case LogOutputStdout:
+		return NewLogHandler(os.Stdout, s.Format, s.Level)
+	case LogOutputStderr:
+		return NewLogHandler(os.Stderr, s.Format, s.Level)
+	case LogOutputSyslog:
+		h := &syslogHandler{buf: &bytes.Buffer{}, mu: &sync.Mutex{}}
+		var err error
+		h.Handler, err = NewLogHandler(h.buf, s.Format, s.Level)
+		if err != nil {
+			return nil, err
+		}
+		h.w, err = syslog.Dial(s.Network, s.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, "harald")
+		if err != nil {
+			return nil, fmt.Errorf("syslog: %w", err)
+		}
+		return h, nil
+	default:
+		// the file is opened before privileges are dropped, it is kept open
+		// for the lifetime of the process.
+		f, err := os.OpenFile(s.Output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		h, err := NewLogHandler(f, s.Format, s.Level)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return h, nil
+	}
+}
+
+// multiHandler passes each record to all of its handlers which are enabled
+// for its level.
+type multiHandler []slog.Handler
+
+func (h multiHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, handler := range h {
+		if handler.Enabled(ctx, r.Level) {
+			errs = append(errs, handler.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (h multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return handlers
+}
+
+// syslogHandler formats each record into buf and sends it with the severity
+// matching its level. The handlers derived from it share buf and mu.
+type syslogHandler struct {
+	slog.Handler
+	w   *syslog.Writer
+	buf *bytes.Buffer
+	mu  *sync.Mutex
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	err := h.Handler.Handle(ctx, r)
+	if err != nil {
+		return err
+	}
+	msg := string(bytes.TrimSuffix(h.buf.Bytes(), []byte("\n")))
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.w.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		return h.w.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		return h.w.Info(msg)
+	default:
+		return h.w.Debug(msg)
+	}
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithAttrs(attrs), w: h.w, buf: h.buf, mu: h.mu}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithGroup(name), w: h.w, buf: h.buf, mu: h.mu}
+}
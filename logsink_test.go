@@ -0,0 +1,91 @@
+package harald
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogHandler(t *testing.T) {
+	dir := t.TempDir()
+	debug := filepath.Join(dir, "debug.log")
+	errs := filepath.Join(dir, "error.log")
+
+	h, err := Config{Logs: []LogSink{
+		{Output: debug, Level: slog.LevelDebug, Format: "text"},
+		{Output: errs, Level: slog.LevelError},
+	}}.LogHandler(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	log := slog.New(h).With("rule", "http")
+	log.Debug("dialing")
+	log.Error("dial failed")
+
+	b, err := os.ReadFile(debug)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(b), "msg=dialing rule=http") || !strings.Contains(string(b), `msg="dial failed"`) {
+		t.Errorf("expected both messages as text; got:\n%s", b)
+	}
+	b, err = os.ReadFile(errs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Contains(string(b), "dialing") || !strings.Contains(string(b), `"msg":"dial failed","rule":"http"`) {
+		t.Errorf("expected only the error as JSON; got:\n%s", b)
+	}
+}
+
+func TestLogHandlerSyslog(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pc.Close()
+
+	h, err := Config{Logs: []LogSink{
+		{Output: LogOutputSyslog, Level: slog.LevelWarn, Network: "udp", Address: pc.LocalAddr().String()},
+	}}.LogHandler(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	log := slog.New(h)
+	log.Info("ignored")
+	log.Error("dial failed")
+
+	buf := make([]byte, 1024)
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// LOG_DAEMON|LOG_ERR
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<27>") || !strings.Contains(msg, `"msg":"dial failed"`) {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestLogHandlerInvalid(t *testing.T) {
+	tests := map[string]Config{
+		"unknown log format": {LogFormat: "xml"},
+		"missing output":     {Logs: []LogSink{{}}},
+		"unknown format":     {Logs: []LogSink{{Output: LogOutputStderr, Format: "xml"}}},
+		"stdout used by a rule": {
+			Logs:  []LogSink{{Output: LogOutputStdout}},
+			Rules: map[string]ForwardRule{"stdio": {Listen: NetConf{Network: networkStdio}}},
+		},
+	}
+	for name, c := range tests {
+		_, err := c.LogHandler(nil)
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
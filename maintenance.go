@@ -0,0 +1,93 @@
+package harald
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const (
+	recordTypeAlert = 21
+	alertLevelFatal = 2
+
+	// maintenanceLinger is how long we keep reading from a rejected client
+	// after the response has been written. Closing a connection with unread
+	// data resets it, which could discard the response on the client side.
+	maintenanceLinger = time.Second
+
+	// smtpMaintenanceReply greets SMTP clients of a rule in maintenance mode
+	// without a response, RFC 5321 has them retry later.
+	smtpMaintenanceReply = "421 4.3.2 Service not available, closing transmission channel\r\n"
+)
+
+// Maintenance configures how clients are rejected while a rule is in
+// maintenance mode. Without a TLSAlert or Response the connection is closed
+// right after it has been accepted, SMTP clients of a starttls rule get a 421
+// reply first.
+type Maintenance struct {
+	// Enabled puts the rule into maintenance mode on start, it can be toggled
+	// at runtime through the admin socket.
+	Enabled bool `json:"enabled" yaml:"enabled" toml:"enabled"`
+	// TLSAlert is the description of a fatal TLS alert sent in response to
+	// the ClientHello, e.g. 80 (internal_error). See
+	// https://www.iana.org/assignments/tls-parameters/tls-parameters.xhtml#tls-parameters-6
+	TLSAlert uint8 `json:"tls_alert" yaml:"tls_alert" toml:"tls_alert"`
+	// Response is written to the client before the connection is closed,
+	// e.g. an HTTP 503 response. If the rule terminates TLS the response is
+	// sent after the handshake.
+	Response string `json:"response" yaml:"response" toml:"response"`
+}
+
+// rejectMaintenance responds to a client of a rule in maintenance mode.
+// terminate reports whether TLS is negotiated with the client, it is false
+// for plaintext connections accepted by the starttls negotiation of a rule
+// terminating TLS, they get neither an alert nor a handshake. SMTP clients
+// never get that far, they are greeted with the response or a 421 reply.
+func (f *Forwarder) rejectMaintenance(source net.Conn, terminate bool, log *slog.Logger) {
+	log.Debug("rejecting connection, rule is in maintenance mode")
+
+	var m Maintenance
+	if f.Maintenance != nil {
+		m = *f.Maintenance
+	}
+
+	_ = source.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	var err error
+	switch {
+	case m.TLSAlert != 0 && (terminate || f.tlsConf == nil):
+		_, err = source.Write([]byte{recordTypeAlert, 3, 3, 0, 2, alertLevelFatal, m.TLSAlert})
+	case m.Response != "":
+		if terminate {
+			tlsConn := tls.Server(source, f.tlsConf)
+			ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+			err = tlsConn.HandshakeContext(ctx)
+			cancel()
+			if err != nil {
+				log.Debug("tls handshake failed", attrError(err))
+				return
+			}
+			source = tlsConn
+		}
+		_, err = io.WriteString(source, m.Response)
+	case f.StartTLS == StartTLSSMTP:
+		_, err = io.WriteString(source, smtpMaintenanceReply)
+	default:
+		return
+	}
+	if err != nil {
+		log.Debug("writing maintenance response failed", attrError(err))
+		return
+	}
+
+	// signal the end of the response and discard whatever the client sends
+	// until it closes the connection as well.
+	if cw, ok := source.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		_ = source.SetDeadline(time.Now().Add(maintenanceLinger))
+		_, _ = io.Copy(io.Discard, source)
+	}
+}
@@ -0,0 +1,174 @@
+package harald
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+// readAll connects to the forwarder, sends a request and returns everything
+// received until the forwarder closes the connection.
+func readAll(t *testing.T, f *Forwarder) []byte {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return b
+}
+
+func TestMaintenanceResponse(t *testing.T) {
+	addr, accepted := haraldtest.EchoServer(t)
+	response := "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+	f, err := ForwardRule{
+		Listen:      NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		Connect:     NetConf{Network: "tcp", Address: addr},
+		Maintenance: &Maintenance{Enabled: true, Response: response},
+	}.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	if got := string(readAll(t, f)); got != response {
+		t.Errorf("want = %q; got = %q", response, got)
+	}
+	if accepted() != 0 {
+		t.Errorf("upstream has been connected during maintenance")
+	}
+
+	f.maintenance.Store(false)
+
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	if err != nil {
+		t.Fatalf("expected forwarding after maintenance: %s", err.Error())
+	}
+}
+
+func TestMaintenanceTLSAlert(t *testing.T) {
+	f, err := ForwardRule{
+		Listen:      NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		Connect:     NetConf{Network: "tcp", Address: "127.0.0.1:1"},
+		Maintenance: &Maintenance{Enabled: true, TLSAlert: 80},
+	}.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	want := []byte{recordTypeAlert, 3, 3, 0, 2, alertLevelFatal, 80}
+	if got := readAll(t, f); !bytes.Equal(got, want) {
+		t.Errorf("want = %v; got = %v", want, got)
+	}
+}
+
+func TestMaintenancePostgresPlaintext(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+	response := "maintenance"
+
+	r := testRule("127.0.0.1:1")
+	r.TLS = &TLS{Certificate: string(crt), Key: string(key)}
+	r.StartTLS = StartTLSPostgres
+	r.Maintenance = &Maintenance{Enabled: true, Response: response}
+	f, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// cancel requests are sent without TLS, the response must be as well
+	cancel := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 16), pgCancelRequest)
+	_, err = conn.Write(append(cancel, make([]byte, 8)...))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(b) != response {
+		t.Errorf("want = %q; got = %q", response, b)
+	}
+}
+
+func TestMaintenanceSMTP(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+
+	r := testRule("127.0.0.1:1")
+	r.TLS = &TLS{Certificate: string(crt), Key: string(key)}
+	r.StartTLS = StartTLSSMTP
+	r.Maintenance = &Maintenance{Enabled: true}
+	f, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the server speaks first, the client only reads the greeting
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(b) != smtpMaintenanceReply {
+		t.Errorf("want = %q; got = %q", smtpMaintenanceReply, b)
+	}
+}
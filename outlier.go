@@ -0,0 +1,175 @@
+package harald
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultOutlierInterval           = 10 * time.Second
+	defaultOutlierMinConnections     = 5
+	defaultOutlierErrorRate          = 50
+	defaultOutlierEjectionTime       = 30 * time.Second
+	defaultOutlierMaxEjectionPercent = 50
+)
+
+// errPrematureClose is reported to the outlier detection for connections the
+// upstream closed before sending any data.
+var errPrematureClose = errors.New("upstream closed the connection before sending any data")
+
+// OutlierDetection tracks the errors of the connections to each upstream and
+// ejects upstreams whose error rate within an interval is too high for a
+// while. Errors are failures to connect, connections the upstream broke off
+// with an error and connections it closed before sending any data.
+type OutlierDetection struct {
+	// Interval is the duration over which the error rate is determined,
+	// defaults to 10s.
+	Interval Duration `json:"interval" yaml:"interval" toml:"interval"`
+	// MinConnections is the number of connections an upstream needs within
+	// an interval to be considered, defaults to 5.
+	MinConnections int `json:"min_connections" yaml:"min_connections" toml:"min_connections"`
+	// ErrorRate is the percentage of failed connections at which an
+	// upstream is ejected, defaults to 50.
+	ErrorRate int `json:"error_rate" yaml:"error_rate" toml:"error_rate"`
+	// EjectionTime is the duration an upstream is ejected for, defaults to
+	// 30s.
+	EjectionTime Duration `json:"ejection_time" yaml:"ejection_time" toml:"ejection_time"`
+	// MaxEjectionPercent limits the share of upstreams which are ejected at
+	// the same time, defaults to 50. At least one upstream is always kept.
+	MaxEjectionPercent int `json:"max_ejection_percent" yaml:"max_ejection_percent" toml:"max_ejection_percent"`
+}
+
+func (o *OutlierDetection) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Interval < 0 || o.MinConnections < 0 || o.EjectionTime < 0 {
+		return fmt.Errorf("outlier detection: interval, min_connections and ejection_time must not be negative")
+	}
+	if o.ErrorRate < 0 || o.ErrorRate > 100 || o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100 {
+		return fmt.Errorf("outlier detection: error_rate and max_ejection_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+func (o *OutlierDetection) interval() time.Duration {
+	if o.Interval == 0 {
+		return defaultOutlierInterval
+	}
+	return o.Interval.Duration()
+}
+
+func (o *OutlierDetection) minConnections() int {
+	if o.MinConnections == 0 {
+		return defaultOutlierMinConnections
+	}
+	return o.MinConnections
+}
+
+func (o *OutlierDetection) errorRate() int {
+	if o.ErrorRate == 0 {
+		return defaultOutlierErrorRate
+	}
+	return o.ErrorRate
+}
+
+func (o *OutlierDetection) ejectionTime() time.Duration {
+	if o.EjectionTime == 0 {
+		return defaultOutlierEjectionTime
+	}
+	return o.EjectionTime.Duration()
+}
+
+func (o *OutlierDetection) maxEjectionPercent() int {
+	if o.MaxEjectionPercent == 0 {
+		return defaultOutlierMaxEjectionPercent
+	}
+	return o.MaxEjectionPercent
+}
+
+// outlier is the state of the outlier detection of a single upstream.
+type outlier struct {
+	mu sync.Mutex
+	// start is the beginning of the current interval.
+	start               time.Time
+	connections, errors int
+	// until is the time in unix nanoseconds the ejection ends, zero if the
+	// upstream isn't ejected.
+	until atomic.Int64
+}
+
+// ejected reports whether u is ejected. Once the ejection ended the upstream
+// starts out slowly.
+func (b *balancer) ejected(u *upstream, now time.Time) bool {
+	if b.outliers == nil {
+		return false
+	}
+	until := u.outlier.until.Load()
+	if until == 0 {
+		return false
+	}
+	if now.UnixNano() < until {
+		return true
+	}
+	if u.outlier.until.CompareAndSwap(until, 0) {
+		u.joined.Store(now.UnixNano())
+	}
+	return false
+}
+
+// report records the outcome of a connection to u. Once the interval passed
+// the error rate within it is evaluated before the outcome starts the next
+// interval, it returns the rate in percent if this ejected the upstream and
+// -1 otherwise.
+func (b *balancer) report(u *upstream, failed bool, now time.Time) int {
+	if b.outliers == nil {
+		return -1
+	}
+	o := &u.outlier
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	rate := -1
+	if !o.start.IsZero() && now.Sub(o.start) >= b.outliers.interval() {
+		if o.connections >= b.outliers.minConnections() && o.errors*100 >= b.outliers.errorRate()*o.connections &&
+			o.until.Load() == 0 && b.mayEject(now) {
+			o.until.Store(now.Add(b.outliers.ejectionTime()).UnixNano())
+			rate = o.errors * 100 / o.connections
+		}
+		o.start, o.connections, o.errors = now, 0, 0
+	}
+
+	if o.start.IsZero() {
+		o.start = now
+	}
+	o.connections++
+	if failed {
+		o.errors++
+	}
+	return rate
+}
+
+// mayEject reports whether another upstream can be ejected without
+// exceeding the max_ejection_percent.
+func (b *balancer) mayEject(now time.Time) bool {
+	upstreams := *b.upstreams.Load()
+	ejected := 1
+	for _, u := range upstreams {
+		if b.ejected(u, now) {
+			ejected++
+		}
+	}
+	return ejected < len(upstreams) && ejected*100 <= b.outliers.maxEjectionPercent()*len(upstreams)
+}
+
+// reportOutlier reports the outcome of a connection to the outlier detection.
+func (f *Forwarder) reportOutlier(u *upstream, failed bool) {
+	if rate := f.balancer.report(u, failed, time.Now()); rate >= 0 {
+		f.log.Warn("ejecting outlier upstream", attrUpstream(u), slog.Int("error-rate", rate),
+			slog.Duration("ejection-time", f.balancer.outliers.ejectionTime()))
+	}
+}
@@ -0,0 +1,130 @@
+package harald
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	b := testBalancer(t, "", testTargets(4)...)
+	b.outliers = &OutlierDetection{Interval: Duration(time.Second), MinConnections: 4, ErrorRate: 50, EjectionTime: Duration(time.Minute)}
+	upstreams := *b.upstreams.Load()
+	a, c := upstreams[0], upstreams[2]
+	now := time.Now()
+
+	// the rate is only evaluated once the interval passed
+	for i := 0; i < 4; i++ {
+		if b.report(a, i > 0, now) >= 0 {
+			t.Fatal("expected no ejection before the interval passed")
+		}
+	}
+	if rate := b.report(a, false, now.Add(time.Second)); rate != 75 {
+		t.Fatalf("expected upstream a to be ejected with an error rate of 75, got %d", rate)
+	}
+	if !b.ejected(a, now) {
+		t.Fatal("expected upstream a to be ejected")
+	}
+	for i := 0; i < 8; i++ {
+		if u := b.pick(netip.Addr{}); u == a {
+			t.Fatal("expected ejected upstream a not to be picked")
+		}
+	}
+
+	// too few connections within the interval
+	for i := 0; i < 3; i++ {
+		b.report(c, true, now)
+	}
+	b.report(c, true, now.Add(time.Second))
+	if b.ejected(c, now) {
+		t.Fatal("expected upstream c not to be ejected with too few connections")
+	}
+
+	// at most half of the upstreams are ejected
+	for _, u := range upstreams[1:] {
+		for i := 0; i < 4; i++ {
+			b.report(u, true, now.Add(2*time.Second))
+		}
+		b.report(u, true, now.Add(3*time.Second))
+	}
+	ejected := 0
+	for _, u := range upstreams {
+		if b.ejected(u, now) {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Fatalf("expected 2 upstreams to be ejected, got %d", ejected)
+	}
+
+	// the upstream starts out slowly once the ejection ended
+	if b.ejected(a, now.Add(2*time.Minute)) || a.joined.Load() == 0 {
+		t.Fatal("expected upstream a to rejoin after the ejection time")
+	}
+}
+
+func TestOutlierDetectionInvalidConfig(t *testing.T) {
+	for _, o := range []OutlierDetection{{ErrorRate: 101}, {MaxEjectionPercent: -1}, {Interval: Duration(-time.Second)}} {
+		if err := o.validate(); err == nil {
+			t.Errorf("expected error for %+v", o)
+		}
+	}
+}
+
+// TestOutlierDetectionPrematureClose ensures that an upstream closing
+// connections without sending any data is ejected.
+func TestOutlierDetectionPrematureClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	echo, _ := haraldtest.EchoServer(t)
+
+	r := testRule("")
+	r.Connect = NetConf{}
+	r.Upstreams = []NetConf{{Network: "tcp", Address: l.Addr().String()}, {Network: "tcp", Address: echo}}
+	r.OutlierDetection = &OutlierDetection{Interval: 1, MinConnections: 1, EjectionTime: Duration(time.Minute)}
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	for i := 0; i < 4; i++ {
+		c, err := net.Dial("tcp", f.Addr().String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, _ = c.Read(make([]byte, 1))
+		_ = c.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !f.Stats().Upstreams[0].Ejected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the upstream closing connections to be ejected, got %+v", f.Stats().Upstreams)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f.Stats().Upstreams[1].Ejected {
+		t.Fatal("expected the echo upstream not to be ejected")
+	}
+}
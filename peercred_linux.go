@@ -0,0 +1,47 @@
+package harald
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials returns the user and process of the peer of a unix socket
+// or an empty string if they can't be determined.
+func peerCredentials(c net.Conn) string {
+	cred := peerCred(c)
+	if cred == nil {
+		return ""
+	}
+	return fmt.Sprintf("uid %d, pid %d", cred.Uid, cred.Pid)
+}
+
+// peerUID returns the user of the peer of a unix socket, ok is false if it
+// can't be determined.
+func peerUID(c net.Conn) (uid int, ok bool) {
+	cred := peerCred(c)
+	if cred == nil {
+		return 0, false
+	}
+	return int(cred.Uid), true
+}
+
+func peerCred(c net.Conn) *unix.Ucred {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var cred *unix.Ucred
+	err = raw.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil
+	}
+	return cred
+}
@@ -0,0 +1,82 @@
+//go:build unix
+
+package harald
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ReadPIDFile returns the PID stored in the file at path.
+func ReadPIDFile(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("pid file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("pid file: invalid content '%s'", strings.TrimSpace(string(b)))
+	}
+	return pid, nil
+}
+
+// writePIDFile writes the PID of the process to path. A file left behind by
+// a process which is no longer running is replaced, if the process is still
+// running an error is returned.
+func writePIDFile(path string) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, fs.ErrExist) {
+			pid, rerr := ReadPIDFile(path)
+			if rerr == nil && pid != os.Getpid() && processAlive(pid) {
+				return fmt.Errorf("pid file: harald is already running with pid %d", pid)
+			}
+			// stale file, replace it
+			err = os.Remove(path)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("pid file: %w", err)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("pid file: %w", err)
+		}
+
+		_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+		cerr := f.Close()
+		if err = errors.Join(err, cerr); err != nil {
+			_ = os.Remove(path)
+			return fmt.Errorf("pid file: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("pid file: %s keeps being recreated", path)
+}
+
+// removePIDFile removes the file at path if it still contains the PID of the
+// process.
+func removePIDFile(path string) error {
+	pid, err := ReadPIDFile(path)
+	if err != nil {
+		return err
+	}
+	if pid != os.Getpid() {
+		return nil
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("pid file: %w", err)
+	}
+	return nil
+}
+
+// processAlive reports whether a process with the pid exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,72 @@
+//go:build unix
+
+package harald
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "harald.pid")
+
+	err := writePIDFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pid, err := ReadPIDFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if pid != os.Getpid() {
+		t.Errorf("want = %d; got = %d", os.Getpid(), pid)
+	}
+
+	err = removePIDFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected pid file to be removed; got %v", err)
+	}
+}
+
+func TestPIDFileOwned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "harald.pid")
+
+	// the parent of the test process is alive
+	err := os.WriteFile(path, []byte(strconv.Itoa(os.Getppid())), 0o644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = writePIDFile(path); err == nil {
+		t.Fatal("expected error for pid file of a running process")
+	}
+	if err = removePIDFile(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Errorf("expected pid file of another process to be kept; got %v", err)
+	}
+}
+
+func TestPIDFileStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "harald.pid")
+
+	// pid_max is at most 2^22, so this process can't exist
+	err := os.WriteFile(path, []byte("99999999\n"), 0o644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = writePIDFile(path)
+	if err != nil {
+		t.Fatalf("expected stale pid file to be replaced; got %s", err.Error())
+	}
+	if pid, _ := ReadPIDFile(path); pid != os.Getpid() {
+		t.Errorf("want = %d; got = %d", os.Getpid(), pid)
+	}
+}
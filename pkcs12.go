@@ -0,0 +1,38 @@
+package harald
+
+import (
+	"crypto"
+	"crypto/tls"
+	"fmt"
+	"os"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// loadPKCS12 reads the certificate, its chain and the private key from a
+// PKCS#12 bundle. Both the legacy encryption (3DES, RC2) and the AES based
+// encryption used by current versions of OpenSSL are supported.
+func loadPKCS12(path, password string) (tls.Certificate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, leaf, chain, err := pkcs12.DecodeChain(b, password)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("%s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return tls.Certificate{}, fmt.Errorf("%s: unsupported private key type %T", path, key)
+	}
+	pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(signer.Public()) {
+		return tls.Certificate{}, fmt.Errorf("%s: private key doesn't match the certificate", path)
+	}
+
+	cert := tls.Certificate{PrivateKey: key, Leaf: leaf, Certificate: [][]byte{leaf.Raw}}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
@@ -0,0 +1,54 @@
+package harald
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestTLSConfigPKCS12(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	certPEM, keyPEM := ca.NewServerCertificate(t)
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	block, _ := pem.Decode(certPEM)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	pfx, err := pkcs12.Modern.Encode(pair.PrivateKey, leaf, []*x509.Certificate{ca.Certificate()}, "secret")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	path := filepath.Join(t.TempDir(), "server.p12")
+	err = os.WriteFile(path, pfx, 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	conf, err := (&TLS{PKCS12File: path, PKCS12Password: "secret"}).Config()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert := conf.Certificates[0]
+	if len(cert.Certificate) != 2 || !cert.Leaf.Equal(leaf) {
+		t.Fatalf("expected the certificate and its chain; got %d certificates", len(cert.Certificate))
+	}
+
+	if _, err = (&TLS{PKCS12File: path, PKCS12Password: "wrong"}).Config(); err == nil {
+		t.Error("expected error for a wrong password")
+	}
+	if _, err = (&TLS{PKCS12File: path, Certificate: string(certPEM), Key: string(keyPEM)}).Config(); err == nil {
+		t.Error("expected error if certificate and key are configured as well")
+	}
+}
@@ -0,0 +1,223 @@
+package harald
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// poolCheckInterval is the interval in which the pool checks for expired
+// connections and refills itself if previous attempts failed.
+const poolCheckInterval = time.Second
+
+// Pool configures a pool of pre-established upstream connections. Since the
+// upstream side of a connection can't be reused for another client, each
+// connection is only handed out once and the pool is refilled in the
+// background.
+type Pool struct {
+	// Min is the number of idle connections the pool tries to maintain.
+	Min int `json:"min" yaml:"min" toml:"min"`
+	// Max is the upper limit of idle connections. Every time the pool runs
+	// empty it grows by one up to Max, every time connections expire it
+	// shrinks by one down to Min.
+	Max int `json:"max" yaml:"max" toml:"max"`
+	// MaxIdleAge is the duration after which idle connections are closed,
+	// zero means they never expire. It should be below the idle timeout of
+	// the upstream, idle connections closed by the upstream are counted as
+	// errors by the outlier detection.
+	MaxIdleAge Duration `json:"max_idle_age" yaml:"max_idle_age" toml:"max_idle_age"`
+}
+
+type pooledConn struct {
+	*upstreamConn
+	created time.Time
+}
+
+// upstreamPool maintains the idle connections of a forwarder. A nil
+// *upstreamPool never returns a connection.
+type upstreamPool struct {
+	conf Pool
+	dial func() (*upstreamConn, error)
+	// broken is called with the idle connections the upstream closed or
+	// broke off and the error, if it isn't nil.
+	broken func(*upstreamConn, error)
+	log    *slog.Logger
+
+	mu     sync.Mutex
+	idle   []pooledConn
+	target int
+	wake   chan struct{}
+	done   chan struct{}
+}
+
+func newUpstreamPool(c Pool, dial func() (*upstreamConn, error), broken func(*upstreamConn, error), log *slog.Logger) (*upstreamPool, error) {
+	if c.Min < 0 || c.Max < 0 {
+		return nil, fmt.Errorf("pool: sizes must not be negative")
+	}
+	if c.Max < c.Min {
+		c.Max = c.Min
+	}
+	if c.Max == 0 {
+		return nil, fmt.Errorf("pool: max size must be greater than zero")
+	}
+
+	return &upstreamPool{
+		conf:   c,
+		dial:   dial,
+		broken: broken,
+		log:    log,
+		target: c.Min,
+		wake:   make(chan struct{}, 1),
+	}, nil
+}
+
+// start begins filling the pool in the background.
+func (p *upstreamPool) start() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done != nil {
+		return
+	}
+	p.done = make(chan struct{})
+	go p.run(p.done)
+}
+
+// stop closes all idle connections and stops refilling the pool.
+func (p *upstreamPool) stop() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done == nil {
+		return
+	}
+	close(p.done)
+	p.done = nil
+
+	for _, c := range p.idle {
+		_ = c.Close()
+	}
+	p.idle = nil
+}
+
+// get returns an idle connection or nil if the pool is empty. Idle
+// connections which have been closed by the upstream in the meantime are
+// discarded.
+func (p *upstreamPool) get() *upstreamConn {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.signal()
+
+	p.expire(time.Now())
+
+	for len(p.idle) > 0 {
+		c := p.idle[0]
+		p.idle = p.idle[1:]
+
+		err := checkClosed(c.Conn)
+		if err == nil {
+			return c.upstreamConn
+		}
+		p.log.Debug("discarding closed pool connection", attrError(err))
+		_ = c.Close()
+		if p.broken != nil {
+			p.broken(c.upstreamConn, err)
+		}
+	}
+
+	p.target = min(p.target+1, p.conf.Max)
+	return nil
+}
+
+func (p *upstreamPool) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *upstreamPool) run(done <-chan struct{}) {
+	t := time.NewTicker(poolCheckInterval)
+	defer t.Stop()
+
+	for {
+		p.mu.Lock()
+		p.expire(time.Now())
+		p.mu.Unlock()
+
+		p.fill(done)
+
+		select {
+		case <-done:
+			return
+		case <-p.wake:
+		case <-t.C:
+		}
+	}
+}
+
+// fill dials new connections until the target size is reached. It gives up
+// on the first error, the next attempt is made by the next run.
+func (p *upstreamPool) fill(done <-chan struct{}) {
+	for {
+		p.mu.Lock()
+		missing := p.target - len(p.idle)
+		p.mu.Unlock()
+
+		if missing <= 0 {
+			return
+		}
+
+		c, err := p.dial()
+		if err != nil {
+			p.log.Debug("unable to fill upstream pool", attrError(err))
+			return
+		}
+
+		p.mu.Lock()
+		select {
+		case <-done:
+			// the pool has been stopped while we were dialing
+			p.mu.Unlock()
+			_ = c.Close()
+			return
+		default:
+		}
+		p.idle = append(p.idle, pooledConn{upstreamConn: c, created: time.Now()})
+		p.mu.Unlock()
+	}
+}
+
+// expire closes connections which exceeded the max idle age. Must be called
+// with p.mu held.
+func (p *upstreamPool) expire(now time.Time) {
+	maxAge := p.conf.MaxIdleAge.Duration()
+	if maxAge <= 0 {
+		return
+	}
+
+	expired := 0
+	for len(p.idle) > 0 && now.Sub(p.idle[0].created) > maxAge {
+		_ = p.idle[0].Close()
+		p.idle = p.idle[1:]
+		expired++
+	}
+
+	if expired > 0 {
+		p.log.Debug("closed expired pool connections", slog.Int("count", expired))
+		p.target = max(p.target-1, p.conf.Min)
+	}
+}
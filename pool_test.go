@@ -0,0 +1,174 @@
+package harald
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestUpstreamPool(t *testing.T) {
+	addr, accepted := haraldtest.EchoServer(t)
+
+	r := ForwardRule{
+		Listen: NetConf{
+			Network: "tcp",
+			Address: "127.0.0.1:0",
+		},
+		Connect: NetConf{
+			Network: "tcp",
+			Address: addr,
+		},
+		Pool: &Pool{Min: 2, Max: 4},
+	}
+
+	forwarder, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = forwarder.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer forwarder.Stop()
+
+	waitFor := func(n int) {
+		t.Helper()
+		for i := 0; i < 100 && accepted() < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if accepted() != n {
+			t.Fatalf("expected %d upstream connections, got %d", n, accepted())
+		}
+	}
+
+	// the pool is filled without any client
+	waitFor(2)
+
+	conn, err := net.Dial("tcp", forwarder.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	payload := []byte("foobar")
+	_, err = conn.Write(payload)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = io.ReadFull(conn, make([]byte, len(payload)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the client used a pooled connection, which is replaced
+	waitFor(3)
+}
+
+func TestUpstreamPoolExpiry(t *testing.T) {
+	addr, accepted := haraldtest.EchoServer(t)
+
+	u := &upstream{NetConf: NetConf{Network: "tcp", Address: addr}}
+	p, err := newUpstreamPool(Pool{Min: 1, MaxIdleAge: Duration(10 * time.Millisecond)}, func() (*upstreamConn, error) {
+		c, err := net.Dial(u.Network, u.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &upstreamConn{Conn: c, upstream: u}, nil
+	}, nil, testLogger())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	p.start()
+	defer p.stop()
+
+	time.Sleep(50 * time.Millisecond)
+	if c := p.get(); c != nil {
+		_ = c.Close()
+		t.Fatal("expected expired connection not to be returned")
+	}
+
+	for i := 0; i < 100 && accepted() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if accepted() < 2 {
+		t.Fatal("expected expired connection to be replaced")
+	}
+}
+
+func TestUpstreamPoolInvalidConfig(t *testing.T) {
+	for _, c := range []Pool{{}, {Min: -1, Max: 1}} {
+		_, err := newUpstreamPool(c, nil, nil, testLogger())
+		if err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
+
+func TestUpstreamPoolDiscardsClosed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	u := &upstream{NetConf: NetConf{Network: "tcp", Address: l.Addr().String()}}
+	var broken []error
+	p, err := newUpstreamPool(Pool{Min: 1}, func() (*upstreamConn, error) {
+		c, err := net.Dial(u.Network, u.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &upstreamConn{Conn: c, upstream: u}, nil
+	}, func(_ *upstreamConn, err error) { broken = append(broken, err) }, testLogger())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	p.start()
+	defer p.stop()
+
+	// the upstream closes the first idle connection
+	_ = (<-accepted).Close()
+	time.Sleep(50 * time.Millisecond)
+	if c := p.get(); c != nil {
+		_ = c.Close()
+		t.Fatal("expected closed connection not to be returned")
+	}
+	if len(broken) != 1 || broken[0] != io.EOF {
+		t.Fatalf("expected the closed connection to be reported; got %v", broken)
+	}
+
+	// data sent by the upstream is left for the client
+	up := <-accepted
+	defer up.Close()
+	_, err = up.Write([]byte("220"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	time.Sleep(50 * time.Millisecond)
+	c := p.get()
+	if c == nil {
+		t.Fatal("expected the open connection to be returned")
+	}
+	defer c.Close()
+	b := make([]byte, 3)
+	_, err = io.ReadFull(c, b)
+	if err != nil || string(b) != "220" {
+		t.Fatalf("expected the data of the upstream; got %q, %v", b, err)
+	}
+}
@@ -0,0 +1,175 @@
+package harald
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// expandedRules are the rules of a config the way they are turned into
+// forwarders.
+type expandedRules struct {
+	rules map[string]ForwardRule
+	// parents maps the name of each expanded rule to the name of the rule of
+	// the config it has been expanded from.
+	parents map[string]string
+	// failed holds the errors of the rules of the config which couldn't be
+	// expanded.
+	failed map[string]error
+}
+
+// expandRules evaluates the templates in the addresses of the rules and
+// replaces each rule listening on a port range with one rule per port, named
+// <rule>/<port>. Other rules are passed through as they are. Rules which can't
+// be expanded are left out and reported as failed.
+func expandRules(rules map[string]ForwardRule) expandedRules {
+	e := expandedRules{
+		rules:   make(map[string]ForwardRule, len(rules)),
+		parents: make(map[string]string, len(rules)),
+		failed:  make(map[string]error),
+	}
+	for name, r := range rules {
+		err := addressTemplate{}.expandRule(&r)
+		if err != nil {
+			e.failed[name] = err
+			continue
+		}
+		expanded, err := r.expand(name)
+		if err != nil {
+			e.failed[name] = err
+			continue
+		}
+		for n, r := range expanded {
+			e.rules[n] = r
+			e.parents[n] = name
+		}
+	}
+	return e
+}
+
+// ExpandRules returns the rules of the config the way a server turns them into
+// forwarders: the templates in their addresses are evaluated and each rule
+// listening on a port range is replaced with one rule per port, named
+// <rule>/<port>. If name isn't empty only the rule with the name or the rules
+// expanded from it are returned.
+func (c Config) ExpandRules(name string) (map[string]ForwardRule, error) {
+	e := expandRules(c.Rules)
+	if name == "" {
+		return e.rules, withKind(ErrConfig, e.err())
+	}
+	if err := e.failed[name]; err != nil {
+		return nil, withKind(ErrConfig, fmt.Errorf("rule %s: %w", name, err))
+	}
+
+	rules := make(map[string]ForwardRule)
+	for n, r := range e.rules {
+		if n == name || e.parents[n] == name {
+			rules[n] = r
+		}
+	}
+	if len(rules) == 0 {
+		return nil, withKind(ErrNotFound, fmt.Errorf("unknown rule '%s'", name))
+	}
+	return rules, nil
+}
+
+// err returns the errors of the failed rules, nil if there are none.
+func (e expandedRules) err() error {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(e.failed)) {
+		errs = append(errs, fmt.Errorf("rule %s: %w", name, e.failed[name]))
+	}
+	return errors.Join(errs...)
+}
+
+// parent returns the name of the rule of the config the rule with the name
+// has been expanded from.
+func (e expandedRules) parent(name string) string {
+	return cmp.Or(e.parents[name], name)
+}
+
+// expand returns the rules for each port of the listen address.
+func (r ForwardRule) expand(name string) (map[string]ForwardRule, error) {
+	host, low, high, ok, err := parsePortRange(r.Listen.Address)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if r.PortOffset != nil {
+			return nil, fmt.Errorf("port_offset requires a port range to listen on")
+		}
+		return map[string]ForwardRule{name: r}, nil
+	}
+	if r.PortOffset != nil && (r.Discovery != nil || isSRVName(r.Connect.Address)) {
+		return nil, fmt.Errorf("port_offset can't be used with discovered upstreams")
+	}
+
+	rules := make(map[string]ForwardRule, high-low+1)
+	for port := low; port <= high; port++ {
+		e := r
+		e.Listen.Address = net.JoinHostPort(host, strconv.Itoa(port))
+		if r.PortOffset != nil {
+			upstreamPort := port + *r.PortOffset
+			if upstreamPort < 1 || upstreamPort > 65535 {
+				return nil, fmt.Errorf("port %d with offset %d is out of range", port, *r.PortOffset)
+			}
+			if e.Connect.Address != "" {
+				e.Connect.Address, err = replacePort(e.Connect.Address, upstreamPort)
+				if err != nil {
+					return nil, err
+				}
+			}
+			e.Upstreams = make([]NetConf, len(r.Upstreams))
+			for i, u := range r.Upstreams {
+				e.Upstreams[i] = u
+				e.Upstreams[i].Address, err = replacePort(u.Address, upstreamPort)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		rules[name+"/"+strconv.Itoa(port)] = e
+	}
+	return rules, nil
+}
+
+// parsePortRange splits an address like :30000-30100 into its parts. ok is
+// false if the address doesn't contain a range.
+func parsePortRange(address string) (host string, low, high int, ok bool, err error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		// not all networks use host:port addresses, e.g. unix sockets
+		return "", 0, 0, false, nil
+	}
+	first, last, ok := strings.Cut(port, "-")
+	if !ok {
+		return "", 0, 0, false, nil
+	}
+
+	low, err = strconv.Atoi(first)
+	if err != nil {
+		return "", 0, 0, false, fmt.Errorf("invalid port range '%s': %w", port, err)
+	}
+	high, err = strconv.Atoi(last)
+	if err != nil {
+		return "", 0, 0, false, fmt.Errorf("invalid port range '%s': %w", port, err)
+	}
+	if low < 1 || high > 65535 || low > high {
+		return "", 0, 0, false, fmt.Errorf("invalid port range '%s'", port)
+	}
+	return host, low, high, true, nil
+}
+
+// replacePort returns address with its port set to port.
+func replacePort(address string, port int) (string, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
@@ -0,0 +1,95 @@
+package harald
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExpandRules(t *testing.T) {
+	offset := 1000
+	e := expandRules(map[string]ForwardRule{
+		"single": testRule("127.0.0.1:1"),
+		"range": {
+			Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:30000-30002"},
+			Connect: NetConf{Network: "tcp", Address: "10.0.0.1:8080"},
+		},
+		"offset": {
+			Listen:     NetConf{Network: "tcp", Address: ":40000-40001"},
+			Upstreams:  []NetConf{{Network: "tcp", Address: "10.0.0.1:1"}, {Network: "tcp", Address: "10.0.0.2:1"}},
+			PortOffset: &offset,
+		},
+	})
+	err := e.err()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	rules := e.rules
+	if len(rules) != 6 {
+		t.Fatalf("expected six rules; got = %v", rules)
+	}
+	if _, ok := rules["single"]; !ok {
+		t.Errorf("rule without range is missing")
+	}
+	for _, name := range []string{"range/30000", "range/30001", "range/30002"} {
+		if r, ok := rules[name]; !ok || r.Connect.Address != "10.0.0.1:8080" {
+			t.Errorf("%s: unexpected rule %v", name, r)
+		}
+	}
+	if r := rules["range/30001"]; r.Listen.Address != "127.0.0.1:30001" {
+		t.Errorf("want = 127.0.0.1:30001; got = %s", r.Listen.Address)
+	}
+	if r := rules["offset/40001"]; r.Upstreams[0].Address != "10.0.0.1:41001" || r.Upstreams[1].Address != "10.0.0.2:41001" {
+		t.Errorf("unexpected upstreams %v", r.Upstreams)
+	}
+}
+
+func TestExpandRulesInvalid(t *testing.T) {
+	offset := 30000
+	for name, r := range map[string]ForwardRule{
+		"reversed":            {Listen: NetConf{Network: "tcp", Address: ":30001-30000"}},
+		"no number":           {Listen: NetConf{Network: "tcp", Address: ":a-b"}},
+		"offset out of range": {Listen: NetConf{Network: "tcp", Address: ":40000-40001"}, Connect: NetConf{Address: "a:1"}, PortOffset: &offset},
+		"offset no range":     {Listen: NetConf{Network: "tcp", Address: ":40000"}, Connect: NetConf{Address: "a:1"}, PortOffset: &offset},
+	} {
+		e := expandRules(map[string]ForwardRule{name: r})
+		if e.err() == nil || len(e.rules) != 0 || e.failed[name] == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestConfigExpandRules(t *testing.T) {
+	offset := -1000
+	c := Config{Rules: map[string]ForwardRule{
+		"web": {
+			Listen:     NetConf{Network: "tcp", Address: "127.0.0.1:19000-19001"},
+			Connect:    NetConf{Network: "tcp", Address: "127.0.0.1:1"},
+			PortOffset: &offset,
+		},
+		"broken": {Listen: NetConf{Network: "tcp", Address: ":2-1"}},
+	}}
+
+	rules, err := c.ExpandRules("web")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(rules) != 2 || rules["web/19001"].Connect.Address != "127.0.0.1:18001" {
+		t.Errorf("expected both ports with the offset applied; got = %v", rules)
+	}
+
+	rules, err = c.ExpandRules("web/19000")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(rules) != 1 || rules["web/19000"].Connect.Address != "127.0.0.1:18000" {
+		t.Errorf("expected a single port; got = %v", rules)
+	}
+
+	if _, err = c.ExpandRules("broken"); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected config error; got %v", err)
+	}
+	if _, err = c.ExpandRules("unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected not found error; got %v", err)
+	}
+}
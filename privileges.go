@@ -0,0 +1,71 @@
+//go:build unix
+
+package harald
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// lookupIdentity resolves the names or numeric ids of the user and group. If
+// group is empty the primary group of the user is used.
+func lookupIdentity(userName, groupName string) (uid, gid int, err error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		u, err = user.LookupId(userName)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("lookup user: %w", err)
+	}
+	uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("lookup user: %w", err)
+	}
+
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("lookup group: %w", err)
+		}
+		gidStr = g.Gid
+	}
+	gid, err = strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("lookup group: %w", err)
+	}
+	return uid, gid, nil
+}
+
+// dropPrivileges switches the process to the user and group, supplementary
+// groups are dropped. This can't be undone, listeners opened afterwards are
+// opened as the new user.
+func dropPrivileges(uid, gid int) error {
+	// the group has to be changed first, afterwards we may lack the
+	// permissions to do so.
+	err := syscall.Setgroups([]int{gid})
+	if err != nil {
+		return fmt.Errorf("drop privileges: setgroups: %w", err)
+	}
+	err = syscall.Setgid(gid)
+	if err != nil {
+		return fmt.Errorf("drop privileges: setgid: %w", err)
+	}
+	err = syscall.Setuid(uid)
+	if err != nil {
+		return fmt.Errorf("drop privileges: setuid: %w", err)
+	}
+	return nil
+}
+
+// logIdentity logs the effective user and group of the process.
+func logIdentity() {
+	slog.Info("running as", slog.Int("uid", os.Geteuid()), slog.Int("gid", os.Getegid()))
+}
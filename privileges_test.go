@@ -0,0 +1,28 @@
+//go:build unix
+
+package harald
+
+import (
+	"testing"
+)
+
+func TestLookupIdentity(t *testing.T) {
+	for _, name := range []string{"root", "0"} {
+		uid, gid, err := lookupIdentity(name, "")
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		if uid != 0 || gid != 0 {
+			t.Errorf("%s: want = 0, 0; got = %d, %d", name, uid, gid)
+		}
+	}
+
+	_, _, err := lookupIdentity("does-not-exist", "")
+	if err == nil {
+		t.Error("expected error for unknown user")
+	}
+	_, _, err = lookupIdentity("root", "does-not-exist")
+	if err == nil {
+		t.Error("expected error for unknown group")
+	}
+}
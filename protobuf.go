@@ -0,0 +1,113 @@
+package harald
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Wire types of the protocol buffer encoding.
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+// pbBuffer encodes a protocol buffer message. Only the types used by
+// admin.proto are supported, fields holding the zero value are omitted like
+// in proto3.
+type pbBuffer []byte
+
+func (b *pbBuffer) tag(field, wireType int) {
+	*b = binary.AppendUvarint(*b, uint64(field)<<3|uint64(wireType))
+}
+
+func (b *pbBuffer) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.tag(field, pbVarint)
+	*b = binary.AppendUvarint(*b, v)
+}
+
+// int encodes int32 and int64 fields, negative values take ten bytes.
+func (b *pbBuffer) int(field int, v int64) {
+	b.uint(field, uint64(v))
+}
+
+func (b *pbBuffer) bool(field int, v bool) {
+	if v {
+		b.uint(field, 1)
+	}
+}
+
+func (b *pbBuffer) string(field int, v string) {
+	if v == "" {
+		return
+	}
+	b.tag(field, pbBytes)
+	*b = binary.AppendUvarint(*b, uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+// message encodes an embedded message written by encode, it is included even
+// if it is empty so it can be used for repeated fields.
+func (b *pbBuffer) message(field int, encode func(*pbBuffer)) {
+	var m pbBuffer
+	encode(&m)
+	b.tag(field, pbBytes)
+	*b = binary.AppendUvarint(*b, uint64(len(m)))
+	*b = append(*b, m...)
+}
+
+var errProtobuf = errors.New("malformed protobuf message")
+
+// decodeProtobuf calls field for each field of the message. Varints are passed
+// as v, length delimited fields as data. Fixed size fields are skipped as
+// admin.proto doesn't use them.
+func decodeProtobuf(b []byte, field func(num, wireType int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtobuf
+		}
+		b = b[n:]
+		num, wireType := int(tag>>3), int(tag&7)
+
+		var v uint64
+		var data []byte
+		switch wireType {
+		case pbVarint:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errProtobuf
+			}
+			b = b[n:]
+		case pbBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errProtobuf
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		case pbFixed64, pbFixed32:
+			size := 8
+			if wireType == pbFixed32 {
+				size = 4
+			}
+			if len(b) < size {
+				return errProtobuf
+			}
+			b = b[size:]
+			continue
+		default:
+			return fmt.Errorf("%w: unsupported wire type %d", errProtobuf, wireType)
+		}
+
+		err := field(num, wireType, v, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
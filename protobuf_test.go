@@ -0,0 +1,58 @@
+package harald
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestProtobuf(t *testing.T) {
+	var b pbBuffer
+	b.string(1, "test")
+	b.uint(2, 300)
+	b.int(3, -1)
+	b.bool(4, false)
+	b.message(5, func(b *pbBuffer) { b.string(1, "inner") })
+
+	// field 1 "test", field 2 300, field 3 -1, field 5 {field 1 "inner"}
+	want := []byte{
+		0x0a, 0x04, 't', 'e', 's', 't',
+		0x10, 0xac, 0x02,
+		0x18, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01,
+		0x2a, 0x07, 0x0a, 0x05, 'i', 'n', 'n', 'e', 'r',
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("want = %x; got = %x", want, []byte(b))
+	}
+
+	var fields []int
+	err := decodeProtobuf(b, func(num, wireType int, v uint64, data []byte) error {
+		fields = append(fields, num)
+		switch num {
+		case 1:
+			if string(data) != "test" {
+				t.Errorf("field 1: got = %q", data)
+			}
+		case 2:
+			if v != 300 {
+				t.Errorf("field 2: got = %d", v)
+			}
+		case 3:
+			if int64(v) != -1 {
+				t.Errorf("field 3: got = %d", int64(v))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(fields) != 4 {
+		t.Errorf("expected four fields; got = %v", fields)
+	}
+
+	err = decodeProtobuf(want[:len(want)-1], func(int, int, uint64, []byte) error { return nil })
+	if !errors.Is(err, errProtobuf) {
+		t.Errorf("expected a truncated message to be rejected; got = %v", err)
+	}
+}
@@ -0,0 +1,390 @@
+package harald
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Details of the client certificate sent in the PROXY protocol header.
+const (
+	// ProxyCertCN sends the common name of a verified client certificate.
+	ProxyCertCN = "cn"
+	// ProxyCertDER sends the full client certificate in DER encoding in
+	// addition to the common name.
+	ProxyCertDER = "der"
+)
+
+// ProxyProtocol configures the PROXY protocol header which is sent to the
+// upstream before any data of the client, it carries the addresses of the
+// client connection.
+type ProxyProtocol struct {
+	// Version of the header, either 1 (text) or 2 (binary).
+	Version int `json:"version" yaml:"version" toml:"version"`
+	// ClientCertificate controls which details of the client certificate are
+	// added to the PP2_TYPE_SSL TLV of rules terminating TLS, either
+	// ProxyCertCN or ProxyCertDER. Requires version 2.
+	ClientCertificate string `json:"client_certificate" yaml:"client_certificate" toml:"client_certificate"`
+	// ConnID adds the ID of the connection as PP2_TYPE_UNIQUE_ID TLV, so the
+	// logs of the upstream can be joined with the ones of harald. Requires
+	// version 2.
+	ConnID bool `json:"conn_id" yaml:"conn_id" toml:"conn_id"`
+	// ServerName adds the server name requested by the client as
+	// PP2_TYPE_AUTHORITY TLV, either from the TLS handshake of rules
+	// terminating TLS or as received from the previous hop. Requires version
+	// 2.
+	ServerName bool `json:"server_name" yaml:"server_name" toml:"server_name"`
+}
+
+func (p *ProxyProtocol) validate() error {
+	if p == nil {
+		return nil
+	}
+	switch p.Version {
+	case 1, 2:
+	default:
+		return fmt.Errorf("proxy protocol: unknown version %d", p.Version)
+	}
+	switch p.ClientCertificate {
+	case "":
+	case ProxyCertCN, ProxyCertDER:
+		if p.Version != 2 {
+			return fmt.Errorf("proxy protocol: client_certificate requires version 2")
+		}
+	default:
+		return fmt.Errorf("proxy protocol: unknown client_certificate '%s'", p.ClientCertificate)
+	}
+	if p.ConnID && p.Version != 2 {
+		return fmt.Errorf("proxy protocol: conn_id requires version 2")
+	}
+	if p.ServerName && p.Version != 2 {
+		return fmt.Errorf("proxy protocol: server_name requires version 2")
+	}
+	return nil
+}
+
+// header returns the header describing the client connection c with the ID
+// id, which requested serverName. The TLS state is only used by version 2 and
+// may be nil.
+func (p *ProxyProtocol) header(c net.Conn, state *tls.ConnectionState, id, serverName string) []byte {
+	src, srcOk := addrPort(c.RemoteAddr())
+	dst, dstOk := addrPort(c.LocalAddr())
+	known := srcOk && dstOk && src.Addr().Is4() == dst.Addr().Is4()
+
+	if p.Version == 1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		if src.Addr().Is6() {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+			family, src.Addr(), dst.Addr(), src.Port(), dst.Port()))
+	}
+
+	var body bytes.Buffer
+	var family byte // AF_UNSPEC
+	if known {
+		if src.Addr().Is4() {
+			family = 0x10 // AF_INET
+		} else {
+			family = 0x20 // AF_INET6
+		}
+		if _, ok := c.RemoteAddr().(*net.UDPAddr); ok {
+			family |= 0x02 // DGRAM
+		} else {
+			family |= 0x01 // STREAM
+		}
+		body.Write(src.Addr().AsSlice())
+		body.Write(dst.Addr().AsSlice())
+		body.Write(binary.BigEndian.AppendUint16(nil, src.Port()))
+		body.Write(binary.BigEndian.AppendUint16(nil, dst.Port()))
+	}
+	if state != nil {
+		writeTLV(&body, pp2TypeSSL, p.sslTLV(state))
+	}
+	if p.ConnID {
+		writeTLV(&body, pp2TypeUniqueID, []byte(id))
+	}
+	if p.ServerName && serverName != "" {
+		writeTLV(&body, pp2TypeAuthority, []byte(serverName))
+	}
+
+	h := bytes.NewBuffer(make([]byte, 0, 16+body.Len()))
+	h.Write(proxyV2Signature)
+	h.WriteByte(0x21) // version 2, PROXY command
+	h.WriteByte(family)
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(body.Len())))
+	h.Write(body.Bytes())
+	return h.Bytes()
+}
+
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// Types of the TLVs of a version 2 header.
+const (
+	pp2TypeSSL           = 0x20
+	pp2SubtypeSSLVersion = 0x21
+	pp2SubtypeSSLCN      = 0x22
+	pp2SubtypeSSLCipher  = 0x23
+	// pp2SubtypeSSLDER is not part of the specification, it is taken from
+	// the range reserved for custom types.
+	pp2SubtypeSSLDER = 0xE0
+
+	pp2ClientSSL      = 0x01
+	pp2ClientCertConn = 0x02
+	pp2ClientCertSess = 0x04
+)
+
+// sslTLV returns the value of the PP2_TYPE_SSL TLV.
+func (p *ProxyProtocol) sslTLV(state *tls.ConnectionState) []byte {
+	var v bytes.Buffer
+
+	client := byte(pp2ClientSSL)
+	// zero means the client presented a certificate which has been verified
+	verify := uint32(1)
+	if len(state.PeerCertificates) > 0 {
+		client |= pp2ClientCertSess
+		if !state.DidResume {
+			client |= pp2ClientCertConn
+		}
+		if len(state.VerifiedChains) > 0 {
+			verify = 0
+		}
+	}
+	v.WriteByte(client)
+	v.Write(binary.BigEndian.AppendUint32(nil, verify))
+
+	writeTLV(&v, pp2SubtypeSSLVersion, []byte(tls.VersionName(state.Version)))
+	writeTLV(&v, pp2SubtypeSSLCipher, []byte(tls.CipherSuiteName(state.CipherSuite)))
+
+	if verify == 0 && p.ClientCertificate != "" {
+		cert := state.PeerCertificates[0]
+		writeTLV(&v, pp2SubtypeSSLCN, []byte(cert.Subject.CommonName))
+		if p.ClientCertificate == ProxyCertDER {
+			writeTLV(&v, pp2SubtypeSSLDER, cert.Raw)
+		}
+	}
+	return v.Bytes()
+}
+
+func writeTLV(b *bytes.Buffer, typ byte, value []byte) {
+	b.WriteByte(typ)
+	b.Write(binary.BigEndian.AppendUint16(nil, uint16(len(value))))
+	b.Write(value)
+}
+
+// addrPort returns the IP address and port of a TCP or UDP address.
+func addrPort(a net.Addr) (netip.AddrPort, bool) {
+	var ap netip.AddrPort
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	default:
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), ap.IsValid()
+}
+
+// AcceptProxyProtocol reads a PROXY protocol header of version 1 or 2 sent by
+// each client, e.g. a load balancer in front of harald. The addresses of the
+// header replace the ones of the connection in logs, limits and headers sent
+// upstream. Clients which don't send a valid header are rejected.
+type AcceptProxyProtocol struct {
+	// ConnID uses the PP2_TYPE_UNIQUE_ID TLV of version 2 headers as the ID
+	// of the connection, so the IDs correlate across hops. A new ID is
+	// generated if the TLV is missing or not printable.
+	ConnID bool `json:"conn_id" yaml:"conn_id" toml:"conn_id"`
+	// ServerName uses the PP2_TYPE_AUTHORITY TLV of version 2 headers as the
+	// server name requested by the client, e.g. if the previous hop
+	// terminated TLS. It is logged and sent on with proxy_protocol.
+	ServerName bool `json:"server_name" yaml:"server_name" toml:"server_name"`
+}
+
+// proxyHeaderTimeout limits how long reading the header of a client may take.
+const proxyHeaderTimeout = 5 * time.Second
+
+const (
+	// pp2TypeAuthority carries the host name requested by the client, e.g.
+	// via SNI.
+	pp2TypeAuthority = 0x02
+	// pp2TypeUniqueID carries an opaque ID of the connection.
+	pp2TypeUniqueID = 0x05
+)
+
+// proxyHeader is a header received from a client.
+type proxyHeader struct {
+	// src and dst are invalid for LOCAL and UNKNOWN headers.
+	src, dst netip.AddrPort
+	tlvs     map[byte][]byte
+}
+
+// connID returns the ID sent by the client, or an empty string.
+func (h *proxyHeader) connID() string {
+	id := h.tlvs[pp2TypeUniqueID]
+	if !validInboundConnID(id) {
+		return ""
+	}
+	return string(id)
+}
+
+// serverName returns the server name sent by the client, or an empty string
+// if it is missing or not a valid host name.
+func (h *proxyHeader) serverName() string {
+	name := h.tlvs[pp2TypeAuthority]
+	if len(name) == 0 || len(name) > 255 {
+		return ""
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return ""
+		}
+	}
+	return string(name)
+}
+
+// readProxyHeader reads the PROXY header at the start of c. The returned
+// connection reports the addresses of the header and replays any data which
+// has been read past it.
+func readProxyHeader(c net.Conn) (net.Conn, *proxyHeader, error) {
+	_ = c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer func() { _ = c.SetReadDeadline(time.Time{}) }()
+
+	r := bufio.NewReaderSize(c, 256)
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+
+	var h *proxyHeader
+	if bytes.Equal(sig, proxyV2Signature) {
+		h, err = readProxyHeaderV2(r)
+	} else {
+		h, err = readProxyHeaderV1(r)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+
+	var conn net.Conn = c
+	if n := r.Buffered(); n > 0 {
+		rest, _ := r.Peek(n)
+		conn = &prefixConn{Conn: c, prefix: bytes.Clone(rest)}
+	}
+	if h.src.IsValid() && h.dst.IsValid() {
+		conn = &proxiedConn{Conn: conn, remote: net.TCPAddrFromAddrPort(h.src), local: net.TCPAddrFromAddrPort(h.dst)}
+	}
+	return conn, h, nil
+}
+
+// proxyV1MaxLength is the maximum length of a version 1 header including the
+// CRLF.
+const proxyV1MaxLength = 107
+
+func readProxyHeaderV1(r *bufio.Reader) (*proxyHeader, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > proxyV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("missing header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("missing header")
+	}
+	h := &proxyHeader{}
+	switch fields[1] {
+	case "UNKNOWN":
+		return h, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unknown protocol '%s'", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed header")
+	}
+
+	src, err1 := netip.ParseAddrPort(net.JoinHostPort(fields[2], fields[4]))
+	dst, err2 := netip.ParseAddrPort(net.JoinHostPort(fields[3], fields[5]))
+	if err1 != nil || err2 != nil || src.Addr().Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("malformed addresses")
+	}
+	h.src, h.dst = src, dst
+	return h, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*proxyHeader, error) {
+	var fixed [16]byte
+	_, err := io.ReadFull(r, fixed[:])
+	if err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("unknown version %d", fixed[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &proxyHeader{tlvs: make(map[byte][]byte)}
+	local := fixed[12]&0x0F == 0x00
+
+	var addrLen int
+	switch fixed[13] >> 4 {
+	case 0x1: // AF_INET
+		addrLen = 12
+	case 0x2: // AF_INET6
+		addrLen = 36
+	case 0x3: // AF_UNIX
+		addrLen = 216
+	}
+	if len(body) < addrLen {
+		return nil, fmt.Errorf("truncated addresses")
+	}
+	if !local && (addrLen == 12 || addrLen == 36) {
+		ipLen := (addrLen - 4) / 2
+		src, _ := netip.AddrFromSlice(body[:ipLen])
+		dst, _ := netip.AddrFromSlice(body[ipLen : 2*ipLen])
+		h.src = netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[2*ipLen:]))
+		h.dst = netip.AddrPortFrom(dst, binary.BigEndian.Uint16(body[2*ipLen+2:]))
+	}
+
+	tlvs := body[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, fmt.Errorf("truncated tlv")
+		}
+		l := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+l {
+			return nil, fmt.Errorf("truncated tlv")
+		}
+		h.tlvs[tlvs[0]] = tlvs[3 : 3+l]
+		tlvs = tlvs[3+l:]
+	}
+	return h, nil
+}
+
+// proxiedConn reports the addresses received in a PROXY header.
+type proxiedConn struct {
+	net.Conn
+	remote, local net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.local
+}
@@ -0,0 +1,334 @@
+package harald
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+// proxyHeaderServer accepts a single connection and passes the PROXY
+// protocol v2 header it received to the returned channel.
+func proxyHeaderServer(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	headers := make(chan []byte, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		h := make([]byte, 16)
+		_, err = io.ReadFull(c, h)
+		if err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint16(h[14:]))
+		_, err = io.ReadFull(c, body)
+		if err != nil {
+			return
+		}
+		headers <- append(h, body...)
+	}()
+	return l.Addr().String(), headers
+}
+
+// tlv returns the value of the first TLV of type typ in b.
+func tlv(b []byte, typ byte) []byte {
+	for len(b) >= 3 {
+		l := int(binary.BigEndian.Uint16(b[1:]))
+		if len(b) < 3+l {
+			return nil
+		}
+		if b[0] == typ {
+			return b[3 : 3+l]
+		}
+		b = b[3+l:]
+	}
+	return nil
+}
+
+func TestProxyProtocolClientCertificate(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+	addr, headers := proxyHeaderServer(t)
+
+	r := testRule(addr)
+	r.TLS = &TLS{
+		Certificate: string(crt),
+		Key:         string(key),
+		ClientCAs:   string(ca.PEM()),
+		ClientAuth:  tls.RequireAndVerifyClientCert,
+	}
+	r.ProxyProtocol = &ProxyProtocol{Version: 2, ClientCertificate: ProxyCertDER}
+	f, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	clientCert, err := tls.X509KeyPair(ca.NewClientCertificate(t))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{clientCert}, RootCAs: x509.NewCertPool()}
+	conf.RootCAs.AddCert(ca.Certificate())
+	conn, err := tls.Dial("tcp", f.Addr().String(), conf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	var h []byte
+	select {
+	case h = <-headers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no proxy protocol header received")
+	}
+
+	if !bytes.Equal(h[:12], proxyV2Signature) || h[12] != 0x21 || h[13] != 0x11 {
+		t.Fatalf("unexpected header %x", h[:16])
+	}
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if !net.IP(h[16:20]).Equal(local.IP) || int(binary.BigEndian.Uint16(h[24:26])) != local.Port {
+		t.Errorf("unexpected source address %x", h[16:28])
+	}
+
+	ssl := tlv(h[28:], pp2TypeSSL)
+	if len(ssl) < 5 {
+		t.Fatalf("missing ssl tlv")
+	}
+	if ssl[0]&pp2ClientCertConn == 0 || binary.BigEndian.Uint32(ssl[1:5]) != 0 {
+		t.Errorf("expected verified client certificate; got client = %x, verify = %x", ssl[0], ssl[1:5])
+	}
+	if der := tlv(ssl[5:], pp2SubtypeSSLDER); !bytes.Equal(der, clientCert.Certificate[0]) {
+		t.Errorf("expected the client certificate in der encoding")
+	}
+	if v := tlv(ssl[5:], pp2SubtypeSSLVersion); string(v) != "TLS 1.3" {
+		t.Errorf("want = TLS 1.3; got = %s", v)
+	}
+}
+
+// addrConn is a connection with fixed addresses.
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestProxyProtocolV1(t *testing.T) {
+	p := &ProxyProtocol{Version: 1}
+
+	c := addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443},
+		remote: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 50000},
+	}
+	if h := string(p.header(c, nil, "", "")); h != "PROXY TCP4 203.0.113.7 10.0.0.1 50000 443\r\n" {
+		t.Errorf("unexpected header %q", h)
+	}
+
+	c.remote = &net.UnixAddr{Name: "@", Net: "unix"}
+	if h := string(p.header(c, nil, "", "")); h != "PROXY UNKNOWN\r\n" {
+		t.Errorf("unexpected header %q", h)
+	}
+}
+
+func TestProxyProtocolInvalid(t *testing.T) {
+	for _, p := range []ProxyProtocol{{Version: 3}, {Version: 1, ClientCertificate: ProxyCertCN}, {Version: 2, ClientCertificate: "pem"}, {Version: 1, ConnID: true}, {Version: 1, ServerName: true}} {
+		if p.validate() == nil {
+			t.Errorf("expected error for %+v", p)
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	c := addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		remote: &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 50000},
+	}
+	v2 := (&ProxyProtocol{Version: 2, ConnID: true, ServerName: true}).header(c, nil, "abc", "shop.example.com")
+	invalidName := (&ProxyProtocol{Version: 2, ServerName: true}).header(c, nil, "", "shop example")
+
+	tests := map[string]struct {
+		header     []byte
+		src        string
+		id         string
+		serverName string
+	}{
+		"v1":                     {header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 50000 443\r\n"), src: "203.0.113.7:50000"},
+		"v1 unknown":             {header: []byte("PROXY UNKNOWN\r\n")},
+		"v2":                     {header: v2, src: "[2001:db8::7]:50000", id: "abc", serverName: "shop.example.com"},
+		"v2 invalid server name": {header: invalidName, src: "[2001:db8::7]:50000"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() { _, _ = client.Write(append(tt.header, "ping"...)) }()
+
+			conn, h, err := readProxyHeader(server)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if tt.src != "" && conn.RemoteAddr().String() != tt.src {
+				t.Errorf("want = %s; got = %s", tt.src, conn.RemoteAddr())
+			}
+			if h.connID() != tt.id {
+				t.Errorf("want = %q; got = %q", tt.id, h.connID())
+			}
+			if h.serverName() != tt.serverName {
+				t.Errorf("want = %q; got = %q", tt.serverName, h.serverName())
+			}
+
+			b := make([]byte, 4)
+			_, err = io.ReadFull(conn, b)
+			if err != nil || string(b) != "ping" {
+				t.Errorf("expected the data after the header; got = %q, %v", b, err)
+			}
+		})
+	}
+
+	for _, h := range []string{"GET / HTTP/1.1\r\n", "PROXY TCP4 203.0.113.7\r\n", "PROXY TCP4 2001:db8::7 10.0.0.1 1 2\r\n"} {
+		client, server := net.Pipe()
+		go func() { _, _ = client.Write([]byte(h)); _ = client.Close() }()
+		_, _, err := readProxyHeader(server)
+		if err == nil {
+			t.Errorf("%q: expected an error", h)
+		}
+	}
+}
+
+func TestAcceptProxyProtocolConnID(t *testing.T) {
+	echo, _ := haraldtest.EchoServer(t)
+	r := testRule(echo)
+	r.AcceptProxyProtocol = &AcceptProxyProtocol{ConnID: true}
+	f, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.events = newEventBus()
+	events, unsubscribe := f.events.subscribe()
+	defer unsubscribe()
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	c, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+
+	h := (&ProxyProtocol{Version: 2, ConnID: true}).header(addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443},
+		remote: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 50000},
+	}, nil, "hop-1", "")
+	_, _ = c.Write(h)
+
+	select {
+	case e := <-events:
+		if e.ConnID != "hop-1" || e.Source != "203.0.113.7" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection has not been established")
+	}
+}
+
+func TestProxyProtocolChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	access, err := newAccessLog(&AccessLog{Path: path})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer access.close()
+
+	echo, _ := haraldtest.EchoServer(t)
+	r := testRule(echo)
+	r.AcceptProxyProtocol = &AcceptProxyProtocol{ConnID: true, ServerName: true}
+	second, err := r.NewForwarder("second", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	second.access = access
+	err = second.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer second.Stop()
+
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+	r = testRule(second.Addr().String())
+	r.TLS = &TLS{Certificate: string(crt), Key: string(key)}
+	r.ProxyProtocol = &ProxyProtocol{Version: 2, ConnID: true, ServerName: true}
+	first, err := r.NewForwarder("first", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	first.access = access
+	err = first.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer first.Stop()
+
+	c, err := tls.Dial("tcp", first.Addr().String(), &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, _ = c.Write([]byte("ping"))
+	_, _ = io.ReadFull(c, make([]byte, 4))
+	_ = c.Close()
+
+	records := make(map[string]map[string]any)
+	for i := 0; i < 50 && len(records) < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+		b, _ := os.ReadFile(path)
+		for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+			var record map[string]any
+			if json.Unmarshal(line, &record) == nil {
+				rule, _ := record["rule"].(string)
+				records[rule] = record
+			}
+		}
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected a record of each hop; got = %v", records)
+	}
+	if records["first"]["conn-id"] != records["second"]["conn-id"] {
+		t.Errorf("expected the same conn id on both hops; got = %v and %v", records["first"]["conn-id"], records["second"]["conn-id"])
+	}
+	if records["second"]["server-name"] != "localhost" {
+		t.Errorf("expected the server name on the second hop; got = %v", records["second"])
+	}
+	if records["second"]["source"] != records["first"]["source"] {
+		t.Errorf("expected the client address on the second hop; got = %v", records["second"])
+	}
+}
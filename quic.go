@@ -0,0 +1,157 @@
+package harald
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// networkQUIC is the listen network of rules which terminate QUIC.
+	networkQUIC = "quic"
+
+	// QUICStreamsFirst forwards the first stream of a QUIC connection and
+	// rejects all others.
+	QUICStreamsFirst = "first"
+	// QUICStreamsEach forwards each stream of a QUIC connection over its own
+	// upstream connection.
+	QUICStreamsEach = "each"
+)
+
+// QUIC configures how rules listening on the quic network forward the
+// streams of a connection.
+type QUIC struct {
+	// Streams is either QUICStreamsFirst (default) or QUICStreamsEach.
+	Streams string `json:"streams" yaml:"streams" toml:"streams"`
+}
+
+// quicListener terminates QUIC and hands out each accepted stream as a
+// net.Conn, this way streams are forwarded like any other connection.
+type quicListener struct {
+	pc        net.PacketConn
+	ln        *quic.Listener
+	each      bool
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func listenQUIC(o SocketOptions, address string, tlsConf *tls.Config, c *QUIC) (*quicListener, error) {
+	if tlsConf == nil || len(tlsConf.NextProtos) == 0 {
+		return nil, fmt.Errorf("quic: tls with at least one application protocol is required")
+	}
+
+	each := false
+	if c != nil {
+		switch c.Streams {
+		case "", QUICStreamsFirst:
+		case QUICStreamsEach:
+			each = true
+		default:
+			return nil, fmt.Errorf("quic: unknown streams mode '%s'", c.Streams)
+		}
+	}
+
+	lc := net.ListenConfig{Control: o.control}
+	pc, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("quic: %w", err)
+	}
+
+	ln, err := quic.Listen(pc, tlsConf, nil)
+	if err != nil {
+		_ = pc.Close()
+		return nil, fmt.Errorf("quic: %w", err)
+	}
+
+	l := &quicListener{
+		pc:    pc,
+		ln:    ln,
+		each:  each,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	go l.acceptConns()
+	return l, nil
+}
+
+func (l *quicListener) acceptConns() {
+	for {
+		c, err := l.ln.Accept(context.Background())
+		if err != nil {
+			// the listener has been closed
+			return
+		}
+		go l.acceptStreams(c)
+	}
+}
+
+func (l *quicListener) acceptStreams(c quic.Connection) {
+	for first := true; ; first = false {
+		s, err := c.AcceptStream(c.Context())
+		if err != nil {
+			return
+		}
+		if !first && !l.each {
+			s.CancelRead(0)
+			s.CancelWrite(0)
+			continue
+		}
+
+		select {
+		case l.conns <- &quicStreamConn{Stream: s, conn: c}:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting streams, established QUIC connections are closed as
+// well.
+func (l *quicListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.done)
+		_ = l.ln.Close()
+		err = l.pc.Close()
+	})
+	return err
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+// quicStreamConn is a single stream of a QUIC connection.
+type quicStreamConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+// Close closes both directions of the stream, the QUIC connection is left
+// open for the client to close it.
+func (c *quicStreamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicStreamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
@@ -0,0 +1,83 @@
+package harald
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+	"github.com/quic-go/quic-go"
+)
+
+func TestQUICTermination(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+	addr, accepted := haraldtest.EchoServer(t)
+
+	r := ForwardRule{
+		Listen:  NetConf{Network: "quic", Address: "127.0.0.1:0"},
+		Connect: NetConf{Network: "tcp", Address: addr},
+		TLS: &TLS{
+			Certificate:          string(crt),
+			Key:                  string(key),
+			ApplicationProtocols: []string{"test"},
+		},
+		QUIC: &QUIC{Streams: QUICStreamsEach},
+	}
+
+	f, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, f.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"test"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() { _ = conn.CloseWithError(0, "") }()
+
+	for i := 0; i < 2; i++ {
+		s, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = s.SetDeadline(time.Now().Add(5 * time.Second))
+
+		payload := []byte("foobar")
+		_, err = s.Write(payload)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = io.ReadFull(s, make([]byte, len(payload)))
+		if err != nil {
+			t.Fatalf("stream %d: %s", i, err.Error())
+		}
+	}
+
+	if n := accepted(); n != 2 {
+		t.Errorf("expected one upstream connection per stream; got %d", n)
+	}
+}
+
+func TestQUICRequiresTLS(t *testing.T) {
+	_, err := ForwardRule{
+		Listen:  NetConf{Network: "quic", Address: "127.0.0.1:0"},
+		Connect: NetConf{Network: "tcp", Address: "127.0.0.1:1"},
+	}.NewForwarder("test", 0)
+	if err == nil {
+		t.Fatal("expected error without tls")
+	}
+}
@@ -0,0 +1,137 @@
+package harald
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+)
+
+// Modes for redacting the addresses of clients in log messages.
+const (
+	// RedactHash replaces an address by a keyed hash. The key is generated
+	// on startup, so the same client can be followed through the logs of a
+	// single process but not across restarts.
+	RedactHash = "hash"
+	// RedactTruncate replaces an address by its network, /24 for IPv4 and
+	// /48 for IPv6.
+	RedactTruncate = "truncate"
+)
+
+// redactor replaces the addresses of clients in log messages. A nil
+// *redactor leaves them as they are.
+type redactor struct {
+	truncate bool
+	key      []byte
+}
+
+func newRedactor(mode string) (*redactor, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case RedactHash:
+		key := make([]byte, sha256.Size)
+		_, err := rand.Read(key)
+		if err != nil {
+			return nil, fmt.Errorf("redact: %w", err)
+		}
+		return &redactor{key: key}, nil
+	case RedactTruncate:
+		return &redactor{truncate: true}, nil
+	default:
+		return nil, fmt.Errorf("redact: unknown mode '%s'", mode)
+	}
+}
+
+// redact returns the replacement of addr.
+func (r *redactor) redact(addr netip.Addr) string {
+	if r.truncate {
+		bits := 24
+		if addr.Is6() {
+			bits = 48
+		}
+		p, _ := addr.Prefix(bits)
+		return p.String()
+	}
+	m := hmac.New(sha256.New, r.key)
+	m.Write(addr.AsSlice())
+	return hex.EncodeToString(m.Sum(nil)[:8])
+}
+
+// addr returns the address as it appears in the logs.
+func (r *redactor) addr(a netip.Addr) string {
+	if r == nil || !a.IsValid() {
+		return a.String()
+	}
+	return r.redact(a)
+}
+
+// logger returns a logger which replaces each occurrence of addr, including
+// the ones in error messages.
+func (r *redactor) logger(log *slog.Logger, addr netip.Addr) *slog.Logger {
+	if r == nil || !addr.IsValid() {
+		return log
+	}
+	return slog.New(&redactHandler{
+		Handler: log.Handler(),
+		addr:    addr.String(),
+		repl:    r.redact(addr),
+	})
+}
+
+type redactHandler struct {
+	slog.Handler
+	addr string
+	repl string
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	nr := slog.NewRecord(r.Time, r.Level, h.replace(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		nr.AddAttrs(h.attr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, nr)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.attr(a)
+	}
+	return &redactHandler{Handler: h.Handler.WithAttrs(redacted), addr: h.addr, repl: h.repl}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{Handler: h.Handler.WithGroup(name), addr: h.addr, repl: h.repl}
+}
+
+func (h *redactHandler) attr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, h.replace(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, g := range group {
+			redacted[i] = h.attr(g)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case slog.KindAny:
+		s := fmt.Sprint(v.Any())
+		if strings.Contains(s, h.addr) {
+			return slog.String(a.Key, h.replace(s))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+func (h *redactHandler) replace(s string) string {
+	return strings.ReplaceAll(s, h.addr, h.repl)
+}
@@ -0,0 +1,60 @@
+package harald
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestRedactorTruncate(t *testing.T) {
+	r, err := newRedactor(RedactTruncate)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for addr, want := range map[string]string{
+		"203.0.113.7":      "203.0.113.0/24",
+		"2001:db8:1:2::42": "2001:db8:1::/48",
+	} {
+		if got := r.redact(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("%s: want = %s; got = %s", addr, want, got)
+		}
+	}
+}
+
+func TestRedactorLogger(t *testing.T) {
+	r, err := newRedactor(RedactHash)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	addr := netip.MustParseAddr("203.0.113.7")
+
+	var buf bytes.Buffer
+	log := r.logger(slog.New(slog.NewTextHandler(&buf, nil)), addr)
+	log.With(attrSource(addr)).Info("read from 203.0.113.7 failed",
+		attrError(errors.New("read tcp 10.0.0.1:443->203.0.113.7:5000: i/o timeout")),
+		slog.Group("peer", slog.Any("addr", addr)))
+
+	out := buf.String()
+	if strings.Contains(out, "203.0.113.7") {
+		t.Errorf("address not redacted: %s", out)
+	}
+	if n := strings.Count(out, r.redact(addr)); n != 4 {
+		t.Errorf("expected four replacements; got %d: %s", n, out)
+	}
+	if r.redact(addr) != r.redact(netip.MustParseAddr("203.0.113.7")) {
+		t.Error("expected the hash to be stable")
+	}
+}
+
+func TestRedactorDisabled(t *testing.T) {
+	r, err := newRedactor("")
+	if err != nil || r != nil {
+		t.Fatalf("expected no redactor; got %v, %v", r, err)
+	}
+	if _, err = newRedactor("drop"); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
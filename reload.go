@@ -0,0 +1,101 @@
+package harald
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configDebounce is the time the config file has to be left alone before it
+// is reloaded, editors and config management tend to write files in several
+// steps.
+const configDebounce = time.Second
+
+// reload loads the config file again and applies its rules. Changes to other
+// settings require a restart and are only logged.
+func (s *Server) reload() error {
+	if s.conf.path == "" {
+		return fmt.Errorf("reload: config has not been loaded from a file")
+	}
+
+	c, err := LoadConfig(s.conf.path)
+	if err != nil {
+		return fmt.Errorf("reload: %w", err)
+	}
+
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+
+	current, next := s.conf, c
+	current.Rules, next.Rules = nil, nil
+	current.hash, next.hash = "", ""
+	if !reflect.DeepEqual(current, next) {
+		slog.Warn("settings other than the rules changed, they are applied on the next restart")
+	}
+
+	s.conf.Rules = c.Rules
+	s.conf.hash = c.hash
+	s.applyRules()
+	return nil
+}
+
+// watchConfig reloads the config file every time it changes until ctx is
+// cancelled. The directory of the file is watched to also pick up files which
+// are replaced instead of written to.
+func (s *Server) watchConfig(ctx context.Context) error {
+	if s.conf.path == "" {
+		return fmt.Errorf("watch config: config has not been loaded from a file")
+	}
+	path := filepath.Clean(s.conf.path)
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watch config: %w", err)
+	}
+	err = w.Add(filepath.Dir(path))
+	if err != nil {
+		_ = w.Close()
+		return fmt.Errorf("watch config: %w", err)
+	}
+
+	go func() {
+		defer func() { _ = w.Close() }()
+
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				// new files in the directory may be the target of a symlink
+				// to the config file, e.g. for kubernetes config maps.
+				if filepath.Clean(e.Name) != path && !e.Has(fsnotify.Create) {
+					continue
+				}
+				slog.Debug("config file changed", slog.String("event", e.String()))
+				reload = time.After(configDebounce)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("watching config file failed", attrError(err))
+			case <-reload:
+				reload = nil
+				err := s.audited("config.reload", "config watch", s.configState, s.reload)
+				if err != nil {
+					slog.Error("reloading config failed", attrError(err))
+				}
+			}
+		}
+	}()
+
+	return nil
+}
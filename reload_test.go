@@ -0,0 +1,167 @@
+package harald
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRulesConfig writes a config file containing a rule for each name.
+func writeRulesConfig(t *testing.T, path string, names ...string) {
+	t.Helper()
+
+	var b strings.Builder
+	b.WriteString("version: 2\nrules:\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %s:\n", name)
+		b.WriteString("    listen: { network: tcp, address: 127.0.0.1:0 }\n")
+		b.WriteString("    connect: { network: tcp, address: 127.0.0.1:1 }\n")
+	}
+
+	err := os.WriteFile(path, []byte(b.String()), 0o600)
+	if err != nil {
+		t.Fatalf("write config: %s", err.Error())
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "harald.yml")
+	writeRulesConfig(t, path, "a")
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s, err := NewServer(c)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.setListening(true)
+	defer s.setListening(false)
+
+	before := s.Addrs()
+	hash := s.conf.hash
+
+	writeRulesConfig(t, path, "a", "b")
+	err = s.reload()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if hash == "" || s.conf.hash == hash {
+		t.Errorf("expected config hash to be updated")
+	}
+
+	after := s.Addrs()
+	if len(after) != 2 {
+		t.Fatalf("expected two listening rules; got = %v", after)
+	}
+	if after["a"].String() != before["a"].String() {
+		t.Errorf("unchanged rule has been restarted")
+	}
+}
+
+func TestServerReloadKeepsBrokenRule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "harald.yml")
+	writeRulesConfig(t, path, "a", "b")
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s, err := NewServer(c)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.setListening(true)
+	defer s.setListening(false)
+
+	before := s.Addrs()
+
+	// a typo in the port range of a running rule
+	broken := "version: 2\nrules:\n" +
+		"  a:\n    listen: { network: tcp, address: 127.0.0.1:20-10 }\n    connect: { network: tcp, address: 127.0.0.1:1 }\n" +
+		"  b:\n    listen: { network: tcp, address: 127.0.0.1:0 }\n    connect: { network: tcp, address: 127.0.0.1:1 }\n"
+	err = os.WriteFile(path, []byte(broken), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = s.reload()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	after := s.Addrs()
+	if after["a"] == nil || after["a"].String() != before["a"].String() {
+		t.Errorf("expected the broken rule to keep its listener; got = %v", after)
+	}
+	if after["b"] == nil || after["b"].String() != before["b"].String() {
+		t.Errorf("unchanged rule has been restarted")
+	}
+}
+
+// TestServerRemovesRuleNamedLikePort ensures that a rule is removed even if
+// its name looks like a port of a broken rule, e.g. rules of etcd.
+func TestServerRemovesRuleNamedLikePort(t *testing.T) {
+	s, err := NewServer(Config{Rules: map[string]ForwardRule{
+		"team":     testRule("127.0.0.1:1"),
+		"team/web": testRule("127.0.0.1:1"),
+	}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	broken := testRule("127.0.0.1:1")
+	broken.Listen.Address = "127.0.0.1:20-10"
+	err = s.updateRules(expandRules(map[string]ForwardRule{"team": broken}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.forwarder("team") == nil {
+		t.Error("expected the broken rule to be kept")
+	}
+	if s.forwarder("team/web") != nil {
+		t.Error("expected the removed rule not to be attributed to the broken one")
+	}
+}
+
+func TestServerWatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "harald.yml")
+	writeRulesConfig(t, path, "a")
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s, err := NewServer(c)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.setListening(true)
+	defer s.setListening(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = s.watchConfig(ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	writeRulesConfig(t, path, "b")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		addrs := s.Addrs()
+		if _, ok := addrs["b"]; ok && len(addrs) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("config has not been reloaded; got = %v", addrs)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,224 @@
+package harald
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ResolverUDP queries the servers over udp and retries truncated
+	// responses over tcp.
+	ResolverUDP = "udp"
+	// ResolverTCP queries the servers over tcp.
+	ResolverTCP = "tcp"
+	// ResolverTLS queries the servers over TLS (DNS over TLS, RFC 7858).
+	ResolverTLS = "tls"
+	// ResolverHTTPS queries the servers over HTTPS (DNS over HTTPS, RFC
+	// 8484).
+	ResolverHTTPS = "https"
+)
+
+// maxDNSMessage is the largest DNS message, its length has to fit into the
+// two byte prefix of the stream protocols.
+const maxDNSMessage = 1<<16 - 1
+
+// Resolver configures the DNS servers which resolve the hostnames of the
+// upstreams, including DNS SRV records, instead of the servers of the system
+// in /etc/resolv.conf. The options of resolv.conf (e.g. the search domains)
+// and /etc/hosts still apply.
+type Resolver struct {
+	// Protocol used to query the servers, one of the Resolver* constants.
+	// Defaults to ResolverUDP.
+	Protocol string `json:"protocol" yaml:"protocol" toml:"protocol"`
+	// Servers are the addresses of the DNS servers, the port defaults to 53
+	// or 853 for ResolverTLS. For ResolverHTTPS they are the URLs of the
+	// endpoints, e.g. https://dns.example/dns-query. Queries are spread
+	// across the servers, a query which fails is retried on the next one.
+	Servers []string `json:"servers" yaml:"servers" toml:"servers"`
+	// ServerName is used to verify the certificates of the servers instead
+	// of their host, e.g. if the servers are given by their IP address.
+	ServerName string `json:"server_name" yaml:"server_name" toml:"server_name"`
+	// CA is a PEM file with the root certificates to verify the servers,
+	// defaults to the roots of the system.
+	CA string `json:"ca" yaml:"ca" toml:"ca"`
+}
+
+// resolver sends the queries of a net.Resolver to the configured servers.
+type resolver struct {
+	protocol string
+	servers  []string
+	next     atomic.Uint32
+	tlsConf  *tls.Config
+	client   *http.Client
+}
+
+// newResolver returns the resolver described by the config, nil if there is
+// no config and the resolver of the system is used.
+func (c *Resolver) newResolver() (*net.Resolver, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if len(c.Servers) == 0 {
+		return nil, fmt.Errorf("resolver: no servers configured")
+	}
+
+	r := &resolver{protocol: c.Protocol}
+	port := "53"
+	switch c.Protocol {
+	case "":
+		r.protocol = ResolverUDP
+	case ResolverUDP, ResolverTCP:
+	case ResolverTLS:
+		port = "853"
+	case ResolverHTTPS:
+	default:
+		return nil, fmt.Errorf("resolver: unknown protocol '%s'", c.Protocol)
+	}
+
+	if c.Protocol == ResolverTLS || c.Protocol == ResolverHTTPS {
+		r.tlsConf = &tls.Config{ServerName: c.ServerName, MinVersion: tls.VersionTLS12}
+		if c.CA != "" {
+			pem, err := os.ReadFile(c.CA)
+			if err != nil {
+				return nil, fmt.Errorf("resolver: %w", err)
+			}
+			r.tlsConf.RootCAs = x509.NewCertPool()
+			if !r.tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("resolver: no certificates found in %s", c.CA)
+			}
+		}
+	} else if c.ServerName != "" || c.CA != "" {
+		return nil, fmt.Errorf("resolver: server_name and ca require protocol tls or https")
+	}
+
+	for _, s := range c.Servers {
+		if c.Protocol == ResolverHTTPS {
+			u, err := url.Parse(s)
+			if err != nil || u.Scheme != "https" || u.Host == "" {
+				return nil, fmt.Errorf("resolver: invalid server '%s', expected an https url", s)
+			}
+			r.servers = append(r.servers, u.String())
+			continue
+		}
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, port)
+		}
+		r.servers = append(r.servers, s)
+	}
+	if c.Protocol == ResolverHTTPS {
+		r.client = &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   r.tlsConf,
+			ForceAttemptHTTP2: true,
+		}}
+	}
+
+	return &net.Resolver{PreferGo: true, Dial: r.dial}, nil
+}
+
+// dial connects to the next server, the servers of the system passed by
+// net.Resolver are ignored. The stream protocols are framed like DNS over tcp
+// so the net.Resolver is able to speak them.
+func (r *resolver) dial(ctx context.Context, network, _ string) (net.Conn, error) {
+	server := r.servers[int(r.next.Add(1)-1)%len(r.servers)]
+	switch r.protocol {
+	case ResolverUDP:
+		// network is tcp if the response over udp was truncated
+		var d net.Dialer
+		return d.DialContext(ctx, network, server)
+	case ResolverTCP:
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", server)
+	case ResolverTLS:
+		d := tls.Dialer{Config: r.tlsConf}
+		return d.DialContext(ctx, "tcp", server)
+	default:
+		return &dohConn{ctx: ctx, client: r.client, url: server}, nil
+	}
+}
+
+// dohConn sends each query written to it as a request to a DNS over HTTPS
+// server, the response is read from it. Queries and responses are prefixed
+// by their length like DNS over tcp.
+type dohConn struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+	query  bytes.Buffer
+	resp   bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.query.Write(b)
+	q := c.query.Bytes()
+	if len(q) < 2 || len(q) < 2+int(binary.BigEndian.Uint16(q)) {
+		return len(b), nil
+	}
+	n := 2 + int(binary.BigEndian.Uint16(q))
+	msg, err := c.exchange(q[2:n])
+	c.query.Next(n)
+	if err != nil {
+		return 0, err
+	}
+	_ = binary.Write(&c.resp, binary.BigEndian, uint16(len(msg)))
+	c.resp.Write(msg)
+	return len(b), nil
+}
+
+func (c *dohConn) exchange(query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns over https: %s: unexpected status %s", c.url, resp.Status)
+	}
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessage+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > maxDNSMessage {
+		return nil, fmt.Errorf("dns over https: %s: response too large", c.url)
+	}
+	return msg, nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.resp.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.resp.Read(b)
+}
+
+func (c *dohConn) Close() error         { return nil }
+func (c *dohConn) LocalAddr() net.Addr  { return dohAddr(c.url) }
+func (c *dohConn) RemoteAddr() net.Addr { return dohAddr(c.url) }
+
+// the deadlines of the net.Resolver are already part of the context of the
+// query.
+func (c *dohConn) SetDeadline(time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(time.Time) error { return nil }
+
+// dohAddr is the address of a DNS over HTTPS server.
+type dohAddr string
+
+func (a dohAddr) Network() string { return ResolverHTTPS }
+func (a dohAddr) String() string  { return string(a) }
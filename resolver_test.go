@@ -0,0 +1,134 @@
+package harald
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+// dnsAnswer responds to a query for an A record with 127.0.0.1, other
+// queries get an empty response. Malformed queries aren't answered.
+func dnsAnswer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += 1 + int(query[end])
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	question := query[12:end]
+	qtype := binary.BigEndian.Uint16(question[len(question)-4:])
+
+	resp := binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(query))
+	resp = append(resp, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0)
+	resp = append(resp, question...)
+	if qtype == 1 {
+		resp[7] = 1
+		// the name points to the question
+		resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+	}
+	return resp
+}
+
+func TestResolverUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(dnsAnswer(buf[:n]), addr)
+		}
+	}()
+
+	echo, _ := haraldtest.EchoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+	r := testRule(net.JoinHostPort("upstream.test.", port))
+	r.Resolver = &Resolver{Servers: []string{pc.LocalAddr().String()}}
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	c, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	_, _ = c.Write([]byte("hello"))
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(c, make([]byte, 5))
+	if err != nil {
+		t.Fatalf("expected the upstream to be resolved by the resolver: %s", err.Error())
+	}
+}
+
+func TestResolverHTTPS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(dnsAnswer(query))
+	}))
+	defer srv.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	r, err := (&Resolver{Protocol: ResolverHTTPS, Servers: []string{srv.URL + "/dns-query"}, CA: ca}).newResolver()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	addrs, err := r.LookupNetIP(context.Background(), "ip4", "upstream.test.")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("127.0.0.1") {
+		t.Fatalf("expected 127.0.0.1; got %v", addrs)
+	}
+}
+
+func TestResolverInvalid(t *testing.T) {
+	for _, c := range []Resolver{
+		{},
+		{Protocol: "quic", Servers: []string{"127.0.0.1"}},
+		{Protocol: ResolverHTTPS, Servers: []string{"127.0.0.1"}},
+		{Servers: []string{"127.0.0.1"}, ServerName: "dns.example"},
+	} {
+		if _, err := c.newResolver(); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
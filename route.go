@@ -0,0 +1,127 @@
+package harald
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// defaultPeekTimeout is how long the router waits for the first bytes of a
+// client by default.
+const defaultPeekTimeout = time.Second
+
+// Routing picks the upstream of a plaintext connection based on the first
+// bytes sent by the client, e.g. to serve SSH and HTTPS on the same port.
+// Connections which match none of the routes are forwarded to the upstreams
+// of the rule.
+type Routing struct {
+	// Routes are matched in order, the first route whose prefix matches the
+	// data of the client is used.
+	Routes []Route `json:"routes" yaml:"routes" toml:"routes"`
+	// PeekTimeout is how long to wait for the client to send enough data to
+	// pick a route, defaults to one second. Clients of protocols in which
+	// the server speaks first are forwarded to the upstreams of the rule
+	// once it has passed.
+	PeekTimeout Duration `json:"peek_timeout" yaml:"peek_timeout" toml:"peek_timeout"`
+}
+
+// Route forwards the connections starting with Prefix to Connect.
+type Route struct {
+	Prefix  string  `json:"prefix" yaml:"prefix" toml:"prefix"`
+	Connect NetConf `json:"connect" yaml:"connect" toml:"connect"`
+}
+
+// router matches the first bytes of connections against the routes.
+type router struct {
+	prefixes  [][]byte
+	upstreams []*upstream
+	timeout   time.Duration
+	// size is the length of the longest prefix.
+	size int
+}
+
+func newRouter(r *Routing) (*router, error) {
+	if r == nil {
+		return nil, nil
+	}
+	rt := &router{timeout: r.PeekTimeout.Duration()}
+	if rt.timeout <= 0 {
+		rt.timeout = defaultPeekTimeout
+	}
+	for i, route := range r.Routes {
+		if route.Prefix == "" {
+			return nil, fmt.Errorf("routing: route %d: empty prefix", i)
+		}
+		if route.Connect.Address == "" {
+			return nil, fmt.Errorf("routing: route %d: missing connect address", i)
+		}
+		err := route.Connect.validate()
+		if err != nil {
+			return nil, fmt.Errorf("routing: route %d: %w", i, err)
+		}
+		if route.Connect.Network == "" {
+			route.Connect.Network = "tcp"
+		}
+		rt.prefixes = append(rt.prefixes, []byte(route.Prefix))
+		rt.upstreams = append(rt.upstreams, &upstream{NetConf: route.Connect})
+		rt.size = max(rt.size, len(route.Prefix))
+	}
+	return rt, nil
+}
+
+// route reads from the connection until the route is known. It returns the
+// upstream of the matching route or nil if the connection should use the
+// upstreams of the rule. The returned connection replaces c, it replays the
+// data read so far.
+func (rt *router) route(c net.Conn) (net.Conn, *upstream, error) {
+	_ = c.SetReadDeadline(time.Now().Add(rt.timeout))
+	defer func() { _ = c.SetReadDeadline(time.Time{}) }()
+
+	buf := make([]byte, 0, rt.size)
+	for {
+		u, undecided := rt.match(buf)
+		if !undecided {
+			return &prefixConn{Conn: c, prefix: buf}, u, nil
+		}
+		n, err := c.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return &prefixConn{Conn: c, prefix: buf}, rt.first(buf), nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading first bytes: %w", err)
+		}
+	}
+}
+
+// match returns the upstream of the first route matching b. If no route
+// matches yet but one could once more data is available, undecided is set.
+func (rt *router) match(b []byte) (_ *upstream, undecided bool) {
+	for i, p := range rt.prefixes {
+		if bytes.HasPrefix(b, p) {
+			if !undecided {
+				return rt.upstreams[i], false
+			}
+			// an earlier route could still match
+			return nil, true
+		}
+		if bytes.HasPrefix(p, b) {
+			undecided = true
+		}
+	}
+	return nil, undecided
+}
+
+// first returns the upstream of the first route matching b, regardless of
+// whether earlier routes could still match.
+func (rt *router) first(b []byte) *upstream {
+	for i, p := range rt.prefixes {
+		if bytes.HasPrefix(b, p) {
+			return rt.upstreams[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package harald
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestRouting(t *testing.T) {
+	ssh, sshAccepted := haraldtest.EchoServer(t)
+	fallback, fallbackAccepted := haraldtest.EchoServer(t)
+
+	r := testRule(fallback)
+	r.Routing = &Routing{
+		Routes:      []Route{{Prefix: "SSH-", Connect: NetConf{Address: ssh}}},
+		PeekTimeout: Duration(100 * time.Millisecond),
+	}
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	for _, tc := range []struct {
+		data          string
+		ssh, fallback int
+	}{
+		{data: "SSH-2.0-OpenSSH_9.6\r\n", ssh: 1},
+		{data: "GET / HTTP/1.1\r\n\r\n", ssh: 1, fallback: 1},
+		// the client waits for the server to speak first
+		{data: "", ssh: 1, fallback: 2},
+	} {
+		c, err := net.Dial("tcp", f.Addr().String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		want := tc.data
+		if want == "" {
+			time.Sleep(200 * time.Millisecond)
+			want = "ping"
+		}
+		_, err = io.WriteString(c, want)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		got := make([]byte, len(want))
+		_, err = io.ReadFull(c, got)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = c.Close()
+
+		if string(got) != want {
+			t.Errorf("want = %q; got = %q", want, got)
+		}
+		if sshAccepted() != tc.ssh || fallbackAccepted() != tc.fallback {
+			t.Errorf("%q: want = %d, %d; got = %d, %d", tc.data, tc.ssh, tc.fallback, sshAccepted(), fallbackAccepted())
+		}
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	rt, err := newRouter(&Routing{Routes: []Route{
+		{Prefix: "SSH-2", Connect: NetConf{Address: "a:1"}},
+		{Prefix: "SSH", Connect: NetConf{Address: "b:1"}},
+		{Prefix: "\x16\x03", Connect: NetConf{Address: "c:1"}},
+	}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for data, want := range map[string]string{
+		"SSH-2.0":  "a:1",
+		"SSH-1.9":  "b:1",
+		"\x16\x03": "c:1",
+		"GET":      "",
+	} {
+		u, undecided := rt.match([]byte(data))
+		if undecided {
+			t.Errorf("%q: expected a decision", data)
+			continue
+		}
+		var got string
+		if u != nil {
+			got = u.Address
+		}
+		if got != want {
+			t.Errorf("%q: want = %s; got = %s", data, want, got)
+		}
+	}
+
+	if _, undecided := rt.match([]byte("SSH-")); !undecided {
+		t.Errorf("expected no decision while an earlier route could match")
+	}
+	if u := rt.first([]byte("SSH-")); u == nil || u.Address != "b:1" {
+		t.Errorf("expected the second route once no more data arrives")
+	}
+}
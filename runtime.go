@@ -0,0 +1,73 @@
+package harald
+
+import (
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+const (
+	runtimeCheckInterval = 30 * time.Second
+	// goroutinesPerConn is the number of goroutines a connection needs at
+	// most: the handler and the two copy operations while it is forwarded.
+	goroutinesPerConn = 3
+	// goroutineLeakThreshold is the number of goroutines on top of the ones
+	// explained by the tracked connections from which on a leak is reported.
+	goroutineLeakThreshold = 1000
+)
+
+// RuntimeStats describes the process, they help to catch leaked handlers.
+type RuntimeStats struct {
+	Goroutines int `json:"goroutines"`
+	// HeapBytes are the bytes of allocated heap objects.
+	HeapBytes uint64 `json:"heap_bytes"`
+	// GCCycles and GCPauseTotal are the completed garbage collections and
+	// the cumulative time the world has been stopped for them.
+	GCCycles     uint32        `json:"gc_cycles"`
+	GCPauseTotal time.Duration `json:"gc_pause_total"`
+	// TrackedConnections are the connections handled by all forwarders.
+	TrackedConnections int `json:"tracked_connections"`
+}
+
+// readRuntimeStats returns a snapshot of the stats of the process.
+func readRuntimeStats(trackedConns int) RuntimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return RuntimeStats{
+		Goroutines:         runtime.NumGoroutine(),
+		HeapBytes:          m.HeapAlloc,
+		GCCycles:           m.NumGC,
+		GCPauseTotal:       time.Duration(m.PauseTotalNs),
+		TrackedConnections: trackedConns,
+	}
+}
+
+// leakDetector reports goroutines which aren't explained by the tracked
+// connections. The goroutines running when it is created (acceptors, admin
+// listeners, ...) are the baseline.
+type leakDetector struct {
+	baseline int
+	// reported is set once a leak has been reported, it is reported again
+	// after the goroutines dropped below the threshold in the meantime.
+	reported bool
+}
+
+func newLeakDetector(rt RuntimeStats) *leakDetector {
+	return &leakDetector{baseline: rt.Goroutines - goroutinesPerConn*rt.TrackedConnections}
+}
+
+// check logs a warning if the goroutines and the tracked connections diverged.
+func (d *leakDetector) check(rt RuntimeStats) {
+	excess := rt.Goroutines - goroutinesPerConn*rt.TrackedConnections - d.baseline
+	if excess < goroutineLeakThreshold {
+		d.reported = false
+		return
+	}
+	if d.reported {
+		return
+	}
+	d.reported = true
+	slog.Warn("goroutines exceed the tracked connections, handlers may be leaking",
+		slog.Int("goroutines", rt.Goroutines), slog.Int("tracked-connections", rt.TrackedConnections),
+		slog.Int("excess", excess))
+}
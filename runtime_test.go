@@ -0,0 +1,70 @@
+package harald
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeakDetector(t *testing.T) {
+	d := newLeakDetector(RuntimeStats{Goroutines: 20, TrackedConnections: 2})
+	if d.baseline != 20-2*goroutinesPerConn {
+		t.Fatalf("unexpected baseline %d", d.baseline)
+	}
+
+	// goroutines of tracked connections are expected
+	d.check(RuntimeStats{Goroutines: 20 + 500*goroutinesPerConn, TrackedConnections: 502})
+	if d.reported {
+		t.Error("expected the goroutines of the connections not to be reported")
+	}
+
+	d.check(RuntimeStats{Goroutines: 20 + goroutineLeakThreshold, TrackedConnections: 2})
+	if !d.reported {
+		t.Error("expected the leak to be reported")
+	}
+
+	d.check(RuntimeStats{Goroutines: 20, TrackedConnections: 2})
+	if d.reported {
+		t.Error("expected the report to be reset once the goroutines are gone")
+	}
+}
+
+func TestStatsdSinkRuntime(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pc.Close()
+
+	sink, err := newStatsdSink(StatsD{Address: pc.LocalAddr().String(), Format: "dogstatsd", Tags: map[string]string{"env": "prod"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer sink.conn.Close()
+	sink.flushRuntime(RuntimeStats{Goroutines: 42, HeapBytes: 1024, TrackedConnections: 7})
+
+	buf := make([]byte, statsdMaxPacketSize)
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Split(string(buf[:n]), "\n")
+	for _, want := range []string{
+		"harald.runtime.goroutines:42|g|#env:prod",
+		"harald.runtime.heap_bytes:1024|g|#env:prod",
+		"harald.runtime.tracked_connections:7|g|#env:prod",
+	} {
+		found := false
+		for _, l := range lines {
+			if l == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected line '%s' in packet:\n%s", want, string(buf[:n]))
+		}
+	}
+}
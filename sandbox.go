@@ -0,0 +1,80 @@
+//go:build unix
+
+package harald
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Sandbox restricts the process once the listeners have been opened on
+// startup, this limits the damage a compromised process can do with the keys
+// it holds.
+type Sandbox struct {
+	// Chroot changes the root directory of the process. Files read later on
+	// (e.g. the config on reload or the CA of Kubernetes) are looked up
+	// relative to it, DNS resolution needs /etc/resolv.conf below it.
+	Chroot string `json:"chroot" yaml:"chroot" toml:"chroot"`
+	// DropCapabilities drops all capabilities except for KeepCapabilities
+	// (e.g. CAP_NET_BIND_SERVICE), including the ones of the bounding set.
+	// If a user is configured the kept capabilities are retained when
+	// switching to it. Only supported on linux for binaries built without
+	// cgo.
+	DropCapabilities bool     `json:"drop_capabilities" yaml:"drop_capabilities" toml:"drop_capabilities"`
+	KeepCapabilities []string `json:"keep_capabilities" yaml:"keep_capabilities" toml:"keep_capabilities"`
+}
+
+// validate reports options which can't be applied.
+func (s *Sandbox) validate() error {
+	if s == nil {
+		return nil
+	}
+	if !s.DropCapabilities && len(s.KeepCapabilities) > 0 {
+		return fmt.Errorf("sandbox: keep_capabilities requires drop_capabilities")
+	}
+	if s.DropCapabilities {
+		_, err := parseCapabilities(s.KeepCapabilities)
+		if err != nil {
+			return fmt.Errorf("sandbox: %w", err)
+		}
+	}
+	return nil
+}
+
+// chroot changes the root directory if configured.
+func (s *Sandbox) chroot() error {
+	if s == nil || s.Chroot == "" {
+		return nil
+	}
+	err := syscall.Chroot(s.Chroot)
+	if err != nil {
+		return fmt.Errorf("sandbox: chroot: %w", err)
+	}
+	err = syscall.Chdir("/")
+	if err != nil {
+		return fmt.Errorf("sandbox: chroot: %w", err)
+	}
+	return nil
+}
+
+// keepsCapabilities reports whether capabilities have to be retained when
+// switching the user.
+func (s *Sandbox) keepsCapabilities() bool {
+	return s != nil && s.DropCapabilities && len(s.KeepCapabilities) > 0
+}
+
+// dropCapabilities drops all capabilities which are not kept, if configured.
+func (s *Sandbox) dropCapabilities() error {
+	if s == nil || !s.DropCapabilities {
+		return nil
+	}
+	caps, err := parseCapabilities(s.KeepCapabilities)
+	if err != nil {
+		return fmt.Errorf("sandbox: %w", err)
+	}
+	err = limitCapabilities(caps)
+	if err != nil {
+		return fmt.Errorf("sandbox: %w", err)
+	}
+	return nil
+}
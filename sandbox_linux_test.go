@@ -0,0 +1,65 @@
+package harald
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	caps, err := parseCapabilities([]string{"CAP_NET_BIND_SERVICE", "net_raw"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(caps) != 2 || caps[0] != unix.CAP_NET_BIND_SERVICE || caps[1] != unix.CAP_NET_RAW {
+		t.Errorf("unexpected capabilities %v", caps)
+	}
+
+	_, err = parseCapabilities([]string{"CAP_DOES_NOT_EXIST"})
+	if err == nil {
+		t.Error("expected error for unknown capability")
+	}
+}
+
+// TestLimitCapabilities drops the capabilities of a child process, the
+// capabilities of the test process itself are left alone.
+func TestLimitCapabilities(t *testing.T) {
+	if os.Getenv("HARALD_TEST_LIMIT_CAPABILITIES") != "" {
+		err := limitCapabilities([]uintptr{unix.CAP_NET_BIND_SERVICE})
+		if errors.Is(err, errCgo) {
+			t.Skip(err.Error())
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		status, err := os.ReadFile("/proc/self/status")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, line := range strings.Split(string(status), "\n") {
+			if strings.HasPrefix(line, "CapEff:") || strings.HasPrefix(line, "CapBnd:") {
+				if !strings.HasSuffix(line, "0000000000000400") {
+					t.Errorf("unexpected capabilities: %s", line)
+				}
+			}
+		}
+		return
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("dropping capabilities requires root")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLimitCapabilities$", "-test.v")
+	cmd.Env = append(os.Environ(), "HARALD_TEST_LIMIT_CAPABILITIES=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %s", err.Error(), out)
+	}
+	if strings.Contains(string(out), "--- SKIP") {
+		t.Skip(string(out))
+	}
+}
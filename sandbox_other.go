@@ -0,0 +1,21 @@
+//go:build unix && !linux
+
+package harald
+
+import (
+	"errors"
+)
+
+var errCapabilities = errors.New("capabilities are only supported on linux")
+
+func parseCapabilities([]string) ([]uintptr, error) {
+	return nil, errCapabilities
+}
+
+func keepCapabilities() error {
+	return errCapabilities
+}
+
+func limitCapabilities([]uintptr) error {
+	return errCapabilities
+}
@@ -0,0 +1,46 @@
+package harald
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestTLSConfigSelfSigned(t *testing.T) {
+	conf, err := (&TLS{SelfSigned: true, SelfSignedSANs: []string{"harald.test", "10.0.0.1"}, SelfSignedLifetime: Duration(time.Hour)}).Config()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	leaf := conf.Certificates[0].Leaf
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "harald.test" || len(leaf.IPAddresses) != 1 || leaf.IPAddresses[0].String() != "10.0.0.1" {
+		t.Fatalf("unexpected SANs %v %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+	if lifetime := time.Until(leaf.NotAfter); lifetime > time.Hour || lifetime < 59*time.Minute {
+		t.Fatalf("unexpected lifetime %s", lifetime)
+	}
+
+	// clients trusting the certificate itself are able to connect
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "harald.test", Roots: roots})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	conf, err = (&TLS{SelfSigned: true}).Config()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = conf.Certificates[0].Leaf.VerifyHostname("localhost"); err != nil {
+		t.Errorf("expected the certificate to be valid for localhost by default: %s", err.Error())
+	}
+
+	for _, c := range []*TLS{
+		{SelfSigned: true, SelfSignedLifetime: Duration(-time.Hour)},
+		{SelfSigned: true, PKCS12File: "server.p12"},
+	} {
+		if _, err = c.Config(); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
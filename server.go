@@ -0,0 +1,925 @@
+//go:build unix
+
+package harald
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Server is a single instance of harald. In contrast to Harald it allows the
+// caller to inspect the instance while it is running.
+type Server struct {
+	conf Config
+	bans *banList
+	// budget limits the memory of the copy buffers of all forwarders.
+	budget *bufferBudget
+	// tenants are the quotas of the configured tenants.
+	tenants map[string]*tenantQuota
+	// adminTenants maps the subjects of admin clients to the tenant they are
+	// limited to.
+	adminTenants map[string]string
+	// redactor hides the addresses of clients in the logs of all forwarders.
+	redactor *redactor
+	// access writes the access records of all forwarders.
+	access *accessLog
+	// events are streamed through the admin socket.
+	events *eventBus
+	// conns holds the open connections of all forwarders.
+	conns *connTable
+	// captures record the data of connections of all forwarders.
+	captures *captureTable
+	// state persists the counters of all forwarders, nil without a state
+	// file.
+	state *stateFile
+	// grpcTLS is the TLS config of the gRPC admin service.
+	grpcTLS *tls.Config
+	// newID generates the IDs of the connections of all forwarders.
+	newID func() string
+
+	mu         sync.Mutex // guards forwarders and listening
+	forwarders Forwarders
+	// listening is set while the listeners should be open, forwarders which
+	// are added in the meantime are started right away.
+	listening bool
+	// stopped contains the rules which have been stopped individually, they
+	// are left alone when all listeners are started.
+	stopped map[string]bool
+
+	// rulesMu guards the rules of conf and dynamicRules, it is held while
+	// they are applied to serialize updates from different sources.
+	rulesMu sync.Mutex
+	// dynamicRules are the rules received from etcd.
+	dynamicRules map[string]ForwardRule
+
+	// uid and gid of the configured user.
+	uid, gid int
+
+	// started is the time Run has been called.
+	started time.Time
+
+	// shutdown is an alternative to SIGTERM for the admin socket.
+	shutdown chan struct{}
+
+	// audit records the changes to the state of the server, it is open
+	// while Run is running.
+	audit *auditLog
+
+	// stopping is set once the server received SIGTERM.
+	stopping atomic.Bool
+}
+
+// NewServer creates the forwarders for all rules of the config. No listener
+// is opened until Run is called.
+func NewServer(c Config) (_ *Server, err error) {
+	defer func() { err = withKind(ErrConfig, err) }()
+
+	s := &Server{
+		conf:     c,
+		budget:   newBufferBudget(c.MemoryBudget),
+		events:   newEventBus(),
+		conns:    newConnTable(),
+		captures: newCaptureTable(c.CaptureDir),
+		stopped:  make(map[string]bool),
+		shutdown: make(chan struct{}, 1),
+	}
+
+	if c.Ban != nil {
+		s.bans, err = newBanList(*c.Ban)
+		if err != nil {
+			return nil, fmt.Errorf("harald: %w", err)
+		}
+	}
+
+	s.tenants, err = newTenantQuotas(c.Tenants)
+	if err != nil {
+		return nil, fmt.Errorf("harald: %w", err)
+	}
+	s.adminTenants = make(map[string]string)
+	for name, t := range c.Tenants {
+		for _, subject := range t.AdminSubjects {
+			if other, ok := s.adminTenants[subject]; ok {
+				return nil, fmt.Errorf("harald: admin subject '%s' belongs to tenants %s and %s", subject, other, name)
+			}
+			s.adminTenants[subject] = name
+		}
+	}
+
+	s.redactor, err = newRedactor(c.RedactSources)
+	if err != nil {
+		return nil, fmt.Errorf("harald: %w", err)
+	}
+
+	s.newID, err = connIDGenerator(c.ConnIDFormat)
+	if err != nil {
+		return nil, fmt.Errorf("harald: %w", err)
+	}
+
+	s.access, err = newAccessLog(c.AccessLog)
+	if err != nil {
+		return nil, fmt.Errorf("harald: %w", err)
+	}
+
+	s.state, err = openStateFile(c.StateFile, c.StateInterval.Duration())
+	if err != nil {
+		return nil, fmt.Errorf("harald: %w", err)
+	}
+
+	if c.AdminGRPC != nil {
+		s.grpcTLS, err = c.AdminGRPC.config()
+		if err != nil {
+			return nil, fmt.Errorf("harald: %w", err)
+		}
+	}
+
+	rules := expandRules(c.Rules)
+	err = rules.err()
+	if err != nil {
+		return nil, fmt.Errorf("harald: %w", err)
+	}
+	// all broken rules are reported at once instead of one per attempt
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(rules.rules)) {
+		f, err := s.newForwarder(name, rules.parent(name), rules.rules[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("harald: %w", err))
+			continue
+		}
+		s.forwarders = append(s.forwarders, f)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	s.forwarders.sort()
+
+	// with a dynamic config source the rules may arrive later
+	if c.Group != "" && c.User == "" {
+		return nil, fmt.Errorf("harald: group requires a user")
+	}
+	if c.User != "" {
+		// resolved right away, the user database may not be accessible
+		// once the sandbox is in place.
+		s.uid, s.gid, err = lookupIdentity(c.User, c.Group)
+		if err != nil {
+			return nil, fmt.Errorf("harald: %w", err)
+		}
+	}
+	err = c.Sandbox.validate()
+	if err != nil {
+		return nil, fmt.Errorf("harald: %w", err)
+	}
+
+	switch c.StartPolicy {
+	case "", StartPolicyAny, StartPolicyAll:
+	default:
+		return nil, fmt.Errorf("harald: unknown start policy '%s'", c.StartPolicy)
+	}
+
+	if len(s.forwarders) == 0 && c.Etcd == nil {
+		return nil, fmt.Errorf("harald: no forwarders configured")
+	}
+
+	return s, nil
+}
+
+// newForwarder creates a forwarder for the rule which shares the state of the
+// server.
+func (s *Server) newForwarder(name, parent string, r ForwardRule) (*Forwarder, error) {
+	f, err := r.NewForwarder(name, s.conf.DialTimeout.Duration())
+	if err != nil {
+		return nil, err
+	}
+	f.parent = parent
+	f.bans = s.bans
+	f.budget = s.budget
+	f.tenant = s.tenants[r.Tenant]
+	f.redactor = s.redactor
+	f.access = s.access
+	f.events = s.events
+	f.conns = s.conns
+	f.captures = s.captures
+	f.newID = s.newID
+	if r.LogSampling == 0 {
+		f.sampler = newDebugSampler(s.conf.LogSampling)
+	}
+	if r.BindRetryWindow == 0 {
+		f.bindRetry = s.conf.BindRetryWindow.Duration()
+	}
+	s.state.restore(f)
+	return f, nil
+}
+
+// Run blocks until SIGTERM is received on the signals channel. The listeners
+// are opened on SIGUSR1 and closed on SIGUSR2, if the config enables the
+// listeners they are opened right away.
+func (s *Server) Run(signals <-chan os.Signal) error {
+	s.started = time.Now()
+
+	if s.conf.AuditLog != "" {
+		var err error
+		s.audit, err = openAuditLog(s.conf.AuditLog)
+		if err != nil {
+			return fmt.Errorf("harald: %w", err)
+		}
+		s.audit.record("server.start", "startup", "", "running", nil)
+		defer func() {
+			s.audit.record("server.stop", "shutdown", "stopping", "stopped", nil)
+			_ = s.audit.close()
+		}()
+	}
+
+	if s.conf.PIDFile != "" {
+		err := writePIDFile(s.conf.PIDFile)
+		if err != nil {
+			return fmt.Errorf("harald: %w", err)
+		}
+		defer func() {
+			err := removePIDFile(s.conf.PIDFile)
+			if err != nil {
+				slog.Warn("unable to remove pid file", attrError(err))
+			}
+		}()
+	}
+
+	defer func() {
+		err := s.access.close()
+		if err != nil {
+			slog.Warn("unable to close access log", attrError(err))
+		}
+	}()
+
+	if s.conf.AdminSocket != "" {
+		l, err := s.listenAdmin(s.conf.AdminSocket)
+		if err != nil {
+			return fmt.Errorf("harald: %w", err)
+		}
+		defer func() { _ = l.Close() }()
+	}
+
+	if s.conf.AdminGRPC != nil {
+		srv, err := s.listenGRPC(s.conf.AdminGRPC.Listen)
+		if err != nil {
+			return fmt.Errorf("harald: %w", err)
+		}
+		defer func() { _ = srv.Close() }()
+	}
+
+	if s.conf.StatsD != nil {
+		sink, err := newStatsdSink(*s.conf.StatsD)
+		if err != nil {
+			return fmt.Errorf("harald: %w", err)
+		}
+		done, flushed := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(flushed)
+			sink.run(s.Stats, s.RuntimeStats, done)
+		}()
+		defer func() {
+			close(done)
+			<-flushed
+		}()
+	}
+
+	if s.state != nil {
+		done, written := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(written)
+			s.state.run(s.getForwarders, done)
+		}()
+		defer func() {
+			close(done)
+			<-written
+		}()
+	}
+
+	if s.conf.HTTPListen != nil {
+		srv, err := s.listenHTTP(*s.conf.HTTPListen)
+		if err != nil {
+			return fmt.Errorf("harald: %w", err)
+		}
+		defer func() { _ = srv.Close() }()
+	}
+
+	slog.Info("harald is ready")
+
+	if s.conf.Etcd != nil {
+		src, err := newEtcdSource(*s.conf.Etcd, slog.Default())
+		if err != nil {
+			return fmt.Errorf("harald: %w", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go src.watch(ctx, func(rules map[string]ForwardRule) {
+			_ = s.audited("rules.update", "etcd", s.rulesState, func() error {
+				s.applyDynamicRules(rules)
+				return nil
+			})
+		})
+	}
+
+	if s.conf.WatchConfig {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		err := s.watchConfig(ctx)
+		if err != nil {
+			return fmt.Errorf("harald: %w", err)
+		}
+	}
+
+	if s.conf.EnableListeners {
+		err := s.audited("listeners.start", "startup", s.listeningState, func() error { return s.setListening(true) })
+		if err != nil {
+			return fmt.Errorf("harald: %w", err)
+		}
+		slog.Info("started listeners")
+	}
+
+	err := s.restrict()
+	if err != nil {
+		return fmt.Errorf("harald: %w", err)
+	}
+	logIdentity()
+
+	// started once the listeners are open, their goroutines are part of the
+	// baseline
+	monitorDone := make(chan struct{})
+	defer close(monitorDone)
+	go s.monitorRuntime(monitorDone)
+	exhausted := make(chan struct{})
+	go s.watchAccepts(exhausted, monitorDone)
+
+	for {
+		var sig os.Signal
+		var trigger string
+		select {
+		case received, ok := <-signals:
+			if !ok {
+				return nil
+			}
+			sig = received
+			trigger = "signal " + sig.String()
+			slog.Info("received signal", attrSignal(sig))
+		case <-s.shutdown:
+			slog.Info("received shutdown command")
+			sig = syscall.SIGTERM
+			trigger = "admin"
+		case <-exhausted:
+			slog.Info("all rules accepted their maximum number of connections")
+			sig = syscall.SIGTERM
+			trigger = "max_accepts"
+		}
+
+		switch sig {
+		case syscall.SIGTERM:
+			slog.Info("shutting down")
+			s.stopping.Store(true)
+			_ = s.audited("listeners.stop", trigger, s.listeningState, func() error { return s.setListening(false) })
+			slog.Info("stopped listeners")
+			return nil // cannot break because of the switch
+		case syscall.SIGUSR1:
+			err := s.audited("listeners.start", trigger, s.listeningState, func() error { return s.setListening(true) })
+			if err != nil {
+				slog.Error("starting listeners failed", attrError(err))
+				continue
+			}
+			slog.Info("started listeners")
+		case syscall.SIGUSR2:
+			_ = s.audited("listeners.stop", trigger, s.listeningState, func() error { return s.setListening(false) })
+			slog.Info("stopped listeners")
+		case syscall.SIGHUP:
+			err := s.audited("config.reload", trigger, s.configState, s.reload)
+			if err != nil {
+				slog.Error("reloading config failed", attrError(err))
+			}
+		default:
+			slog.Debug("ignoring unknown signal", attrSignal(sig))
+		}
+	}
+}
+
+// watchAccepts closes exhausted once every rule has been closed after
+// accepting its maximum number of connections and all of them are done. Rules
+// without max accepts keep the server running.
+func (s *Server) watchAccepts(exhausted chan<- struct{}, done <-chan struct{}) {
+	t := time.NewTicker(drainInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		forwarders := s.getForwarders()
+		if len(forwarders) > 0 && !slices.ContainsFunc(forwarders, func(f *Forwarder) bool { return !f.exhausted() }) {
+			close(exhausted)
+			return
+		}
+	}
+}
+
+// restrict applies the sandbox and switches the user once the listeners have
+// been opened.
+func (s *Server) restrict() error {
+	err := s.conf.Sandbox.chroot()
+	if err != nil {
+		return err
+	}
+	if s.conf.User != "" {
+		if s.conf.Sandbox.keepsCapabilities() {
+			err = keepCapabilities()
+			if err != nil {
+				return fmt.Errorf("sandbox: %w", err)
+			}
+		}
+		err = dropPrivileges(s.uid, s.gid)
+		if err != nil {
+			return err
+		}
+	}
+	return s.conf.Sandbox.dropCapabilities()
+}
+
+// Addrs returns the addresses the forwarders are currently listening on keyed
+// by the name of their rule. Rules without an open listener are omitted.
+func (s *Server) Addrs() map[string]net.Addr {
+	forwarders := s.getForwarders()
+	addrs := make(map[string]net.Addr, len(forwarders))
+	for _, f := range forwarders {
+		if a := f.Addr(); a != nil {
+			addrs[f.name] = a
+		}
+	}
+	return addrs
+}
+
+// Stats returns a snapshot of the counters of each forwarder keyed by the name
+// of its rule.
+func (s *Server) Stats() map[string]Stats {
+	forwarders := s.getForwarders()
+	stats := make(map[string]Stats, len(forwarders))
+	for _, f := range forwarders {
+		stats[f.name] = f.Stats()
+	}
+	return stats
+}
+
+// RuntimeStats returns a snapshot of the stats of the process.
+func (s *Server) RuntimeStats() RuntimeStats {
+	return readRuntimeStats(s.conns.count())
+}
+
+// monitorRuntime checks for leaked goroutines and connections exceeding the
+// age warning periodically until done is closed.
+func (s *Server) monitorRuntime(done <-chan struct{}) {
+	d := newLeakDetector(s.RuntimeStats())
+	t := time.NewTicker(runtimeCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			d.check(s.RuntimeStats())
+			s.conns.warnOld(s.conf.ConnectionAgeWarning.Duration())
+		case <-done:
+			return
+		}
+	}
+}
+
+// StartErrors returns the errors of the forwarders whose last attempt to open
+// their listener failed, keyed by the name of their rule.
+func (s *Server) StartErrors() StartErrors {
+	errs := make(StartErrors)
+	for _, f := range s.getForwarders() {
+		if err := f.StartError(); err != nil {
+			errs[f.name] = err
+		}
+	}
+	return errs
+}
+
+// connections lists the open connections of the rule, or of all rules if it
+// is empty.
+func (s *Server) connections(rule string) ([]Connection, error) {
+	if rule != "" {
+		s.mu.Lock()
+		f := s.forwarder(rule)
+		s.mu.Unlock()
+		if f == nil {
+			return nil, withKind(ErrNotFound, fmt.Errorf("unknown rule '%s'", rule))
+		}
+	}
+	return s.conns.list(rule), nil
+}
+
+// killConnection closes the connection with the id and waits until it has
+// been cleaned up.
+func (s *Server) killConnection(id string) error {
+	if !s.conns.kill(id) {
+		return withKind(ErrNotFound, fmt.Errorf("unknown connection '%s'", id))
+	}
+	slog.Info("killed connection", attrConnId(id))
+	return nil
+}
+
+// getForwarders returns a copy of the current list of forwarders.
+func (s *Server) getForwarders() Forwarders {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.forwarders)
+}
+
+// setListening opens or closes the listeners of all forwarders. If some
+// listeners can't be opened, the start policy decides whether that is an
+// error, in which case all listeners are closed again.
+func (s *Server) setListening(listening bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.listening = listening
+	if !listening {
+		s.forwarders.Stop()
+		return nil
+	}
+
+	var start Forwarders
+	for _, f := range s.forwarders {
+		if !s.stopped[f.name] {
+			start = append(start, f)
+		}
+	}
+	err := s.startForwarders(start, func(f *Forwarder) bool {
+		return s.listening && !s.stopped[f.name] && s.forwarder(f.name) == f
+	})
+	if err == nil {
+		return nil
+	}
+
+	var errs StartErrors
+	errors.As(err, &errs)
+	switch {
+	case s.conf.StartPolicy == StartPolicyAll:
+		err = fmt.Errorf("not all listeners could be started: %w", err)
+	case slices.ContainsFunc(start, func(f *Forwarder) bool { return f.Required && errs[f.name] != nil }):
+		err = fmt.Errorf("required listeners could not be started: %w", err)
+	case slices.ContainsFunc(s.forwarders, func(f *Forwarder) bool { return f.State() == StateListening }):
+		// at least one rule is up, which is good enough
+		return nil
+	default:
+		err = fmt.Errorf("no listener could be started: %w", err)
+	}
+	s.listening = false
+	s.forwarders.Stop()
+	return err
+}
+
+// errStartCanceled is returned for forwarders which are no longer supposed to
+// listen once their startup conditions are met, e.g. because the listeners
+// have been stopped or the rule has been replaced in the meantime.
+var errStartCanceled = errors.New("start canceled")
+
+// startForwarders opens the listeners of the forwarders. The caller must hold
+// mu, it is released while the forwarders wait for their startup conditions
+// so the server stays responsive, and only held to open the listener of a
+// forwarder if wanted still reports true for it.
+func (s *Server) startForwarders(forwarders Forwarders, wanted func(f *Forwarder) bool) error {
+	if len(forwarders) == 0 {
+		return nil
+	}
+	s.mu.Unlock()
+	defer s.mu.Lock()
+
+	return forwarders.start(s.lookup, func(f *Forwarder) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !wanted(f) {
+			f.changeState(StateStarting, StateStopped)
+			return errStartCanceled
+		}
+		return f.Start()
+	})
+}
+
+// lookup is like forwarder for callers which don't hold mu.
+func (s *Server) lookup(name string) *Forwarder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forwarder(name)
+}
+
+// startRule opens the listener of a single rule, regardless of the state of
+// the other rules.
+func (s *Server) startRule(name string) (*Forwarder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.forwarder(name)
+	if f == nil {
+		return nil, withKind(ErrNotFound, fmt.Errorf("unknown rule '%s'", name))
+	}
+	delete(s.stopped, name)
+	err := s.startForwarders(Forwarders{f}, func(f *Forwarder) bool {
+		return !s.stopped[f.name] && s.forwarder(f.name) == f
+	})
+	if err != nil {
+		return nil, fmt.Errorf("start rule '%s': %w", name, err)
+	}
+	slog.Info("started rule", attrRule(name))
+	return f, nil
+}
+
+// stopRule closes the listener of a single rule, it stays closed until it is
+// started individually again.
+func (s *Server) stopRule(name string) (*Forwarder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.forwarder(name)
+	if f == nil {
+		return nil, withKind(ErrNotFound, fmt.Errorf("unknown rule '%s'", name))
+	}
+	s.stopped[name] = true
+	f.Stop()
+	slog.Info("stopped rule", attrRule(name))
+	return f, nil
+}
+
+// drainInterval is the interval in which draining rules check whether their
+// last connection has been closed.
+const drainInterval = 100 * time.Millisecond
+
+// drainRule closes the listener of a single rule like stopRule and keeps the
+// existing connections alive. Once the last one has been closed the rule is
+// reported as drained through the log and the events. If the rule has a drain
+// timeout the connections left after it are closed, reset or kept according
+// to its drain configuration.
+func (s *Server) drainRule(name string) (*Forwarder, error) {
+	f, err := s.stopRule(name)
+	if err != nil {
+		return nil, err
+	}
+	if !f.changeState(StateStopped, StateDraining) {
+		return f, nil
+	}
+	slog.Info("draining rule", attrRule(name), slog.Int64("active", f.handlers.Load()))
+
+	timeout, action := f.Drain.deadline()
+	go func() {
+		t := time.NewTicker(drainInterval)
+		defer t.Stop()
+		var deadline <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		// connections still being set up, e.g. during the TLS handshake or
+		// the dial, aren't active yet but have to be waited for as well
+		for f.handlers.Load() > 0 {
+			select {
+			case <-t.C:
+			case <-deadline:
+				deadline = nil
+				if f.State() != StateDraining {
+					return
+				}
+				s.drainDeadline(f, action)
+			}
+			if f.State() != StateDraining {
+				// the rule has been started again
+				return
+			}
+		}
+		if f.changeState(StateDraining, StateStopped) {
+			slog.Info("drained rule", attrRule(name))
+			s.events.publish(Event{Type: EventRuleDrained, Rule: name})
+		}
+	}()
+	return f, nil
+}
+
+// drainDeadline applies the action to the connections of a draining rule
+// which are still open after the drain timeout.
+func (s *Server) drainDeadline(f *Forwarder, action string) {
+	if action == DrainWait {
+		slog.Info("drain deadline expired, waiting for connections", attrRule(f.name),
+			slog.Int64("active", f.handlers.Load()))
+		return
+	}
+	n := s.conns.closeRule(f.name, action == DrainReset)
+	slog.Warn("drain deadline expired, cut connections", attrRule(f.name),
+		slog.String("action", action), slog.Int("connections", n))
+}
+
+// setMaintenance puts a single rule into or out of maintenance mode.
+func (s *Server) setMaintenance(name string, enabled bool) (*Forwarder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.forwarder(name)
+	if f == nil {
+		return nil, withKind(ErrNotFound, fmt.Errorf("unknown rule '%s'", name))
+	}
+	f.maintenance.Store(enabled)
+	slog.Info("changed maintenance mode", attrRule(name), slog.Bool("enabled", enabled))
+	return f, nil
+}
+
+// forwarder returns the forwarder of the rule or nil if there is none. The
+// caller must hold mu.
+func (s *Server) forwarder(name string) *Forwarder {
+	for _, f := range s.forwarders {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// ruleDiff describes the difference between two sets of rules by name.
+type ruleDiff struct {
+	added, changed, removed, unchanged []string
+}
+
+// diffRules compares the rules of the forwarders to the desired rules. The
+// forwarders of failed rules, including the ones of their port ranges, are
+// unchanged: a rule which can't be expanded must not take down a working one.
+func diffRules(current Forwarders, rules expandedRules) ruleDiff {
+	var d ruleDiff
+	known := make(map[string]bool, len(current))
+	for _, f := range current {
+		known[f.name] = true
+		r, ok := rules.rules[f.name]
+		switch {
+		case !ok && rules.failed[cmp.Or(f.parent, f.name)] != nil:
+			d.unchanged = append(d.unchanged, f.name)
+		case !ok:
+			d.removed = append(d.removed, f.name)
+		case reflect.DeepEqual(f.ForwardRule, r):
+			d.unchanged = append(d.unchanged, f.name)
+		default:
+			d.changed = append(d.changed, f.name)
+		}
+	}
+	for name := range rules.rules {
+		if !known[name] {
+			d.added = append(d.added, name)
+		}
+	}
+	slices.Sort(d.added)
+	return d
+}
+
+func (d ruleDiff) empty() bool {
+	return len(d.added) == 0 && len(d.changed) == 0 && len(d.removed) == 0
+}
+
+// updateRules replaces the rules of the server. Forwarders of removed rules
+// are stopped, forwarders of added rules are created and started if the
+// server is listening. Unchanged rules keep their forwarder including the
+// listener and active connections. The forwarder of a changed rule is
+// replaced, the new forwarder takes over the listener if the listen address
+// didn't change while the connections of the old one run to completion. Rules
+// which can't be turned into a forwarder are skipped and reported through the
+// returned error, the forwarders of the failed rules which couldn't be
+// expanded are kept as they are.
+func (s *Server) updateRules(rules expandedRules) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := diffRules(s.forwarders, rules)
+	if d.empty() {
+		return nil
+	}
+	slog.Info("updating rules",
+		slog.Any("added", d.added),
+		slog.Any("changed", d.changed),
+		slog.Any("removed", d.removed),
+		slog.Int("unchanged", len(d.unchanged)))
+
+	var errs []error
+	current := make(map[string]*Forwarder, len(s.forwarders))
+	for _, f := range s.forwarders {
+		current[f.name] = f
+	}
+
+	// the new forwarders are started once the list is complete, so they can
+	// be started after the rules they depend on
+	var forwarders, launch Forwarders
+	for _, name := range d.unchanged {
+		forwarders = append(forwarders, current[name])
+	}
+	for _, name := range d.removed {
+		current[name].Stop()
+		s.state.retire(current[name])
+		delete(s.stopped, name)
+	}
+	for _, name := range slices.Concat(d.changed, d.added) {
+		f, err := s.newForwarder(name, rules.parent(name), rules.rules[name])
+		if err != nil {
+			// keep the old forwarder of a changed rule, a broken rule must
+			// not take down a working one.
+			if old, ok := current[name]; ok {
+				forwarders = append(forwarders, old)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		old, replace := current[name]
+		if replace {
+			s.state.replace(f, old)
+		}
+		switch {
+		case replace && f.takeOver(old):
+			// the socket stays open, so clients don't notice the replacement
+		case !s.listening || s.stopped[name]:
+			// nothing to do, the old forwarder isn't listening either
+		default:
+			if replace {
+				old.Stop()
+			}
+			launch = append(launch, f)
+		}
+		forwarders = append(forwarders, f)
+	}
+
+	forwarders.sort()
+	s.forwarders = forwarders
+	// failures are logged, the rules are updated regardless
+	_ = s.startForwarders(launch, func(f *Forwarder) bool {
+		return s.listening && !s.stopped[f.name] && s.forwarder(f.name) == f
+	})
+
+	return errors.Join(errs...)
+}
+
+// applyDynamicRules replaces the rules from the dynamic config source and
+// applies them together with the rules of the config file. Rules which are
+// refused keep the previous rule of the same name.
+func (s *Server) applyDynamicRules(rules map[string]ForwardRule) {
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+
+	accepted := make(map[string]ForwardRule, len(rules))
+	for name, r := range rules {
+		err := validateDynamic(r)
+		if err != nil {
+			slog.Error("refusing dynamic rule", attrRule(name), attrError(err))
+			if prev, ok := s.dynamicRules[name]; ok {
+				accepted[name] = prev
+			}
+			continue
+		}
+		accepted[name] = r
+	}
+	s.dynamicRules = accepted
+	s.applyRules()
+}
+
+// validateDynamic refuses rules from a dynamic config source which would give
+// everyone who can write to the source more than control over forwarding,
+// e.g. running commands as the harald user.
+func validateDynamic(r ForwardRule) error {
+	if r.Exec != nil || r.usesNetwork(networkExec) {
+		return fmt.Errorf("exec is only allowed in the config file")
+	}
+	if r.usesNetwork(networkStdio) {
+		return fmt.Errorf("stdio is only allowed in the config file")
+	}
+	return nil
+}
+
+// applyRules merges the rules of the config file and the dynamic config
+// source and updates the forwarders accordingly. Rules of the config file take
+// precedence. The caller must hold rulesMu.
+func (s *Server) applyRules() {
+	merged := maps.Clone(s.conf.Rules)
+	if merged == nil {
+		merged = make(map[string]ForwardRule, len(s.dynamicRules))
+	}
+	for name, r := range s.dynamicRules {
+		if _, ok := merged[name]; ok {
+			slog.Error("ignoring dynamic rule which is already defined in the config file", attrRule(name))
+			continue
+		}
+		merged[name] = r
+	}
+
+	rules := expandRules(merged)
+	err := errors.Join(rules.err(), s.updateRules(rules))
+	if err != nil {
+		slog.Error("failed to apply some rules", attrError(err))
+	}
+}
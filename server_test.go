@@ -0,0 +1,283 @@
+package harald
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+// testRule returns a rule listening on a random port forwarding to connect.
+func testRule(connect string) ForwardRule {
+	return ForwardRule{
+		Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		Connect: NetConf{Network: "tcp", Address: connect},
+	}
+}
+
+func TestServerUpdateRules(t *testing.T) {
+	s, err := NewServer(Config{Rules: map[string]ForwardRule{
+		"keep":    testRule("127.0.0.1:1"),
+		"change":  testRule("127.0.0.1:2"),
+		"removed": testRule("127.0.0.1:3"),
+	}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.setListening(true)
+	defer s.setListening(false)
+
+	before := s.Addrs()
+
+	err = s.updateRules(expandRules(map[string]ForwardRule{
+		"keep":    testRule("127.0.0.1:1"),
+		"change":  testRule("127.0.0.1:4"),
+		"added":   testRule("127.0.0.1:5"),
+		"invalid": {Listen: testRule("").Listen, Connect: NetConf{Address: "a"}, Upstreams: []NetConf{{Address: "b"}}},
+	}))
+	if err == nil {
+		t.Error("expected error for invalid rule")
+	}
+
+	after := s.Addrs()
+	if len(after) != 3 {
+		t.Fatalf("expected three listening rules; got = %v", after)
+	}
+	if after["keep"].String() != before["keep"].String() {
+		t.Errorf("unchanged rule has been restarted")
+	}
+	if after["change"].String() != before["change"].String() {
+		t.Errorf("changed rule didn't take over the listener")
+	}
+	if after["added"] == nil {
+		t.Errorf("added rule is not listening")
+	}
+	if _, ok := after["removed"]; ok {
+		t.Errorf("removed rule is still present")
+	}
+}
+
+func TestServerReplaceKeepsConnections(t *testing.T) {
+	oldUpstream, oldAccepted := haraldtest.EchoServer(t)
+	newUpstream, newAccepted := haraldtest.EchoServer(t)
+
+	s, err := NewServer(Config{Rules: map[string]ForwardRule{
+		"test": testRule(oldUpstream),
+	}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.setListening(true)
+	defer s.setListening(false)
+
+	addr := s.Addrs()["test"].String()
+
+	echo := func(c net.Conn) {
+		t.Helper()
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err := c.Write([]byte("ping"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(c, buf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	active, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer active.Close()
+	echo(active)
+
+	err = s.updateRules(expandRules(map[string]ForwardRule{"test": testRule(newUpstream)}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the connection established before the update still works
+	echo(active)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("listener has been closed during the update: %s", err.Error())
+	}
+	defer c.Close()
+	echo(c)
+
+	if oldAccepted() != 1 || newAccepted() != 1 {
+		t.Errorf("expected one connection per upstream; got old = %d, new = %d", oldAccepted(), newAccepted())
+	}
+}
+
+func TestServerStartPolicy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	conflict := testRule("127.0.0.1:1")
+	conflict.Listen.Address = l.Addr().String()
+	rules := map[string]ForwardRule{
+		"conflict": conflict,
+		"ok":       testRule("127.0.0.1:1"),
+	}
+
+	s, err := NewServer(Config{Rules: rules})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = s.setListening(true)
+	if err != nil {
+		t.Fatalf("expected to continue with one rule up; got %s", err.Error())
+	}
+	if len(s.Addrs()) != 1 {
+		t.Errorf("expected one listener; got %v", s.Addrs())
+	}
+	errs := s.StartErrors()
+	if len(errs) != 1 || !errors.Is(errs["conflict"], ErrBind) {
+		t.Errorf("expected bind error of conflict; got %v", errs)
+	}
+	s.setListening(false)
+
+	required := conflict
+	required.Required = true
+	s, err = NewServer(Config{Rules: map[string]ForwardRule{"conflict": required, "ok": testRule("127.0.0.1:1")}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = s.setListening(true)
+	var startErrs StartErrors
+	if !errors.As(err, &startErrs) || len(startErrs) != 1 || startErrs["conflict"] == nil {
+		t.Fatalf("expected start error of the required rule; got %v", err)
+	}
+	if len(s.Addrs()) != 0 {
+		t.Errorf("expected all listeners to be closed; got %v", s.Addrs())
+	}
+
+	s, err = NewServer(Config{Rules: rules, StartPolicy: StartPolicyAll})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = s.setListening(true)
+	if !errors.Is(err, ErrBind) {
+		t.Fatalf("expected bind error; got %v", err)
+	}
+	if len(s.Addrs()) != 0 {
+		t.Errorf("expected all listeners to be closed; got %v", s.Addrs())
+	}
+
+	s, err = NewServer(Config{Rules: map[string]ForwardRule{"conflict": conflict}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = s.setListening(true)
+	if err == nil {
+		t.Fatal("expected error without any listener")
+	}
+}
+
+func TestServerMaxAccepts(t *testing.T) {
+	echo, _ := haraldtest.EchoServer(t)
+	r := testRule(echo)
+	r.MaxAccepts = 1
+	s, err := NewServer(Config{
+		EnableListeners: true,
+		Rules:           map[string]ForwardRule{"test": r},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run(make(chan os.Signal)) }()
+
+	var addr net.Addr
+	for i := 0; i < 100 && addr == nil; i++ {
+		addr = s.Addrs()["test"]
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr == nil {
+		t.Fatal("rule didn't start listening")
+	}
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, _ = c.Write([]byte("ping"))
+	_, err = io.ReadFull(c, make([]byte, 4))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the listener is closed right away, the server keeps running until the
+	// connection is done
+	if _, err = net.Dial("tcp", addr.String()); err == nil {
+		t.Error("expected the listener to be closed")
+	}
+	select {
+	case <-done:
+		t.Fatal("server exited while the connection is open")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	_ = c.Close()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't exit")
+	}
+}
+
+func TestServerDynamicRulesRefuseExec(t *testing.T) {
+	e := newFakeEtcd()
+	e.put("/harald/a", `{"listen": {"network": "tcp", "address": "127.0.0.1:0"}, "connect": {"network": "tcp", "address": "127.0.0.1:1"}}`)
+	e.put("/harald/run", `{"listen": {"network": "tcp", "address": "127.0.0.1:0"}, "connect": {"network": "exec"}, "exec": {"command": ["/bin/sh"]}}`)
+	e.put("/harald/stdio", `{"listen": {"network": "tcp", "address": "127.0.0.1:0"}, "connect": {"network": "stdio"}}`)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	s, err := NewServer(Config{Etcd: &Etcd{Endpoints: []string{srv.URL}, Prefix: "/harald/", Username: "harald", Password: "secret"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	src, err := newEtcdSource(*s.conf.Etcd, testLogger())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	applied := make(chan struct{}, 1)
+	go src.watch(ctx, func(rules map[string]ForwardRule) {
+		s.applyDynamicRules(rules)
+		applied <- struct{}{}
+	})
+	select {
+	case <-applied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update received")
+	}
+
+	if s.forwarder("a") == nil {
+		t.Error("expected rule a to be applied")
+	}
+	for _, name := range []string{"run", "stdio"} {
+		if s.forwarder(name) != nil {
+			t.Errorf("expected rule %s to be refused", name)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+//go:build unix
+
+package harald
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// SocketOptions are applied to the sockets of one side of a rule. Options of
+// the listener are inherited by the accepted connections.
+type SocketOptions struct {
+	// MultipathTCP enables MPTCP, connections fall back to plain TCP if the
+	// peer or the kernel doesn't support it.
+	MultipathTCP bool `json:"multipath_tcp" yaml:"multipath_tcp" toml:"multipath_tcp"`
+	// TOS is the value of the TOS byte of IPv4 packets and the traffic class
+	// of IPv6 packets, the DSCP value is the upper six bits (e.g. 184 for
+	// DSCP 46, expedited forwarding). Zero leaves the default of the system.
+	TOS uint8 `json:"tos" yaml:"tos" toml:"tos"`
+	// Interface binds the sockets to a network interface (SO_BINDTODEVICE),
+	// only packets of this interface are received and sent. Only supported
+	// on linux.
+	Interface string `json:"interface" yaml:"interface" toml:"interface"`
+	// V6Only sets IPV6_V6ONLY on IPv6 sockets, a listener on the wildcard
+	// address then only accepts IPv6 connections instead of both families.
+	V6Only bool `json:"v6only" yaml:"v6only" toml:"v6only"`
+	// PreferFamily is either "ipv4" or "ipv6". Upstreams with a hostname are
+	// dialed with the preferred family first, by default the order of the
+	// resolver is kept. Only applies to the connect options of tcp rules.
+	PreferFamily string `json:"prefer_family" yaml:"prefer_family" toml:"prefer_family"`
+	// HappyEyeballsDelay is the head start of each connection attempt to an
+	// upstream with a hostname before the next address, alternating between
+	// IPv6 and IPv4, is tried in parallel (RFC 8305). Defaults to 250ms. Only
+	// applies to the connect options of tcp rules.
+	HappyEyeballsDelay Duration `json:"happy_eyeballs_delay" yaml:"happy_eyeballs_delay" toml:"happy_eyeballs_delay"`
+	// UserTimeout sets TCP_USER_TIMEOUT, the connection fails once sent data
+	// remains unacknowledged for this long instead of after the retries of
+	// the kernel are exhausted (about 15 minutes by default). Only supported
+	// on linux.
+	UserTimeout Duration `json:"user_timeout" yaml:"user_timeout" toml:"user_timeout"`
+	// Backlog is the length of the queue of connections waiting to be
+	// accepted, the kernel caps it at net.core.somaxconn. Zero leaves the
+	// default of the system. Only applies to the listen options.
+	Backlog int `json:"backlog" yaml:"backlog" toml:"backlog"`
+	// DeferAccept sets TCP_DEFER_ACCEPT, connections are only accepted once
+	// the client sent data or this duration passed. Only applies to the
+	// listen options of tcp rules and is only supported on linux.
+	DeferAccept Duration `json:"defer_accept" yaml:"defer_accept" toml:"defer_accept"`
+	// ReceiveBuffer and SendBuffer set the size in bytes of the socket
+	// buffers (SO_RCVBUF, SO_SNDBUF), zero leaves the default of the system
+	// which auto-tunes them. Connections over paths with a high bandwidth
+	// and latency need larger buffers than the default maximum to reach the
+	// line rate. The kernel caps them at net.core.rmem_max and wmem_max and
+	// disables the auto-tuning.
+	ReceiveBuffer int `json:"receive_buffer" yaml:"receive_buffer" toml:"receive_buffer"`
+	SendBuffer    int `json:"send_buffer" yaml:"send_buffer" toml:"send_buffer"`
+}
+
+// validate reports options which can't be applied.
+func (o SocketOptions) validate() error {
+	switch o.PreferFamily {
+	case "", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("unknown family '%s', must be ipv4 or ipv6", o.PreferFamily)
+	}
+	if o.UserTimeout < 0 {
+		return fmt.Errorf("user_timeout must not be negative")
+	}
+	if o.HappyEyeballsDelay < 0 {
+		return fmt.Errorf("happy_eyeballs_delay must not be negative")
+	}
+	if o.Backlog < 0 || o.DeferAccept < 0 {
+		return fmt.Errorf("backlog and defer_accept must not be negative")
+	}
+	if o.ReceiveBuffer < 0 || o.SendBuffer < 0 {
+		return fmt.Errorf("receive_buffer and send_buffer must not be negative")
+	}
+	return nil
+}
+
+// listen opens a listener with the options applied.
+func (o SocketOptions) listen(network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: o.control}
+	if o.MultipathTCP {
+		lc.SetMultipathTCP(true)
+	}
+	l, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	if o.Backlog > 0 || o.DeferAccept > 0 {
+		err = o.tuneListener(network, l)
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// tuneListener applies the options which only affect listening sockets.
+func (o SocketOptions) tuneListener(network string, l net.Listener) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("listener of network %s doesn't support socket options", network)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	cerr := raw.Control(func(fd uintptr) {
+		if o.DeferAccept > 0 && strings.HasPrefix(network, "tcp") {
+			errs = append(errs, setDeferAccept(int(fd), o.DeferAccept.Duration()))
+		}
+		if o.Backlog > 0 {
+			// calling listen on a listening socket only updates its backlog
+			errs = append(errs, os.NewSyscallError("listen", unix.Listen(int(fd), o.Backlog)))
+		}
+	})
+	return errors.Join(append(errs, cerr)...)
+}
+
+// dial connects to address with the options applied, hostnames are resolved
+// by the resolver or the one of the system if it is nil.
+func (o SocketOptions) dial(network, address string, timeout time.Duration, resolver *net.Resolver) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout, Control: o.control}
+	if o.MultipathTCP {
+		d.SetMultipathTCP(true)
+	}
+
+	if !strings.HasPrefix(network, "tcp") {
+		return d.Dial(network, address)
+	}
+	return dialHappyEyeballs(context.Background(), d, resolver.LookupNetIP, network, address, o.PreferFamily, o.happyEyeballsDelay())
+}
+
+func (o SocketOptions) happyEyeballsDelay() time.Duration {
+	if o.HappyEyeballsDelay == 0 {
+		return defaultHappyEyeballsDelay
+	}
+	return o.HappyEyeballsDelay.Duration()
+}
+
+// control applies the options to the raw socket before it is bound or
+// connected.
+func (o SocketOptions) control(network, _ string, c syscall.RawConn) error {
+	var errs []error
+	cerr := c.Control(func(fd uintptr) {
+		if o.TOS != 0 {
+			errs = append(errs, setTOS(int(fd), network, o.TOS))
+		}
+		if o.Interface != "" {
+			errs = append(errs, bindToDevice(int(fd), o.Interface))
+		}
+		if o.V6Only && strings.HasSuffix(network, "6") {
+			errs = append(errs, os.NewSyscallError("setsockopt IPV6_V6ONLY", unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1)))
+		}
+		if o.UserTimeout > 0 && strings.HasPrefix(network, "tcp") {
+			errs = append(errs, setUserTimeout(int(fd), o.UserTimeout.Duration()))
+		}
+		// the buffers have to be set before connecting, the window scale
+		// is negotiated during the handshake. Accepted connections inherit
+		// them from the listener.
+		if o.ReceiveBuffer > 0 {
+			errs = append(errs, os.NewSyscallError("setsockopt SO_RCVBUF", unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, o.ReceiveBuffer)))
+		}
+		if o.SendBuffer > 0 {
+			errs = append(errs, os.NewSyscallError("setsockopt SO_SNDBUF", unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, o.SendBuffer)))
+		}
+	})
+	return errors.Join(append(errs, cerr)...)
+}
+
+// checkClosed peeks at the socket of c without blocking. It returns io.EOF if
+// the peer closed the connection, the error of the socket if it has been
+// broken off and nil otherwise. Connections without a socket are assumed to be
+// open, TLS connections are checked on the underlying connection.
+func checkClosed(c net.Conn) error {
+	if tc, ok := c.(interface{ NetConn() net.Conn }); ok {
+		c = tc.NetConn()
+	}
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var perr error
+	cerr := raw.Control(func(fd uintptr) {
+		var b [1]byte
+		n, _, err := unix.Recvfrom(int(fd), b[:], unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		switch {
+		case errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK):
+		case err != nil:
+			perr = os.NewSyscallError("recvfrom", err)
+		case n == 0:
+			perr = io.EOF
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return perr
+}
+
+func setTOS(fd int, network string, tos uint8) error {
+	if !strings.HasSuffix(network, "6") {
+		return os.NewSyscallError("setsockopt IP_TOS", unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, int(tos)))
+	}
+	// IPv4 traffic of a dual-stack socket uses the TOS option, it fails on
+	// IPv6-only sockets which is fine.
+	_ = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, int(tos))
+	return os.NewSyscallError("setsockopt IPV6_TCLASS", unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, int(tos)))
+}
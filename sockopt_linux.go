@@ -0,0 +1,22 @@
+package harald
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func bindToDevice(fd int, name string) error {
+	return os.NewSyscallError("setsockopt SO_BINDTODEVICE", unix.BindToDevice(fd, name))
+}
+
+func setUserTimeout(fd int, timeout time.Duration) error {
+	return os.NewSyscallError("setsockopt TCP_USER_TIMEOUT", unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(timeout.Milliseconds())))
+}
+
+func setDeferAccept(fd int, timeout time.Duration) error {
+	// the option is in seconds, round up to not disable it by accident
+	secs := int((timeout + time.Second - 1) / time.Second)
+	return os.NewSyscallError("setsockopt TCP_DEFER_ACCEPT", unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT, secs))
+}
@@ -0,0 +1,105 @@
+package harald
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketOptionsInterface(t *testing.T) {
+	o := SocketOptions{Interface: "lo"}
+
+	l, err := o.listen("tcp4", "127.0.0.1:0")
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("binding to an interface requires CAP_NET_RAW")
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			_ = c.Close()
+		}
+	}()
+
+	c, err := o.dial("tcp4", l.Addr().String(), 0, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var dev string
+	_ = raw.Control(func(fd uintptr) {
+		dev, err = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if dev != "lo" {
+		t.Errorf("want = lo; got = %s", dev)
+	}
+
+	_, err = SocketOptions{Interface: "does-not-exist0"}.listen("tcp4", "127.0.0.1:0")
+	if err == nil {
+		t.Error("expected error for unknown interface")
+	}
+}
+
+func TestSocketOptionsUserTimeout(t *testing.T) {
+	o := SocketOptions{UserTimeout: Duration(10 * time.Second)}
+
+	l, err := o.listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	c, err := o.dial("tcp4", l.Addr().String(), 0, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+
+	if v := sockoptInt(t, c.(*net.TCPConn), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT); v != 10000 {
+		t.Errorf("dialed connection: want = 10000; got = %d", v)
+	}
+	a := <-accepted
+	defer a.Close()
+	if v := sockoptInt(t, a.(*net.TCPConn), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT); v != 10000 {
+		t.Errorf("accepted connection: want = 10000; got = %d", v)
+	}
+}
+
+func TestSocketOptionsListenTuning(t *testing.T) {
+	o := SocketOptions{Backlog: 16, DeferAccept: Duration(5 * time.Second)}
+
+	l, err := o.listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	// the kernel rounds the timeout up to the next retransmission
+	if v := sockoptInt(t, l.(*net.TCPListener), unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT); v < 5 {
+		t.Errorf("want >= 5; got = %d", v)
+	}
+}
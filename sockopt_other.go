@@ -0,0 +1,20 @@
+//go:build unix && !linux
+
+package harald
+
+import (
+	"errors"
+	"time"
+)
+
+func bindToDevice(int, string) error {
+	return errors.New("binding to an interface is only supported on linux")
+}
+
+func setUserTimeout(int, time.Duration) error {
+	return errors.New("tcp user timeout is only supported on linux")
+}
+
+func setDeferAccept(int, time.Duration) error {
+	return errors.New("deferring accept is only supported on linux")
+}
@@ -0,0 +1,181 @@
+//go:build unix
+
+package harald
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketOptionsMultipathTCP(t *testing.T) {
+	o := SocketOptions{MultipathTCP: true}
+
+	l, err := o.listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			_ = c.Close()
+		}
+	}()
+
+	c, err := o.dial("tcp", l.Addr().String(), 0, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+
+	// MPTCP may not be available in the test environment, in that case the
+	// connection falls back to plain TCP which must work all the same.
+	if _, ok := c.(*net.TCPConn); !ok {
+		t.Fatalf("expected a tcp connection; got %T", c)
+	}
+}
+
+// sockoptInt reads an integer socket option of c.
+func sockoptInt(t *testing.T, c syscall.Conn, level, opt int) int {
+	t.Helper()
+
+	raw, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var v int
+	cerr := raw.Control(func(fd uintptr) {
+		v, err = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	if cerr != nil {
+		t.Fatal(cerr.Error())
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return v
+}
+
+func TestSocketOptionsTOS(t *testing.T) {
+	o := SocketOptions{TOS: 0xb8}
+
+	l, err := o.listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	c, err := o.dial("tcp4", l.Addr().String(), 0, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+
+	if tos := sockoptInt(t, c.(*net.TCPConn), unix.IPPROTO_IP, unix.IP_TOS); tos != 0xb8 {
+		t.Errorf("dialed connection: want = %d; got = %d", 0xb8, tos)
+	}
+
+	a := <-accepted
+	defer a.Close()
+	if tos := sockoptInt(t, a.(*net.TCPConn), unix.IPPROTO_IP, unix.IP_TOS); tos != 0xb8 {
+		t.Errorf("accepted connection: want = %d; got = %d", 0xb8, tos)
+	}
+}
+
+func TestSocketOptionsBuffers(t *testing.T) {
+	o := SocketOptions{ReceiveBuffer: 1 << 17, SendBuffer: 1 << 17}
+
+	l, err := o.listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	c, err := o.dial("tcp4", l.Addr().String(), 0, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	a := <-accepted
+	defer a.Close()
+
+	// linux doubles the values for its bookkeeping
+	for name, conn := range map[string]net.Conn{"dialed": c, "accepted": a} {
+		for opt, want := range map[int]int{unix.SO_RCVBUF: 1 << 17, unix.SO_SNDBUF: 1 << 17} {
+			if got := sockoptInt(t, conn.(*net.TCPConn), unix.SOL_SOCKET, opt); got < want {
+				t.Errorf("%s connection: expected buffer %d of at least %d; got = %d", name, opt, want, got)
+			}
+		}
+	}
+
+	if err = (SocketOptions{SendBuffer: -1}).validate(); err == nil {
+		t.Error("expected error for a negative buffer size")
+	}
+}
+
+func TestSocketOptionsV6Only(t *testing.T) {
+	l, err := SocketOptions{V6Only: true}.listen("tcp", "[::]:0")
+	if err != nil {
+		t.Skipf("IPv6 not available: %s", err.Error())
+	}
+	defer l.Close()
+
+	if v := sockoptInt(t, l.(*net.TCPListener), unix.IPPROTO_IPV6, unix.IPV6_V6ONLY); v != 1 {
+		t.Errorf("want = 1; got = %d", v)
+	}
+}
+
+func TestSocketOptionsPreferFamily(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// the listener only exists for IPv4, so preferring IPv6 must fall back
+	for _, family := range []string{"ipv4", "ipv6"} {
+		c, err := SocketOptions{PreferFamily: family}.dial("tcp", net.JoinHostPort("localhost", port), time.Second, nil)
+		if err != nil {
+			t.Errorf("%s: %s", family, err.Error())
+			continue
+		}
+		_ = c.Close()
+	}
+
+	if err = (SocketOptions{PreferFamily: "ipv5"}).validate(); err == nil {
+		t.Error("expected error for unknown family")
+	}
+}
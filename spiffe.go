@@ -0,0 +1,243 @@
+package harald
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	// spiffeSocketEnv contains the address of the Workload API if the config
+	// doesn't set one.
+	spiffeSocketEnv = "SPIFFE_ENDPOINT_SOCKET"
+	// spiffeRetry is the delay before the Workload API is called again after
+	// the stream of certificates failed.
+	spiffeRetry = 5 * time.Second
+)
+
+// SPIFFESource fetches X.509-SVIDs from the SPIFFE Workload API, e.g. of a
+// SPIRE agent. The trust bundle is used as the client CAs unless they are
+// configured explicitly. The Workload API pushes renewed SVIDs, they are used
+// for all following handshakes.
+type SPIFFESource struct {
+	// Socket is the address of the Workload API, either unix:///path or
+	// tcp://host:port. Defaults to the environment variable
+	// SPIFFE_ENDPOINT_SOCKET.
+	Socket string `json:"socket" yaml:"socket" toml:"socket"`
+	// ID selects the SVID if the workload is entitled to several, defaults
+	// to the first one.
+	ID string `json:"id" yaml:"id" toml:"id"`
+}
+
+// spiffeSource streams the SVIDs from the Workload API.
+type spiffeSource struct {
+	id       string
+	endpoint string
+	client   *http.Client
+	log      *slog.Logger
+}
+
+func newSPIFFESource(c SPIFFESource, log *slog.Logger) (*spiffeSource, error) {
+	if c.Socket == "" {
+		c.Socket = os.Getenv(spiffeSocketEnv)
+	}
+	if c.Socket == "" {
+		return nil, fmt.Errorf("spiffe: missing socket and %s is not set", spiffeSocketEnv)
+	}
+	if c.ID != "" && !strings.HasPrefix(c.ID, "spiffe://") {
+		return nil, fmt.Errorf("spiffe: invalid id '%s'", c.ID)
+	}
+
+	u, err := url.Parse(c.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("spiffe: %w", err)
+	}
+	var network, address string
+	switch {
+	case u.Scheme == "unix" && u.Path != "":
+		network, address = "unix", u.Path
+	case u.Scheme == "unix" && u.Opaque != "":
+		network, address = "unix", u.Opaque
+	case u.Scheme == "tcp" && u.Host != "":
+		network, address = "tcp", u.Host
+	default:
+		return nil, fmt.Errorf("spiffe: invalid socket '%s', expected unix:///path or tcp://host:port", c.Socket)
+	}
+
+	// the Workload API speaks gRPC over HTTP/2 without TLS
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+	return &spiffeSource{
+		id:       c.ID,
+		endpoint: "http://localhost/SpiffeWorkloadAPI/FetchX509SVID",
+		client:   &http.Client{Transport: transport},
+		log:      log,
+	}, nil
+}
+
+func (s *spiffeSource) watch(ctx context.Context, update func(certBundle)) {
+	for {
+		err := s.stream(ctx, update)
+		if ctx.Err() != nil {
+			return
+		}
+		s.log.Error("fetching spiffe svids failed", attrError(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(spiffeRetry):
+		}
+	}
+}
+
+// stream calls FetchX509SVID and passes each response to update until the
+// stream ends.
+func (s *spiffeSource) stream(ctx context.Context, update func(certBundle)) error {
+	var req bytes.Buffer
+	_ = writeGRPCMessage(&req, nil)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, &req)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("TE", "trailers")
+	// required by the Workload API to prevent SSRF
+	r.Header.Set("workload.spiffe.io", "true")
+
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	for {
+		msg, err := readGRPCMessage(resp.Body)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// the status is in the trailers once the body has been read
+			status := resp.Trailer.Get("Grpc-Status")
+			if status == "" {
+				status = resp.Header.Get("Grpc-Status")
+			}
+			message, _ := url.PathUnescape(resp.Trailer.Get("Grpc-Message"))
+			return fmt.Errorf("stream ended with status %s: %s", status, message)
+		}
+		if err != nil {
+			return err
+		}
+
+		b, err := s.parse(msg)
+		if err != nil {
+			return err
+		}
+		update(b)
+	}
+}
+
+// parse decodes a X509SVIDResponse into the selected SVID with the bundles of
+// its trust domain and the federated ones as client CAs.
+func (s *spiffeSource) parse(msg []byte) (certBundle, error) {
+	var found bool
+	var chain, key []byte
+	var bundles [][]byte
+	err := decodeProtobuf(msg, func(num, wireType int, _ uint64, data []byte) error {
+		switch {
+		case num == 1 && wireType == pbBytes && !found:
+			// X509SVID
+			var id string
+			var svidChain, svidKey, bundle []byte
+			err := decodeProtobuf(data, func(num, wireType int, _ uint64, data []byte) error {
+				if wireType != pbBytes {
+					return nil
+				}
+				switch num {
+				case 1:
+					id = string(data)
+				case 2:
+					svidChain = data
+				case 3:
+					svidKey = data
+				case 4:
+					bundle = data
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if s.id == "" || s.id == id {
+				found, chain, key = true, svidChain, svidKey
+				bundles = append(bundles, bundle)
+			}
+		case num == 3 && wireType == pbBytes:
+			// an entry of federated_bundles, the map of trust domains to
+			// their bundles
+			return decodeProtobuf(data, func(num, wireType int, _ uint64, data []byte) error {
+				if num == 2 && wireType == pbBytes {
+					bundles = append(bundles, data)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return certBundle{}, fmt.Errorf("decode response: %w", err)
+	}
+	if !found {
+		return certBundle{}, fmt.Errorf("no svid with id '%s' received", s.id)
+	}
+
+	certs, err := x509.ParseCertificates(chain)
+	if err != nil {
+		return certBundle{}, fmt.Errorf("parse svid: %w", err)
+	}
+	if len(certs) == 0 {
+		return certBundle{}, fmt.Errorf("svid without certificates received")
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(key)
+	if err != nil {
+		return certBundle{}, fmt.Errorf("parse svid key: %w", err)
+	}
+	b := certBundle{
+		cert:      tls.Certificate{PrivateKey: priv, Leaf: certs[0]},
+		clientCAs: x509.NewCertPool(),
+	}
+	for _, c := range certs {
+		b.cert.Certificate = append(b.cert.Certificate, c.Raw)
+	}
+	for _, bundle := range bundles {
+		roots, err := x509.ParseCertificates(bundle)
+		if err != nil {
+			return certBundle{}, fmt.Errorf("parse bundle: %w", err)
+		}
+		for _, r := range roots {
+			b.clientCAs.AddCert(r)
+		}
+	}
+	return b, nil
+}
+
+func (s *spiffeSource) String() string {
+	return "spiffe"
+}
@@ -0,0 +1,170 @@
+package harald
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+// workloadAPI serves the SVIDs sent on the channel to a single stream of
+// FetchX509SVID and returns the address of its socket.
+func workloadAPI(t *testing.T, svids <-chan []byte) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/SpiffeWorkloadAPI/FetchX509SVID" || r.Header.Get("workload.spiffe.io") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, err := readGRPCMessage(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case msg, ok := <-svids:
+				if !ok {
+					w.Header().Set("Grpc-Status", "0")
+					return
+				}
+				_ = writeGRPCMessage(w, msg)
+				w.(http.Flusher).Flush()
+			}
+		}
+	})
+	srv := &http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return "unix://" + socket
+}
+
+// svidResponse encodes a X509SVIDResponse with a new certificate of ca.
+func svidResponse(t *testing.T, ca *haraldtest.CA, id string) ([]byte, *big.Int) {
+	t.Helper()
+	certPEM, keyPEM := ca.NewServerCertificate(t)
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	block, _ = pem.Decode(keyPEM)
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var b pbBuffer
+	b.message(1, func(m *pbBuffer) {
+		m.string(1, id)
+		m.string(2, string(cert.Raw))
+		m.string(3, string(pkcs8))
+		m.string(4, string(ca.Certificate().Raw))
+	})
+	return b, cert.SerialNumber
+}
+
+func TestSPIFFESource(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	svids := make(chan []byte, 1)
+	socket := workloadAPI(t, svids)
+
+	first, serial := svidResponse(t, ca, "spiffe://example.org/harald")
+	svids <- first
+
+	echo, _ := haraldtest.EchoServer(t)
+	r := testRule(echo)
+	r.TLS = &TLS{Source: &CertificateSource{Type: "spiffe", SPIFFE: &SPIFFESource{Socket: socket}}}
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	served := func() *big.Int {
+		t.Helper()
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Certificate())
+		c, err := tls.Dial("tcp", f.Addr().String(), &tls.Config{RootCAs: roots})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer c.Close()
+		return c.ConnectionState().PeerCertificates[0].SerialNumber
+	}
+	if got := served(); got.Cmp(serial) != 0 {
+		t.Fatalf("expected the svid with serial %s; got %s", serial, got)
+	}
+
+	// the Workload API pushes a renewed svid
+	second, serial := svidResponse(t, ca, "spiffe://example.org/harald")
+	svids <- second
+	for deadline := time.Now().Add(2 * time.Second); served().Cmp(serial) != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the renewed svid to be served")
+		}
+	}
+}
+
+func TestSPIFFESourceParse(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	msg, serial := svidResponse(t, ca, "spiffe://example.org/harald")
+
+	s := &spiffeSource{id: "spiffe://example.org/other"}
+	if _, err := s.parse(msg); err == nil {
+		t.Error("expected error if no svid has the configured id")
+	}
+
+	s.id = "spiffe://example.org/harald"
+	b, err := s.parse(msg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if b.cert.Leaf.SerialNumber.Cmp(serial) != 0 {
+		t.Errorf("unexpected certificate %s", b.cert.Leaf.SerialNumber)
+	}
+	if !b.clientCAs.Equal(func() *x509.CertPool { p := x509.NewCertPool(); p.AddCert(ca.Certificate()); return p }()) {
+		t.Error("expected the bundle to be used as client CAs")
+	}
+}
+
+func TestSPIFFESourceInvalid(t *testing.T) {
+	t.Setenv(spiffeSocketEnv, "")
+	for _, c := range []SPIFFESource{
+		{},
+		{Socket: "/run/spire/agent.sock"},
+		{Socket: "unix:///run/spire/agent.sock", ID: "example.org/harald"},
+	} {
+		if _, err := newSPIFFESource(c, nil); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package harald
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultDiscoveryInterval is used by upstream sources which poll for changes
+// if the rule doesn't configure an interval.
+const defaultDiscoveryInterval = 30 * time.Second
+
+// isSRVName reports whether address is the name of DNS SRV records like
+// _service._tcp.example.com instead of a host and port.
+func isSRVName(address string) bool {
+	_, _, err := net.SplitHostPort(address)
+	return err != nil && strings.HasPrefix(address, "_")
+}
+
+// srvSource periodically resolves the upstreams from DNS SRV records.
+type srvSource struct {
+	network  string
+	name     string
+	interval time.Duration
+	// resolver is nil if the resolver of the system is used.
+	resolver *net.Resolver
+	log      *slog.Logger
+}
+
+func (s *srvSource) watch(ctx context.Context, update func([]target)) {
+	for {
+		targets, err := s.resolve(ctx)
+		if err != nil {
+			s.log.Error("resolving srv records failed", attrError(err))
+		} else {
+			s.log.Debug("resolved srv records", slog.Int("targets", len(targets)))
+			update(targets)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+func (s *srvSource) resolve(ctx context.Context) ([]target, error) {
+	_, records, err := s.resolver.LookupSRV(ctx, "", "", s.name)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]target, 0, len(records))
+	for _, r := range records {
+		// the target "." marks the service as not available (RFC 2782)
+		if r.Target == "." {
+			continue
+		}
+		targets = append(targets, target{
+			NetConf: NetConf{
+				Network: s.network,
+				Address: net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))),
+			},
+			Priority: r.Priority,
+			Weight:   r.Weight,
+		})
+	}
+	return targets, nil
+}
+
+func (s *srvSource) String() string {
+	return "srv:" + s.network + "@" + s.name
+}
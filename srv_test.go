@@ -0,0 +1,114 @@
+package harald
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsSRVName(t *testing.T) {
+	tests := map[string]bool{
+		"_http._tcp.example.com":  true,
+		"_http._tcp.example.com.": true,
+		"localhost:8080":          false,
+		"_foo:8080":               false,
+		"example.com":             false,
+		"":                        false,
+	}
+	for address, want := range tests {
+		if got := isSRVName(address); got != want {
+			t.Errorf("isSRVName(%q): want = %v; got = %v", address, want, got)
+		}
+	}
+}
+
+func TestSRVForwarderString(t *testing.T) {
+	r := ForwardRule{
+		Listen:  NetConf{Network: "tcp", Address: ":8443"},
+		Connect: NetConf{Network: "tcp", Address: "_http._tcp.example.com"},
+	}
+	f, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	want := "Forwarder(test; tcp@:8443->srv:tcp@_http._tcp.example.com)"
+	if got := f.String(); got != want {
+		t.Fatalf("want = %s; got = %s", want, got)
+	}
+}
+
+// srvAnswer responds to a query with SRV records of the targets on port 8080.
+func srvAnswer(query []byte, targets ...string) []byte {
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += 1 + int(query[end])
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+
+	resp := binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(query))
+	resp = append(resp, 0x81, 0x80, 0, 1, 0, byte(len(targets)), 0, 0, 0, 0)
+	resp = append(resp, query[12:end]...)
+	for _, target := range targets {
+		var name []byte
+		for _, label := range strings.Split(strings.TrimSuffix(target, "."), ".") {
+			if label != "" {
+				name = append(name, byte(len(label)))
+				name = append(name, label...)
+			}
+		}
+		name = append(name, 0)
+		// the name points to the question
+		resp = append(resp, 0xc0, 12, 0, 33, 0, 1, 0, 0, 0, 60)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(6+len(name)))
+		resp = append(resp, 0, 1, 0, 1, 0x1f, 0x90)
+		resp = append(resp, name...)
+	}
+	return resp
+}
+
+func TestSRVSourceNotAvailable(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(srvAnswer(buf[:n], ".", "upstream.test."), addr)
+		}
+	}()
+
+	s := &srvSource{
+		network: "tcp",
+		name:    "_http._tcp.example.com.",
+		resolver: &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", pc.LocalAddr().String())
+		}},
+		log: testLogger(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	targets, err := s.resolve(ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	want := []target{{NetConf: NetConf{Network: "tcp", Address: "upstream.test:8080"}, Priority: 1, Weight: 1}}
+	if !slices.Equal(targets, want) {
+		t.Errorf("want = %v; got = %v", want, targets)
+	}
+}
@@ -0,0 +1,231 @@
+package harald
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Protocols which negotiate TLS in-band before the handshake.
+const (
+	// StartTLSPostgres answers the SSLRequest of PostgreSQL clients before
+	// the handshake. Clients connecting with direct TLS (sslnegotiation
+	// =direct) are accepted as well.
+	StartTLSPostgres = "postgres"
+	// StartTLSSMTP relays the dialogue between SMTP clients and the upstream
+	// until the client issues STARTTLS, which is advertised in the response
+	// to EHLO and answered by harald.
+	StartTLSSMTP = "smtp"
+)
+
+func validateStartTLS(mode string, t *TLS) error {
+	switch mode {
+	case "":
+		return nil
+	case StartTLSPostgres, StartTLSSMTP:
+	default:
+		return fmt.Errorf("starttls: unknown protocol '%s'", mode)
+	}
+	if t == nil {
+		return fmt.Errorf("starttls: %s requires tls", mode)
+	}
+	if mode == StartTLSSMTP && (len(t.AllowFingerprints) > 0 || len(t.DenyFingerprints) > 0) {
+		// the client hello is only sent once the upstream is connected
+		return fmt.Errorf("starttls: fingerprints are not supported with %s", mode)
+	}
+	if mode == StartTLSSMTP && (t.RequireSNI || len(t.AllowServerNames) > 0) {
+		return fmt.Errorf("starttls: require_sni and allow_server_names are not supported with %s", mode)
+	}
+	return nil
+}
+
+// Request codes of the PostgreSQL messages sent before the startup message.
+const (
+	pgCancelRequest = 80877102
+	pgSSLRequest    = 80877103
+	pgGSSENCRequest = 80877104
+)
+
+// negotiatePostgres reads the messages a PostgreSQL client sends before the
+// TLS handshake and accepts the SSLRequest. Cancel requests are sent by some
+// clients in plaintext on a separate connection, they are forwarded as is
+// which is reported by plaintext. Any other client is rejected. The returned
+// connection replaces c.
+func negotiatePostgres(c net.Conn) (_ net.Conn, plaintext bool, err error) {
+	_ = c.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer func() { _ = c.SetDeadline(time.Time{}) }()
+
+	for {
+		var first [1]byte
+		_, err = io.ReadFull(c, first[:])
+		if err != nil {
+			return nil, false, fmt.Errorf("postgres: %w", err)
+		}
+		if first[0] == recordTypeHandshake {
+			// direct TLS without an SSLRequest
+			return &prefixConn{Conn: c, prefix: first[:]}, false, nil
+		}
+
+		msg := make([]byte, 8)
+		msg[0] = first[0]
+		_, err = io.ReadFull(c, msg[1:])
+		if err != nil {
+			return nil, false, fmt.Errorf("postgres: %w", err)
+		}
+		length := binary.BigEndian.Uint32(msg)
+		code := binary.BigEndian.Uint32(msg[4:])
+
+		switch {
+		case length == 8 && code == pgSSLRequest:
+			_, err = c.Write([]byte{'S'})
+			if err != nil {
+				return nil, false, fmt.Errorf("postgres: %w", err)
+			}
+			return c, false, nil
+		case length == 8 && code == pgGSSENCRequest:
+			// the client falls back to an SSLRequest
+			_, err = c.Write([]byte{'N'})
+			if err != nil {
+				return nil, false, fmt.Errorf("postgres: %w", err)
+			}
+		case length == 16 && code == pgCancelRequest:
+			return &prefixConn{Conn: c, prefix: msg}, true, nil
+		default:
+			_, _ = c.Write(pgError("28000", "SSL connection is required"))
+			return nil, false, fmt.Errorf("postgres: client did not request ssl")
+		}
+	}
+}
+
+// pgError returns a fatal ErrorResponse message.
+func pgError(code, message string) []byte {
+	var fields bytes.Buffer
+	for _, f := range [][2]string{{"S", "FATAL"}, {"V", "FATAL"}, {"C", code}, {"M", message}} {
+		fields.WriteString(f[0])
+		fields.WriteString(f[1])
+		fields.WriteByte(0)
+	}
+	fields.WriteByte(0)
+
+	msg := []byte{'E'}
+	msg = binary.BigEndian.AppendUint32(msg, uint32(4+fields.Len()))
+	return append(msg, fields.Bytes()...)
+}
+
+// smtpMaxLine limits the length of the lines read during the SMTP dialogue,
+// RFC 5321 allows 512 bytes for commands and replies.
+const smtpMaxLine = 4096
+
+var errSMTPQuit = errors.New("smtp: client quit before starttls")
+
+// negotiateSMTP relays the SMTP dialogue between the client and the upstream
+// until the client issues STARTTLS. Commands which are not needed to get
+// there are refused, this way nothing of the session is sent in plaintext.
+func negotiateSMTP(client, upstream net.Conn) error {
+	deadline := time.Now().Add(handshakeTimeout)
+	_ = client.SetDeadline(deadline)
+	_ = upstream.SetDeadline(deadline)
+	defer func() {
+		_ = client.SetDeadline(time.Time{})
+		_ = upstream.SetDeadline(time.Time{})
+	}()
+
+	cr := bufio.NewReaderSize(client, smtpMaxLine)
+	ur := bufio.NewReaderSize(upstream, smtpMaxLine)
+
+	greeting, err := smtpReply(ur)
+	if err != nil {
+		return err
+	}
+	_, err = client.Write(bytes.Join(greeting, nil))
+	if err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+
+	for {
+		cmd, err := cr.ReadSlice('\n')
+		if err != nil {
+			return fmt.Errorf("smtp: reading command: %w", err)
+		}
+		verb, _, _ := strings.Cut(strings.TrimSpace(string(cmd)), " ")
+
+		switch strings.ToUpper(verb) {
+		case "STARTTLS":
+			// data sent along with the command would end up in the
+			// encrypted session (CVE-2011-0411)
+			if cr.Buffered() > 0 || ur.Buffered() > 0 {
+				return fmt.Errorf("smtp: unexpected data after starttls")
+			}
+			_, err = io.WriteString(client, "220 2.0.0 Ready to start TLS\r\n")
+			if err != nil {
+				return fmt.Errorf("smtp: %w", err)
+			}
+			return nil
+		case "EHLO", "HELO", "NOOP", "RSET", "QUIT":
+			_, err = upstream.Write(cmd)
+			if err != nil {
+				return fmt.Errorf("smtp: %w", err)
+			}
+			reply, err := smtpReply(ur)
+			if err != nil {
+				return err
+			}
+			if strings.EqualFold(verb, "EHLO") {
+				reply = advertiseStartTLS(reply)
+			}
+			_, err = client.Write(bytes.Join(reply, nil))
+			if err != nil {
+				return fmt.Errorf("smtp: %w", err)
+			}
+			if strings.EqualFold(verb, "QUIT") {
+				return errSMTPQuit
+			}
+		default:
+			_, err = io.WriteString(client, "530 5.7.0 Must issue a STARTTLS command first\r\n")
+			if err != nil {
+				return fmt.Errorf("smtp: %w", err)
+			}
+		}
+	}
+}
+
+// smtpReply reads the lines of a single, possibly multiline, reply.
+func smtpReply(r *bufio.Reader) ([][]byte, error) {
+	var lines [][]byte
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			return nil, fmt.Errorf("smtp: reading reply: %w", err)
+		}
+		if len(line) < 5 {
+			return nil, fmt.Errorf("smtp: invalid reply %q", line)
+		}
+		lines = append(lines, bytes.Clone(line))
+		if line[3] != '-' {
+			return lines, nil
+		}
+	}
+}
+
+// advertiseStartTLS adds the STARTTLS extension to a successful reply to
+// EHLO.
+func advertiseStartTLS(reply [][]byte) [][]byte {
+	last := reply[len(reply)-1]
+	if !bytes.HasPrefix(last, []byte("250")) {
+		return reply
+	}
+	for _, l := range reply[1:] {
+		if bytes.EqualFold(bytes.TrimSpace(l[4:]), []byte("STARTTLS")) {
+			return reply
+		}
+	}
+	last = bytes.Clone(last)
+	last[3] = '-'
+	return append(reply[:len(reply)-1], last, []byte("250 STARTTLS\r\n"))
+}
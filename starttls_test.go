@@ -0,0 +1,239 @@
+package harald
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+// startTLSForwarder starts a rule terminating TLS with the starttls
+// protocol, it returns the address it listens on and the config for clients.
+func startTLSForwarder(t *testing.T, protocol, connect string) (string, *tls.Config) {
+	t.Helper()
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+
+	r := testRule(connect)
+	r.TLS = &TLS{Certificate: string(crt), Key: string(key)}
+	r.StartTLS = protocol
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(f.Stop)
+
+	conf := &tls.Config{RootCAs: x509.NewCertPool(), ServerName: "localhost"}
+	conf.RootCAs.AddCert(ca.Certificate())
+	return f.Addr().String(), conf
+}
+
+func pgRequest(code uint32) []byte {
+	return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), code)
+}
+
+func TestStartTLSPostgres(t *testing.T) {
+	echo, _ := haraldtest.EchoServer(t)
+	addr, conf := startTLSForwarder(t, StartTLSPostgres, echo)
+
+	dial := func(requests ...uint32) (net.Conn, []byte) {
+		t.Helper()
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		t.Cleanup(func() { _ = c.Close() })
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		var answers []byte
+		for _, r := range requests {
+			_, err = c.Write(pgRequest(r))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			b := make([]byte, 1)
+			_, err = io.ReadFull(c, b)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			answers = append(answers, b...)
+		}
+		return c, answers
+	}
+
+	echoTLS := func(c net.Conn) {
+		t.Helper()
+		tc := tls.Client(c, conf)
+		_, err := tc.Write([]byte("ping"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		b := make([]byte, 4)
+		_, err = io.ReadFull(tc, b)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(b) != "ping" {
+			t.Errorf("want = ping; got = %s", b)
+		}
+	}
+
+	c, answers := dial(pgGSSENCRequest, pgSSLRequest)
+	if string(answers) != "NS" {
+		t.Fatalf("want = NS; got = %q", answers)
+	}
+	echoTLS(c)
+
+	// direct TLS
+	c, _ = dial()
+	echoTLS(c)
+
+	// startup message of protocol 3.0 without ssl
+	c, answers = dial(196608)
+	if string(answers) != "E" {
+		t.Errorf("expected an error response; got = %q", answers)
+	}
+}
+
+func TestStartTLSInvalid(t *testing.T) {
+	if validateStartTLS(StartTLSPostgres, nil) == nil {
+		t.Errorf("expected error without tls")
+	}
+	if validateStartTLS("ftp", &TLS{}) == nil {
+		t.Errorf("expected error for unknown protocol")
+	}
+}
+
+// smtpServer is a minimal SMTP server without STARTTLS, it records the
+// commands it received.
+func smtpServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	commands := make(chan string, 16)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		defer close(commands)
+
+		r := bufio.NewReader(c)
+		_, _ = io.WriteString(c, "220 backend ESMTP\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			commands <- line
+			switch {
+			case strings.HasPrefix(line, "EHLO"):
+				_, _ = io.WriteString(c, "250-backend\r\n250 SIZE 1000\r\n")
+			case line == "QUIT":
+				_, _ = io.WriteString(c, "221 bye\r\n")
+				return
+			default:
+				_, _ = io.WriteString(c, "250 OK\r\n")
+			}
+		}
+	}()
+	return l.Addr().String(), commands
+}
+
+func TestStartTLSSMTP(t *testing.T) {
+	backend, commands := smtpServer(t)
+	addr, conf := startTLSForwarder(t, StartTLSSMTP, backend)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	tp := textproto.NewConn(c)
+	expect := func(tp *textproto.Conn, code int, cmd string) string {
+		t.Helper()
+		if cmd != "" {
+			err := tp.PrintfLine("%s", cmd)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		_, msg, err := tp.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("%s: %s", cmd, err.Error())
+		}
+		return msg
+	}
+
+	expect(tp, 220, "")
+	expect(tp, 530, "MAIL FROM:<harald@example.com>")
+	if msg := expect(tp, 250, "EHLO client"); !strings.HasSuffix(msg, "\nSTARTTLS") {
+		t.Errorf("expected starttls to be advertised; got = %q", msg)
+	}
+	expect(tp, 220, "STARTTLS")
+
+	tc := tls.Client(c, conf)
+	tp = textproto.NewConn(tc)
+	if msg := expect(tp, 250, "EHLO client"); strings.Contains(msg, "STARTTLS") {
+		t.Errorf("expected starttls not to be advertised after the upgrade; got = %q", msg)
+	}
+	expect(tp, 250, "MAIL FROM:<harald@example.com>")
+	expect(tp, 221, "QUIT")
+
+	var got []string
+	for cmd := range commands {
+		got = append(got, cmd)
+	}
+	want := []string{"EHLO client", "EHLO client", "MAIL FROM:<harald@example.com>", "QUIT"}
+	if !slices.Equal(got, want) {
+		t.Errorf("want = %q; got = %q", want, got)
+	}
+}
+
+func TestStartTLSSMTPPipelining(t *testing.T) {
+	backend, _ := smtpServer(t)
+	addr, _ := startTLSForwarder(t, StartTLSSMTP, backend)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	tp := textproto.NewConn(c)
+	_, _, err = tp.ReadResponse(220)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// commands injected after STARTTLS must not end up in the session
+	_, err = io.WriteString(c, "STARTTLS\r\nMAIL FROM:<mallory@example.com>\r\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = tp.ReadLine()
+	if err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+}
@@ -0,0 +1,158 @@
+package harald
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// startupPollInterval is the interval in which a rule waiting for its
+	// upstreams tries to connect them.
+	startupPollInterval = time.Second
+	// defaultStartupTimeout limits how long a rule waits for its upstreams if
+	// the startup config doesn't set a timeout.
+	defaultStartupTimeout = 30 * time.Second
+)
+
+// Startup delays opening the listener of a rule until the system behind it is
+// ready, so clients aren't accepted before they can be served.
+type Startup struct {
+	// After are the rules which have to be listening before the listener of
+	// the rule is opened. When all listeners are started they are started
+	// first, otherwise opening the listener fails if they aren't listening.
+	After []string `json:"after" yaml:"after" toml:"after"`
+	// WaitForUpstream delays opening the listener until one of the upstreams
+	// of the rule accepts a connection.
+	WaitForUpstream bool `json:"wait_for_upstream" yaml:"wait_for_upstream" toml:"wait_for_upstream"`
+	// Timeout limits how long to wait for an upstream, opening the listener
+	// fails afterwards. Defaults to 30s.
+	Timeout Duration `json:"timeout" yaml:"timeout" toml:"timeout"`
+}
+
+func (s *Startup) validate(r ForwardRule) error {
+	switch {
+	case s == nil:
+		return nil
+	case s.Timeout < 0:
+		return fmt.Errorf("startup: timeout must not be negative")
+	case s.WaitForUpstream && (r.Exec != nil || r.HTTPConnect != nil):
+		return fmt.Errorf("startup: wait_for_upstream can't be combined with exec or http_connect")
+	}
+	for _, name := range s.After {
+		if name == "" {
+			return fmt.Errorf("startup: after must not contain empty rule names")
+		}
+	}
+	return nil
+}
+
+// after returns the rules the rule is started after.
+func (s *Startup) after() []string {
+	if s == nil {
+		return nil
+	}
+	return s.After
+}
+
+func (s *Startup) waitsForUpstream() bool {
+	return s != nil && s.WaitForUpstream
+}
+
+func (s *Startup) timeout() time.Duration {
+	if s == nil || s.Timeout == 0 {
+		return defaultStartupTimeout
+	}
+	return s.Timeout.Duration()
+}
+
+// startWhenReady opens the listener with start once the conditions of the
+// startup config are met. rule looks up the forwarders of the other rules by
+// name.
+func (f *Forwarder) startWhenReady(rule func(name string) *Forwarder, start func(*Forwarder) error) error {
+	if f.Startup == nil || f.State() == StateListening {
+		return start(f)
+	}
+
+	f.setState(StateStarting)
+	err := f.awaitStartup(rule)
+	if err != nil {
+		f.mu.Lock()
+		f.startErr = err
+		f.mu.Unlock()
+		f.setState(StateStopped)
+		return err
+	}
+	return start(f)
+}
+
+// awaitStartup blocks until the rules the forwarder is started after are
+// listening and, if configured, one of its upstreams accepts a connection.
+func (f *Forwarder) awaitStartup(rule func(name string) *Forwarder) error {
+	for _, name := range f.Startup.after() {
+		dep := rule(name)
+		if dep == nil {
+			return fmt.Errorf("startup: unknown rule '%s'", name)
+		}
+		if dep.State() != StateListening {
+			return fmt.Errorf("startup: rule '%s' is not listening", name)
+		}
+	}
+	if !f.Startup.waitsForUpstream() {
+		return nil
+	}
+
+	deadline := time.Now().Add(f.Startup.timeout())
+	for {
+		results, err := f.TestDial()
+		if err != nil {
+			return fmt.Errorf("startup: %w", err)
+		}
+		for _, r := range results {
+			if r.Error == "" {
+				return nil
+			}
+		}
+		if time.Now().Add(startupPollInterval).After(deadline) {
+			return fmt.Errorf("startup: no upstream accepted a connection within %s", f.Startup.timeout())
+		}
+		f.log.Info("waiting for an upstream before opening the listener", slog.String("error", results[0].Error))
+		time.Sleep(startupPollInterval)
+	}
+}
+
+// rule returns the forwarder of the rule with the name, nil if there is none
+// in the list.
+func (forwarders Forwarders) rule(name string) *Forwarder {
+	for _, f := range forwarders {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// startOrder returns the forwarders ordered so that each one comes after the
+// forwarders of the list it is started after. Forwarders on a cycle fail to
+// start because the other ones aren't listening yet.
+func (forwarders Forwarders) startOrder() Forwarders {
+	ordered := make(Forwarders, 0, len(forwarders))
+	visited := make(map[*Forwarder]bool, len(forwarders))
+	var visit func(f *Forwarder)
+	visit = func(f *Forwarder) {
+		if visited[f] {
+			return
+		}
+		visited[f] = true
+		for _, name := range f.Startup.after() {
+			if dep := forwarders.rule(name); dep != nil {
+				visit(dep)
+			}
+		}
+		ordered = append(ordered, f)
+	}
+	for _, f := range forwarders {
+		visit(f)
+	}
+	return ordered
+}
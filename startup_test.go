@@ -0,0 +1,174 @@
+package harald
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestStartupAfter(t *testing.T) {
+	echo, _ := haraldtest.EchoServer(t)
+
+	internal, err := testRule(echo).NewForwarder("internal", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r := testRule(echo)
+	r.Startup = &Startup{After: []string{"internal"}}
+	public, err := r.NewForwarder("public", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the dependency is started first regardless of the order of the list
+	err = Forwarders{public, internal}.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if public.State() != StateListening || internal.State() != StateListening {
+		t.Fatalf("expected both rules to listen; got = %s, %s", public.State(), internal.State())
+	}
+
+	public.Stop()
+	internal.Stop()
+	err = public.startWhenReady(Forwarders{internal}.rule, (*Forwarder).Start)
+	if err == nil {
+		t.Fatal("expected an error while the dependency isn't listening")
+	}
+	if public.State() != StateStopped || !errors.Is(public.StartError(), err) {
+		t.Errorf("expected the rule to be stopped with the error; got = %s, %v", public.State(), public.StartError())
+	}
+}
+
+func TestStartupCycle(t *testing.T) {
+	a := testRule("127.0.0.1:1")
+	a.Startup = &Startup{After: []string{"b"}}
+	b := testRule("127.0.0.1:1")
+	b.Startup = &Startup{After: []string{"a"}}
+
+	var forwarders Forwarders
+	for name, r := range map[string]ForwardRule{"a": a, "b": b} {
+		f, err := r.NewForwarder(name, time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		forwarders = append(forwarders, f)
+	}
+
+	var errs StartErrors
+	err := forwarders.Start()
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("expected both rules to fail; got = %v", err)
+	}
+}
+
+func TestStartupWaitForUpstream(t *testing.T) {
+	// reserve an address for the upstream which comes up after a moment
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	upstream := l.Addr().String()
+	_ = l.Close()
+
+	r := testRule(upstream)
+	r.Startup = &Startup{WaitForUpstream: true, Timeout: Duration(5 * time.Second)}
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	up := make(chan net.Listener, 1)
+	time.AfterFunc(500*time.Millisecond, func() {
+		l, err := net.Listen("tcp", upstream)
+		if err != nil {
+			t.Error(err.Error())
+		}
+		up <- l
+	})
+
+	err = f.startWhenReady(nil, (*Forwarder).Start)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+	if l := <-up; l != nil {
+		defer l.Close()
+	}
+	if f.State() != StateListening {
+		t.Errorf("want = %s; got = %s", StateListening, f.State())
+	}
+}
+
+func TestStartupWaitForUpstreamTimeout(t *testing.T) {
+	r := testRule("127.0.0.1:1")
+	r.Startup = &Startup{WaitForUpstream: true, Timeout: Duration(500 * time.Millisecond)}
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = f.startWhenReady(nil, (*Forwarder).Start)
+	if err == nil {
+		f.Stop()
+		t.Fatal("expected an error without a reachable upstream")
+	}
+	if f.Addr() != nil {
+		t.Error("expected the listener to stay closed")
+	}
+}
+
+// TestStartupWaitDoesntBlockServer ensures that a rule waiting for its
+// upstream neither blocks the server nor the other rules.
+func TestStartupWaitDoesntBlockServer(t *testing.T) {
+	slow := testRule("127.0.0.1:1")
+	slow.Startup = &Startup{WaitForUpstream: true, Timeout: Duration(2 * time.Second)}
+	s, err := NewServer(Config{Rules: map[string]ForwardRule{
+		"fast": testRule("127.0.0.1:1"),
+		"slow": slow,
+	}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	started := make(chan error, 1)
+	go func() { started <- s.setListening(true) }()
+	defer s.setListening(false)
+
+	deadline := time.Now().Add(time.Second)
+	for s.lookup("fast").State() != StateListening {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the other rule to listen while one is waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := make(chan map[string]Stats, 1)
+	go func() { stats <- s.Stats() }()
+	select {
+	case st := <-stats:
+		if len(st) != 2 {
+			t.Errorf("expected the stats of both rules; got %v", st)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the stats while a rule is waiting for its upstream")
+	}
+	if state := s.lookup("slow").State(); state != StateStarting {
+		t.Errorf("want = %s; got = %s", StateStarting, state)
+	}
+
+	select {
+	case err = <-started:
+		if err != nil {
+			t.Fatalf("expected to continue with one rule up; got %s", err.Error())
+		}
+		if errs := s.StartErrors(); len(errs) != 1 || errs["slow"] == nil {
+			t.Errorf("expected the waiting rule to time out; got %v", errs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the listeners to be started")
+	}
+}
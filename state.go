@@ -0,0 +1,173 @@
+package harald
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultStateInterval = time.Minute
+
+// ruleState holds the cumulative counters of a rule in the state file.
+type ruleState struct {
+	TotalConnections uint64 `json:"total_connections"`
+	BytesIn          uint64 `json:"bytes_in"`
+	BytesOut         uint64 `json:"bytes_out"`
+}
+
+type stateContent struct {
+	Rules map[string]ruleState `json:"rules"`
+}
+
+// stateFile persists the counters of the rules so they continue across
+// restarts. A nil *stateFile doesn't persist anything.
+type stateFile struct {
+	path     string
+	interval time.Duration
+
+	mu sync.Mutex
+	// rules holds the counters of the rules without a forwarder, either
+	// because they haven't been restored yet or because the rule has been
+	// removed.
+	rules map[string]ruleState
+}
+
+// openStateFile reads the counters stored at path, a missing file is treated
+// as empty.
+func openStateFile(path string, interval time.Duration) (*stateFile, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if interval <= 0 {
+		interval = defaultStateInterval
+	}
+	s := &stateFile{path: path, interval: interval, rules: make(map[string]ruleState)}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("state file: %w", err)
+	}
+	var c stateContent
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("state file: %s: %w", path, err)
+	}
+	if c.Rules != nil {
+		s.rules = c.Rules
+	}
+	return s, nil
+}
+
+// restore adds the stored counters of the rule to the forwarder.
+func (s *stateFile) restore(f *Forwarder) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	r, ok := s.rules[f.name]
+	delete(s.rules, f.name)
+	s.mu.Unlock()
+
+	if ok {
+		f.stats.totalConns.Add(r.TotalConnections)
+		f.stats.bytesIn.Add(r.BytesIn)
+		f.stats.bytesOut.Add(r.BytesOut)
+	}
+}
+
+// replace carries the counters of old over to f which replaces it.
+func (s *stateFile) replace(f, old *Forwarder) {
+	if s == nil {
+		return
+	}
+	f.stats.totalConns.Add(old.stats.totalConns.Load())
+	f.stats.bytesIn.Add(old.stats.bytesIn.Load())
+	f.stats.bytesOut.Add(old.stats.bytesOut.Load())
+}
+
+// retire keeps the counters of a removed forwarder, they are restored if the
+// rule is added again.
+func (s *stateFile) retire(f *Forwarder) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules[f.name] = counterState(f)
+}
+
+func counterState(f *Forwarder) ruleState {
+	return ruleState{
+		TotalConnections: f.stats.totalConns.Load(),
+		BytesIn:          f.stats.bytesIn.Load(),
+		BytesOut:         f.stats.bytesOut.Load(),
+	}
+}
+
+// checkpoint writes the counters of the forwarders and the retired rules to
+// the file. The file is replaced atomically, so it is never left half written.
+func (s *stateFile) checkpoint(forwarders Forwarders) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	c := stateContent{Rules: make(map[string]ruleState, len(s.rules)+len(forwarders))}
+	for name, r := range s.rules {
+		c.Rules[name] = r
+	}
+	s.mu.Unlock()
+	for _, f := range forwarders {
+		c.Rules[f.name] = counterState(f)
+	}
+
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("state file: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".harald-state-*")
+	if err != nil {
+		return fmt.Errorf("state file: %w", err)
+	}
+	_, err = tmp.Write(append(b, '\n'))
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("state file: %w", err)
+	}
+	return nil
+}
+
+// run checkpoints the counters periodically until done is closed, after which
+// a final checkpoint is written.
+func (s *stateFile) run(forwarders func() Forwarders, done <-chan struct{}) {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-done:
+			err := s.checkpoint(forwarders())
+			if err != nil {
+				slog.Error("writing state file failed", attrError(err))
+			}
+			return
+		}
+		err := s.checkpoint(forwarders())
+		if err != nil {
+			slog.Warn("writing state file failed", attrError(err))
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package harald
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	newForwarder := func(name string) *Forwarder {
+		f, err := testRule("127.0.0.1:0").NewForwarder(name, time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return f
+	}
+
+	// a missing file starts from zero
+	state, err := openStateFile(path, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	a, b := newForwarder("a"), newForwarder("b")
+	state.restore(a)
+	a.stats.totalConns.Add(3)
+	a.stats.bytesIn.Add(10)
+	a.stats.bytesOut.Add(20)
+	b.stats.totalConns.Add(1)
+	state.retire(b)
+
+	err = state.checkpoint(Forwarders{a})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	state, err = openStateFile(path, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	a, b = newForwarder("a"), newForwarder("b")
+	a.stats.totalConns.Add(1)
+	state.restore(a)
+	state.restore(b)
+	if got := a.Stats(); got.TotalConnections != 4 || got.BytesIn != 10 || got.BytesOut != 20 {
+		t.Errorf("unexpected counters of a: %+v", got)
+	}
+	if got := b.Stats(); got.TotalConnections != 1 {
+		t.Errorf("unexpected counters of b: %+v", got)
+	}
+
+	// counters are only restored once
+	c := newForwarder("a")
+	state.restore(c)
+	if got := c.Stats(); got.TotalConnections != 0 {
+		t.Errorf("expected the counters to be restored once; got = %+v", got)
+	}
+	state.replace(c, a)
+	if got := c.Stats(); got.TotalConnections != 4 {
+		t.Errorf("expected the counters to be carried over; got = %+v", got)
+	}
+
+	err = os.WriteFile(path, []byte("{"), 0o644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = openStateFile(path, 0)
+	if err == nil {
+		t.Error("expected an error for a corrupt state file")
+	}
+}
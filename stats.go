@@ -0,0 +1,89 @@
+package harald
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the counters maintained by a Forwarder. Byte counters
+// are updated once the copy operation of a connection has finished, so they do
+// not include the traffic of connections which are still active.
+type Stats struct {
+	// TotalConnections is the number of connections accepted since the
+	// forwarder has been created.
+	TotalConnections uint64 `json:"total_connections"`
+	// ActiveConnections is the number of connections currently handled.
+	ActiveConnections int64 `json:"active_connections"`
+	// BytesIn is the number of bytes forwarded from clients to the upstream.
+	BytesIn uint64 `json:"bytes_in"`
+	// BytesOut is the number of bytes forwarded from the upstream to clients.
+	BytesOut uint64 `json:"bytes_out"`
+	// DialErrors is the number of failed attempts to connect upstream.
+	DialErrors uint64 `json:"dial_errors"`
+	// Overflows is the number of connections which have been rejected because
+	// all workers were busy.
+	Overflows uint64 `json:"overflows"`
+	// IdleReaped is the number of connections which have been closed
+	// because they were idle for too long.
+	IdleReaped uint64 `json:"idle_reaped"`
+	// LastError is the message of the most recent error, if any.
+	LastError string `json:"last_error,omitempty"`
+	// Uptime is the duration since the listener has been opened, it is zero
+	// if the listener is closed.
+	Uptime time.Duration `json:"uptime"`
+	// Upstreams contains the counters of each upstream.
+	Upstreams []UpstreamStats `json:"upstreams"`
+	// Labels of the rule, they are added as tags to the metrics.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Tenant of the rule, it namespaces the metrics.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// stats holds the live counters of a forwarder, all fields may be accessed
+// concurrently.
+type stats struct {
+	totalConns  atomic.Uint64
+	activeConns atomic.Int64
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	dialErrors  atomic.Uint64
+	overflows   atomic.Uint64
+	idleReaped  atomic.Uint64
+	lastError   atomic.Pointer[string]
+	// listeningSince is the time the listener was opened in unix nanoseconds
+	// or zero if it is closed.
+	listeningSince atomic.Int64
+}
+
+func (s *stats) setError(err error) {
+	msg := err.Error()
+	s.lastError.Store(&msg)
+}
+
+func (s *stats) snapshot() Stats {
+	st := Stats{
+		TotalConnections:  s.totalConns.Load(),
+		ActiveConnections: s.activeConns.Load(),
+		BytesIn:           s.bytesIn.Load(),
+		BytesOut:          s.bytesOut.Load(),
+		DialErrors:        s.dialErrors.Load(),
+		Overflows:         s.overflows.Load(),
+		IdleReaped:        s.idleReaped.Load(),
+	}
+	if msg := s.lastError.Load(); msg != nil {
+		st.LastError = *msg
+	}
+	if since := s.listeningSince.Load(); since != 0 {
+		st.Uptime = time.Since(time.Unix(0, since))
+	}
+	return st
+}
+
+// Stats returns a snapshot of the counters of the forwarder.
+func (f *Forwarder) Stats() Stats {
+	st := f.stats.snapshot()
+	st.Upstreams = f.balancer.stats()
+	st.Labels = f.Labels
+	st.Tenant = f.Tenant
+	return st
+}
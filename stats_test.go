@@ -0,0 +1,124 @@
+package harald
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestForwarderStats(t *testing.T) {
+	r := ForwardRule{
+		Listen: NetConf{
+			Network: "tcp",
+			Address: "127.0.0.1:0",
+		},
+		Connect: NetConf{
+			Network: "tcp",
+			Address: haraldtest.EchoChamber(t),
+		},
+	}
+
+	forwarder, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if uptime := forwarder.Stats().Uptime; uptime != 0 {
+		t.Fatalf("expected uptime of stopped forwarder to be zero, got %s", uptime)
+	}
+
+	err = forwarder.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer forwarder.Stop()
+
+	conn, err := net.Dial("tcp", forwarder.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	payload := []byte("foobar")
+	_, err = conn.Write(payload)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = conn.Read(make([]byte, len(payload)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if active := forwarder.Stats().ActiveConnections; active != 1 {
+		t.Fatalf("expected one active connection, got %d", active)
+	}
+
+	_ = conn.Close()
+
+	var stats Stats
+	for i := 0; i < 100; i++ {
+		stats = forwarder.Stats()
+		if stats.ActiveConnections == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if stats.ActiveConnections != 0 {
+		t.Fatalf("expected no active connections, got %d", stats.ActiveConnections)
+	}
+	if stats.TotalConnections != 1 {
+		t.Errorf("expected one connection in total, got %d", stats.TotalConnections)
+	}
+	if stats.BytesIn != uint64(len(payload)) {
+		t.Errorf("expected %d bytes in, got %d", len(payload), stats.BytesIn)
+	}
+	if stats.BytesOut != uint64(len(payload)) {
+		t.Errorf("expected %d bytes out, got %d", len(payload), stats.BytesOut)
+	}
+	if stats.Uptime == 0 {
+		t.Errorf("expected uptime to be set")
+	}
+}
+
+func TestForwarderStatsDialError(t *testing.T) {
+	r := ForwardRule{
+		Listen: NetConf{
+			Network: "tcp",
+			Address: "127.0.0.1:0",
+		},
+		Connect: NetConf{
+			Network: "tcp",
+			Address: "127.0.0.1:0",
+		},
+	}
+
+	forwarder, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = forwarder.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer forwarder.Stop()
+
+	conn, err := net.Dial("tcp", forwarder.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	// the forwarder closes the connection once the dial failed
+	_, _ = conn.Read(make([]byte, 1))
+
+	stats := forwarder.Stats()
+	if stats.DialErrors != 1 {
+		t.Errorf("expected one dial error, got %d", stats.DialErrors)
+	}
+	if stats.LastError == "" {
+		t.Errorf("expected last error to be set")
+	}
+}
@@ -0,0 +1,320 @@
+package harald
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStatsDPrefix        = "harald."
+	defaultStatsDFlushInterval = 10 * time.Second
+	// statsdMaxPacketSize keeps datagrams below the common MTU of 1500 bytes.
+	statsdMaxPacketSize = 1432
+)
+
+// StatsD configures the optional StatsD sink which periodically flushes the
+// statistics of each forwarder.
+type StatsD struct {
+	// Network and Address of the StatsD daemon, the network defaults to udp.
+	Network string `json:"network" yaml:"network" toml:"network"`
+	Address string `json:"address" yaml:"address" toml:"address"`
+	// Prefix is prepended to all metric names, defaults to "harald.".
+	Prefix string `json:"prefix" yaml:"prefix" toml:"prefix"`
+	// Tags are attached to every metric, they are only sent with the
+	// dogstatsd format. The labels of a rule take precedence over tags with
+	// the same name.
+	Tags map[string]string `json:"tags" yaml:"tags" toml:"tags"`
+	// Format is either "statsd" (default) which includes the rule in the
+	// metric name or "dogstatsd" which adds a rule tag instead.
+	Format        string   `json:"format" yaml:"format" toml:"format"`
+	FlushInterval Duration `json:"flush_interval" yaml:"flush_interval" toml:"flush_interval"`
+	// Metrics are the names of the metrics sent for each rule, e.g.
+	// connections or bytes_in. All of them are sent if it is empty.
+	Metrics []string `json:"metrics" yaml:"metrics" toml:"metrics"`
+	// DropTags are the names of tags and labels which are not sent, e.g.
+	// labels with many distinct values. The rule and tenant tags are always
+	// sent.
+	DropTags []string `json:"drop_tags" yaml:"drop_tags" toml:"drop_tags"`
+	// MaxSeries limits the number of rules which are sent individually, e.g.
+	// with large port ranges. The metrics of the rules beyond it (in the
+	// order of their names) are summed up and sent as the rule _other.
+	// Unlimited if zero.
+	MaxSeries int `json:"max_series" yaml:"max_series" toml:"max_series"`
+}
+
+// statsdOtherSeries is the rule the metrics of the rules beyond the max series
+// are sent as.
+const statsdOtherSeries = "_other"
+
+// statsdMetric is a metric sent for each rule.
+type statsdMetric struct {
+	name string
+	typ  string
+	// value returns the value from the current and the previous stats.
+	value func(cur, prev Stats) int64
+	// noSum is set if the sum of the values of several rules is
+	// meaningless.
+	noSum bool
+}
+
+// statsdRuleMetrics are the metrics sent for each rule, counters are sent as
+// the delta since the last flush.
+var statsdRuleMetrics = []statsdMetric{
+	{"connections", "c", func(cur, prev Stats) int64 { return counterDelta(cur.TotalConnections, prev.TotalConnections) }, false},
+	{"bytes_in", "c", func(cur, prev Stats) int64 { return counterDelta(cur.BytesIn, prev.BytesIn) }, false},
+	{"bytes_out", "c", func(cur, prev Stats) int64 { return counterDelta(cur.BytesOut, prev.BytesOut) }, false},
+	{"dial_errors", "c", func(cur, prev Stats) int64 { return counterDelta(cur.DialErrors, prev.DialErrors) }, false},
+	{"overflows", "c", func(cur, prev Stats) int64 { return counterDelta(cur.Overflows, prev.Overflows) }, false},
+	{"idle_reaped", "c", func(cur, prev Stats) int64 { return counterDelta(cur.IdleReaped, prev.IdleReaped) }, false},
+	{"active_connections", "g", func(cur, _ Stats) int64 { return cur.ActiveConnections }, false},
+	{"uptime_seconds", "g", func(cur, _ Stats) int64 { return int64(cur.Uptime.Seconds()) }, true},
+}
+
+// counterDelta returns the increase of a counter since the last flush. A
+// counter which went backwards has been reset, e.g. because its rule has been
+// replaced on reload, all of its current value is new.
+func counterDelta(cur, prev uint64) int64 {
+	if cur < prev {
+		return int64(cur)
+	}
+	return int64(cur - prev)
+}
+
+// statsdSink sends the stats of a set of forwarders to a StatsD daemon.
+// Monotonic counters are sent as the delta since the last flush.
+type statsdSink struct {
+	conf StatsD
+	conn net.Conn
+	last map[string]Stats
+	// metrics and dropTags are the sets of Metrics and DropTags, metrics is
+	// nil if all of them are sent.
+	metrics  map[string]bool
+	dropTags map[string]bool
+	// capped is set once the max series have been exceeded, it is only
+	// logged once.
+	capped bool
+}
+
+func newStatsdSink(c StatsD) (*statsdSink, error) {
+	if c.Network == "" {
+		c.Network = "udp"
+	}
+	if c.Prefix == "" {
+		c.Prefix = defaultStatsDPrefix
+	}
+	switch c.Format {
+	case "":
+		c.Format = "statsd"
+	case "statsd", "dogstatsd":
+	default:
+		return nil, fmt.Errorf("statsd: unknown format '%s'", c.Format)
+	}
+
+	if c.MaxSeries < 0 {
+		return nil, fmt.Errorf("statsd: max_series must not be negative")
+	}
+	var metrics map[string]bool
+	for _, m := range c.Metrics {
+		if !slices.ContainsFunc(statsdRuleMetrics, func(rm statsdMetric) bool { return rm.name == m }) {
+			return nil, fmt.Errorf("statsd: unknown metric '%s'", m)
+		}
+		if metrics == nil {
+			metrics = make(map[string]bool, len(c.Metrics))
+		}
+		metrics[m] = true
+	}
+	dropTags := make(map[string]bool, len(c.DropTags))
+	for _, tag := range c.DropTags {
+		dropTags[tag] = true
+	}
+
+	conn, err := net.Dial(c.Network, c.Address)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %w", err)
+	}
+
+	return &statsdSink{
+		conf:     c,
+		conn:     conn,
+		last:     make(map[string]Stats),
+		metrics:  metrics,
+		dropTags: dropTags,
+	}, nil
+}
+
+// run flushes the stats returned by stats periodically until done is closed.
+// A final flush is done before returning.
+func (s *statsdSink) run(stats func() map[string]Stats, process func() RuntimeStats, done <-chan struct{}) {
+	interval := s.conf.FlushInterval.Duration()
+	if interval <= 0 {
+		interval = defaultStatsDFlushInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	// counters restored from a state file have been sent before the
+	// restart, only what has been added since is sent.
+	s.last = stats()
+
+	for {
+		select {
+		case <-t.C:
+			s.flush(stats())
+			s.flushRuntime(process())
+		case <-done:
+			s.flush(stats())
+			s.flushRuntime(process())
+			_ = s.conn.Close()
+			return
+		}
+	}
+}
+
+func (s *statsdSink) flush(stats map[string]Stats) {
+	var packet bytes.Buffer
+
+	write := func(line string) {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > statsdMaxPacketSize {
+			s.send(packet.Bytes())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	// removed rules start over if they are added again
+	maps.DeleteFunc(s.last, func(name string, _ Stats) bool {
+		_, ok := stats[name]
+		return !ok
+	})
+
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// the metrics of the rules beyond the max series are summed up
+	var other []int64
+	for i, name := range names {
+		cur, prev := stats[name], s.last[name]
+		s.last[name] = cur
+		values := make([]int64, len(statsdRuleMetrics))
+		for j, m := range statsdRuleMetrics {
+			values[j] = m.value(cur, prev)
+		}
+		if s.conf.MaxSeries > 0 && i >= s.conf.MaxSeries {
+			if other == nil {
+				other = make([]int64, len(statsdRuleMetrics))
+			}
+			for j := range values {
+				other[j] += values[j]
+			}
+			continue
+		}
+		tags := s.tags(name, cur.Tenant, cur.Labels)
+		// the series of a tenant are namespaced by its name
+		series := name
+		if cur.Tenant != "" {
+			series = cur.Tenant + "." + name
+		}
+		s.writeMetrics(write, series, tags, values, false)
+	}
+	if other != nil {
+		if !s.capped {
+			s.capped = true
+			slog.Warn("statsd: rules exceed max_series, sending the others as one series",
+				slog.Int("max-series", s.conf.MaxSeries), slog.Int("rules", len(names)), slog.String("series", statsdOtherSeries))
+		}
+		s.writeMetrics(write, statsdOtherSeries, s.tags(statsdOtherSeries, "", nil), other, true)
+	}
+
+	if packet.Len() > 0 {
+		s.send(packet.Bytes())
+	}
+}
+
+// writeMetrics writes the values of the metrics which haven't been turned
+// off. Metrics which can't be summed up are left out of the sums.
+func (s *statsdSink) writeMetrics(write func(line string), series, tags string, values []int64, sum bool) {
+	for i, m := range statsdRuleMetrics {
+		if (s.metrics == nil || s.metrics[m.name]) && !(sum && m.noSum) {
+			write(s.metric(series, tags, m.name, values[i], m.typ))
+		}
+	}
+}
+
+// flushRuntime sends the stats of the process as gauges, they aren't
+// attributed to a rule.
+func (s *statsdSink) flushRuntime(rt RuntimeStats) {
+	var tags []string
+	for k, v := range s.conf.Tags {
+		if !s.dropTags[k] {
+			tags = append(tags, k+":"+v)
+		}
+	}
+	sort.Strings(tags)
+
+	var lines []string
+	for _, m := range []struct {
+		name  string
+		value uint64
+	}{
+		{"goroutines", uint64(rt.Goroutines)},
+		{"heap_bytes", rt.HeapBytes},
+		{"gc_cycles", uint64(rt.GCCycles)},
+		{"gc_pause_total_ns", uint64(rt.GCPauseTotal)},
+		{"tracked_connections", uint64(rt.TrackedConnections)},
+	} {
+		line := fmt.Sprintf("%sruntime.%s:%d|g", s.conf.Prefix, m.name, m.value)
+		if s.conf.Format == "dogstatsd" && len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+		lines = append(lines, line)
+	}
+	s.send([]byte(strings.Join(lines, "\n")))
+}
+
+// tags returns the dogstatsd tags of the metrics of a rule.
+func (s *statsdSink) tags(rule, tenant string, labels map[string]string) string {
+	tags := make([]string, 0, len(s.conf.Tags)+len(labels))
+	for k, v := range s.conf.Tags {
+		if _, ok := labels[k]; !ok && !s.dropTags[k] {
+			tags = append(tags, k+":"+v)
+		}
+	}
+	for k, v := range labels {
+		if !s.dropTags[k] {
+			tags = append(tags, k+":"+v)
+		}
+	}
+	sort.Strings(tags)
+	prefix := []string{"rule:" + rule}
+	if tenant != "" {
+		prefix = append(prefix, "tenant:"+tenant)
+	}
+	return strings.Join(append(prefix, tags...), ",")
+}
+
+func (s *statsdSink) metric(series, tags, name string, value any, typ string) string {
+	if s.conf.Format == "statsd" {
+		return fmt.Sprintf("%s%s.%s:%d|%s", s.conf.Prefix, series, name, value, typ)
+	}
+	return fmt.Sprintf("%s%s:%d|%s|#%s", s.conf.Prefix, name, value, typ, tags)
+}
+
+func (s *statsdSink) send(packet []byte) {
+	_, err := s.conn.Write(packet)
+	if err != nil {
+		slog.Warn("unable to send stats to statsd", attrError(err))
+	}
+}
@@ -0,0 +1,254 @@
+package harald
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdSinkFlush(t *testing.T) {
+	tests := map[string]struct {
+		conf   StatsD
+		labels map[string]string
+		tenant string
+		want   []string
+		// notWant are the metric names which must not be sent
+		notWant []string
+	}{
+		"statsd": {
+			conf: StatsD{},
+			want: []string{
+				"harald.http.connections:2|c",
+				"harald.http.bytes_in:10|c",
+				"harald.http.active_connections:1|g",
+			},
+		},
+		"dogstatsd": {
+			conf: StatsD{
+				Prefix: "proxy.",
+				Format: "dogstatsd",
+				Tags:   map[string]string{"env": "test"},
+			},
+			want: []string{
+				"proxy.connections:2|c|#rule:http,env:test",
+				"proxy.bytes_in:10|c|#rule:http,env:test",
+				"proxy.active_connections:1|g|#rule:http,env:test",
+			},
+		},
+		"dogstatsd with labels": {
+			conf: StatsD{
+				Format: "dogstatsd",
+				Tags:   map[string]string{"env": "test", "team": "unknown"},
+			},
+			labels: map[string]string{"team": "web"},
+			want: []string{
+				"harald.connections:2|c|#rule:http,env:test,team:web",
+			},
+		},
+		"statsd with tenant": {
+			conf:   StatsD{},
+			tenant: "web",
+			want: []string{
+				"harald.web.http.connections:2|c",
+			},
+		},
+		"dogstatsd with tenant": {
+			conf:   StatsD{Format: "dogstatsd"},
+			tenant: "web",
+			want: []string{
+				"harald.connections:2|c|#rule:http,tenant:web",
+			},
+		},
+		"selected metrics": {
+			conf: StatsD{Metrics: []string{"connections"}},
+			want: []string{
+				"harald.http.connections:2|c",
+			},
+			notWant: []string{"bytes_in", "active_connections", "uptime_seconds"},
+		},
+		"dropped tags": {
+			conf: StatsD{
+				Format:   "dogstatsd",
+				Tags:     map[string]string{"env": "test"},
+				DropTags: []string{"env", "client", "rule"},
+			},
+			labels: map[string]string{"client": "10.0.0.1", "team": "web"},
+			want: []string{
+				"harald.connections:2|c|#rule:http,team:web",
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer pc.Close()
+
+			tt.conf.Address = pc.LocalAddr().String()
+			sink, err := newStatsdSink(tt.conf)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer sink.conn.Close()
+
+			// the first flush establishes the baseline, the second one
+			// must only report the delta.
+			sink.flush(map[string]Stats{"http": {TotalConnections: 3, BytesIn: 5, Labels: tt.labels, Tenant: tt.tenant}})
+			sink.flush(map[string]Stats{"http": {TotalConnections: 5, BytesIn: 15, ActiveConnections: 1, Labels: tt.labels, Tenant: tt.tenant}})
+
+			buf := make([]byte, statsdMaxPacketSize)
+			_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err = pc.ReadFrom(buf) // baseline
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			lines := strings.Split(string(buf[:n]), "\n")
+			for _, want := range tt.want {
+				found := false
+				for _, l := range lines {
+					if l == want {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Errorf("expected line '%s' in packet:\n%s", want, string(buf[:n]))
+				}
+			}
+			for _, name := range tt.notWant {
+				for _, l := range lines {
+					if strings.Contains(l, "."+name+":") {
+						t.Errorf("unexpected line '%s'", l)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStatsdSinkMaxSeries(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pc.Close()
+
+	sink, err := newStatsdSink(StatsD{Address: pc.LocalAddr().String(), MaxSeries: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer sink.conn.Close()
+
+	sink.flush(map[string]Stats{
+		"a": {TotalConnections: 1, ActiveConnections: 1, Uptime: time.Minute},
+		"b": {TotalConnections: 2, ActiveConnections: 2, Uptime: time.Minute},
+		"c": {TotalConnections: 3, ActiveConnections: 3, Uptime: time.Minute},
+	})
+
+	buf := make([]byte, statsdMaxPacketSize)
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	packet := string(buf[:n])
+	for _, want := range []string{
+		"harald.a.connections:1|c",
+		"harald.a.uptime_seconds:60|g",
+		"harald._other.connections:5|c",
+		"harald._other.active_connections:5|g",
+	} {
+		if !strings.Contains(packet, want+"\n") && !strings.HasSuffix(packet, want) {
+			t.Errorf("expected line '%s' in packet:\n%s", want, packet)
+		}
+	}
+	for _, notWant := range []string{"harald.b.", "harald.c.", "harald._other.uptime_seconds"} {
+		if strings.Contains(packet, notWant) {
+			t.Errorf("unexpected '%s' in packet:\n%s", notWant, packet)
+		}
+	}
+}
+
+func TestStatsdSinkCounterReset(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pc.Close()
+
+	sink, err := newStatsdSink(StatsD{Address: pc.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer sink.conn.Close()
+
+	// the rule has been replaced in between, its counters start over
+	sink.flush(map[string]Stats{"http": {TotalConnections: 10, BytesIn: 100}})
+	sink.flush(map[string]Stats{"http": {TotalConnections: 3, BytesIn: 30}})
+
+	buf := make([]byte, statsdMaxPacketSize)
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = pc.ReadFrom(buf) // baseline
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Split(string(buf[:n]), "\n")
+	for _, want := range []string{"harald.http.connections:3|c", "harald.http.bytes_in:30|c"} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("expected line '%s' in packet:\n%s", want, string(buf[:n]))
+		}
+	}
+}
+
+func TestStatsdSinkRemovedRule(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pc.Close()
+
+	sink, err := newStatsdSink(StatsD{Address: pc.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer sink.conn.Close()
+
+	sink.flush(map[string]Stats{"http": {TotalConnections: 10}, "web/8080": {TotalConnections: 5}})
+	sink.flush(map[string]Stats{"http": {TotalConnections: 12}})
+
+	if _, ok := sink.last["web/8080"]; ok || len(sink.last) != 1 {
+		t.Errorf("expected only the stats of the current rules to be kept; got = %v", sink.last)
+	}
+}
+
+func TestStatsdSinkUnknownFormat(t *testing.T) {
+	_, err := newStatsdSink(StatsD{Address: "127.0.0.1:8125", Format: "foo"})
+	if err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+}
+
+func TestStatsdSinkInvalidOptions(t *testing.T) {
+	for name, c := range map[string]StatsD{
+		"unknown metric":      {Address: "127.0.0.1:8125", Metrics: []string{"requests"}},
+		"negative max series": {Address: "127.0.0.1:8125", MaxSeries: -1},
+	} {
+		_, err := newStatsdSink(c)
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
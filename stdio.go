@@ -0,0 +1,125 @@
+package harald
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// networkStdio is the listen or connect network of rules which use the
+// standard input and output of the process as one end of the connection, e.g.
+// to run as an SSH ProxyCommand or to be started by inetd. They serve a single
+// connection.
+const networkStdio = "stdio"
+
+// stdin and stdout are the standard input and output of the process, tests
+// replace them.
+var stdin, stdout = os.Stdin, os.Stdout
+
+// stdioInUse is set once the standard input and output have been handed to a
+// connection, they are only used once.
+var stdioInUse atomic.Bool
+
+// openStdio returns a connection reading from the standard input and writing
+// to the standard output. If the standard input is a socket, e.g. because the
+// process has been started by inetd, it is used directly.
+func openStdio() (net.Conn, error) {
+	if !stdioInUse.CompareAndSwap(false, true) {
+		return nil, fmt.Errorf("stdio: the standard input and output are already in use")
+	}
+	// only sockets are handed to net.FileConn, it makes the file descriptor
+	// non-blocking which breaks reading other kinds of files.
+	in, out := stdin, stdout
+	if fi, err := in.Stat(); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		c, err := net.FileConn(in)
+		if err != nil {
+			return nil, fmt.Errorf("stdio: %w", err)
+		}
+		return c, nil
+	}
+
+	// the pipe can be closed while reading from the standard input blocks,
+	// the goroutine reading it is left behind in that case.
+	c, process := net.Pipe()
+	go func() {
+		_, _ = io.Copy(process, in)
+		_ = process.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(out, process)
+		_ = out.Close()
+	}()
+	return c, nil
+}
+
+// validateStdio reports options which don't make sense with the standard
+// input and output as one end of the connection.
+func validateStdio(r ForwardRule) error {
+	switch {
+	case r.Listen.Network == networkStdio && r.Connect.Network == networkStdio:
+		return fmt.Errorf("stdio: can't listen and connect on stdio")
+	case r.Listen.Network == networkStdio && (r.Acceptors > 1 || r.MaxAccepts > 1):
+		return fmt.Errorf("stdio: listening on stdio accepts a single connection")
+	}
+	return nil
+}
+
+// stdioListener accepts the connection on the standard input and output once.
+type stdioListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func listenStdio() (net.Listener, error) {
+	c, err := openStdio()
+	if err != nil {
+		return nil, err
+	}
+	l := &stdioListener{conns: make(chan net.Conn, 1), closed: make(chan struct{})}
+	l.conns <- c
+	return l, nil
+}
+
+func (l *stdioListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *stdioListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *stdioListener) Addr() net.Addr {
+	return stdioAddr{}
+}
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return networkStdio }
+func (stdioAddr) String() string  { return networkStdio }
+
+// UsesStdio reports whether a rule of the config listens or connects on the
+// standard input and output, logs must not be written to the standard output
+// in that case.
+func (c Config) UsesStdio() bool {
+	for _, r := range c.Rules {
+		if r.usesNetwork(networkStdio) {
+			return true
+		}
+	}
+	return false
+}
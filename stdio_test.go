@@ -0,0 +1,143 @@
+package harald
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// fakeStdio replaces the standard input and output with pipes, it returns the
+// ends writing to the input and reading from the output.
+func fakeStdio(t *testing.T) (*os.File, *os.File) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	oldIn, oldOut := stdin, stdout
+	stdin, stdout = inR, outW
+	stdioInUse.Store(false)
+	t.Cleanup(func() {
+		stdin, stdout = oldIn, oldOut
+		stdioInUse.Store(false)
+		_ = inW.Close()
+		_ = outR.Close()
+	})
+	return inW, outR
+}
+
+func TestStdioListen(t *testing.T) {
+	in, out := fakeStdio(t)
+
+	f, err := ForwardRule{
+		Listen:  NetConf{Network: networkStdio},
+		Connect: NetConf{Network: networkEcho},
+	}.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	_, _ = in.Write([]byte("ping"))
+	_ = out.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(out, b)
+	if err != nil || string(b) != "ping" {
+		t.Fatalf("want = ping; got = %q, %v", b, err)
+	}
+
+	// the only connection has been accepted, the rule is done once it ends
+	if f.State() != StateStopped {
+		t.Errorf("want = %s; got = %s", StateStopped, f.State())
+	}
+	_ = in.Close()
+	for i := 0; i < 100 && !f.exhausted(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !f.exhausted() {
+		t.Error("expected the rule to be exhausted")
+	}
+}
+
+func TestStdioConnect(t *testing.T) {
+	in, out := fakeStdio(t)
+
+	f, err := ForwardRule{
+		Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		Connect: NetConf{Network: networkStdio},
+	}.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	c, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+	_ = out.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	_, _ = c.Write([]byte("ping"))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(out, b)
+	if err != nil || string(b) != "ping" {
+		t.Fatalf("want = ping on stdout; got = %q, %v", b, err)
+	}
+	_, _ = in.Write([]byte("pong"))
+	_, err = io.ReadFull(c, b)
+	if err != nil || string(b) != "pong" {
+		t.Fatalf("want = pong from stdin; got = %q, %v", b, err)
+	}
+
+	// stdio is only used once
+	second, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer second.Close()
+	_ = second.SetDeadline(time.Now().Add(2 * time.Second))
+	n, err := second.Read(make([]byte, 1))
+	if n != 0 || err == nil {
+		t.Errorf("expected the second client to be rejected; got = %d, %v", n, err)
+	}
+}
+
+func TestStdioValidate(t *testing.T) {
+	tests := map[string]ForwardRule{
+		"both sides": {
+			Listen:  NetConf{Network: networkStdio},
+			Connect: NetConf{Network: networkStdio},
+		},
+		"max accepts": {
+			Listen:     NetConf{Network: networkStdio},
+			Connect:    NetConf{Network: networkEcho},
+			MaxAccepts: 2,
+		},
+		"upstreams": {
+			Listen:    NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+			Connect:   NetConf{Network: networkStdio},
+			Upstreams: []NetConf{{Network: "tcp", Address: "127.0.0.1:1"}},
+		},
+	}
+	for name, r := range tests {
+		_, err := r.NewForwarder(name, time.Second)
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package harald
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tenant configures the quotas and admin access of the team owning the rules
+// which name it as their tenant. Rules may name tenants which aren't
+// configured, they are only namespaced in that case.
+type Tenant struct {
+	// MaxConnections limits the concurrent connections of all rules of the
+	// tenant together, zero is unlimited.
+	MaxConnections int `json:"max_connections" yaml:"max_connections" toml:"max_connections"`
+	// Bandwidth limits the bytes per second forwarded by all rules of the
+	// tenant together in each direction, zero is unlimited.
+	Bandwidth int64 `json:"bandwidth" yaml:"bandwidth" toml:"bandwidth"`
+	// AdminSubjects are the subjects of admin gRPC client certificates (as
+	// recorded in the audit log, e.g. "CN=team-a,O=example") which only see
+	// and control the rules of the tenant.
+	AdminSubjects []string `json:"admin_subjects" yaml:"admin_subjects" toml:"admin_subjects"`
+}
+
+// validateTenant rejects names which can't be sent as dogstatsd tags or
+// metric names.
+func validateTenant(name string) error {
+	if strings.ContainsAny(name, ".:,|#@ \n") {
+		return fmt.Errorf("invalid tenant '%s'", name)
+	}
+	return nil
+}
+
+// tenantQuota enforces the quotas of a tenant across its forwarders. A nil
+// *tenantQuota does not limit anything.
+type tenantQuota struct {
+	maxConns int64
+	conns    atomic.Int64
+	// in and out limit the bandwidth from and to the clients, nil if the
+	// bandwidth is unlimited.
+	in, out *bandwidthLimiter
+}
+
+// newTenantQuotas creates the quotas of the configured tenants.
+func newTenantQuotas(tenants map[string]Tenant) (map[string]*tenantQuota, error) {
+	quotas := make(map[string]*tenantQuota, len(tenants))
+	for name, t := range tenants {
+		err := validateTenant(name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return nil, fmt.Errorf("tenant without name")
+		}
+		if t.MaxConnections < 0 || t.Bandwidth < 0 {
+			return nil, fmt.Errorf("tenant %s: quotas must not be negative", name)
+		}
+		q := &tenantQuota{maxConns: int64(t.MaxConnections)}
+		if t.Bandwidth > 0 {
+			q.in, q.out = newBandwidthLimiter(t.Bandwidth), newBandwidthLimiter(t.Bandwidth)
+		}
+		quotas[name] = q
+	}
+	return quotas, nil
+}
+
+// acquire reserves a connection, it returns false if the tenant already holds
+// the maximum number of connections. Every successful call must be followed
+// by a call to release.
+func (q *tenantQuota) acquire() bool {
+	if q == nil || q.maxConns == 0 {
+		return true
+	}
+	if q.conns.Add(1) > q.maxConns {
+		q.conns.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (q *tenantQuota) release() {
+	if q == nil || q.maxConns == 0 {
+		return
+	}
+	q.conns.Add(-1)
+}
+
+// limit wraps the connections to share the bandwidth of the tenant, they are
+// returned as is if it is unlimited.
+func (q *tenantQuota) limit(source, target net.Conn) (net.Conn, net.Conn) {
+	if q == nil || q.in == nil {
+		return source, target
+	}
+	return &throttledConn{Conn: source, limiter: q.in}, &throttledConn{Conn: target, limiter: q.out}
+}
+
+// bandwidthLimiter is a token bucket holding up to one second of bandwidth.
+// Readers take the tokens for the data they have read and wait until the
+// bucket is no longer in debt.
+type bandwidthLimiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// delay takes n tokens and returns how long to wait for them.
+func (l *bandwidthLimiter) delay(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// throttledConn waits after each read until the limiter allows the data to be
+// forwarded. It hides the fast paths of io.Copy, so it is only used if a
+// bandwidth is configured.
+type throttledConn struct {
+	net.Conn
+	limiter *bandwidthLimiter
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		time.Sleep(c.limiter.delay(n))
+	}
+	return n, err
+}
@@ -0,0 +1,52 @@
+package harald
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTenantQuota(t *testing.T) {
+	quotas, err := newTenantQuotas(map[string]Tenant{"web": {MaxConnections: 2}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	q := quotas["web"]
+	if !q.acquire() || !q.acquire() {
+		t.Fatal("expected the first two connections to be accepted")
+	}
+	if q.acquire() {
+		t.Error("expected the third connection to be rejected")
+	}
+	q.release()
+	if !q.acquire() {
+		t.Error("expected a released connection to be available again")
+	}
+
+	var unlimited *tenantQuota
+	if !unlimited.acquire() {
+		t.Error("expected a nil quota to accept every connection")
+	}
+	unlimited.release()
+
+	for name, tenants := range map[string]map[string]Tenant{
+		"negative": {"web": {Bandwidth: -1}},
+		"invalid":  {"web.shop": {}},
+		"empty":    {"": {}},
+	} {
+		_, err = newTenantQuotas(tenants)
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	l := newBandwidthLimiter(1000)
+	if d := l.delay(1000); d != 0 {
+		t.Errorf("expected a full bucket to pass without delay; got = %s", d)
+	}
+	d := l.delay(500)
+	if d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("expected a delay of about 500ms; got = %s", d)
+	}
+}
@@ -0,0 +1,121 @@
+package harald
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// testDialDiscoveryTimeout limits how long TestDial waits for the discovery
+// source of a rule to report its upstreams.
+const testDialDiscoveryTimeout = 10 * time.Second
+
+// DialResult reports the outcome of a test connection to an upstream.
+type DialResult struct {
+	// Rule is the name of the rule the upstream belongs to.
+	Rule     string  `json:"rule"`
+	Upstream NetConf `json:"upstream"`
+	// RemoteAddr is the address the connection has been established to, it
+	// differs from the upstream if its hostname has been resolved.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Latency includes the TLS handshake if the rule connects with TLS.
+	Latency time.Duration `json:"latency"`
+	Error   string        `json:"error,omitempty"`
+	// TLS describes the session negotiated with the upstream, nil if the
+	// rule doesn't connect with TLS.
+	TLS *DialTLSResult `json:"tls,omitempty"`
+}
+
+// DialTLSResult describes a TLS session negotiated with an upstream.
+type DialTLSResult struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ALPN        string `json:"alpn,omitempty"`
+	ServerName  string `json:"server_name,omitempty"`
+	// Subject and NotAfter are taken from the certificate of the upstream.
+	Subject  string    `json:"subject,omitempty"`
+	NotAfter time.Time `json:"not_after,omitempty"`
+}
+
+// TestDial connects to each upstream of the forwarder once, the same way it
+// connects for a client, and reports the outcome. The attempts don't count
+// towards the stats or the circuit breakers of the upstreams. Upstreams of a
+// discovery source are resolved first. The forwarder must not be started.
+func (f *Forwarder) TestDial() ([]DialResult, error) {
+	switch {
+	case f.tunnel != nil:
+		return nil, fmt.Errorf("test dial: %s: the upstreams of a tunnel rendezvous are only reachable through its agents", f.name)
+	case f.HTTPConnect != nil:
+		return nil, fmt.Errorf("test dial: %s: the upstreams of an http_connect rule are chosen by the clients", f.name)
+	case f.exec != nil:
+		return nil, fmt.Errorf("test dial: %s: the processes of an exec rule are spawned for each client", f.name)
+	case f.Connect.Network == networkStdio:
+		return nil, fmt.Errorf("test dial: %s: stdio can only be connected once", f.name)
+	}
+
+	if f.source != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), testDialDiscoveryTimeout)
+		defer cancel()
+		discovered := make(chan []target, 1)
+		go f.source.watch(ctx, func(targets []target) {
+			select {
+			case discovered <- targets:
+			default:
+			}
+		})
+		select {
+		case targets := <-discovered:
+			f.balancer.update(targets)
+		case <-ctx.Done():
+			return nil, fmt.Errorf("test dial: %s: discovery didn't report any upstreams", f.name)
+		}
+	}
+
+	upstreams := *f.balancer.upstreams.Load()
+	if f.router != nil {
+		upstreams = slices.Concat(upstreams, f.router.upstreams)
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("test dial: %s: no upstreams", f.name)
+	}
+
+	results := make([]DialResult, len(upstreams))
+	for i, u := range upstreams {
+		results[i] = f.testDial(u)
+	}
+	return results, nil
+}
+
+func (f *Forwarder) testDial(u *upstream) DialResult {
+	r := DialResult{Rule: f.name, Upstream: u.NetConf}
+
+	start := time.Now()
+	c, err := f.connect(u)
+	if err == nil {
+		r.RemoteAddr = c.RemoteAddr().String()
+		c, err = f.upstreamHandshake(c, u.Address)
+	}
+	r.Latency = time.Since(start)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	defer func() { _ = c.Close() }()
+
+	if tc, ok := c.(*tls.Conn); ok {
+		cs := tc.ConnectionState()
+		r.TLS = &DialTLSResult{
+			Version:     tls.VersionName(cs.Version),
+			CipherSuite: tls.CipherSuiteName(cs.CipherSuite),
+			ALPN:        cs.NegotiatedProtocol,
+			ServerName:  cs.ServerName,
+		}
+		if len(cs.PeerCertificates) > 0 {
+			r.TLS.Subject = cs.PeerCertificates[0].Subject.String()
+			r.TLS.NotAfter = cs.PeerCertificates[0].NotAfter
+		}
+	}
+	return r
+}
@@ -0,0 +1,64 @@
+package harald
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestTestDial(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	addr, leaf := tlsEchoServer(t, ca)
+
+	f, err := ForwardRule{
+		Listen: NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		Upstreams: []NetConf{
+			{Network: "tcp", Address: addr},
+			// nothing listens on the port of tcpmux
+			{Network: "tcp", Address: "127.0.0.1:1"},
+		},
+		UpstreamTLS: &UpstreamTLS{RootCAs: string(ca.PEM())},
+	}.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	results, err := f.TestDial()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected a result per upstream; got = %+v", results)
+	}
+
+	ok := results[0]
+	if ok.Error != "" || ok.RemoteAddr != addr || ok.TLS == nil {
+		t.Fatalf("unexpected result of the upstream: %+v", ok)
+	}
+	if ok.TLS.Version != tls.VersionName(tls.VersionTLS13) || ok.TLS.Subject != leaf.Subject.String() {
+		t.Errorf("unexpected tls session: %+v", ok.TLS)
+	}
+	if results[1].Error == "" {
+		t.Errorf("expected the closed upstream to fail; got = %+v", results[1])
+	}
+	if st := f.Stats(); st.DialErrors != 0 {
+		t.Errorf("expected the test to leave the stats alone; got = %+v", st)
+	}
+}
+
+func TestTestDialTunnel(t *testing.T) {
+	f, err := ForwardRule{
+		Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		Connect: NetConf{Network: networkTunnel, Address: "127.0.0.1:0"},
+		Tunnel:  &Tunnel{Token: "secret"},
+	}.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = f.TestDial()
+	if err == nil {
+		t.Error("expected the rendezvous to be rejected")
+	}
+}
@@ -0,0 +1,71 @@
+package harald
+
+import (
+	"net"
+	"time"
+)
+
+// Timeouts limit how long a connection may stall in each direction. Each
+// timeout is the maximum time a single read or write may take, zero disables
+// it. This way a stalled peer is detected even if data still flows in the
+// other direction.
+type Timeouts struct {
+	ClientRead    Duration `json:"client_read" yaml:"client_read" toml:"client_read"`
+	ClientWrite   Duration `json:"client_write" yaml:"client_write" toml:"client_write"`
+	UpstreamRead  Duration `json:"upstream_read" yaml:"upstream_read" toml:"upstream_read"`
+	UpstreamWrite Duration `json:"upstream_write" yaml:"upstream_write" toml:"upstream_write"`
+}
+
+// client wraps the connection of the client, it is returned as is if neither
+// of its timeouts is set.
+func (t *Timeouts) client(c net.Conn) net.Conn {
+	if t == nil {
+		return c
+	}
+	return withTimeouts(c, t.ClientRead.Duration(), t.ClientWrite.Duration())
+}
+
+// upstream wraps the connection to the upstream, it is returned as is if
+// neither of its timeouts is set.
+func (t *Timeouts) upstream(c net.Conn) net.Conn {
+	if t == nil {
+		return c
+	}
+	return withTimeouts(c, t.UpstreamRead.Duration(), t.UpstreamWrite.Duration())
+}
+
+func withTimeouts(c net.Conn, read, write time.Duration) net.Conn {
+	if read <= 0 && write <= 0 {
+		return c
+	}
+	return &timeoutConn{Conn: c, read: read, write: write}
+}
+
+// timeoutConn moves the deadline of the connection ahead before each read
+// and write. It hides the fast paths of io.Copy, so it is only used if a
+// timeout is configured.
+type timeoutConn struct {
+	net.Conn
+	read  time.Duration
+	write time.Duration
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if c.read > 0 {
+		err := c.Conn.SetReadDeadline(time.Now().Add(c.read))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	if c.write > 0 {
+		err := c.Conn.SetWriteDeadline(time.Now().Add(c.write))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(p)
+}
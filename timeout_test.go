@@ -0,0 +1,76 @@
+package harald
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientReadTimeout(t *testing.T) {
+	// the upstream keeps sending data, only the client stalls.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() { _ = l.Close() }()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = c.Close() }()
+		for {
+			_, err = c.Write([]byte("x"))
+			if err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	r := testRule(l.Addr().String())
+	r.Timeouts = &Timeouts{ClientRead: Duration(100 * time.Millisecond)}
+	f, err := r.NewForwarder("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	start := time.Now()
+	_, err = io.Copy(io.Discard, conn)
+	if err != nil {
+		t.Fatalf("expected the forwarder to close the connection; got %s", err.Error())
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("connection closed before the timeout passed: %s", d)
+	}
+}
+
+func TestTimeoutsDisabled(t *testing.T) {
+	c, _ := net.Pipe()
+	defer func() { _ = c.Close() }()
+
+	var timeouts *Timeouts
+	if timeouts.client(c) != c {
+		t.Error("expected connection to be returned as is without timeouts")
+	}
+	timeouts = &Timeouts{ClientRead: Duration(time.Second)}
+	if timeouts.upstream(c) != c {
+		t.Error("expected upstream connection to be returned as is")
+	}
+	if _, ok := timeouts.client(c).(*timeoutConn); !ok {
+		t.Error("expected client connection to be wrapped")
+	}
+}
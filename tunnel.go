@@ -0,0 +1,505 @@
+package harald
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// networkTunnel connects two rules through a reverse tunnel. An agent next to
+// the upstream listens on it, its listen address is the rendezvous it dials
+// out to. The rendezvous connects to it, its connect address is where it
+// accepts the tunnel connections of the agents.
+const networkTunnel = "tunnel"
+
+const (
+	// tunnelMagic starts the hello of each tunnel connection, followed by the
+	// length of the token as two big endian bytes and the token itself.
+	tunnelMagic = "harald-tunnel/1\n"
+	// tunnelPing is sent by the rendezvous to keep idle tunnel connections
+	// alive, tunnelOpen hands the connection over to a client. Everything
+	// after tunnelOpen is forwarded as is.
+	tunnelPing byte = 0
+	tunnelOpen byte = 1
+	// tunnelPingInterval is the interval in which idle tunnel connections are
+	// pinged, agents reconnect if they miss three pings in a row.
+	tunnelPingInterval = 15 * time.Second
+	// tunnelMaxIdle limits the idle tunnel connections of a rendezvous.
+	tunnelMaxIdle = 256
+	// defaultTunnelConnections is the default number of idle tunnel
+	// connections of an agent.
+	defaultTunnelConnections = 4
+
+	tunnelMinBackoff = 100 * time.Millisecond
+	tunnelMaxBackoff = 10 * time.Second
+)
+
+// Tunnel configures both sides of a reverse tunnel, which exposes an upstream
+// behind NAT similar to ssh -R: the agent keeps idle connections open to the
+// rendezvous, which hands them to its clients. See networkTunnel.
+type Tunnel struct {
+	// Token authenticates the agents, it must be the same on both sides.
+	Token string `json:"token" yaml:"token" toml:"token"`
+	// Connections is the number of idle tunnel connections the agent keeps
+	// open, it limits how many clients can connect at the same moment.
+	// Defaults to 4.
+	Connections int `json:"connections" yaml:"connections" toml:"connections"`
+	// TLS terminates the tunnel connections on the rendezvous.
+	TLS *TLS `json:"tls" yaml:"tls" toml:"tls"`
+	// DialTLS secures the tunnel connections of the agent, ServerName
+	// defaults to the host of the rendezvous address.
+	DialTLS *UpstreamTLS `json:"dial_tls" yaml:"dial_tls" toml:"dial_tls"`
+}
+
+// validate checks the side of the tunnel the rule is on.
+func (t *Tunnel) validate(r ForwardRule) error {
+	agent, rendezvous := r.Listen.Network == networkTunnel, r.Connect.Network == networkTunnel
+	switch {
+	case t == nil && (agent || rendezvous):
+		return fmt.Errorf("tunnel: the tunnel network requires tunnel")
+	case t == nil:
+		return nil
+	case !agent && !rendezvous:
+		return fmt.Errorf("tunnel: requires the tunnel network to listen or connect on")
+	case agent && rendezvous:
+		return fmt.Errorf("tunnel: can't listen and connect on the tunnel network")
+	case t.Token == "":
+		return fmt.Errorf("tunnel: token is required")
+	case len(t.Token) > 0xffff:
+		return fmt.Errorf("tunnel: token exceeds %d bytes", 0xffff)
+	case t.Connections < 0:
+		return fmt.Errorf("tunnel: connections must not be negative")
+	case agent && t.TLS != nil:
+		return fmt.Errorf("tunnel: tls is only used on the rendezvous, use dial_tls on the agent")
+	case rendezvous && (t.DialTLS != nil || t.Connections != 0):
+		return fmt.Errorf("tunnel: dial_tls and connections are only used on the agent")
+	case rendezvous && (len(r.Upstreams) > 0 || r.Discovery != nil || r.HTTPConnect != nil):
+		return fmt.Errorf("tunnel: the rendezvous can't be combined with upstreams, discovery or http_connect")
+	}
+	return nil
+}
+
+// hello returns the message which authenticates a tunnel connection.
+func (t *Tunnel) hello() []byte {
+	b := append([]byte(tunnelMagic), 0, 0)
+	binary.BigEndian.PutUint16(b[len(tunnelMagic):], uint16(len(t.Token)))
+	return append(b, t.Token...)
+}
+
+// tunnelAddr is the address of a tunnel listener, which is the address of the
+// rendezvous.
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return networkTunnel }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// tunnelListener accepts the clients of the agent, which arrive through the
+// idle tunnel connections it keeps open to the rendezvous.
+type tunnelListener struct {
+	address string
+	hello   []byte
+	tlsConf *tls.Config
+	log     *slog.Logger
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu sync.Mutex // guards idle
+	// idle are the tunnel connections waiting for a client, they are closed
+	// together with the listener.
+	idle map[net.Conn]struct{}
+}
+
+// listenTunnel starts keeping the idle tunnel connections of an agent open.
+func listenTunnel(address string, t *Tunnel, log *slog.Logger) (*tunnelListener, error) {
+	tlsConf, err := t.DialTLS.Config()
+	if err != nil {
+		return nil, fmt.Errorf("tunnel: %w", err)
+	}
+	if tlsConf != nil && tlsConf.ServerName == "" {
+		tlsConf.ServerName, _, _ = net.SplitHostPort(address)
+	}
+
+	l := &tunnelListener{
+		address: address,
+		hello:   t.hello(),
+		tlsConf: tlsConf,
+		log:     log.With(slog.String("rendezvous", address)),
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+		idle:    make(map[net.Conn]struct{}),
+	}
+	n := t.Connections
+	if n == 0 {
+		n = defaultTunnelConnections
+	}
+	for range n {
+		go l.run()
+	}
+	return l, nil
+}
+
+// run keeps one idle tunnel connection open and passes it to Accept once a
+// client arrives through it.
+func (l *tunnelListener) run() {
+	backoff := tunnelMinBackoff
+	for {
+		c, err := l.connect()
+		if err == nil {
+			backoff = tunnelMinBackoff
+			select {
+			case l.conns <- c:
+				continue
+			case <-l.done:
+				_ = c.Close()
+				return
+			}
+		}
+
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+		l.log.Warn("tunnel connection to the rendezvous failed, retrying", attrError(err), slog.Duration("backoff", backoff))
+		select {
+		case <-l.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, tunnelMaxBackoff)
+	}
+}
+
+// connect establishes a tunnel connection and waits until the rendezvous
+// opens it for a client.
+func (l *tunnelListener) connect() (net.Conn, error) {
+	c, err := net.DialTimeout("tcp", l.address, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if !l.track(c) {
+		_ = c.Close()
+		return nil, net.ErrClosed
+	}
+	defer l.untrack(c)
+
+	_ = c.SetDeadline(time.Now().Add(handshakeTimeout))
+	if l.tlsConf != nil {
+		tc := tls.Client(c, l.tlsConf)
+		err = tc.Handshake()
+		if err != nil {
+			_ = c.Close()
+			return nil, withKind(ErrTLS, fmt.Errorf("tls handshake: %w", err))
+		}
+		c = tc
+	}
+	_, err = c.Write(l.hello)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	// the rendezvous acknowledges the hello with a ping, afterwards it
+	// pings the idle connection until a client arrives
+	var b [1]byte
+	for {
+		_, err = io.ReadFull(c, b[:])
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		switch b[0] {
+		case tunnelPing:
+			_ = c.SetDeadline(time.Now().Add(3 * tunnelPingInterval))
+		case tunnelOpen:
+			_ = c.SetDeadline(time.Time{})
+			return c, nil
+		default:
+			_ = c.Close()
+			return nil, fmt.Errorf("unexpected message %d from the rendezvous", b[0])
+		}
+	}
+}
+
+// track registers an idle connection to be closed with the listener, it
+// returns false if the listener has already been closed.
+func (l *tunnelListener) track(c net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.idle == nil {
+		return false
+	}
+	l.idle[c] = struct{}{}
+	return true
+}
+
+func (l *tunnelListener) untrack(c net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.idle, c)
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the idle tunnel connections, connections which have been
+// accepted already are left open.
+func (l *tunnelListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for c := range l.idle {
+			_ = c.Close()
+		}
+		l.idle = nil
+		err = nil
+	})
+	return err
+}
+
+func (l *tunnelListener) Addr() net.Addr {
+	return tunnelAddr(l.address)
+}
+
+// tunnelServer accepts the tunnel connections of agents on the rendezvous
+// and hands them out as upstream connections. A nil *tunnelServer doesn't
+// accept anything.
+type tunnelServer struct {
+	address string
+	token   []byte
+	tlsConf *tls.Config
+	log     *slog.Logger
+
+	mu       sync.Mutex // guards listener and idle
+	listener net.Listener
+	idle     []net.Conn
+	// ready is signaled whenever a connection becomes idle.
+	ready chan struct{}
+	done  chan struct{}
+}
+
+func newTunnelServer(address string, t *Tunnel, log *slog.Logger) (*tunnelServer, error) {
+	tlsConf, err := t.TLS.Config()
+	if err != nil {
+		return nil, fmt.Errorf("tunnel: %w", err)
+	}
+	return &tunnelServer{
+		address: address,
+		token:   []byte(t.Token),
+		tlsConf: tlsConf,
+		log:     log,
+		ready:   make(chan struct{}, 1),
+	}, nil
+}
+
+// start opens the listener for the agents.
+func (s *tunnelServer) start() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener != nil {
+		return nil
+	}
+	l, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return withKind(ErrBind, fmt.Errorf("tunnel: %w", err))
+	}
+	s.listener, s.done = l, make(chan struct{})
+	go s.accept(l)
+	go s.ping(s.done)
+	return nil
+}
+
+// stop closes the listener and the idle tunnel connections.
+func (s *tunnelServer) stop() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return
+	}
+	_ = s.listener.Close()
+	close(s.done)
+	s.listener, s.done = nil, nil
+	for _, c := range s.idle {
+		_ = c.Close()
+	}
+	s.idle = nil
+}
+
+func (s *tunnelServer) accept(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.log.Error("unable to accept tunnel connection", attrError(err))
+			}
+			return
+		}
+		go func() {
+			err := s.authenticate(c)
+			if err != nil {
+				s.log.Warn("rejecting tunnel connection", attrError(err), slog.String("agent", c.RemoteAddr().String()))
+				_ = c.Close()
+			}
+		}()
+	}
+}
+
+// authenticate checks the hello of an agent and makes the connection
+// available to clients.
+func (s *tunnelServer) authenticate(c net.Conn) error {
+	_ = c.SetDeadline(time.Now().Add(handshakeTimeout))
+	if s.tlsConf != nil {
+		tc := tls.Server(c, s.tlsConf)
+		err := tc.Handshake()
+		if err != nil {
+			return withKind(ErrTLS, fmt.Errorf("tls handshake: %w", err))
+		}
+		c = tc
+	}
+
+	hdr := make([]byte, len(tunnelMagic)+2)
+	_, err := io.ReadFull(c, hdr)
+	if err != nil {
+		return fmt.Errorf("read hello: %w", err)
+	}
+	if string(hdr[:len(tunnelMagic)]) != tunnelMagic {
+		return fmt.Errorf("invalid hello")
+	}
+	token := make([]byte, binary.BigEndian.Uint16(hdr[len(tunnelMagic):]))
+	_, err = io.ReadFull(c, token)
+	if err != nil {
+		return fmt.Errorf("read hello: %w", err)
+	}
+	if subtle.ConstantTimeCompare(token, s.token) != 1 {
+		return fmt.Errorf("invalid token")
+	}
+	_, err = c.Write([]byte{tunnelPing})
+	if err != nil {
+		return err
+	}
+	_ = c.SetDeadline(time.Time{})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil || len(s.idle) >= tunnelMaxIdle {
+		return fmt.Errorf("no room for another idle tunnel connection")
+	}
+	s.idle = append(s.idle, c)
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// ping keeps the idle connections alive and drops the ones which are gone.
+// The connections are taken out while they are pinged, so a ping can't end up
+// in the data of a client.
+func (s *tunnelServer) ping(done <-chan struct{}) {
+	t := time.NewTicker(tunnelPingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		s.mu.Lock()
+		idle := s.idle
+		s.idle = nil
+		s.mu.Unlock()
+
+		idle = slices.DeleteFunc(idle, func(c net.Conn) bool {
+			_ = c.SetWriteDeadline(time.Now().Add(time.Second))
+			_, err := c.Write([]byte{tunnelPing})
+			_ = c.SetWriteDeadline(time.Time{})
+			if err != nil {
+				_ = c.Close()
+				return true
+			}
+			return false
+		})
+
+		s.mu.Lock()
+		if s.listener == nil {
+			for _, c := range idle {
+				_ = c.Close()
+			}
+		} else {
+			s.idle = append(s.idle, idle...)
+		}
+		s.mu.Unlock()
+		if len(idle) > 0 {
+			select {
+			case s.ready <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// dial opens an idle tunnel connection for a client, waiting up to timeout
+// for an agent to provide one.
+func (s *tunnelServer) dial(timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		timeout = handshakeTimeout
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		s.mu.Lock()
+		var c net.Conn
+		if n := len(s.idle); n > 0 {
+			// the most recent connection is the most likely to be alive
+			c, s.idle = s.idle[n-1], s.idle[:n-1]
+		}
+		s.mu.Unlock()
+
+		if c != nil {
+			_ = c.SetWriteDeadline(time.Now().Add(time.Second))
+			_, err := c.Write([]byte{tunnelOpen})
+			_ = c.SetWriteDeadline(time.Time{})
+			if err == nil {
+				return c, nil
+			}
+			_ = c.Close()
+			continue
+		}
+
+		select {
+		case <-s.ready:
+		case <-deadline.C:
+			return nil, fmt.Errorf("tunnel: no idle connection of an agent within %s", timeout)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package harald
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestTunnel(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	crt, key := ca.NewServerCertificate(t)
+	echo, _ := haraldtest.EchoServer(t)
+
+	rendezvous, err := ForwardRule{
+		Listen:  NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+		Connect: NetConf{Network: networkTunnel, Address: "127.0.0.1:0"},
+		Tunnel: &Tunnel{
+			Token: "secret",
+			TLS:   &TLS{Certificate: string(crt), Key: string(key)},
+		},
+	}.NewForwarder("rendezvous", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = rendezvous.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rendezvous.Stop()
+	tunnelAddr := rendezvous.tunnel.listener.Addr().String()
+
+	agent := func(token string) *Forwarder {
+		f, err := ForwardRule{
+			Listen:  NetConf{Network: networkTunnel, Address: tunnelAddr},
+			Connect: NetConf{Network: "tcp", Address: echo},
+			Tunnel: &Tunnel{
+				Token:       token,
+				Connections: 1,
+				DialTLS:     &UpstreamTLS{RootCAs: string(ca.PEM())},
+			},
+		}.NewForwarder("agent", 0)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = f.Start()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return f
+	}
+	ping := func() error {
+		c, err := net.Dial("tcp", rendezvous.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+		_, err = c.Write([]byte("ping"))
+		if err != nil {
+			return err
+		}
+		b := make([]byte, 4)
+		_, err = io.ReadFull(c, b)
+		if err == nil && string(b) != "ping" {
+			t.Errorf("want = ping; got = %s", b)
+		}
+		return err
+	}
+
+	wrong := agent("wrong")
+	err = ping()
+	wrong.Stop()
+	if err == nil {
+		t.Error("expected the agent with the wrong token to be rejected")
+	}
+
+	defer agent("secret").Stop()
+	// every client uses up an idle tunnel connection, which the agent
+	// replaces right away
+	for range 3 {
+		err = ping()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestTunnelValidate(t *testing.T) {
+	tests := map[string]ForwardRule{
+		"missing tunnel": {
+			Listen: NetConf{Network: networkTunnel, Address: "127.0.0.1:7000"},
+		},
+		"missing network": {
+			Listen: NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+			Tunnel: &Tunnel{Token: "secret"},
+		},
+		"missing token": {
+			Listen: NetConf{Network: networkTunnel, Address: "127.0.0.1:7000"},
+			Tunnel: &Tunnel{},
+		},
+		"rendezvous with upstreams": {
+			Listen:    NetConf{Network: "tcp", Address: "127.0.0.1:0"},
+			Connect:   NetConf{Network: networkTunnel, Address: "127.0.0.1:7000"},
+			Upstreams: []NetConf{{Network: "tcp", Address: "127.0.0.1:8080"}},
+			Tunnel:    &Tunnel{Token: "secret"},
+		},
+		"agent with tls": {
+			Listen: NetConf{Network: networkTunnel, Address: "127.0.0.1:7000"},
+			Tunnel: &Tunnel{Token: "secret", TLS: &TLS{}},
+		},
+	}
+	for name, r := range tests {
+		err := r.Tunnel.validate(r)
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package harald
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Policies to balance connections across the upstreams of a rule.
+const (
+	// BalanceRoundRobin picks the upstreams in turn.
+	BalanceRoundRobin = "round_robin"
+	// BalanceLeastConnections picks the upstream with the fewest active
+	// connections, ties are broken round robin.
+	BalanceLeastConnections = "least_connections"
+	// BalanceSourceHash picks the upstream based on a consistent hash of the
+	// source IP, a client always reaches the same upstream as long as the
+	// set of upstreams doesn't change.
+	BalanceSourceHash = "source_hash"
+)
+
+var (
+	errNoUpstreams = errors.New("no upstreams available")
+	// errUnavailable is returned while the circuits of all upstreams are
+	// open or they are ejected.
+	errUnavailable = errors.New("all upstreams are unavailable")
+)
+
+// target describes an upstream as provided by the config or an upstream
+// source. Priority and Weight follow the semantics of DNS SRV records: only
+// the targets with the lowest priority are used, within a priority the
+// targets are picked proportional to their weight.
+type target struct {
+	NetConf
+	Priority uint16
+	Weight   uint16
+}
+
+// upstreamSource provides the upstreams of a rule and keeps them up to date.
+type upstreamSource interface {
+	fmt.Stringer
+	// watch calls update with the current set of targets every time it is
+	// known until ctx is cancelled.
+	watch(ctx context.Context, update func([]target))
+}
+
+// upstream is a single target of a forwarder including its counters.
+type upstream struct {
+	NetConf
+	priority   atomic.Uint32
+	weight     atomic.Uint32
+	active     atomic.Int64
+	total      atomic.Uint64
+	dialErrors atomic.Uint64
+	// joined is the time in unix nanoseconds the upstream has become
+	// available again, zero if it hasn't been unavailable.
+	joined atomic.Int64
+	// circuit is the state of the circuit breaker of the upstream.
+	circuit circuit
+	// outlier is the state of the outlier detection of the upstream.
+	outlier outlier
+}
+
+func (u *upstream) String() string {
+	return u.Network + "@" + u.Address
+}
+
+// UpstreamStats is a snapshot of the counters of a single upstream.
+type UpstreamStats struct {
+	Network           string `json:"network"`
+	Address           string `json:"address"`
+	ActiveConnections int64  `json:"active_connections"`
+	TotalConnections  uint64 `json:"total_connections"`
+	DialErrors        uint64 `json:"dial_errors"`
+	// Circuit is the state of the circuit breaker if it isn't closed.
+	Circuit string `json:"circuit,omitempty"`
+	// Ejected reports whether the outlier detection ejected the upstream.
+	Ejected bool `json:"ejected,omitempty"`
+}
+
+// upstreamConn is a connection to an upstream.
+type upstreamConn struct {
+	net.Conn
+	upstream *upstream
+	// balanced reports whether the balancer picked the upstream, only then
+	// the outcome is reported to the circuit breaker.
+	balanced bool
+	// probe reports whether the connection probes an open circuit.
+	probe bool
+}
+
+// balancer picks an upstream for each new connection.
+type balancer struct {
+	policy    string
+	upstreams atomic.Pointer[[]*upstream]
+	next      atomic.Uint64
+	// slowStart is the duration over which the share of an upstream which
+	// became available again grows to its full weight, zero disables it.
+	slowStart time.Duration
+	// breaker is the config of the circuit breakers, nil disables them.
+	breaker *CircuitBreaker
+	// outliers is the config of the outlier detection, nil disables it.
+	outliers *OutlierDetection
+}
+
+func newBalancer(policy string) (*balancer, error) {
+	switch policy {
+	case "":
+		policy = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConnections, BalanceSourceHash:
+	default:
+		return nil, fmt.Errorf("unknown balancing policy '%s'", policy)
+	}
+
+	b := &balancer{policy: policy}
+	b.upstreams.Store(&[]*upstream{})
+	return b, nil
+}
+
+// update replaces the set of upstreams. Upstreams which are part of the
+// current and the new set are kept including their counters.
+func (b *balancer) update(targets []target) {
+	current := make(map[string]*upstream)
+	for _, u := range *b.upstreams.Load() {
+		current[u.String()] = u
+	}
+
+	upstreams := make([]*upstream, 0, len(targets))
+	for _, t := range targets {
+		u, ok := current[t.Network+"@"+t.Address]
+		if !ok {
+			u = &upstream{NetConf: t.NetConf}
+			// an upstream appearing later on (e.g. once it passes the
+			// health checks of the discovery source) starts out slowly,
+			// the initial set has nothing to share the load with.
+			if len(current) > 0 {
+				u.joined.Store(time.Now().UnixNano())
+			}
+		}
+		u.priority.Store(uint32(t.Priority))
+		u.weight.Store(uint32(t.Weight))
+		upstreams = append(upstreams, u)
+	}
+
+	b.upstreams.Store(&upstreams)
+}
+
+// candidates returns the upstreams with the lowest priority whose circuit
+// isn't open and which aren't ejected, upstreams with a higher priority take
+// over once all upstreams of a priority are unavailable.
+func (b *balancer) candidates() []*upstream {
+	all := *b.upstreams.Load()
+	if b.breaker != nil || b.outliers != nil {
+		now := time.Now()
+		available := make([]*upstream, 0, len(all))
+		for _, u := range all {
+			if b.breaker.available(&u.circuit, now) && !b.ejected(u, now) {
+				available = append(available, u)
+			}
+		}
+		all = available
+	}
+	if len(all) == 0 {
+		return nil
+	}
+
+	lowest := uint32(math.MaxUint32)
+	for _, u := range all {
+		lowest = min(lowest, u.priority.Load())
+	}
+
+	var res []*upstream
+	for _, u := range all {
+		if u.priority.Load() == lowest {
+			res = append(res, u)
+		}
+	}
+	return res
+}
+
+// pick returns the upstream the next connection from src should be forwarded
+// to or nil if there are no upstreams. If src is invalid, source_hash falls
+// back to round robin.
+func (b *balancer) pick(src netip.Addr) *upstream {
+	upstreams := b.candidates()
+	n := len(upstreams)
+	if n == 0 {
+		return nil
+	}
+	next := b.next.Add(1)
+	weights, total := b.weightsOf(upstreams)
+
+	switch {
+	case b.policy == BalanceSourceHash && src.IsValid():
+		// weighted rendezvous hashing: each source ranks all upstreams by a
+		// hash of the pair and picks the highest one. Adding or removing an
+		// upstream only moves the sources which ranked it highest.
+		var best *upstream
+		var bestScore float64
+		key := src.AsSlice()
+		for i, u := range upstreams {
+			if weights[i] == 0 {
+				continue
+			}
+			h := fnv.New64a()
+			_, _ = h.Write(key)
+			_, _ = h.Write([]byte(u.String()))
+			// map the hash into (0, 1) to derive the score
+			x := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+			if score := -float64(weights[i]) / math.Log(x); best == nil || score > bestScore {
+				best, bestScore = u, score
+			}
+		}
+		return best
+	case b.policy == BalanceLeastConnections:
+		// the connections are weighted by the share of upstreams in slow
+		// start, all other upstreams count them as is.
+		offset := int(next % uint64(n))
+		var best *upstream
+		var bestScore uint64
+		for i := 0; i < n; i++ {
+			j := (offset + i) % n
+			if weights[j] == 0 {
+				continue
+			}
+			u := upstreams[j]
+			score := uint64(max(u.active.Load(), 0)+1) * slowStartResolution / b.share(u)
+			if best == nil || score < bestScore {
+				best, bestScore = u, score
+			}
+		}
+		return best
+	default:
+		// weighted round robin, each upstream is picked as often as its
+		// weight within a cycle.
+		pos := next % total
+		for i, w := range weights {
+			if pos < w {
+				return upstreams[i]
+			}
+			pos -= w
+		}
+		return upstreams[n-1]
+	}
+}
+
+// weightsOf returns the weight of each upstream and their sum. If all
+// weights are zero, each upstream is weighted equally. The weights of
+// upstreams in slow start are reduced to their current share.
+func (b *balancer) weightsOf(upstreams []*upstream) ([]uint64, uint64) {
+	weights := make([]uint64, len(upstreams))
+	var total uint64
+	for i, u := range upstreams {
+		weights[i] = uint64(u.weight.Load())
+		total += weights[i]
+	}
+	if total == 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+		total = uint64(len(weights))
+	}
+	if b.slowStart <= 0 {
+		return weights, total
+	}
+
+	// the weights are only scaled while an upstream is in slow start, this
+	// keeps the cycles of round robin short otherwise.
+	shares := make([]uint64, len(upstreams))
+	scaled := false
+	for i, u := range upstreams {
+		shares[i] = b.share(u)
+		scaled = scaled || shares[i] != slowStartResolution
+	}
+	if !scaled {
+		return weights, total
+	}
+	total = 0
+	for i := range weights {
+		weights[i] *= shares[i]
+		total += weights[i]
+	}
+	return weights, total
+}
+
+const (
+	// slowStartResolution is the share of an upstream which isn't in slow
+	// start.
+	slowStartResolution = 100
+	// slowStartMinShare is the share an upstream starts out with, so it
+	// receives some connections right away.
+	slowStartMinShare = 10
+)
+
+// share returns the share of its weight an upstream receives out of
+// slowStartResolution. It grows linearly during the slow start.
+func (b *balancer) share(u *upstream) uint64 {
+	joined := u.joined.Load()
+	if b.slowStart <= 0 || joined == 0 {
+		return slowStartResolution
+	}
+	elapsed := time.Since(time.Unix(0, joined))
+	if elapsed >= b.slowStart {
+		// done, skip the calculation from now on
+		u.joined.CompareAndSwap(joined, 0)
+		return slowStartResolution
+	}
+	return slowStartMinShare + uint64(elapsed)*(slowStartResolution-slowStartMinShare)/uint64(b.slowStart)
+}
+
+func (b *balancer) stats() []UpstreamStats {
+	upstreams := *b.upstreams.Load()
+	stats := make([]UpstreamStats, len(upstreams))
+	now := time.Now()
+	for i, u := range upstreams {
+		stats[i] = UpstreamStats{
+			Network:           u.Network,
+			Address:           u.Address,
+			ActiveConnections: u.active.Load(),
+			TotalConnections:  u.total.Load(),
+			DialErrors:        u.dialErrors.Load(),
+			Circuit:           u.circuit.String(),
+			Ejected:           b.ejected(u, now),
+		}
+	}
+	return stats
+}
+
+// unavailable returns the error for a connection for which pick didn't
+// return an upstream.
+func (b *balancer) unavailable() error {
+	if len(*b.upstreams.Load()) > 0 {
+		return errUnavailable
+	}
+	return errNoUpstreams
+}
+
+func (b *balancer) String() string {
+	upstreams := *b.upstreams.Load()
+	s := make([]string, len(upstreams))
+	for i, u := range upstreams {
+		s[i] = u.String()
+	}
+	return strings.Join(s, ",")
+}
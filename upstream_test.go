@@ -0,0 +1,208 @@
+package harald
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func testUpstreams(n int) []NetConf {
+	targets := make([]NetConf, n)
+	for i := range targets {
+		targets[i] = NetConf{Network: "tcp", Address: string(rune('a' + i))}
+	}
+	return targets
+}
+
+func testBalancer(t *testing.T, policy string, targets ...target) *balancer {
+	t.Helper()
+	b, err := newBalancer(policy)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b.update(targets)
+	return b
+}
+
+func testTargets(n int) []target {
+	targets := make([]target, n)
+	for i, u := range testUpstreams(n) {
+		targets[i] = target{NetConf: u}
+	}
+	return targets
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := testBalancer(t, "", testTargets(3)...)
+
+	seen := make(map[*upstream]int)
+	for i := 0; i < 9; i++ {
+		seen[b.pick(netip.Addr{})]++
+	}
+	for _, u := range *b.upstreams.Load() {
+		if seen[u] != 3 {
+			t.Errorf("expected upstream %s to be picked 3 times, got %d", u, seen[u])
+		}
+	}
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	b := testBalancer(t, BalanceLeastConnections, testTargets(3)...)
+	upstreams := *b.upstreams.Load()
+
+	upstreams[0].active.Store(2)
+	upstreams[1].active.Store(1)
+	upstreams[2].active.Store(3)
+
+	for i := 0; i < 3; i++ {
+		if u := b.pick(netip.Addr{}); u != upstreams[1] {
+			t.Fatalf("expected upstream b, got %s", u)
+		}
+	}
+
+	// ties are broken round robin
+	upstreams[0].active.Store(1)
+	seen := make(map[*upstream]bool)
+	for i := 0; i < 4; i++ {
+		seen[b.pick(netip.Addr{})] = true
+	}
+	if !seen[upstreams[0]] || !seen[upstreams[1]] || seen[upstreams[2]] {
+		t.Fatalf("expected ties to alternate between a and b")
+	}
+}
+
+func TestBalancerInvalidPolicy(t *testing.T) {
+	_, err := newBalancer("foo")
+	if err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func TestBalancerNoUpstreams(t *testing.T) {
+	b := testBalancer(t, "")
+	if u := b.pick(netip.Addr{}); u != nil {
+		t.Fatalf("expected no upstream, got %s", u)
+	}
+}
+
+func TestBalancerPriorityAndWeight(t *testing.T) {
+	targets := testTargets(3)
+	targets[0].Priority, targets[0].Weight = 10, 1
+	targets[1].Priority, targets[1].Weight = 10, 3
+	targets[2].Priority, targets[2].Weight = 20, 100
+	b := testBalancer(t, "", targets...)
+
+	seen := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		seen[b.pick(netip.Addr{}).Address]++
+	}
+	if seen["a"] != 2 || seen["b"] != 6 || seen["c"] != 0 {
+		t.Fatalf("expected picks proportional to weight within the lowest priority, got %v", seen)
+	}
+}
+
+func TestBalancerUpdateKeepsCounters(t *testing.T) {
+	b := testBalancer(t, "", testTargets(2)...)
+	a := b.pick(netip.Addr{})
+	a.total.Add(5)
+
+	b.update(testTargets(3))
+	for _, u := range *b.upstreams.Load() {
+		if u.Address == a.Address && u.total.Load() != 5 {
+			t.Fatalf("expected counters of upstream %s to be kept", u)
+		}
+	}
+}
+
+func TestConnectAndUpstreamsAreExclusive(t *testing.T) {
+	r := ForwardRule{
+		Connect:   NetConf{Network: "tcp", Address: "127.0.0.1:1"},
+		Upstreams: testUpstreams(2),
+	}
+	_, err := r.NewForwarder("test", 0)
+	if err == nil {
+		t.Fatal("expected error when connect and upstreams are set")
+	}
+}
+
+func TestBalancerSourceHash(t *testing.T) {
+	b := testBalancer(t, BalanceSourceHash, testTargets(5)...)
+
+	sources := make([]netip.Addr, 100)
+	picked := make(map[netip.Addr]*upstream)
+	for i := range sources {
+		sources[i] = netip.AddrFrom4([4]byte{192, 0, 2, byte(i)})
+		picked[sources[i]] = b.pick(sources[i])
+	}
+
+	used := make(map[*upstream]bool)
+	for _, src := range sources {
+		for i := 0; i < 3; i++ {
+			if u := b.pick(src); u != picked[src] {
+				t.Fatalf("source %s moved from %s to %s", src, picked[src], u)
+			}
+		}
+		used[picked[src]] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("expected sources to be spread across upstreams")
+	}
+
+	// removing an upstream only moves the sources which were using it
+	upstreams := *b.upstreams.Load()
+	removed := upstreams[0]
+	b.update(testTargets(5)[1:])
+	for _, src := range sources {
+		if picked[src].Address != removed.Address && b.pick(src).Address != picked[src].Address {
+			t.Errorf("source %s moved although its upstream is still available", src)
+		}
+	}
+}
+
+func TestBalancerSlowStart(t *testing.T) {
+	b := testBalancer(t, "", testTargets(1)...)
+	b.slowStart = time.Minute
+	b.update(testTargets(2))
+	upstreams := *b.upstreams.Load()
+	if upstreams[0].joined.Load() != 0 || upstreams[1].joined.Load() == 0 {
+		t.Fatalf("expected only the new upstream to start slowly")
+	}
+
+	// counts the picks of the new upstream in ten cycles of the weights
+	count := func(total int) int {
+		seen := 0
+		for i := 0; i < 10*total; i++ {
+			if b.pick(netip.Addr{}) == upstreams[1] {
+				seen++
+			}
+		}
+		return seen
+	}
+
+	// starts out with a tenth of its weight
+	if n := count(110); n != 100 {
+		t.Errorf("want = 100 picks; got = %d", n)
+	}
+
+	// halfway through it receives 55 of 155
+	upstreams[1].joined.Store(time.Now().Add(-30 * time.Second).UnixNano())
+	if n := count(155); n != 550 {
+		t.Errorf("want = 550 picks; got = %d", n)
+	}
+
+	upstreams[1].joined.Store(time.Now().Add(-time.Minute).UnixNano())
+	if n := count(2); n != 10 {
+		t.Errorf("want = 10 picks; got = %d", n)
+	}
+	if upstreams[1].joined.Load() != 0 {
+		t.Errorf("expected the slow start to be over")
+	}
+
+	// least connections compares the connections relative to the share
+	b.policy = BalanceLeastConnections
+	upstreams[1].joined.Store(time.Now().UnixNano())
+	upstreams[0].active.Store(5)
+	if u := b.pick(netip.Addr{}); u != upstreams[0] {
+		t.Errorf("expected the upstream in slow start to be skipped; got %s", u)
+	}
+}
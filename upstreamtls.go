@@ -0,0 +1,133 @@
+package harald
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// UpstreamTLS establishes TLS to the upstreams, the data of the clients is
+// forwarded over it. The upstreams are verified by their certificate chain
+// and, if any pins are configured, have to match at least one of them.
+type UpstreamTLS struct {
+	// ServerName is sent via SNI and verified against the certificates of
+	// the upstreams, defaults to the host of the upstream address.
+	ServerName string `json:"server_name" yaml:"server_name" toml:"server_name"`
+	// RootCAs contains the PEM encoded certificates of the authorities which
+	// are trusted to issue the certificates of the upstreams, defaults to the
+	// roots of the system.
+	RootCAs string `json:"root_cas" yaml:"root_cas" toml:"root_cas"`
+	// PinnedPublicKeys are the base64 encoded SHA-256 hashes of public keys
+	// (SPKI), any key of the verified chain matches. They are printed by
+	//   openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+	PinnedPublicKeys []string `json:"pinned_public_keys" yaml:"pinned_public_keys" toml:"pinned_public_keys"`
+	// PinnedCertificates are the hex encoded SHA-256 hashes of certificates,
+	// only the certificate of the upstream itself matches. Colons between the
+	// bytes are ignored.
+	PinnedCertificates []string `json:"pinned_certificates" yaml:"pinned_certificates" toml:"pinned_certificates"`
+	// ApplicationProtocols offered to the upstreams via ALPN.
+	ApplicationProtocols []string `json:"application_protocols" yaml:"application_protocols" toml:"application_protocols"`
+}
+
+// Config returns the config of the TLS client.
+func (t *UpstreamTLS) Config() (conf *tls.Config, err error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	defer func() {
+		if err != nil {
+			err = withKind(ErrTLS, fmt.Errorf("upstream tls config: %w", err))
+		}
+	}()
+
+	conf = &tls.Config{
+		ServerName:   t.ServerName,
+		NextProtos:   t.ApplicationProtocols,
+		KeyLogWriter: keyLogWriter,
+	}
+	if t.RootCAs != "" {
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM([]byte(t.RootCAs)) {
+			return nil, fmt.Errorf("unable to parse provided root CAs")
+		}
+	}
+
+	keys := make([][]byte, len(t.PinnedPublicKeys))
+	for i, p := range t.PinnedPublicKeys {
+		keys[i], err = base64.StdEncoding.DecodeString(p)
+		if err != nil || len(keys[i]) != sha256.Size {
+			return nil, fmt.Errorf("invalid public key pin '%s', expected a base64 encoded SHA-256 hash", p)
+		}
+	}
+	certs := make([][]byte, len(t.PinnedCertificates))
+	for i, p := range t.PinnedCertificates {
+		certs[i], err = hex.DecodeString(strings.ReplaceAll(p, ":", ""))
+		if err != nil || len(certs[i]) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate pin '%s', expected a hex encoded SHA-256 hash", p)
+		}
+	}
+	if len(keys) > 0 || len(certs) > 0 {
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, keys, certs)
+		}
+	}
+
+	return conf, nil
+}
+
+// verifyPins checks the connection against the pinned hashes, it is called
+// after the chain has been verified.
+func verifyPins(cs tls.ConnectionState, keys, certs [][]byte) error {
+	if len(certs) > 0 && len(cs.PeerCertificates) > 0 {
+		sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		if slices.ContainsFunc(certs, func(p []byte) bool { return bytes.Equal(p, sum[:]) }) {
+			return nil
+		}
+	}
+	for _, chain := range cs.VerifiedChains {
+		for _, c := range chain {
+			sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+			if slices.ContainsFunc(keys, func(p []byte) bool { return bytes.Equal(p, sum[:]) }) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("certificate of %s doesn't match any of the pins", cs.ServerName)
+}
+
+// upstreamHandshake establishes TLS on the connection to the upstream at
+// address if the rule configures it.
+func (f *Forwarder) upstreamHandshake(c net.Conn, address string) (net.Conn, error) {
+	if f.upstreamTLS == nil {
+		return c, nil
+	}
+	conf := f.upstreamTLS
+	if conf.ServerName == "" {
+		host, _, _ := net.SplitHostPort(address)
+		conf = conf.Clone()
+		conf.ServerName = host
+	}
+
+	ctx := context.Background()
+	if f.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.timeout)
+		defer cancel()
+	}
+	tc := tls.Client(c, conf)
+	err := tc.HandshakeContext(ctx)
+	if err != nil {
+		_ = c.Close()
+		return nil, withKind(ErrTLS, fmt.Errorf("upstream tls handshake: %w", err))
+	}
+	return tc, nil
+}
@@ -0,0 +1,128 @@
+package harald
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+// tlsEchoServer echoes the data of TLS clients with a certificate of ca and
+// returns its address and certificate.
+func tlsEchoServer(t *testing.T, ca *haraldtest.CA) (string, *x509.Certificate) {
+	t.Helper()
+	certPEM, keyPEM := ca.NewServerCertificate(t)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	block, _ := pem.Decode(certPEM)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return l.Addr().String(), leaf
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	addr, leaf := tlsEchoServer(t, ca)
+	keyPin := sha256.Sum256(ca.Certificate().RawSubjectPublicKeyInfo)
+
+	r := testRule(addr)
+	r.UpstreamTLS = &UpstreamTLS{
+		RootCAs:          string(ca.PEM()),
+		PinnedPublicKeys: []string{base64.StdEncoding.EncodeToString(keyPin[:])},
+	}
+	f, err := r.NewForwarder("test", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = f.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Stop()
+
+	c, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	_, _ = c.Write([]byte("hello"))
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, 5)
+	_, err = io.ReadFull(c, b)
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("expected the data to be forwarded over tls; got %q: %v", b, err)
+	}
+
+	certPin := sha256.Sum256(leaf.Raw)
+	for _, test := range []struct {
+		name string
+		conf UpstreamTLS
+		ok   bool
+	}{
+		{"certificate pin", UpstreamTLS{RootCAs: string(ca.PEM()), PinnedCertificates: []string{hex.EncodeToString(certPin[:])}}, true},
+		{"unknown authority", UpstreamTLS{}, false},
+		{"server name", UpstreamTLS{RootCAs: string(ca.PEM()), ServerName: "upstream.test"}, false},
+		{"pin mismatch", UpstreamTLS{RootCAs: string(ca.PEM()), PinnedPublicKeys: []string{base64.StdEncoding.EncodeToString(certPin[:])}}, false},
+	} {
+		r.UpstreamTLS = &test.conf
+		f, err := r.NewForwarder("test", time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		c, err := f.dial(netip.Addr{})
+		if test.ok {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err.Error())
+				continue
+			}
+			_ = c.Close()
+		} else if !errors.Is(err, ErrTLS) || !errors.Is(err, ErrDial) {
+			t.Errorf("%s: expected tls dial error; got %v", test.name, err)
+		}
+	}
+}
+
+func TestUpstreamTLSInvalidPins(t *testing.T) {
+	for _, conf := range []UpstreamTLS{
+		{PinnedPublicKeys: []string{"not base64"}},
+		{PinnedPublicKeys: []string{base64.StdEncoding.EncodeToString([]byte("short"))}},
+		{PinnedCertificates: []string{"ab:cd"}},
+		{RootCAs: "no pem"},
+	} {
+		if _, err := conf.Config(); err == nil {
+			t.Errorf("expected error for %+v", conf)
+		}
+	}
+}
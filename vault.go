@@ -0,0 +1,313 @@
+package harald
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVaultAddress = "https://127.0.0.1:8200"
+	// vaultRetry is the delay before a failed request for a certificate is
+	// retried, the previous certificate is served in the meantime.
+	vaultRetry = 10 * time.Second
+	// vaultRenewAt is the share of the lifetime of a certificate after which
+	// a new one is requested.
+	vaultRenewAt = 2.0 / 3
+)
+
+// VaultSource requests short-lived certificates from the PKI secrets engine
+// of HashiCorp Vault and renews them after two thirds of their lifetime. The
+// issuing CA is used as the client CAs unless they are configured explicitly.
+type VaultSource struct {
+	// Address of Vault, defaults to the environment variable VAULT_ADDR or
+	// https://127.0.0.1:8200.
+	Address string `json:"address" yaml:"address" toml:"address"`
+	// Namespace of Vault Enterprise, defaults to VAULT_NAMESPACE.
+	Namespace string `json:"namespace" yaml:"namespace" toml:"namespace"`
+	// CA is a PEM file with the root certificates to verify Vault, defaults
+	// to VAULT_CACERT or the roots of the system.
+	CA string `json:"ca" yaml:"ca" toml:"ca"`
+	// Mount is the path of the PKI secrets engine, defaults to pki.
+	Mount string `json:"mount" yaml:"mount" toml:"mount"`
+	// Role of the PKI secrets engine which issues the certificates.
+	Role       string   `json:"role" yaml:"role" toml:"role"`
+	CommonName string   `json:"common_name" yaml:"common_name" toml:"common_name"`
+	AltNames   []string `json:"alt_names" yaml:"alt_names" toml:"alt_names"`
+	IPSANs     []string `json:"ip_sans" yaml:"ip_sans" toml:"ip_sans"`
+	// TTL of the certificates, defaults to the TTL of the role.
+	TTL  Duration  `json:"ttl" yaml:"ttl" toml:"ttl"`
+	Auth VaultAuth `json:"auth" yaml:"auth" toml:"auth"`
+}
+
+// VaultAuth configures how harald authenticates to Vault.
+type VaultAuth struct {
+	// Method is token (default), approle or kubernetes.
+	Method string `json:"method" yaml:"method" toml:"method"`
+	// Mount is the path of the auth method, defaults to its name.
+	Mount string `json:"mount" yaml:"mount" toml:"mount"`
+	// Token is used by the token method, defaults to VAULT_TOKEN.
+	Token string `json:"token" yaml:"token" toml:"token"`
+	// RoleID and SecretID are the credentials of the approle method, the
+	// secret id can be read from SecretIDFile instead.
+	RoleID       string `json:"role_id" yaml:"role_id" toml:"role_id"`
+	SecretID     string `json:"secret_id" yaml:"secret_id" toml:"secret_id"`
+	SecretIDFile string `json:"secret_id_file" yaml:"secret_id_file" toml:"secret_id_file"`
+	// Role of the kubernetes method, the token of the service account of the
+	// pod is used to log in.
+	Role string `json:"role" yaml:"role" toml:"role"`
+}
+
+// vaultSource issues certificates from the PKI secrets engine.
+type vaultSource struct {
+	conf     VaultSource
+	endpoint *url.URL
+	// tokenFile is the token of the service account for the kubernetes
+	// method.
+	tokenFile string
+	client    *http.Client
+	log       *slog.Logger
+}
+
+func newVaultSource(c VaultSource, log *slog.Logger) (*vaultSource, error) {
+	if c.Address == "" {
+		c.Address = os.Getenv("VAULT_ADDR")
+	}
+	if c.Address == "" {
+		c.Address = defaultVaultAddress
+	}
+	if c.Namespace == "" {
+		c.Namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	if c.CA == "" {
+		c.CA = os.Getenv("VAULT_CACERT")
+	}
+	if c.Mount == "" {
+		c.Mount = "pki"
+	}
+	if c.Role == "" || c.CommonName == "" {
+		return nil, fmt.Errorf("vault: role and common_name are required")
+	}
+	if c.TTL < 0 {
+		return nil, fmt.Errorf("vault: ttl must not be negative")
+	}
+
+	switch c.Auth.Method {
+	case "", "token":
+		c.Auth.Method = "token"
+		if c.Auth.Token == "" {
+			c.Auth.Token = os.Getenv("VAULT_TOKEN")
+		}
+		if c.Auth.Token == "" {
+			return nil, fmt.Errorf("vault: missing token and VAULT_TOKEN is not set")
+		}
+	case "approle":
+		if c.Auth.RoleID == "" || (c.Auth.SecretID == "") == (c.Auth.SecretIDFile == "") {
+			return nil, fmt.Errorf("vault: approle requires role_id and either secret_id or secret_id_file")
+		}
+	case "kubernetes":
+		if c.Auth.Role == "" {
+			return nil, fmt.Errorf("vault: kubernetes requires a role")
+		}
+	default:
+		return nil, fmt.Errorf("vault: unknown auth method '%s'", c.Auth.Method)
+	}
+	if c.Auth.Mount == "" {
+		c.Auth.Mount = c.Auth.Method
+	}
+
+	endpoint, err := url.Parse(c.Address)
+	if err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("vault: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("vault: no certificates found in %s", c.CA)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &vaultSource{
+		conf:      c,
+		endpoint:  endpoint,
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		client:    &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		log:       log,
+	}, nil
+}
+
+func (s *vaultSource) watch(ctx context.Context, update func(certBundle)) {
+	for {
+		b, err := s.issue(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		wait := vaultRetry
+		if err != nil {
+			s.log.Error("requesting certificate from vault failed", attrError(err))
+		} else {
+			update(b)
+			leaf := b.cert.Leaf
+			renew := leaf.NotBefore.Add(time.Duration(float64(leaf.NotAfter.Sub(leaf.NotBefore)) * vaultRenewAt))
+			wait = max(time.Until(renew), vaultRetry)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// vaultResponse contains the fields we need from the responses of Vault.
+type vaultResponse struct {
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Data struct {
+		Certificate string   `json:"certificate"`
+		PrivateKey  string   `json:"private_key"`
+		IssuingCA   string   `json:"issuing_ca"`
+		CAChain     []string `json:"ca_chain"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// issue requests a new certificate, logging in first unless a static token
+// is configured.
+func (s *vaultSource) issue(ctx context.Context) (certBundle, error) {
+	token, err := s.login(ctx)
+	if err != nil {
+		return certBundle{}, err
+	}
+
+	req := map[string]string{"common_name": s.conf.CommonName}
+	if len(s.conf.AltNames) > 0 {
+		req["alt_names"] = strings.Join(s.conf.AltNames, ",")
+	}
+	if len(s.conf.IPSANs) > 0 {
+		req["ip_sans"] = strings.Join(s.conf.IPSANs, ",")
+	}
+	if s.conf.TTL > 0 {
+		req["ttl"] = s.conf.TTL.Duration().String()
+	}
+	resp, err := s.request(ctx, s.conf.Mount+"/issue/"+s.conf.Role, token, req)
+	if err != nil {
+		return certBundle{}, fmt.Errorf("issue certificate: %w", err)
+	}
+
+	chain := resp.Data.Certificate + "\n" + strings.Join(resp.Data.CAChain, "\n")
+	cert, err := tls.X509KeyPair([]byte(chain), []byte(resp.Data.PrivateKey))
+	if err != nil {
+		return certBundle{}, fmt.Errorf("parse certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return certBundle{}, fmt.Errorf("parse certificate: %w", err)
+		}
+	}
+	b := certBundle{cert: cert}
+	if resp.Data.IssuingCA != "" {
+		b.clientCAs = x509.NewCertPool()
+		if !b.clientCAs.AppendCertsFromPEM([]byte(resp.Data.IssuingCA)) {
+			return certBundle{}, fmt.Errorf("parse issuing ca: no certificates found")
+		}
+	}
+	return b, nil
+}
+
+// login returns a token to issue certificates with.
+func (s *vaultSource) login(ctx context.Context) (string, error) {
+	var req map[string]string
+	switch s.conf.Auth.Method {
+	case "token":
+		return s.conf.Auth.Token, nil
+	case "approle":
+		secretID := s.conf.Auth.SecretID
+		if s.conf.Auth.SecretIDFile != "" {
+			b, err := os.ReadFile(s.conf.Auth.SecretIDFile)
+			if err != nil {
+				return "", fmt.Errorf("login: %w", err)
+			}
+			secretID = strings.TrimSpace(string(b))
+		}
+		req = map[string]string{"role_id": s.conf.Auth.RoleID, "secret_id": secretID}
+	case "kubernetes":
+		// the token is rotated by kubernetes, so we read it for every login
+		jwt, err := os.ReadFile(s.tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("login: %w", err)
+		}
+		req = map[string]string{"role": s.conf.Auth.Role, "jwt": strings.TrimSpace(string(jwt))}
+	}
+
+	resp, err := s.request(ctx, "auth/"+s.conf.Auth.Mount+"/login", "", req)
+	if err != nil {
+		return "", fmt.Errorf("login: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("login: no token received")
+	}
+	return resp.Auth.ClientToken, nil
+}
+
+// request posts body to the path of the API.
+func (s *vaultSource) request(ctx context.Context, path, token string, body any) (*vaultResponse, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint.JoinPath("/v1", path).String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if s.conf.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.conf.Namespace)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var v vaultResponse
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	if resp.StatusCode != http.StatusOK {
+		if len(v.Errors) > 0 {
+			return nil, fmt.Errorf("unexpected status '%s': %s", resp.Status, strings.Join(v.Errors, "; "))
+		}
+		return nil, fmt.Errorf("unexpected status '%s'", resp.Status)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &v, nil
+}
+
+func (s *vaultSource) String() string {
+	return "vault:" + s.conf.Mount + "/" + s.conf.Role
+}
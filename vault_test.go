@@ -0,0 +1,101 @@
+package harald
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxmoehl/harald/haraldtest"
+)
+
+func TestVaultSource(t *testing.T) {
+	ca := haraldtest.NewCertificateAuthority(t)
+	cert, key := ca.NewServerCertificate(t)
+
+	var issued map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/v1/auth/k8s/login":
+			if body["role"] != "harald" || body["jwt"] != "service-account-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, _ = w.Write([]byte(`{"auth": {"client_token": "s.token"}}`))
+		case "/v1/pki_int/issue/web":
+			if r.Header.Get("X-Vault-Token") != "s.token" {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"errors": ["permission denied"]}`))
+				return
+			}
+			issued = body
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+				"certificate": string(cert),
+				"private_key": string(key),
+				"issuing_ca":  string(ca.PEM()),
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := newVaultSource(VaultSource{
+		Address:    srv.URL,
+		Mount:      "pki_int",
+		Role:       "web",
+		CommonName: "harald.example.com",
+		AltNames:   []string{"a.example.com", "b.example.com"},
+		TTL:        Duration(time.Hour),
+		Auth:       VaultAuth{Method: "kubernetes", Mount: "k8s", Role: "harald"},
+	}, slog.Default())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.tokenFile = filepath.Join(t.TempDir(), "token")
+	err = os.WriteFile(s.tokenFile, []byte("service-account-token\n"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	b, err := s.issue(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if issued["common_name"] != "harald.example.com" || issued["alt_names"] != "a.example.com,b.example.com" || issued["ttl"] != "1h0m0s" {
+		t.Errorf("unexpected request %v", issued)
+	}
+	if b.cert.Leaf == nil || b.cert.Leaf.Subject.OrganizationalUnit[0] != "server" {
+		t.Error("expected the issued certificate")
+	}
+	if b.clientCAs == nil {
+		t.Error("expected the issuing ca to be used as client CAs")
+	}
+
+	s.conf.Auth = VaultAuth{Method: "token", Token: "s.invalid"}
+	if _, err = s.issue(context.Background()); err == nil {
+		t.Error("expected error for an invalid token")
+	}
+}
+
+func TestVaultSourceInvalid(t *testing.T) {
+	t.Setenv("VAULT_TOKEN", "")
+	for _, c := range []VaultSource{
+		{Role: "web", CommonName: "harald.example.com"},
+		{Role: "web", Auth: VaultAuth{Token: "s.token"}},
+		{Role: "web", CommonName: "harald.example.com", Auth: VaultAuth{Method: "approle", RoleID: "id"}},
+		{Role: "web", CommonName: "harald.example.com", Auth: VaultAuth{Method: "kubernetes"}},
+		{Role: "web", CommonName: "harald.example.com", Auth: VaultAuth{Method: "ldap"}},
+	} {
+		if _, err := newVaultSource(c, slog.Default()); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}